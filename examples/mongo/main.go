@@ -92,6 +92,7 @@ func ensureDagCreated() error {
 		}
 	}
 	if oldDag != nil {
+		dag.Version = oldDag.Version
 		if err := mod.GetStore().UpdateDag(dag); err != nil {
 			return err
 		}
@@ -108,6 +108,7 @@ func ensureDagCreated(dag *entity.Dag) error {
 		}
 	}
 	if oldDag != nil {
+		dag.Version = oldDag.Version
 		if err := mod.GetStore().UpdateDag(dag); err != nil {
 			return err
 		}
@@ -24,7 +24,13 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
-var closers []mod.Closer
+// ensureDagAttempts is the max times to write a dag read from dir when it is conflicted with others
+const ensureDagAttempts = 3
+
+var (
+	closers []mod.Closer
+	parser  *mod.DefParser
+)
 
 // RegisterAction you need register all used action to it
 func RegisterAction(acts []run.Action) {
@@ -52,6 +58,10 @@ type InitialOption struct {
 	ExecutorTimeout time.Duration
 	// ExecutorTimeout default 15s
 	DagScheduleTimeout time.Duration
+	// DispatchStrategy used to choose worker for dag instance, default is mod.LeastLoadedStrategy
+	DispatchStrategy mod.DispatchStrategy
+	// InterruptedTaskPolicy decide what to do with the running tasks whose worker exited, default is mod.InterruptedTaskPolicyFail
+	InterruptedTaskPolicy mod.InterruptedTaskPolicy
 
 	// Read dag define from directory
 	// each file will be pared to a dag, so you CAN'T define all dag in one file
@@ -90,6 +100,8 @@ func Init(opt *InitialOption) error {
 
 	RegisterAction([]run.Action{
 		&actions.Waiting{},
+		&actions.SubDag{},
+		&actions.Branch{},
 	})
 
 	if opt.ReadDagFromDir != "" {
@@ -146,9 +158,13 @@ func (l *LeaderChangedHandler) Handle(cxt context.Context, e goevent.Event) {
 		wg.Init()
 		l.leaderCloser = append(l.leaderCloser, wg)
 
-		dis := mod.NewDefDispatcher()
+		dis := mod.NewDefDispatcher(l.opt.DispatchStrategy)
 		dis.Init()
 		l.leaderCloser = append(l.leaderCloser, dis)
+
+		sch := mod.NewDefScheduler()
+		sch.Init()
+		l.leaderCloser = append(l.leaderCloser, sch)
 		log.Println("leader initial")
 	}
 	// continue leader failed
@@ -165,6 +181,16 @@ func (l *LeaderChangedHandler) Close() {
 	l.leaderCloser = []mod.Closer{}
 }
 
+// Drain stop the worker accepting new dag instances, wait for its executing tasks until ctx is done,
+// then hand its unfinished dag instances over to other workers. It should be called before Close.
+func Drain(ctx context.Context) error {
+	if parser == nil {
+		return fmt.Errorf("fastflow is not initialized")
+	}
+	mod.GetKeeper().SetDraining(true)
+	return parser.Drain(ctx)
+}
+
 // Close all closer
 func Close() {
 	for i := range closers {
@@ -193,6 +219,12 @@ func checkOption(opt *InitialOption) error {
 	if opt.ParserWorkersCnt == 0 {
 		opt.ParserWorkersCnt = 100
 	}
+	if opt.InterruptedTaskPolicy == "" {
+		opt.InterruptedTaskPolicy = mod.InterruptedTaskPolicyFail
+	}
+	if err := opt.InterruptedTaskPolicy.Validate(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -205,13 +237,13 @@ func initCommonComponent(opt *InitialOption) {
 	// Executor must init before parse otherwise will cause a error
 	exe := mod.NewDefExecutor(opt.ExecutorTimeout, opt.ExecutorWorkerCnt)
 	mod.SetExecutor(exe)
-	p := mod.NewDefParser(opt.ParserWorkersCnt, opt.ExecutorTimeout)
-	mod.SetParser(p)
+	parser = mod.NewDefParser(opt.ParserWorkersCnt, opt.ExecutorTimeout, opt.InterruptedTaskPolicy)
+	mod.SetParser(parser)
 
 	exe.Init()
 	closers = append(closers, exe)
-	p.Init()
-	closers = append(closers, p)
+	parser.Init()
+	closers = append(closers, parser)
 
 	comm := &mod.DefCommander{}
 	mod.SetCommander(comm)
@@ -252,12 +284,34 @@ func readDagFromDir(dir string) error {
 	return nil
 }
 
+// ensureDagLatest create or update the dag to the definition read from dir,
+// other workers may do the same thing at the same time, so read again when the write is conflicted
 func ensureDagLatest(dag *entity.Dag) error {
+	for i := 0; i < ensureDagAttempts; i++ {
+		err := writeDagIfChanged(dag)
+		if !errors.Is(err, data.ErrDataConflicted) {
+			return err
+		}
+	}
+	log.Printf("dag[%s] is still changed by others, skip it", dag.ID)
+	return nil
+}
+
+func writeDagIfChanged(dag *entity.Dag) error {
 	oDag, err := mod.GetStore().GetDag(dag.ID)
 	if err != nil && !errors.Is(err, data.ErrDataNotFound) {
 		return err
 	}
 	if oDag != nil {
+		// every update creates a new version, so skip the unchanged dag
+		diff, err := entity.DiffDag(oDag, dag)
+		if err != nil {
+			return err
+		}
+		if diff.IsEmpty() {
+			return nil
+		}
+		dag.Version = oDag.Version
 		return mod.GetStore().UpdateDag(dag)
 	}
 
@@ -10,6 +10,7 @@ import (
 	"github.com/shiningrush/fastflow/pkg/event"
 	"github.com/shiningrush/fastflow/pkg/mod"
 	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"gopkg.in/yaml.v3"
@@ -27,14 +28,32 @@ func Test_checkOption(t *testing.T) {
 				Store:  &mod.MockStore{},
 			},
 			wantOpt: &InitialOption{
-				Keeper:             &mod.MockKeeper{},
-				Store:              &mod.MockStore{},
-				ParserWorkersCnt:   100,
-				ExecutorWorkerCnt:  1000,
-				ExecutorTimeout:    time.Second * 30,
-				DagScheduleTimeout: time.Second * 15,
+				Keeper:                &mod.MockKeeper{},
+				Store:                 &mod.MockStore{},
+				ParserWorkersCnt:      100,
+				ExecutorWorkerCnt:     1000,
+				ExecutorTimeout:       time.Second * 30,
+				DagScheduleTimeout:    time.Second * 15,
+				InterruptedTaskPolicy: mod.InterruptedTaskPolicyFail,
 			},
 		},
+		{
+			giveOpt: &InitialOption{
+				Keeper:                &mod.MockKeeper{},
+				Store:                 &mod.MockStore{},
+				InterruptedTaskPolicy: "ignore",
+			},
+			wantOpt: &InitialOption{
+				Keeper:                &mod.MockKeeper{},
+				Store:                 &mod.MockStore{},
+				ParserWorkersCnt:      100,
+				ExecutorWorkerCnt:     1000,
+				ExecutorTimeout:       time.Second * 30,
+				DagScheduleTimeout:    time.Second * 15,
+				InterruptedTaskPolicy: "ignore",
+			},
+			wantErr: fmt.Errorf("interrupted task policy[ignore] is invalid"),
+		},
 		{
 			giveOpt: &InitialOption{},
 			wantOpt: &InitialOption{},
@@ -65,6 +84,7 @@ func Test_readDagFromDir(t *testing.T) {
 		givePathsErr   error
 		givePathDagMap map[string][]byte
 		calledEnsured  []bool
+		giveExistedDag *entity.Dag
 		giveDir        string
 		wantDag        *entity.Dag
 		wantErr        error
@@ -126,6 +146,79 @@ tasks:
 				Status: entity.DagStatusNormal,
 			},
 		},
+		{
+			caseDesc:  "unchanged",
+			givePaths: []string{"dag1"},
+			givePathDagMap: map[string][]byte{
+				"dag1": []byte(`
+id: test-dag
+name: dag-name
+tasks:
+  - id: "task-1"
+    actionName: "action"
+`),
+			},
+			giveExistedDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID:        "test-dag",
+					CreatedAt: 1,
+				},
+				Name:    "dag-name",
+				Status:  entity.DagStatusNormal,
+				Version: 2,
+				Tasks: []entity.Task{
+					{
+						ID:         "task-1",
+						ActionName: "action",
+						Params:     map[string]interface{}{},
+					},
+				},
+			},
+		},
+		{
+			caseDesc:  "changed",
+			givePaths: []string{"dag1"},
+			givePathDagMap: map[string][]byte{
+				"dag1": []byte(`
+id: test-dag
+name: new-name
+tasks:
+  - id: "task-1"
+    actionName: "action"
+`),
+			},
+			giveExistedDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID:        "test-dag",
+					CreatedAt: 1,
+				},
+				Name:    "dag-name",
+				Status:  entity.DagStatusNormal,
+				Version: 2,
+				Tasks: []entity.Task{
+					{
+						ID:         "task-1",
+						ActionName: "action",
+						Params:     map[string]interface{}{},
+					},
+				},
+			},
+			calledEnsured: []bool{true},
+			wantDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Name:    "new-name",
+				Status:  entity.DagStatusNormal,
+				Version: 2,
+				Tasks: []entity.Task{
+					{
+						ID:         "task-1",
+						ActionName: "action",
+					},
+				},
+			},
+		},
 		{
 			caseDesc:  "no id",
 			givePaths: []string{"/test/filename.yaml"},
@@ -177,6 +270,9 @@ tasks:
 			var called []bool
 			mStore := &mod.MockStore{}
 			existedDag := &entity.Dag{}
+			if tc.giveExistedDag != nil {
+				existedDag = tc.giveExistedDag
+			}
 			mStore.On("GetDag", mock.Anything).Return(existedDag, nil)
 			mStore.On("UpdateDag", mock.Anything).Run(func(args mock.Arguments) {
 				called = append(called, true)
@@ -193,6 +289,107 @@ tasks:
 	}
 }
 
+func Test_ensureDagLatest(t *testing.T) {
+	conflictErr := fmt.Errorf("conflicted: %w", data.ErrDataConflicted)
+	newDag := func(name string, version int) *entity.Dag {
+		return &entity.Dag{
+			BaseInfo: entity.BaseInfo{ID: "dag"},
+			Name:     name,
+			Status:   entity.DagStatusNormal,
+			Version:  version,
+			Tasks:    []entity.Task{{ID: "task-1", ActionName: "action"}},
+		}
+	}
+	tests := []struct {
+		caseDesc     string
+		giveStored   []*entity.Dag
+		giveWriteErr []error
+		wantWrites   []string
+		wantVersion  int
+		wantErr      error
+	}{
+		{
+			caseDesc:    "update",
+			giveStored:  []*entity.Dag{newDag("old", 1)},
+			wantWrites:  []string{"update"},
+			wantVersion: 1,
+		},
+		{
+			caseDesc:   "unchanged",
+			giveStored: []*entity.Dag{newDag("new", 1)},
+		},
+		{
+			caseDesc:     "conflicted and updated by others",
+			giveStored:   []*entity.Dag{newDag("old", 1), newDag("new", 2)},
+			giveWriteErr: []error{conflictErr},
+			wantWrites:   []string{"update"},
+			wantVersion:  1,
+		},
+		{
+			caseDesc:     "conflicted and changed by others",
+			giveStored:   []*entity.Dag{newDag("old", 1), newDag("other", 2)},
+			giveWriteErr: []error{conflictErr, nil},
+			wantWrites:   []string{"update", "update"},
+			wantVersion:  2,
+		},
+		{
+			caseDesc:     "created by others",
+			giveStored:   []*entity.Dag{nil, newDag("new", 1)},
+			giveWriteErr: []error{conflictErr},
+			wantWrites:   []string{"create"},
+		},
+		{
+			caseDesc:     "always conflicted",
+			giveStored:   []*entity.Dag{newDag("old", 1), newDag("old", 2), newDag("old", 3)},
+			giveWriteErr: []error{conflictErr, conflictErr, conflictErr},
+			wantWrites:   []string{"update", "update", "update"},
+			wantVersion:  3,
+		},
+		{
+			caseDesc:     "write failed",
+			giveStored:   []*entity.Dag{newDag("old", 1)},
+			giveWriteErr: []error{fmt.Errorf("write failed")},
+			wantWrites:   []string{"update"},
+			wantVersion:  1,
+			wantErr:      fmt.Errorf("write failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var writes []string
+			writeErr := func(op string) error {
+				writes = append(writes, op)
+				if len(writes) > len(tc.giveWriteErr) {
+					return nil
+				}
+				return tc.giveWriteErr[len(writes)-1]
+			}
+			mStore := &mod.MockStore{}
+			for _, d := range tc.giveStored {
+				if d == nil {
+					mStore.On("GetDag", "dag").Return(nil, data.ErrDataNotFound).Once()
+					continue
+				}
+				mStore.On("GetDag", "dag").Return(d, nil).Once()
+			}
+			mStore.On("UpdateDag", mock.Anything).Return(func(dag *entity.Dag) error {
+				return writeErr("update")
+			})
+			mStore.On("CreateDag", mock.Anything).Return(func(dag *entity.Dag) error {
+				return writeErr("create")
+			})
+			mod.SetStore(mStore)
+
+			dag := newDag("new", 0)
+			err := ensureDagLatest(dag)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantWrites, writes)
+			assert.Equal(t, tc.wantVersion, dag.Version)
+		})
+	}
+}
+
 func Test_LeaderChangeHandler(t *testing.T) {
 	tests := []struct {
 		isLeader      bool
@@ -7,6 +7,7 @@ require (
 	github.com/golang/mock v1.6.0
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/prometheus/client_golang v1.14.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/shiningrush/goevent v0.1.0
 	github.com/sony/sonyflake v1.0.0
 	github.com/spaolacci/murmur3 v1.1.0
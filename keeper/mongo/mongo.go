@@ -31,6 +31,7 @@ type Keeper struct {
 	mutexClsName     string
 
 	leaderFlag  atomic.Value
+	draining    atomic.Value
 	keyNumber   int
 	mongoClient *mongo.Client
 	mongoDb     *mongo.Database
@@ -54,6 +55,8 @@ type KeeperOption struct {
 	UnhealthyTime time.Duration
 	// Timeout default 2s
 	Timeout time.Duration
+	// Labels of worker, it is used to match the node selector of dag
+	Labels map[string]string
 }
 
 // NewKeeper
@@ -63,6 +66,7 @@ func NewKeeper(opt *KeeperOption) *Keeper {
 		closeCh: make(chan struct{}),
 	}
 	k.leaderFlag.Store(false)
+	k.draining.Store(false)
 	k.initCompleted.Store(false)
 	return k
 }
@@ -183,8 +187,25 @@ func (k *Keeper) IsLeader() bool {
 	return k.leaderFlag.Load().(bool)
 }
 
-// AliveNodes get all alive nodes
+// AliveNodes get all alive nodes, the draining nodes are excluded
 func (k *Keeper) AliveNodes() ([]string, error) {
+	workers, err := k.AliveWorkers()
+	if err != nil {
+		return nil, err
+	}
+
+	var aliveNodes []string
+	for i := range workers {
+		if workers[i].Draining {
+			continue
+		}
+		aliveNodes = append(aliveNodes, workers[i].Key)
+	}
+	return aliveNodes, nil
+}
+
+// AliveWorkers get all alive workers and their load
+func (k *Keeper) AliveWorkers() ([]*mod.WorkerInfo, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
 	defer cancel()
 	// mongodb background worker delete expired date every 60s, so can not believe it
@@ -202,11 +223,16 @@ func (k *Keeper) AliveNodes() ([]string, error) {
 		return nil, fmt.Errorf("decode failed: %w", err)
 	}
 
-	var aliveNodes []string
+	var workers []*mod.WorkerInfo
 	for i := range ret {
-		aliveNodes = append(aliveNodes, ret[i].WorkerKey)
+		workers = append(workers, &mod.WorkerInfo{
+			Key:        ret[i].WorkerKey,
+			WorkerLoad: ret[i].WorkerLoad,
+			Labels:     ret[i].Labels,
+			Draining:   ret[i].Draining,
+		})
 	}
-	return aliveNodes, nil
+	return workers, nil
 }
 
 // IsAlive check if a worker still alive
@@ -250,6 +276,14 @@ func (k *Keeper) NewMutex(key string) mod.DistributedMutex {
 	}
 }
 
+// SetDraining mark the worker as draining and report it immediately
+func (k *Keeper) SetDraining(draining bool) {
+	k.draining.Store(draining)
+	if err := k.heartBeat(); err != nil {
+		log.Errorf("report draining failed: %s", err)
+	}
+}
+
 // close component
 func (k *Keeper) Close() {
 	close(k.closeCh)
@@ -287,8 +321,11 @@ func (k *Keeper) forceClose() {
 
 // Payload header beat dto
 type Payload struct {
-	WorkerKey string    `bson:"_id"`
-	UpdatedAt time.Time `bson:"updatedAt"`
+	WorkerKey      string            `bson:"_id"`
+	UpdatedAt      time.Time         `bson:"updatedAt"`
+	Labels         map[string]string `bson:"labels,omitempty"`
+	Draining       bool              `bson:"draining,omitempty"`
+	mod.WorkerLoad `bson:",inline"`
 }
 
 // LeaderPayload leader election dto
@@ -432,6 +469,12 @@ func (k *Keeper) goHeartBeat() {
 }
 
 func (k *Keeper) heartBeat() error {
+	// executor may not be initialized yet, then report nothing
+	var load mod.WorkerLoad
+	if exe := mod.GetExecutor(); exe != nil {
+		load = exe.Load()
+	}
+
 	ctx, cancel := context.WithTimeout(context.TODO(), k.opt.Timeout)
 	defer cancel()
 	_, err := k.mongoDb.Collection(k.heartbeatClsName).UpdateOne(ctx,
@@ -440,7 +483,12 @@ func (k *Keeper) heartBeat() error {
 		},
 		bson.M{
 			"$set": bson.M{
-				"updatedAt": time.Now(),
+				"updatedAt":         time.Now(),
+				"runningTaskCnt":    load.RunningTaskCnt,
+				"queuedTaskCnt":     load.QueuedTaskCnt,
+				"executorWorkerCnt": load.ExecutorWorkerCnt,
+				"labels":            k.opt.Labels,
+				"draining":          k.draining.Load().(bool),
 			},
 		},
 		&options.UpdateOptions{
@@ -26,6 +26,9 @@ func TestKeeper_Sanity(t *testing.T) {
 	nodes, err := w2.AliveNodes()
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, []string{"worker-1", "worker-2", "worker-3"}, nodes)
+	workers, err := w2.AliveWorkers()
+	assert.NoError(t, err)
+	assert.Len(t, workers, 3)
 	log.Println("keeper work well, ready to re-goElect")
 
 	w1.Close()
@@ -116,6 +119,22 @@ func TestKeeper_Reconnect(t *testing.T) {
 	w1.Close()
 }
 
+func TestKeeper_Labels(t *testing.T) {
+	w := NewKeeper(&KeeperOption{
+		Key:     "worker-1",
+		ConnStr: mongoConn,
+		Labels:  map[string]string{"zone": "bj"},
+	})
+	require.NoError(t, w.Init())
+	defer w.Close()
+
+	workers, err := w.AliveWorkers()
+	assert.NoError(t, err)
+	require.Len(t, workers, 1)
+	assert.Equal(t, "worker-1", workers[0].Key)
+	assert.Equal(t, map[string]string{"zone": "bj"}, workers[0].Labels)
+}
+
 func initWorker(t *testing.T, key string) *Keeper {
 	w := NewKeeper(&KeeperOption{
 		Key:     key,
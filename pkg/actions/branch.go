@@ -0,0 +1,74 @@
+package actions
+
+import (
+	"fmt"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/entity/run"
+)
+
+const (
+	ActionKeyBranch = "ff-branch"
+)
+
+// BranchParams
+type BranchParams struct {
+	// Cases are checked in order, the tasks of first matched case will be chosen
+	Cases []BranchCase `json:"cases"`
+	// Default tasks will be chosen when no case is matched, all downstream tasks will be skipped if it is empty
+	Default []string `json:"default"`
+}
+
+// BranchCase
+type BranchCase struct {
+	// Conditions must be all meet
+	Conditions []entity.TaskCondition `json:"conditions"`
+	// TaskIDs are the downstream tasks to follow
+	TaskIDs []string `json:"taskIds"`
+}
+
+// Branch action choose the downstream tasks by conditions, the unchosen ones will be skipped
+type Branch struct {
+}
+
+// Name
+func (b *Branch) Name() string {
+	return ActionKeyBranch
+}
+
+// ParameterNew
+func (b *Branch) ParameterNew() interface{} {
+	return &BranchParams{}
+}
+
+// Run
+func (b *Branch) Run(ctx run.ExecuteContext, params interface{}) error {
+	return nil
+}
+
+// Branch
+func (b *Branch) Branch(ctx run.ExecuteContext, params interface{}) ([]string, error) {
+	p := params.(*BranchParams)
+	taskIns, ok := entity.CtxRunningTaskIns(ctx.Context())
+	if !ok || taskIns.RelatedDagInstance == nil {
+		return nil, fmt.Errorf("running dag instance not found in context")
+	}
+
+	for i, c := range p.Cases {
+		for j := range c.Conditions {
+			switch c.Conditions[j].Source {
+			case entity.TaskConditionSourceVars, entity.TaskConditionSourceShareData:
+			default:
+				return nil, fmt.Errorf("case[%d] condition source[%s] is invalid", i, c.Conditions[j].Source)
+			}
+		}
+
+		check := &entity.Check{Conditions: c.Conditions}
+		if check.IsMeet(taskIns.RelatedDagInstance) {
+			ctx.Tracef("case[%d] is matched, choose tasks: %v", i, c.TaskIDs)
+			return c.TaskIDs, nil
+		}
+	}
+	ctx.Tracef("no case is matched, choose default tasks: %v", p.Default)
+	return p.Default, nil
+}
@@ -0,0 +1,91 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/entity/run"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBranch_Branch(t *testing.T) {
+	params := &BranchParams{
+		Cases: []BranchCase{
+			{
+				Conditions: []entity.TaskCondition{
+					{Source: entity.TaskConditionSourceVars, Key: "env", Op: entity.OperatorIn, Values: []string{"prod"}},
+				},
+				TaskIDs: []string{"prod-task"},
+			},
+			{
+				Conditions: []entity.TaskCondition{
+					{Source: entity.TaskConditionSourceShareData, Key: "result", Op: entity.OperatorIn, Values: []string{"A"}},
+					{Source: entity.TaskConditionSourceVars, Key: "env", Op: entity.OperatorNotIn, Values: []string{"prod"}},
+				},
+				TaskIDs: []string{"a-task", "other-task"},
+			},
+		},
+		Default: []string{"default-task"},
+	}
+
+	tests := []struct {
+		caseDesc      string
+		giveVars      map[string]string
+		giveShareData map[string]string
+		giveParams    *BranchParams
+		wantTaskIds   []string
+		wantErr       error
+	}{
+		{
+			caseDesc:    "first case",
+			giveVars:    map[string]string{"env": "prod"},
+			giveParams:  params,
+			wantTaskIds: []string{"prod-task"},
+		},
+		{
+			caseDesc:      "second case",
+			giveVars:      map[string]string{"env": "test"},
+			giveShareData: map[string]string{"result": "A"},
+			giveParams:    params,
+			wantTaskIds:   []string{"a-task", "other-task"},
+		},
+		{
+			caseDesc:      "default",
+			giveVars:      map[string]string{"env": "test"},
+			giveShareData: map[string]string{"result": "B"},
+			giveParams:    params,
+			wantTaskIds:   []string{"default-task"},
+		},
+		{
+			caseDesc: "invalid source",
+			giveParams: &BranchParams{
+				Cases: []BranchCase{
+					{Conditions: []entity.TaskCondition{{Source: "test", Key: "env"}}},
+				},
+			},
+			wantErr: fmt.Errorf("case[0] condition source[test] is invalid"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			dagIns := &entity.DagInstance{
+				Vars:      entity.DagInstanceVars{},
+				ShareData: &entity.ShareData{Dict: tc.giveShareData},
+			}
+			for k, v := range tc.giveVars {
+				dagIns.Vars[k] = entity.DagInstanceVar{Value: v}
+			}
+			taskIns := &entity.TaskInstance{RelatedDagInstance: dagIns}
+			ctx := run.NewDefExecuteContext(
+				entity.CtxWithRunningTaskIns(context.Background(), taskIns),
+				dagIns.ShareData, func(msg string, opt ...run.TraceOp) {}, nil, nil)
+
+			taskIds, err := (&Branch{}).Branch(ctx, tc.giveParams)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantTaskIds, taskIds)
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package actions
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/entity/run"
+	"github.com/shiningrush/fastflow/pkg/mod"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+)
+
+const (
+	ActionKeySubDag = "ff-sub-dag"
+
+	cancelChildAttempts = 3
+)
+
+// SubDagParams
+type SubDagParams struct {
+	// DagID is the dag will be run as child
+	DagID string `json:"dagId"`
+	// Vars of child dag instance, you can use template to render them such as "{{fileName}}"
+	Vars map[string]string `json:"vars"`
+	// ShareData copy the share data of child back to parent when child succeed,
+	// key is the share data key of parent and value is the one of child
+	ShareData map[string]string `json:"shareData"`
+	// CheckInterval is the interval to check child status, support "d|h|m|s|ms", default is 1s
+	CheckInterval string `json:"checkInterval"`
+}
+
+// SubDag action start a child dag instance and wait until it completes,
+// the child is bound to the task instance, so it will not be started twice even if worker restarts.
+// NOTICE: the task will be timeout if the child runs too long, so you should set "timeoutSecs" of the task
+type SubDag struct {
+}
+
+// Name
+func (s *SubDag) Name() string {
+	return ActionKeySubDag
+}
+
+// ParameterNew
+func (s *SubDag) ParameterNew() interface{} {
+	return &SubDagParams{}
+}
+
+// Run
+func (s *SubDag) Run(ctx run.ExecuteContext, params interface{}) error {
+	p := params.(*SubDagParams)
+	interval := time.Second
+	if p.CheckInterval != "" {
+		d, err := ParseDuration(p.CheckInterval)
+		if err != nil {
+			return err
+		}
+		interval = d
+	}
+
+	taskIns, ok := entity.CtxRunningTaskIns(ctx.Context())
+	if !ok {
+		return fmt.Errorf("running task instance not found in context")
+	}
+	child, err := s.latestChild(taskIns)
+	if err != nil {
+		return err
+	}
+	if child == nil {
+		if child, err = s.startChild(ctx, taskIns, p, 0); err != nil {
+			return err
+		}
+	}
+
+	err = run.LoopDo(ctx, func() error {
+		// keep the last loaded child if loading failed, it is still needed to cancel the child
+		latest, err := mod.GetStore().GetDagInstance(child.ID)
+		if err != nil {
+			return fmt.Errorf("get child dag instance failed: %w", err)
+		}
+		child = latest
+		if child.IsTerminal() {
+			return run.EndLoop
+		}
+		return nil
+	}, run.LoopInterval(interval))
+	if err != nil {
+		if ctx.Context().Err() != nil {
+			s.cancelChild(ctx, child)
+		}
+		return err
+	}
+
+	if child.Status != entity.DagInstanceStatusSuccess {
+		return fmt.Errorf("child dag instance[%s] is %s: %s", child.ID, child.Status, child.Reason)
+	}
+	for parentKey, childKey := range p.ShareData {
+		if child.ShareData == nil {
+			break
+		}
+		if v, ok := child.ShareData.Get(childKey); ok {
+			ctx.ShareData().Set(parentKey, v)
+		}
+	}
+	return nil
+}
+
+// RetryBefore start a new child if the previous one failed, otherwise the retried task will wait the old one
+func (s *SubDag) RetryBefore(ctx run.ExecuteContext, params interface{}) error {
+	taskIns, ok := entity.CtxRunningTaskIns(ctx.Context())
+	if !ok {
+		return fmt.Errorf("running task instance not found in context")
+	}
+	children, err := s.listChildren(taskIns)
+	if err != nil {
+		return err
+	}
+	if len(children) == 0 || children[0].Status == entity.DagInstanceStatusSuccess || !children[0].IsTerminal() {
+		return nil
+	}
+
+	_, err = s.startChild(ctx, taskIns, params.(*SubDagParams), len(children))
+	return err
+}
+
+// SubDagInsID return the id of child dag instance, attempt is increased when the task is retried
+func SubDagInsID(taskInsId string, attempt int) string {
+	return fmt.Sprintf("sub-%s-%d", taskInsId, attempt)
+}
+
+func (s *SubDag) listChildren(taskIns *entity.TaskInstance) ([]*entity.DagInstance, error) {
+	children, err := mod.GetStore().ListDagInstance(&mod.ListDagInstanceInput{
+		ParentTaskInsID: taskIns.ID,
+		SortBy:          []string{"-createdAt"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list child dag instances failed: %w", err)
+	}
+	return children, nil
+}
+
+func (s *SubDag) latestChild(taskIns *entity.TaskInstance) (*entity.DagInstance, error) {
+	children, err := s.listChildren(taskIns)
+	if err != nil || len(children) == 0 {
+		return nil, err
+	}
+	return children[0], nil
+}
+
+func (s *SubDag) startChild(
+	ctx run.ExecuteContext, taskIns *entity.TaskInstance, p *SubDagParams, attempt int) (*entity.DagInstance, error) {
+	dag, err := mod.GetStore().GetDag(p.DagID)
+	if err != nil {
+		return nil, fmt.Errorf("get dag[%s] failed: %w", p.DagID, err)
+	}
+	child, err := dag.Run(entity.TriggerSubDag, p.Vars)
+	if err != nil {
+		return nil, err
+	}
+	child.ID = SubDagInsID(taskIns.ID, attempt)
+	child.ParentDagInsID = taskIns.DagInsID
+	child.ParentTaskInsID = taskIns.ID
+	if err := mod.GetStore().CreateDagIns(child); err != nil {
+		// another worker has created it
+		if errors.Is(err, data.ErrDataConflicted) {
+			return child, nil
+		}
+		return nil, fmt.Errorf("create child dag instance failed: %w", err)
+	}
+	ctx.Tracef("start child dag instance[%s]", child.ID)
+	return child, nil
+}
+
+// cancelChild cancel the child which is not completed, it is best effort.
+// the child is reloaded and canceled again if its status is changed meanwhile
+func (s *SubDag) cancelChild(ctx run.ExecuteContext, child *entity.DagInstance) {
+	var err error
+	for i := 0; i < cancelChildAttempts; i++ {
+		if child.IsTerminal() {
+			return
+		}
+		if child.Status == entity.DagInstanceStatusPending {
+			err = mod.GetCommander().CancelPendingDagIns(child.ID)
+		} else {
+			err = mod.GetCommander().CancelDagIns(child.ID, "parent task is canceled")
+		}
+		if err == nil {
+			ctx.Tracef("child dag instance[%s] is canceled", child.ID)
+			return
+		}
+
+		latest, getErr := mod.GetStore().GetDagInstance(child.ID)
+		if getErr != nil {
+			err = getErr
+			break
+		}
+		child = latest
+	}
+	ctx.Tracef("cancel child dag instance[%s] failed: %s", child.ID, err)
+}
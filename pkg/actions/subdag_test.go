@@ -0,0 +1,292 @@
+package actions
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/entity/run"
+	"github.com/shiningrush/fastflow/pkg/mod"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSubDag_Run(t *testing.T) {
+	taskIns := &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task-ins"},
+		DagInsID: "parent-ins",
+	}
+	childDag := &entity.Dag{
+		BaseInfo: entity.BaseInfo{ID: "child"},
+		Status:   entity.DagStatusNormal,
+		Vars:     entity.DagVars{"input": {}},
+	}
+
+	tests := []struct {
+		caseDesc      string
+		giveChildren  []*entity.DagInstance
+		giveCreateErr error
+		giveStatus    entity.DagInstanceStatus
+		wantCreated   *entity.DagInstance
+		wantShareData map[string]string
+		wantErr       error
+	}{
+		{
+			caseDesc:   "start child",
+			giveStatus: entity.DagInstanceStatusSuccess,
+			wantCreated: &entity.DagInstance{
+				BaseInfo:        entity.BaseInfo{ID: "sub-task-ins-0"},
+				DagID:           "child",
+				Trigger:         entity.TriggerSubDag,
+				Vars:            entity.DagInstanceVars{"input": {Value: "value"}},
+				ShareData:       &entity.ShareData{},
+				Status:          entity.DagInstanceStatusInit,
+				ParentDagInsID:  "parent-ins",
+				ParentTaskInsID: "task-ins",
+			},
+			wantShareData: map[string]string{"result": "ok"},
+		},
+		{
+			caseDesc:      "child created by others",
+			giveCreateErr: data.ErrDataConflicted,
+			giveStatus:    entity.DagInstanceStatusSuccess,
+			wantShareData: map[string]string{"result": "ok"},
+		},
+		{
+			caseDesc: "reuse existed child",
+			giveChildren: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"}, Status: entity.DagInstanceStatusRunning},
+			},
+			giveStatus:    entity.DagInstanceStatusSuccess,
+			wantShareData: map[string]string{"result": "ok"},
+		},
+		{
+			caseDesc:      "create failed",
+			giveCreateErr: fmt.Errorf("create failed"),
+			wantErr:       fmt.Errorf("create child dag instance failed: %w", fmt.Errorf("create failed")),
+		},
+		{
+			caseDesc:   "child failed",
+			giveStatus: entity.DagInstanceStatusFailed,
+			wantErr:    fmt.Errorf("child dag instance[sub-task-ins-0] is failed: child reason"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var created *entity.DagInstance
+			mStore := &mod.MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, &mod.ListDagInstanceInput{
+					ParentTaskInsID: "task-ins",
+					SortBy:          []string{"-createdAt"},
+				}, args.Get(0))
+			}).Return(tc.giveChildren, nil)
+			mStore.On("GetDag", "child").Return(childDag, nil)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				if tc.giveCreateErr == nil {
+					created = args.Get(0).(*entity.DagInstance)
+				}
+			}).Return(tc.giveCreateErr)
+			mStore.On("GetDagInstance", "sub-task-ins-0").Return(&entity.DagInstance{
+				BaseInfo:  entity.BaseInfo{ID: "sub-task-ins-0"},
+				Status:    tc.giveStatus,
+				Reason:    "child reason",
+				ShareData: &entity.ShareData{Dict: map[string]string{"output": "ok"}},
+			}, nil)
+			mod.SetStore(mStore)
+
+			shareData := &entity.ShareData{Dict: map[string]string{}}
+			ctx := run.NewDefExecuteContext(
+				entity.CtxWithRunningTaskIns(context.Background(), taskIns),
+				shareData, func(msg string, opt ...run.TraceOp) {}, nil, nil)
+			err := (&SubDag{}).Run(ctx, &SubDagParams{
+				DagID:         "child",
+				Vars:          map[string]string{"input": "value"},
+				ShareData:     map[string]string{"result": "output"},
+				CheckInterval: "1ms",
+			})
+			assert.Equal(t, tc.wantErr, err)
+			if tc.wantCreated != nil {
+				assert.Equal(t, tc.wantCreated, created)
+			}
+			if tc.wantShareData != nil {
+				assert.Equal(t, tc.wantShareData, shareData.Dict)
+			}
+		})
+	}
+}
+
+func TestSubDag_RunCanceled(t *testing.T) {
+	taskIns := &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task-ins"},
+		DagInsID: "parent-ins",
+	}
+	newChild := func(status entity.DagInstanceStatus) *entity.DagInstance {
+		return &entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"},
+			Worker:   "worker",
+			Status:   status,
+		}
+	}
+	canceled := &entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"},
+		Status:   entity.DagInstanceStatusCanceled,
+		Reason:   "parent task is canceled",
+		Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+	}
+
+	tests := []struct {
+		caseDesc     string
+		giveChildren []*entity.DagInstance
+		giveGetErr   error
+		givePatchErr []error
+		wantErr      error
+		wantPatched  []*entity.DagInstance
+		wantConds    []*mod.PatchDagInsCondition
+	}{
+		{
+			caseDesc:     "init",
+			giveChildren: []*entity.DagInstance{newChild(entity.DagInstanceStatusInit)},
+			wantErr:      context.DeadlineExceeded,
+			wantPatched:  []*entity.DagInstance{canceled},
+			wantConds: []*mod.PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit}, Worker: "worker"},
+			},
+		},
+		{
+			caseDesc:     "paused",
+			giveChildren: []*entity.DagInstance{newChild(entity.DagInstanceStatusPaused)},
+			wantErr:      context.DeadlineExceeded,
+			wantPatched:  []*entity.DagInstance{canceled},
+			wantConds: []*mod.PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPaused}, Worker: "worker"},
+			},
+		},
+		{
+			caseDesc:     "pending",
+			giveChildren: []*entity.DagInstance{newChild(entity.DagInstanceStatusPending)},
+			wantErr:      context.DeadlineExceeded,
+			wantPatched: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"}, Status: entity.DagInstanceStatusCanceled},
+			},
+			wantConds: []*mod.PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending}},
+			},
+		},
+		{
+			caseDesc:     "changed meanwhile",
+			giveChildren: []*entity.DagInstance{newChild(entity.DagInstanceStatusScheduled)},
+			givePatchErr: []error{data.ErrDataConflicted, nil},
+			wantErr:      context.DeadlineExceeded,
+			wantPatched:  []*entity.DagInstance{canceled, canceled},
+			wantConds: []*mod.PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "worker"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "worker"},
+			},
+		},
+		{
+			caseDesc:     "get child failed",
+			giveChildren: []*entity.DagInstance{newChild(entity.DagInstanceStatusRunning)},
+			giveGetErr:   fmt.Errorf("get failed"),
+			wantErr:      fmt.Errorf("get child dag instance failed: %w", fmt.Errorf("get failed")),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			c, cancel := context.WithTimeout(entity.CtxWithRunningTaskIns(context.Background(), taskIns), 20*time.Millisecond)
+			defer cancel()
+
+			var patched []*entity.DagInstance
+			var conds []*mod.PatchDagInsCondition
+			mStore := &mod.MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(tc.giveChildren, nil)
+			mStore.On("GetDagInstance", "sub-task-ins-0").Run(func(args mock.Arguments) {
+				// the context is canceled while loading the child
+				if tc.giveGetErr != nil {
+					cancel()
+				}
+			}).Return(func(string) *entity.DagInstance {
+				if tc.giveGetErr != nil {
+					return nil
+				}
+				return newChild(tc.giveChildren[0].Status)
+			}, tc.giveGetErr)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patched = append(patched, args.Get(0).(*entity.DagInstance))
+				conds = append(conds, args.Get(1).(*mod.PatchDagInsCondition))
+			}).Return(func(*entity.DagInstance, *mod.PatchDagInsCondition, ...string) error {
+				if len(patched) <= len(tc.givePatchErr) {
+					return tc.givePatchErr[len(patched)-1]
+				}
+				return nil
+			})
+			mod.SetStore(mStore)
+			mod.SetCommander(&mod.DefCommander{})
+
+			ctx := run.NewDefExecuteContext(c, &entity.ShareData{}, func(msg string, opt ...run.TraceOp) {}, nil, nil)
+			err := (&SubDag{}).Run(ctx, &SubDagParams{DagID: "child", CheckInterval: "1ms"})
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatched, patched)
+			assert.Equal(t, tc.wantConds, conds)
+		})
+	}
+}
+
+func TestSubDag_RetryBefore(t *testing.T) {
+	taskIns := &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task-ins"},
+		DagInsID: "parent-ins",
+	}
+
+	tests := []struct {
+		caseDesc     string
+		giveChildren []*entity.DagInstance
+		wantCreated  string
+	}{
+		{
+			caseDesc: "no child",
+		},
+		{
+			caseDesc: "child is running",
+			giveChildren: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"}, Status: entity.DagInstanceStatusRunning},
+			},
+		},
+		{
+			caseDesc: "child failed",
+			giveChildren: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "sub-task-ins-1"}, Status: entity.DagInstanceStatusFailed},
+				{BaseInfo: entity.BaseInfo{ID: "sub-task-ins-0"}, Status: entity.DagInstanceStatusFailed},
+			},
+			wantCreated: "sub-task-ins-2",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var created string
+			mStore := &mod.MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(tc.giveChildren, nil)
+			mStore.On("GetDag", "child").Return(&entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "child"},
+				Status:   entity.DagStatusNormal,
+			}, nil)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				created = args.Get(0).(*entity.DagInstance).ID
+			}).Return(nil)
+			mod.SetStore(mStore)
+
+			ctx := run.NewDefExecuteContext(
+				entity.CtxWithRunningTaskIns(context.Background(), taskIns),
+				&entity.ShareData{}, func(msg string, opt ...run.TraceOp) {}, nil, nil)
+			err := (&SubDag{}).RetryBefore(ctx, &SubDagParams{DagID: "child"})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantCreated, created)
+		})
+	}
+}
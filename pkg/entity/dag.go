@@ -3,11 +3,15 @@ package entity
 import (
 	"encoding/json"
 	"fmt"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/shiningrush/fastflow/pkg/log"
 	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/shiningrush/fastflow/pkg/utils/value"
 )
 
@@ -24,9 +28,277 @@ type Dag struct {
 	Name     string    `yaml:"name,omitempty" json:"name,omitempty" bson:"name,omitempty"`
 	Desc     string    `yaml:"desc,omitempty" json:"desc,omitempty" bson:"desc,omitempty"`
 	Cron     string    `yaml:"cron,omitempty" json:"cron,omitempty" bson:"cron,omitempty"`
+	Timezone string    `yaml:"timezone,omitempty" json:"timezone,omitempty" bson:"timezone,omitempty"` // IANA location name used by cron, default is local
 	Vars     DagVars   `yaml:"vars,omitempty" json:"vars,omitempty" bson:"vars,omitempty"`
 	Status   DagStatus `yaml:"status,omitempty" json:"status,omitempty" bson:"status,omitempty"`
 	Tasks    []Task    `yaml:"tasks,omitempty" json:"tasks,omitempty" bson:"tasks,omitempty"`
+	// Priority decide the order of dispatching and executing, higher is first, default 0
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty" bson:"priority,omitempty"`
+	// MaxActiveRuns limit the count of active(scheduled, running and blocked) instances, 0 means no limit
+	MaxActiveRuns int `yaml:"maxActiveRuns,omitempty" json:"maxActiveRuns,omitempty" bson:"maxActiveRuns,omitempty"`
+	// CatchUp decide how to handle cron points missed when leader was down or dag was stopped
+	CatchUp CatchUpPolicy `yaml:"catchUp,omitempty" json:"catchUp,omitempty" bson:"catchUp,omitempty"`
+	// CatchUpLimit is the max count of missed points will be fired under "all" policy, default 10
+	CatchUpLimit int `yaml:"catchUpLimit,omitempty" json:"catchUpLimit,omitempty" bson:"catchUpLimit,omitempty"`
+	// NodeSelector limit the workers which can run the instances, such as "zone=bj, net in (a,b)"
+	NodeSelector string `yaml:"nodeSelector,omitempty" json:"nodeSelector,omitempty" bson:"nodeSelector,omitempty"`
+	// DependsOnDags make the dag run automatically when the instances of upstream dags complete
+	DependsOnDags []DagDependency `yaml:"dependsOnDags,omitempty" json:"dependsOnDags,omitempty" bson:"dependsOnDags,omitempty"`
+	// Retry is the default retry policy of tasks which do not declare their own
+	Retry *RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty" bson:"retry,omitempty"`
+	// TimeoutSecs limit the duration of a running instance, the instance will be failed by watch dog when it exceeds, 0 means no limit
+	TimeoutSecs int `yaml:"timeoutSecs,omitempty" json:"timeoutSecs,omitempty" bson:"timeoutSecs,omitempty"`
+	// SlaSecs is the expected duration of a running instance, the instance will be marked as sla missed but not failed when it exceeds
+	SlaSecs int `yaml:"slaSecs,omitempty" json:"slaSecs,omitempty" bson:"slaSecs,omitempty"`
+	// Version is increased by store every time the dag is saved, each version has an immutable snapshot
+	Version int `yaml:"version,omitempty" json:"version,omitempty" bson:"version,omitempty"`
+}
+
+// DagDependency describe which upstream dag instance will trigger the dag
+type DagDependency struct {
+	// DagID is the id of upstream dag
+	DagID string `yaml:"dagId,omitempty" json:"dagId,omitempty" bson:"dagId,omitempty"`
+	// On is the statuses of upstream instance which trigger the dag, default is success
+	On []DagInstanceStatus `yaml:"on,omitempty" json:"on,omitempty" bson:"on,omitempty"`
+	// VarsMapping map the share data of upstream instance to vars, key is var name and value is share data key
+	VarsMapping map[string]string `yaml:"varsMapping,omitempty" json:"varsMapping,omitempty" bson:"varsMapping,omitempty"`
+}
+
+// Match check if the upstream instance should trigger the dag
+func (d *DagDependency) Match(upstream *DagInstance) bool {
+	if d.DagID != upstream.DagID {
+		return false
+	}
+	if len(d.On) == 0 {
+		return upstream.Status == DagInstanceStatusSuccess
+	}
+	for _, s := range d.On {
+		if s == upstream.Status {
+			return true
+		}
+	}
+	return false
+}
+
+// Vars build the vars of downstream instance from the share data of upstream instance
+func (d *DagDependency) Vars(upstream *DagInstance) map[string]string {
+	vars := map[string]string{}
+	if upstream.ShareData == nil {
+		return vars
+	}
+	for varName, key := range d.VarsMapping {
+		if v, ok := upstream.ShareData.Get(key); ok {
+			vars[varName] = v
+		}
+	}
+	return vars
+}
+
+// RunByUpstream run the dag by the upstream dag instance, return nil if the upstream does not match any dependency
+func (d *Dag) RunByUpstream(upstream *DagInstance) (*DagInstance, error) {
+	for i := range d.DependsOnDags {
+		if !d.DependsOnDags[i].Match(upstream) {
+			continue
+		}
+
+		dagIns, err := d.Run(TriggerUpstream, d.DependsOnDags[i].Vars(upstream))
+		if err != nil {
+			return nil, err
+		}
+		dagIns.ParentDagInsID = upstream.ID
+		return dagIns, nil
+	}
+	return nil, nil
+}
+
+// CatchUpPolicy
+type CatchUpPolicy string
+
+const (
+	// CatchUpNone means all missed points will be skipped
+	CatchUpNone CatchUpPolicy = "none"
+	// CatchUpLatest means only the latest missed point will be fired, it is the default policy
+	CatchUpLatest CatchUpPolicy = "latest"
+	// CatchUpAll means all missed points will be fired, but not more than "CatchUpLimit"
+	CatchUpAll CatchUpPolicy = "all"
+
+	DefaultCatchUpLimit = 10
+)
+
+const (
+	// VarKeyScheduleTime is the built-in var which record the logical schedule time(RFC3339) of a cron or backfill instance
+	VarKeyScheduleTime = "ff_schedule_time"
+)
+
+var cronParser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// CronSchedule parse the cron expression of dag,
+// it supports standard 5 fields, 6 fields(with seconds) and descriptors like "@daily"
+func (d *Dag) CronSchedule() (cron.Schedule, error) {
+	if d.Cron == "" {
+		return nil, fmt.Errorf("dag[%s] has no cron expression", d.ID)
+	}
+
+	sch, err := cronParser.Parse(d.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("parse cron[%s] failed: %w", d.Cron, err)
+	}
+	if d.Timezone != "" {
+		loc, err := time.LoadLocation(d.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("load timezone[%s] failed: %w", d.Timezone, err)
+		}
+		if specSch, ok := sch.(*cron.SpecSchedule); ok {
+			specSch.Location = loc
+		}
+	}
+	return sch, nil
+}
+
+// CronTimes return all cron points in the range (from, to]
+func (d *Dag) CronTimes(from, to time.Time) ([]time.Time, error) {
+	sch, err := d.CronSchedule()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []time.Time
+	for next := sch.Next(from); !next.IsZero() && !next.After(to); next = sch.Next(next) {
+		ret = append(ret, next)
+	}
+	return ret, nil
+}
+
+// DagSchedule record the schedule state of a cron dag, its id is same as dag's
+type DagSchedule struct {
+	BaseInfo `bson:"inline"`
+	// LastFiredAt is the unix time of the latest cron point which has been fired
+	LastFiredAt int64 `json:"lastFiredAt,omitempty" bson:"lastFiredAt,omitempty"`
+}
+
+// DagVersion is an immutable snapshot of a dag, its id is "{dagId}@{version}"
+type DagVersion struct {
+	BaseInfo `bson:"inline"`
+	DagID    string `json:"dagId,omitempty" bson:"dagId,omitempty"`
+	Version  int    `json:"version,omitempty" bson:"version,omitempty"`
+	Dag      Dag    `json:"dag,omitempty" bson:"dag,omitempty"`
+}
+
+// NewDagVersion build the snapshot of the given dag
+func NewDagVersion(dag *Dag) *DagVersion {
+	return &DagVersion{
+		BaseInfo: BaseInfo{ID: DagVersionID(dag.ID, dag.Version)},
+		DagID:    dag.ID,
+		Version:  dag.Version,
+		Dag:      *dag,
+	}
+}
+
+// DagVersionID return the id of the given dag version
+func DagVersionID(dagId string, version int) string {
+	return fmt.Sprintf("%s@%d", dagId, version)
+}
+
+// DagDiff describe the differences between two dag versions
+type DagDiff struct {
+	// Fields is the changed fields except tasks, the names are same as json
+	Fields       []string `json:"fields,omitempty"`
+	AddedTasks   []string `json:"addedTasks,omitempty"`
+	RemovedTasks []string `json:"removedTasks,omitempty"`
+	ChangedTasks []string `json:"changedTasks,omitempty"`
+}
+
+// IsEmpty check if there is no difference
+func (d *DagDiff) IsEmpty() bool {
+	return len(d.Fields) == 0 && len(d.AddedTasks) == 0 && len(d.RemovedTasks) == 0 && len(d.ChangedTasks) == 0
+}
+
+// DiffDag compare the definitions of two dags, base info and version are ignored
+func DiffDag(from, to *Dag) (*DagDiff, error) {
+	diff := &DagDiff{}
+	fv, tv := reflect.ValueOf(from).Elem(), reflect.ValueOf(to).Elem()
+	for i := 0; i < fv.NumField(); i++ {
+		field := fv.Type().Field(i)
+		if field.Anonymous || field.Name == "Version" || field.Name == "Tasks" {
+			continue
+		}
+		equal, err := jsonEqual(fv.Field(i).Interface(), tv.Field(i).Interface())
+		if err != nil {
+			return nil, fmt.Errorf("compare %s failed: %w", field.Name, err)
+		}
+		if !equal {
+			diff.Fields = append(diff.Fields, strings.Split(field.Tag.Get("json"), ",")[0])
+		}
+	}
+
+	toTasks := map[string]*Task{}
+	for i := range to.Tasks {
+		toTasks[to.Tasks[i].ID] = &to.Tasks[i]
+	}
+	for i := range from.Tasks {
+		t, ok := toTasks[from.Tasks[i].ID]
+		if !ok {
+			diff.RemovedTasks = append(diff.RemovedTasks, from.Tasks[i].ID)
+			continue
+		}
+		delete(toTasks, t.ID)
+
+		equal, err := jsonEqual(&from.Tasks[i], t)
+		if err != nil {
+			return nil, fmt.Errorf("compare task[%s] failed: %w", t.ID, err)
+		}
+		if !equal {
+			diff.ChangedTasks = append(diff.ChangedTasks, t.ID)
+		}
+	}
+	for i := range to.Tasks {
+		if _, ok := toTasks[to.Tasks[i].ID]; ok {
+			diff.AddedTasks = append(diff.AddedTasks, to.Tasks[i].ID)
+		}
+	}
+	return diff, nil
+}
+
+// jsonEqual compare values by json, so nil and empty value are treated as same
+func jsonEqual(a, b interface{}) (bool, error) {
+	if isEmptyValue(a) && isEmptyValue(b) {
+		return true, nil
+	}
+	ab, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return string(ab) == string(bb), nil
+}
+
+func isEmptyValue(v interface{}) bool {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice:
+		return rv.Len() == 0
+	case reflect.Ptr:
+		return rv.IsNil()
+	}
+	return rv.IsZero()
+}
+
+// RunScheduled used to build a new DagInstance for the given logical schedule time
+func (d *Dag) RunScheduled(trigger Trigger, scheduleTime time.Time) (*DagInstance, error) {
+	dagIns, err := d.Run(trigger, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dagIns.Vars[VarKeyScheduleTime] = DagInstanceVar{
+		Value: scheduleTime.Format(time.RFC3339),
+	}
+	return dagIns, nil
 }
 
 // SpecifiedVar
@@ -41,6 +313,11 @@ func (d *Dag) Run(trigger Trigger, specVars map[string]string) (*DagInstance, er
 		return nil, fmt.Errorf("you cannot run a stopeed dag")
 	}
 
+	nodeSelector, err := d.InsNodeSelector()
+	if err != nil {
+		return nil, err
+	}
+
 	dagInsVars := DagInstanceVars{}
 	for key, value := range d.Vars {
 		v := value.DefaultValue
@@ -53,14 +330,42 @@ func (d *Dag) Run(trigger Trigger, specVars map[string]string) (*DagInstance, er
 	}
 
 	return &DagInstance{
-		DagID:     d.ID,
-		Trigger:   trigger,
-		Vars:      dagInsVars,
-		ShareData: &ShareData{},
-		Status:    DagInstanceStatusInit,
+		DagID:        d.ID,
+		DagVersion:   d.Version,
+		Trigger:      trigger,
+		Vars:         dagInsVars,
+		ShareData:    &ShareData{},
+		Status:       DagInstanceStatusInit,
+		Priority:     d.Priority,
+		NodeSelector: nodeSelector,
+		TimeoutSecs:  d.TimeoutSecs,
+		SlaSecs:      d.SlaSecs,
 	}, nil
 }
 
+// InsNodeSelector return the node selector of dag instance, it merges the selectors of dag and tasks,
+// because all tasks of a dag instance are executed on the same worker
+func (d *Dag) InsNodeSelector() (string, error) {
+	var exprs []string
+	if d.NodeSelector != "" {
+		exprs = append(exprs, d.NodeSelector)
+	}
+	for i := range d.Tasks {
+		if d.Tasks[i].NodeSelector != "" {
+			exprs = append(exprs, d.Tasks[i].NodeSelector)
+		}
+	}
+	if len(exprs) == 0 {
+		return "", nil
+	}
+
+	selector := strings.Join(exprs, ", ")
+	if _, err := data.PareSelectors(selector); err != nil {
+		return "", fmt.Errorf("node selector[%s] is invalid: %w", selector, err)
+	}
+	return selector, nil
+}
+
 type DagVars map[string]DagVar
 
 // DagVar
@@ -93,6 +398,30 @@ type DagInstance struct {
 	Status    DagInstanceStatus `json:"status,omitempty" bson:"status,omitempty"`
 	Reason    string            `json:"reason,omitempty" bson:"reason,omitempty"`
 	Cmd       *Command          `json:"cmd,omitempty" bson:"cmd,omitempty"`
+	Priority  int               `json:"priority,omitempty" bson:"priority,omitempty"`
+	// DagVersion is the version of dag which the instance is created from, 0 means the latest
+	DagVersion int `json:"dagVersion,omitempty" bson:"dagVersion,omitempty"`
+	// RunAt is the unix time when a pending dag instance can start
+	RunAt int64 `json:"runAt,omitempty" bson:"runAt,omitempty"`
+	// IdempotencyKey is unique within a dag, the runs with the same key return the same instance
+	IdempotencyKey string `json:"idempotencyKey,omitempty" bson:"idempotencyKey,omitempty"`
+	// NodeSelector is merged from dag and tasks, only the matched workers can run it
+	NodeSelector string `json:"nodeSelector,omitempty" bson:"nodeSelector,omitempty"`
+	// ParentDagInsID is the dag instance which triggers this one, such as the upstream dag instance
+	ParentDagInsID string `json:"parentDagInsId,omitempty" bson:"parentDagInsId,omitempty"`
+	// Generation is increased when the finished instance is reopened by retry, rerun or mark,
+	// so each completion of it can trigger downstream dags once
+	Generation int `json:"generation,omitempty" bson:"generation,omitempty"`
+	// ParentTaskInsID is the task instance which starts this one as a sub dag
+	ParentTaskInsID string `json:"parentTaskInsId,omitempty" bson:"parentTaskInsId,omitempty"`
+	TimeoutSecs     int    `json:"timeoutSecs,omitempty" bson:"timeoutSecs,omitempty"`
+	// Deadline is the unix time when the running instance will be timeout, it is set when the instance starts running
+	Deadline int64 `json:"deadline,omitempty" bson:"deadline,omitempty"`
+	SlaSecs  int   `json:"slaSecs,omitempty" bson:"slaSecs,omitempty"`
+	// SlaDueAt is the unix time when the instance should be completed, it is set when the instance starts running
+	SlaDueAt int64 `json:"slaDueAt,omitempty" bson:"slaDueAt,omitempty"`
+	// SlaMissed means the instance is not completed before SlaDueAt
+	SlaMissed bool `json:"slaMissed,omitempty" bson:"slaMissed,omitempty"`
 }
 
 var (
@@ -169,8 +498,8 @@ type DagInstanceVars map[string]DagInstanceVar
 
 // Cancel a task, it is just set a command, command will execute by Parser
 func (dagIns *DagInstance) Cancel(taskInsIds []string) error {
-	if dagIns.Status != DagInstanceStatusRunning {
-		return fmt.Errorf("you can only cancel a running dag instance")
+	if dagIns.Status != DagInstanceStatusRunning && dagIns.Status != DagInstanceStatusPaused {
+		return fmt.Errorf("you can only cancel a running or paused dag instance")
 	}
 	if dagIns.Cmd != nil {
 		return fmt.Errorf("dag instance have a incomplete command")
@@ -182,6 +511,58 @@ func (dagIns *DagInstance) Cancel(taskInsIds []string) error {
 	return nil
 }
 
+// Expire fail the task instances which execute too long, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Expire(taskInsIds []string) error {
+	if dagIns.Cmd != nil {
+		return fmt.Errorf("dag instance have a incomplete command")
+	}
+	dagIns.Cmd = &Command{
+		Name:             CommandNameExpire,
+		TargetTaskInsIDs: taskInsIds,
+	}
+	return nil
+}
+
+// CancelAll cancel the whole dag instance, it is marked canceled at once
+// and the unfinished tasks will be canceled by the command.
+// pending instance is not accepted, you should use CancelPending for it
+func (dagIns *DagInstance) CancelAll(reason string) error {
+	if dagIns.Status == DagInstanceStatusPending {
+		return fmt.Errorf("you should cancel a pending dag instance by CancelPending")
+	}
+	if dagIns.IsTerminal() {
+		return fmt.Errorf("you can only cancel a unfinished dag instance")
+	}
+	if dagIns.Cmd != nil {
+		return fmt.Errorf("dag instance have a incomplete command")
+	}
+	dagIns.executeHook(HookDagInstance.BeforeCancel)
+	dagIns.Status = DagInstanceStatusCanceled
+	dagIns.Reason = reason
+	dagIns.Cmd = &Command{
+		Name: CommandNameCancelDagIns,
+	}
+	return nil
+}
+
+// IsTerminal indicate if the dag instance will not change its status anymore
+func (dagIns *DagInstance) IsTerminal() bool {
+	switch dagIns.Status {
+	case DagInstanceStatusSuccess, DagInstanceStatusFailed, DagInstanceStatusCanceled:
+		return true
+	}
+	return false
+}
+
+// CancelPending cancel a pending dag instance before it starts
+func (dagIns *DagInstance) CancelPending() error {
+	if dagIns.Status != DagInstanceStatusPending {
+		return fmt.Errorf("you can only cancel a pending dag instance")
+	}
+	dagIns.Status = DagInstanceStatusCanceled
+	return nil
+}
+
 var (
 	HookDagInstance DagInstanceLifecycleHook
 )
@@ -196,6 +577,12 @@ type DagInstanceLifecycleHook struct {
 	BeforeBlock    DagInstanceHookFunc
 	BeforeRetry    DagInstanceHookFunc
 	BeforeContinue DagInstanceHookFunc
+	BeforeTimeout  DagInstanceHookFunc
+	BeforePause    DagInstanceHookFunc
+	BeforeResume   DagInstanceHookFunc
+	BeforeCancel   DagInstanceHookFunc
+	BeforeRerun    DagInstanceHookFunc
+	BeforeMark     DagInstanceHookFunc
 }
 
 // VarsGetter
@@ -222,6 +609,12 @@ func (dagIns *DagInstance) Run() {
 	dagIns.executeHook(HookDagInstance.BeforeRun)
 	dagIns.Status = DagInstanceStatusRunning
 	dagIns.Reason = ""
+	if dagIns.TimeoutSecs > 0 && dagIns.Deadline == 0 {
+		dagIns.Deadline = time.Now().Add(time.Duration(dagIns.TimeoutSecs) * time.Second).Unix()
+	}
+	if dagIns.SlaSecs > 0 && dagIns.SlaDueAt == 0 {
+		dagIns.SlaDueAt = time.Now().Add(time.Duration(dagIns.SlaSecs) * time.Second).Unix()
+	}
 }
 
 // Success the dag instance
@@ -238,6 +631,22 @@ func (dagIns *DagInstance) Fail(reason string) {
 	dagIns.Status = DagInstanceStatusFailed
 }
 
+// IsTimeout indicate if the dag instance exceeds its deadline
+func (dagIns *DagInstance) IsTimeout() bool {
+	return dagIns.Deadline > 0 && time.Now().Unix() >= dagIns.Deadline
+}
+
+// Timeout fail the dag instance because it exceeds its deadline
+func (dagIns *DagInstance) Timeout() {
+	dagIns.executeHook(HookDagInstance.BeforeTimeout)
+	dagIns.Fail(dagIns.TimeoutReason())
+}
+
+// TimeoutReason
+func (dagIns *DagInstance) TimeoutReason() string {
+	return fmt.Sprintf("dag instance is timeout, it runs more than %d seconds", dagIns.TimeoutSecs)
+}
+
 // Block the dag instance
 func (dagIns *DagInstance) Block(reason string) {
 	dagIns.executeHook(HookDagInstance.BeforeBlock)
@@ -254,6 +663,47 @@ func (dagIns *DagInstance) Continue(taskInsIds []string) error {
 	return dagIns.genCmd(taskInsIds, CommandNameContinue)
 }
 
+// Rerun the finished tasks, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Rerun(taskInsIds []string) error {
+	if !dagIns.IsTerminal() {
+		return fmt.Errorf("you can only rerun a finished dag instance")
+	}
+	return dagIns.genCmd(taskInsIds, CommandNameRerun)
+}
+
+// MarkTasks mark the tasks as success or skipped, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) MarkTasks(taskInsIds []string, mark *TaskMark) error {
+	switch dagIns.Status {
+	case DagInstanceStatusRunning, DagInstanceStatusBlocked, DagInstanceStatusFailed:
+	default:
+		return fmt.Errorf("you can only mark tasks of a running, blocked or failed dag instance")
+	}
+	if err := mark.Validate(); err != nil {
+		return err
+	}
+	if err := dagIns.genCmd(taskInsIds, CommandNameMark); err != nil {
+		return err
+	}
+	dagIns.Cmd.Mark = mark
+	return nil
+}
+
+// Pause the dag instance, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Pause() error {
+	if dagIns.Status != DagInstanceStatusRunning {
+		return fmt.Errorf("you can only pause a running dag instance")
+	}
+	return dagIns.genCmd(nil, CommandNamePause)
+}
+
+// Resume the paused dag instance, it is just set a command, command will execute by Parser
+func (dagIns *DagInstance) Resume() error {
+	if dagIns.Status != DagInstanceStatusPaused {
+		return fmt.Errorf("you can only resume a paused dag instance")
+	}
+	return dagIns.genCmd(nil, CommandNameResume)
+}
+
 func (dagIns *DagInstance) genCmd(taskInsIds []string, cmdName CommandName) error {
 	if dagIns.Cmd != nil {
 		return fmt.Errorf("dag instance have a incomplete command")
@@ -264,6 +714,14 @@ func (dagIns *DagInstance) genCmd(taskInsIds []string, cmdName CommandName) erro
 		dagIns.executeHook(HookDagInstance.BeforeRetry)
 	case CommandNameContinue:
 		dagIns.executeHook(HookDagInstance.BeforeContinue)
+	case CommandNameRerun:
+		dagIns.executeHook(HookDagInstance.BeforeRerun)
+	case CommandNameMark:
+		dagIns.executeHook(HookDagInstance.BeforeMark)
+	case CommandNamePause:
+		dagIns.executeHook(HookDagInstance.BeforePause)
+	case CommandNameResume:
+		dagIns.executeHook(HookDagInstance.BeforeResume)
 	}
 
 	dagIns.Cmd = &Command{
@@ -300,27 +758,38 @@ func (vars DagInstanceVars) Render(p map[string]interface{}) (map[string]interfa
 type Command struct {
 	Name             CommandName
 	TargetTaskInsIDs []string
+	// Mark is only used by mark command
+	Mark *TaskMark
 }
 
 // CommandName
 type CommandName string
 
 const (
-	CommandNameRetry    = "retry"
-	CommandNameCancel   = "cancel"
-	CommandNameContinue = "continue"
+	CommandNameRetry        = "retry"
+	CommandNameCancel       = "cancel"
+	CommandNameContinue     = "continue"
+	CommandNamePause        = "pause"
+	CommandNameResume       = "resume"
+	CommandNameCancelDagIns = "cancel-dag"
+	CommandNameRerun        = "rerun"
+	CommandNameMark         = "mark"
+	CommandNameExpire       = "expire"
 )
 
 // DagInstanceStatus
 type DagInstanceStatus string
 
 const (
+	DagInstanceStatusPending   DagInstanceStatus = "pending"
 	DagInstanceStatusInit      DagInstanceStatus = "init"
 	DagInstanceStatusScheduled DagInstanceStatus = "scheduled"
 	DagInstanceStatusRunning   DagInstanceStatus = "running"
 	DagInstanceStatusBlocked   DagInstanceStatus = "blocked"
+	DagInstanceStatusPaused    DagInstanceStatus = "paused"
 	DagInstanceStatusFailed    DagInstanceStatus = "failed"
 	DagInstanceStatusSuccess   DagInstanceStatus = "success"
+	DagInstanceStatusCanceled  DagInstanceStatus = "canceled"
 )
 
 // Trigger
@@ -329,4 +798,8 @@ type Trigger string
 const (
 	TriggerManually Trigger = "manually"
 	TriggerCron     Trigger = "cron"
+	TriggerBackfill Trigger = "backfill"
+	TriggerWebhook  Trigger = "webhook"
+	TriggerUpstream Trigger = "upstream"
+	TriggerSubDag   Trigger = "subDag"
 )
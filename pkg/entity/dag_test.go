@@ -3,6 +3,7 @@ package entity
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -93,6 +94,54 @@ func TestDagInstance_Run(t *testing.T) {
 	})
 }
 
+func TestDagInstance_RunDeadline(t *testing.T) {
+	dagIns := &DagInstance{TimeoutSecs: 60}
+	dagIns.Run()
+	assert.InDelta(t, time.Now().Unix()+60, dagIns.Deadline, 1)
+	assert.False(t, dagIns.IsTimeout())
+
+	// deadline should not be changed when dag instance runs again
+	dagIns.Deadline = time.Now().Add(-time.Second).Unix()
+	dagIns.Run()
+	assert.True(t, dagIns.IsTimeout())
+
+	noTimeout := &DagInstance{}
+	noTimeout.Run()
+	assert.Zero(t, noTimeout.Deadline)
+	assert.False(t, noTimeout.IsTimeout())
+}
+
+func TestDagInstance_RunSla(t *testing.T) {
+	dagIns := &DagInstance{SlaSecs: 30}
+	dagIns.Run()
+	assert.InDelta(t, time.Now().Unix()+30, dagIns.SlaDueAt, 1)
+
+	noSla := &DagInstance{}
+	noSla.Run()
+	assert.Zero(t, noSla.SlaDueAt)
+}
+
+func TestDagInstance_Timeout(t *testing.T) {
+	var hooks []string
+	HookDagInstance = DagInstanceLifecycleHook{
+		BeforeTimeout: func(dagIns *DagInstance) {
+			hooks = append(hooks, "timeout")
+		},
+		BeforeFail: func(dagIns *DagInstance) {
+			hooks = append(hooks, string(DagInstanceStatusFailed))
+		},
+	}
+	defer func() {
+		HookDagInstance = DagInstanceLifecycleHook{}
+	}()
+
+	dagIns := &DagInstance{Status: DagInstanceStatusRunning, TimeoutSecs: 10}
+	dagIns.Timeout()
+	assert.Equal(t, DagInstanceStatusFailed, dagIns.Status)
+	assert.Equal(t, "dag instance is timeout, it runs more than 10 seconds", dagIns.Reason)
+	assert.Equal(t, []string{"timeout", string(DagInstanceStatusFailed)}, hooks)
+}
+
 func TestDagInstance_Retry(t *testing.T) {
 	dagIns := &DagInstance{
 		Status: DagInstanceStatusFailed,
@@ -102,6 +151,45 @@ func TestDagInstance_Retry(t *testing.T) {
 	})
 }
 
+func TestDagInstance_Rerun(t *testing.T) {
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusSuccess,
+	}
+	testHook(t, dagIns, "rerun", DagInstanceStatusSuccess, func() {
+		err := dagIns.Rerun([]string{"testId"})
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, &Command{Name: CommandNameRerun, TargetTaskInsIDs: []string{"testId"}}, dagIns.Cmd)
+
+	runningDagIns := &DagInstance{
+		Status: DagInstanceStatusRunning,
+	}
+	err := runningDagIns.Rerun([]string{"testId"})
+	assert.Equal(t, fmt.Errorf("you can only rerun a finished dag instance"), err)
+}
+
+func TestDagInstance_MarkTasks(t *testing.T) {
+	mark := &TaskMark{Status: TaskInstanceStatusSuccess, Reason: "fixed by hand"}
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusFailed,
+	}
+	testHook(t, dagIns, "mark", DagInstanceStatusFailed, func() {
+		err := dagIns.MarkTasks([]string{"testId"}, mark)
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, &Command{Name: CommandNameMark, TargetTaskInsIDs: []string{"testId"}, Mark: mark}, dagIns.Cmd)
+
+	canceledDagIns := &DagInstance{
+		Status: DagInstanceStatusCanceled,
+	}
+	err := canceledDagIns.MarkTasks([]string{"testId"}, mark)
+	assert.Equal(t, fmt.Errorf("you can only mark tasks of a running, blocked or failed dag instance"), err)
+
+	err = (&DagInstance{Status: DagInstanceStatusRunning}).MarkTasks(
+		[]string{"testId"}, &TaskMark{Status: TaskInstanceStatusFailed})
+	assert.Equal(t, fmt.Errorf("you can only mark task instance as success or skipped"), err)
+}
+
 func TestDagInstance_Block(t *testing.T) {
 	dagIns := &DagInstance{}
 	testHook(t, dagIns, string(DagInstanceStatusBlocked), DagInstanceStatusBlocked, func() {
@@ -126,6 +214,83 @@ func TestDagInstance_Continue(t *testing.T) {
 	assert.Equal(t, fmt.Errorf("dag instance have a incomplete command"), err)
 }
 
+func TestDagInstance_Pause(t *testing.T) {
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusRunning,
+	}
+	testHook(t, dagIns, "pause", DagInstanceStatusRunning, func() {
+		err := dagIns.Pause()
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, &Command{Name: CommandNamePause}, dagIns.Cmd)
+
+	pausedDagIns := &DagInstance{
+		Status: DagInstanceStatusPaused,
+	}
+	err := pausedDagIns.Pause()
+	assert.Equal(t, fmt.Errorf("you can only pause a running dag instance"), err)
+}
+
+func TestDagInstance_Resume(t *testing.T) {
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusPaused,
+	}
+	testHook(t, dagIns, "resume", DagInstanceStatusPaused, func() {
+		err := dagIns.Resume()
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, &Command{Name: CommandNameResume}, dagIns.Cmd)
+
+	runningDagIns := &DagInstance{
+		Status: DagInstanceStatusRunning,
+	}
+	err := runningDagIns.Resume()
+	assert.Equal(t, fmt.Errorf("you can only resume a paused dag instance"), err)
+}
+
+func TestDagInstance_CancelAll(t *testing.T) {
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusBlocked,
+	}
+	testHook(t, dagIns, string(DagInstanceStatusCanceled), DagInstanceStatusCanceled, func() {
+		err := dagIns.CancelAll("cancel by user")
+		assert.NoError(t, err)
+	})
+	assert.Equal(t, "cancel by user", dagIns.Reason)
+	assert.Equal(t, &Command{Name: CommandNameCancelDagIns}, dagIns.Cmd)
+
+	tests := []struct {
+		caseDesc   string
+		giveStatus DagInstanceStatus
+		wantErr    error
+	}{
+		{caseDesc: "init", giveStatus: DagInstanceStatusInit},
+		{caseDesc: "scheduled", giveStatus: DagInstanceStatusScheduled},
+		{caseDesc: "running", giveStatus: DagInstanceStatusRunning},
+		{caseDesc: "paused", giveStatus: DagInstanceStatusPaused},
+		{
+			caseDesc:   "pending",
+			giveStatus: DagInstanceStatusPending,
+			wantErr:    fmt.Errorf("you should cancel a pending dag instance by CancelPending"),
+		},
+		{
+			caseDesc:   "failed",
+			giveStatus: DagInstanceStatusFailed,
+			wantErr:    fmt.Errorf("you can only cancel a unfinished dag instance"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			dagIns := &DagInstance{Status: tc.giveStatus}
+			err := dagIns.CancelAll("cancel by user")
+			assert.Equal(t, tc.wantErr, err)
+			if tc.wantErr == nil {
+				assert.Equal(t, DagInstanceStatusCanceled, dagIns.Status)
+			}
+		})
+	}
+}
+
 func testHook(t *testing.T, dagIns *DagInstance, wantRet string, wantStatus DagInstanceStatus, call func()) {
 	ret := ""
 	HookDagInstance = DagInstanceLifecycleHook{
@@ -153,6 +318,26 @@ func testHook(t *testing.T, dagIns *DagInstance, wantRet string, wantStatus DagI
 			assert.NotNil(t, dagIns)
 			ret = "retry"
 		},
+		BeforePause: func(dagIns *DagInstance) {
+			assert.NotNil(t, dagIns)
+			ret = "pause"
+		},
+		BeforeResume: func(dagIns *DagInstance) {
+			assert.NotNil(t, dagIns)
+			ret = "resume"
+		},
+		BeforeRerun: func(dagIns *DagInstance) {
+			assert.NotNil(t, dagIns)
+			ret = "rerun"
+		},
+		BeforeMark: func(dagIns *DagInstance) {
+			assert.NotNil(t, dagIns)
+			ret = "mark"
+		},
+		BeforeCancel: func(dagIns *DagInstance) {
+			assert.NotNil(t, dagIns)
+			ret = string(DagInstanceStatusCanceled)
+		},
 	}
 
 	call()
@@ -160,6 +345,19 @@ func testHook(t *testing.T, dagIns *DagInstance, wantRet string, wantStatus DagI
 	assert.Equal(t, wantRet, ret)
 }
 
+func TestDagInstance_Expire(t *testing.T) {
+	dagIns := &DagInstance{
+		Status: DagInstanceStatusRunning,
+	}
+	err := dagIns.Expire([]string{"task1"})
+	assert.NoError(t, err)
+	assert.Equal(t, &Command{Name: CommandNameExpire, TargetTaskInsIDs: []string{"task1"}}, dagIns.Cmd)
+	assert.Equal(t, DagInstanceStatusRunning, dagIns.Status)
+
+	err = dagIns.Expire([]string{"task2"})
+	assert.Equal(t, fmt.Errorf("dag instance have a incomplete command"), err)
+}
+
 func TestDagInstanceVars_Render(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -279,3 +477,300 @@ func TestShareData_Set(t *testing.T) {
 		assert.Equal(t, tc.wantRet, tc.giveData.Dict)
 	}
 }
+
+func TestDag_CronSchedule(t *testing.T) {
+	giveTime := time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		caseDesc string
+		giveDag  *Dag
+		wantNext time.Time
+		wantErr  bool
+	}{
+		{
+			caseDesc: "five fields",
+			giveDag:  &Dag{Cron: "30 * * * *", Timezone: "UTC"},
+			wantNext: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "six fields",
+			giveDag:  &Dag{Cron: "10 * * * * *", Timezone: "UTC"},
+			wantNext: time.Date(2022, 1, 1, 10, 0, 10, 0, time.UTC),
+		},
+		{
+			caseDesc: "timezone",
+			giveDag:  &Dag{Cron: "0 19 * * *", Timezone: "Asia/Shanghai"},
+			wantNext: time.Date(2022, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "descriptor",
+			giveDag:  &Dag{Cron: "@hourly", Timezone: "UTC"},
+			wantNext: time.Date(2022, 1, 1, 11, 0, 0, 0, time.UTC),
+		},
+		{
+			caseDesc: "no cron",
+			giveDag:  &Dag{},
+			wantErr:  true,
+		},
+		{
+			caseDesc: "invalid cron",
+			giveDag:  &Dag{Cron: "invalid"},
+			wantErr:  true,
+		},
+		{
+			caseDesc: "invalid timezone",
+			giveDag:  &Dag{Cron: "* * * * *", Timezone: "invalid"},
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			sch, err := tc.giveDag.CronSchedule()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, tc.wantNext.Equal(sch.Next(giveTime)), sch.Next(giveTime).String())
+		})
+	}
+}
+
+func TestDag_CronTimes(t *testing.T) {
+	dag := &Dag{Cron: "0 */6 * * *", Timezone: "UTC"}
+	from := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	ret, err := dag.CronTimes(from, from.Add(18*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{
+		from.Add(6 * time.Hour),
+		from.Add(12 * time.Hour),
+		from.Add(18 * time.Hour),
+	}, ret)
+
+	_, err = (&Dag{}).CronTimes(from, from)
+	assert.Error(t, err)
+}
+
+func TestDag_RunScheduled(t *testing.T) {
+	dag := &Dag{
+		BaseInfo: BaseInfo{ID: "dag"},
+		Status:   DagStatusNormal,
+		Vars: DagVars{
+			"name": {DefaultValue: "value"},
+		},
+		Version: 3,
+	}
+	dagIns, err := dag.RunScheduled(TriggerBackfill, time.Date(2022, 1, 1, 8, 0, 0, 0, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, TriggerBackfill, dagIns.Trigger)
+	assert.Equal(t, 3, dagIns.DagVersion)
+	assert.Equal(t, DagInstanceVars{
+		"name":             {Value: "value"},
+		VarKeyScheduleTime: {Value: "2022-01-01T08:00:00Z"},
+	}, dagIns.Vars)
+
+	_, err = (&Dag{Status: DagStatusStopped}).RunScheduled(TriggerBackfill, time.Now())
+	assert.Error(t, err)
+}
+
+func TestDag_InsNodeSelector(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveDag      *Dag
+		wantSelector string
+		wantErr      bool
+	}{
+		{
+			caseDesc: "no selector",
+			giveDag:  &Dag{Tasks: []Task{{ID: "task"}}},
+		},
+		{
+			caseDesc: "merge dag and tasks",
+			giveDag: &Dag{
+				NodeSelector: "zone=bj",
+				Tasks: []Task{
+					{ID: "t1", NodeSelector: "net in (a,b)"},
+					{ID: "t2"},
+					{ID: "t3", NodeSelector: "gpu=true"},
+				},
+			},
+			wantSelector: "zone=bj, net in (a,b), gpu=true",
+		},
+		{
+			caseDesc: "only task",
+			giveDag: &Dag{
+				Tasks: []Task{{ID: "t1", NodeSelector: "gpu=true"}},
+			},
+			wantSelector: "gpu=true",
+		},
+		{
+			caseDesc: "invalid",
+			giveDag: &Dag{
+				NodeSelector: "zone>bj",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			selector, err := tc.giveDag.InsNodeSelector()
+			assert.Equal(t, tc.wantErr, err != nil)
+			assert.Equal(t, tc.wantSelector, selector)
+
+			tc.giveDag.Status = DagStatusNormal
+			dagIns, err := tc.giveDag.Run(TriggerManually, nil)
+			assert.Equal(t, tc.wantErr, err != nil)
+			if err == nil {
+				assert.Equal(t, tc.wantSelector, dagIns.NodeSelector)
+			}
+		})
+	}
+}
+
+func TestDag_RunByUpstream(t *testing.T) {
+	upstream := &DagInstance{
+		BaseInfo: BaseInfo{ID: "up-ins"},
+		DagID:    "up",
+		Status:   DagInstanceStatusSuccess,
+		ShareData: &ShareData{Dict: map[string]string{
+			"output": "out-value",
+		}},
+	}
+	tests := []struct {
+		caseDesc     string
+		giveDeps     []DagDependency
+		giveUpstream *DagInstance
+		wantVars     DagInstanceVars
+		wantNil      bool
+	}{
+		{
+			caseDesc: "default success",
+			giveDeps: []DagDependency{
+				{DagID: "other"},
+				{DagID: "up", VarsMapping: map[string]string{"input": "output", "missed": "not-exist"}},
+			},
+			giveUpstream: upstream,
+			wantVars: DagInstanceVars{
+				"input":  {Value: "out-value"},
+				"missed": {Value: "default"},
+			},
+		},
+		{
+			caseDesc:     "status not match",
+			giveDeps:     []DagDependency{{DagID: "up"}},
+			giveUpstream: &DagInstance{DagID: "up", Status: DagInstanceStatusFailed},
+			wantNil:      true,
+		},
+		{
+			caseDesc:     "specified status",
+			giveDeps:     []DagDependency{{DagID: "up", On: []DagInstanceStatus{DagInstanceStatusFailed}}},
+			giveUpstream: &DagInstance{BaseInfo: BaseInfo{ID: "up-ins"}, DagID: "up", Status: DagInstanceStatusFailed},
+			wantVars: DagInstanceVars{
+				"input":  {},
+				"missed": {Value: "default"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			dag := &Dag{
+				BaseInfo: BaseInfo{ID: "down"},
+				Status:   DagStatusNormal,
+				Vars: DagVars{
+					"input":  {},
+					"missed": {DefaultValue: "default"},
+				},
+				DependsOnDags: tc.giveDeps,
+			}
+			dagIns, err := dag.RunByUpstream(tc.giveUpstream)
+			assert.NoError(t, err)
+			if tc.wantNil {
+				assert.Nil(t, dagIns)
+				return
+			}
+			assert.Equal(t, TriggerUpstream, dagIns.Trigger)
+			assert.Equal(t, "up-ins", dagIns.ParentDagInsID)
+			assert.Equal(t, tc.wantVars, dagIns.Vars)
+		})
+	}
+}
+
+func TestNewDagVersion(t *testing.T) {
+	dag := &Dag{BaseInfo: BaseInfo{ID: "dag"}, Name: "name", Version: 2}
+	ver := NewDagVersion(dag)
+	assert.Equal(t, "dag@2", ver.ID)
+	assert.Equal(t, "dag", ver.DagID)
+	assert.Equal(t, 2, ver.Version)
+	assert.Equal(t, *dag, ver.Dag)
+}
+
+func TestDiffDag(t *testing.T) {
+	tests := []struct {
+		caseDesc  string
+		giveFrom  *Dag
+		giveTo    *Dag
+		wantDiff  *DagDiff
+		wantEmpty bool
+	}{
+		{
+			caseDesc: "same",
+			giveFrom: &Dag{
+				BaseInfo: BaseInfo{ID: "dag", UpdatedAt: 1},
+				Name:     "name",
+				Tasks:    []Task{{ID: "t1", ActionName: "a"}},
+				Version:  1,
+			},
+			giveTo: &Dag{
+				BaseInfo: BaseInfo{ID: "dag", UpdatedAt: 2},
+				Name:     "name",
+				Vars:     DagVars{},
+				Tasks:    []Task{{ID: "t1", ActionName: "a", Params: map[string]interface{}{}}},
+				Version:  2,
+			},
+			wantDiff:  &DagDiff{},
+			wantEmpty: true,
+		},
+		{
+			caseDesc: "fields changed",
+			giveFrom: &Dag{Name: "name", Cron: "* * * * *"},
+			giveTo: &Dag{
+				Name:    "name",
+				Vars:    DagVars{"v": {DefaultValue: "value"}},
+				Retry:   &RetryPolicy{MaxAttempts: 1},
+				SlaSecs: 10,
+			},
+			wantDiff: &DagDiff{
+				Fields: []string{"cron", "vars", "retry", "slaSecs"},
+			},
+		},
+		{
+			caseDesc: "tasks changed",
+			giveFrom: &Dag{Tasks: []Task{
+				{ID: "t1", ActionName: "a"},
+				{ID: "t2", ActionName: "a"},
+				{ID: "t3", ActionName: "a"},
+			}},
+			giveTo: &Dag{Tasks: []Task{
+				{ID: "t1", ActionName: "a"},
+				{ID: "t3", ActionName: "b"},
+				{ID: "t4", ActionName: "a"},
+			}},
+			wantDiff: &DagDiff{
+				AddedTasks:   []string{"t4"},
+				RemovedTasks: []string{"t2"},
+				ChangedTasks: []string{"t3"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			diff, err := DiffDag(tc.giveFrom, tc.giveTo)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantDiff, diff)
+			assert.Equal(t, tc.wantEmpty, diff.IsEmpty())
+		})
+	}
+}
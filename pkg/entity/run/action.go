@@ -35,6 +35,12 @@ type RetryBeforeAction interface {
 	RetryBefore(ctx ExecuteContext, params interface{}) error
 }
 
+// BranchAction choose the downstream tasks to follow after run action,
+// the ones which are not chosen will be skipped
+type BranchAction interface {
+	Branch(ctx ExecuteContext, params interface{}) (taskIds []string, err error)
+}
+
 var (
 	EndLoop = errors.New("end loop")
 )
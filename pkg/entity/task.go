@@ -1,8 +1,11 @@
 package entity
 
 import (
+	"encoding/json"
 	"fmt"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity/run"
@@ -19,6 +22,17 @@ type Task struct {
 	TimeoutSecs int                    `yaml:"timeoutSecs,omitempty" json:"timeoutSecs,omitempty"  bson:"timeoutSecs,omitempty"`
 	Params      map[string]interface{} `yaml:"params,omitempty" json:"params,omitempty"  bson:"params,omitempty"`
 	PreChecks   PreChecks              `yaml:"preCheck,omitempty" json:"preCheck,omitempty"  bson:"preCheck,omitempty"`
+	// NodeSelector will be merged into the node selector of dag instance
+	NodeSelector string `yaml:"nodeSelector,omitempty" json:"nodeSelector,omitempty"  bson:"nodeSelector,omitempty"`
+	// ForEach expand the task into one task instance per item when parser reaches it
+	ForEach *ForEach `yaml:"forEach,omitempty" json:"forEach,omitempty"  bson:"forEach,omitempty"`
+	// TriggerRule decide when the task can be executed according to the status of upstream tasks
+	TriggerRule TriggerRule `yaml:"triggerRule,omitempty" json:"triggerRule,omitempty"  bson:"triggerRule,omitempty"`
+	// Retry make the failed task instance be retried automatically, it overrides the one of dag
+	Retry *RetryPolicy `yaml:"retry,omitempty" json:"retry,omitempty"  bson:"retry,omitempty"`
+	// SlaSecs is the expected duration from the dag instance starts to the task completes,
+	// the task instance will be marked as sla missed but not failed when it exceeds
+	SlaSecs int `yaml:"slaSecs,omitempty" json:"slaSecs,omitempty"  bson:"slaSecs,omitempty"`
 }
 
 // GetGraphID
@@ -41,6 +55,157 @@ func (t *Task) GetStatus() TaskInstanceStatus {
 	return ""
 }
 
+// GetTriggerRule
+func (t *Task) GetTriggerRule() TriggerRule {
+	return t.TriggerRule
+}
+
+// TriggerRule
+type TriggerRule string
+
+const (
+	// TriggerRuleAllSuccess means all upstream tasks are success, the task will be skipped if any of them is skipped
+	TriggerRuleAllSuccess TriggerRule = "all_success"
+	// TriggerRuleAllDone means all upstream tasks are completed, no matter succeed or failed
+	TriggerRuleAllDone TriggerRule = "all_done"
+	// TriggerRuleOneSuccess means at least one upstream task is success
+	TriggerRuleOneSuccess TriggerRule = "one_success"
+	// TriggerRuleOneFailed means at least one upstream task is failed or canceled
+	TriggerRuleOneFailed TriggerRule = "one_failed"
+	// TriggerRuleNoneFailed means all upstream tasks are success or skipped, it is the default rule
+	TriggerRuleNoneFailed TriggerRule = "none_failed"
+	// TriggerRuleAlways means the task can be executed at any time
+	TriggerRuleAlways TriggerRule = "always"
+)
+
+// Validate
+func (r TriggerRule) Validate() error {
+	switch r {
+	case "", TriggerRuleAllSuccess, TriggerRuleAllDone, TriggerRuleOneSuccess,
+		TriggerRuleOneFailed, TriggerRuleNoneFailed, TriggerRuleAlways:
+		return nil
+	default:
+		return fmt.Errorf("trigger rule[%s] is invalid", r)
+	}
+}
+
+// RetryOn is the kind of failure
+type RetryOn string
+
+const (
+	// RetryOnError means the action returns an error
+	RetryOnError RetryOn = "error"
+	// RetryOnTimeout means the task instance exceeds its timeout
+	RetryOnTimeout RetryOn = "timeout"
+)
+
+// RetryPolicy
+type RetryPolicy struct {
+	// MaxAttempts is the max count of running including the first one, the task will not be retried if it is less than 2
+	MaxAttempts int `yaml:"maxAttempts,omitempty" json:"maxAttempts,omitempty"  bson:"maxAttempts,omitempty"`
+	// InitialIntervalSecs is the backoff before the first retry, default 1
+	InitialIntervalSecs int `yaml:"initialIntervalSecs,omitempty" json:"initialIntervalSecs,omitempty"  bson:"initialIntervalSecs,omitempty"`
+	// MaxIntervalSecs limit the backoff, zero means no limit
+	MaxIntervalSecs int `yaml:"maxIntervalSecs,omitempty" json:"maxIntervalSecs,omitempty"  bson:"maxIntervalSecs,omitempty"`
+	// Multiplier of the backoff after each retry, default 2
+	Multiplier float64 `yaml:"multiplier,omitempty" json:"multiplier,omitempty"  bson:"multiplier,omitempty"`
+	// RetryOn decide which failures will be retried, all of them will be retried if it is empty
+	RetryOn []RetryOn `yaml:"retryOn,omitempty" json:"retryOn,omitempty"  bson:"retryOn,omitempty"`
+}
+
+// CanRetry check if the task can be retried again, attempt is the count of retries already done
+func (p *RetryPolicy) CanRetry(attempt int, failure RetryOn) bool {
+	if attempt+1 >= p.MaxAttempts {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, on := range p.RetryOn {
+		if on == failure {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff return the interval before next retry, attempt is the count of retries already done
+func (p *RetryPolicy) Backoff(attempt int) time.Duration {
+	interval := float64(p.InitialIntervalSecs)
+	if interval <= 0 {
+		interval = 1
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	for i := 0; i < attempt; i++ {
+		interval *= multiplier
+		if p.MaxIntervalSecs > 0 && interval >= float64(p.MaxIntervalSecs) {
+			break
+		}
+	}
+	if p.MaxIntervalSecs > 0 && interval > float64(p.MaxIntervalSecs) {
+		interval = float64(p.MaxIntervalSecs)
+	}
+	return time.Duration(interval * float64(time.Second))
+}
+
+const (
+	// VarKeyForEachItem is the built-in var which can be used in params of for-each task, such as "{{ff_item}}"
+	VarKeyForEachItem = "ff_item"
+	// VarKeyForEachIndex is the index of item, it starts with 0
+	VarKeyForEachIndex = "ff_item_index"
+)
+
+// ForEach
+type ForEach struct {
+	// Source of items, it could be "vars" or "share-data"
+	Source TaskConditionSource `yaml:"source,omitempty" json:"source,omitempty"  bson:"source,omitempty"`
+	// Key of items, the value should be a json array of string or a comma-separated string
+	Key string `yaml:"key,omitempty" json:"key,omitempty"  bson:"key,omitempty"`
+	// MaxParallel limit the count of mapped task instances running at the same time, zero means no limit
+	MaxParallel int `yaml:"maxParallel,omitempty" json:"maxParallel,omitempty"  bson:"maxParallel,omitempty"`
+}
+
+// Items return the items which task will be expanded with
+func (f *ForEach) Items(dagIns *DagInstance) ([]string, error) {
+	switch f.Source {
+	case TaskConditionSourceVars, TaskConditionSourceShareData:
+	default:
+		return nil, fmt.Errorf("for-each source[%s] is invalid", f.Source)
+	}
+	if f.Source == TaskConditionSourceShareData && dagIns.ShareData == nil {
+		return nil, fmt.Errorf("for-each key[%s] is not found in %s", f.Key, f.Source)
+	}
+
+	v, ok := f.Source.BuildKvGetter(dagIns)(f.Key)
+	if !ok {
+		return nil, fmt.Errorf("for-each key[%s] is not found in %s", f.Key, f.Source)
+	}
+	v = strings.TrimSpace(v)
+	if strings.HasPrefix(v, "[") {
+		var items []string
+		if err := json.Unmarshal([]byte(v), &items); err != nil {
+			return nil, fmt.Errorf("for-each items[%s] is not a valid json array: %w", v, err)
+		}
+		return items, nil
+	}
+
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// MappedTaskID return the task id of mapped task instance
+func MappedTaskID(taskId string, index int) string {
+	return fmt.Sprintf("%s[%d]", taskId, index)
+}
+
 type PreChecks map[string]*Check
 
 // Check
@@ -145,6 +310,30 @@ type TaskInstance struct {
 	Status      TaskInstanceStatus     `json:"status,omitempty" bson:"status,omitempty"`
 	Reason      string                 `json:"reason,omitempty" bson:"reason,omitempty"`
 	PreChecks   PreChecks              `json:"preChecks,omitempty"  bson:"preChecks,omitempty"`
+	ForEach     *ForEach               `json:"forEach,omitempty"  bson:"forEach,omitempty"`
+	// Expanded means the mapped task instances of for-each task have been created
+	Expanded bool `json:"expanded,omitempty" bson:"expanded,omitempty"`
+	// MappedFrom is the task id of for-each task which this instance is expanded from
+	MappedFrom string `json:"mappedFrom,omitempty" bson:"mappedFrom,omitempty"`
+	// Item is the for-each item of mapped task instance
+	Item string `json:"item,omitempty" bson:"item,omitempty"`
+	// Branch is the result of branch action
+	Branch      *Branch      `json:"branch,omitempty" bson:"branch,omitempty"`
+	TriggerRule TriggerRule  `json:"triggerRule,omitempty" bson:"triggerRule,omitempty"`
+	Retry       *RetryPolicy `json:"retry,omitempty" bson:"retry,omitempty"`
+	// Attempt is the count of automatic retries already done
+	Attempt int `json:"attempt,omitempty" bson:"attempt,omitempty"`
+	// NextRetryAt is the unix time when the retrying task instance can be executed
+	NextRetryAt int64 `json:"nextRetryAt,omitempty" bson:"nextRetryAt,omitempty"`
+	SlaSecs     int   `json:"slaSecs,omitempty" bson:"slaSecs,omitempty"`
+	// SlaDueAt is the unix time when the task instance should be completed
+	SlaDueAt int64 `json:"slaDueAt,omitempty" bson:"slaDueAt,omitempty"`
+	// SlaMissed means the task instance is not completed before SlaDueAt
+	SlaMissed bool `json:"slaMissed,omitempty" bson:"slaMissed,omitempty"`
+	// Mark records who marks the task instance manually and why
+	Mark *TaskMark `json:"mark,omitempty" bson:"mark,omitempty"`
+	// History is the previous runs of the task instance, it is appended when the task instance is rerun
+	History []TaskInstanceRun `json:"history,omitempty" bson:"history,omitempty"`
 
 	// used to save changes
 	Patch              func(*TaskInstance) error `json:"-" bson:"-"`
@@ -155,6 +344,38 @@ type TaskInstance struct {
 	bufTraces []TraceInfo
 }
 
+// Branch
+type Branch struct {
+	// ChosenTaskIDs are the downstream tasks to follow, other downstream tasks will be skipped
+	ChosenTaskIDs []string `json:"chosenTaskIds,omitempty" bson:"chosenTaskIds,omitempty"`
+}
+
+// TaskInstanceRun is a previous run of task instance
+type TaskInstanceRun struct {
+	Status    TaskInstanceStatus `json:"status,omitempty" bson:"status,omitempty"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Attempt   int                `json:"attempt,omitempty" bson:"attempt,omitempty"`
+	Traces    []TraceInfo        `json:"traces,omitempty" bson:"traces,omitempty"`
+	Mark      *TaskMark          `json:"mark,omitempty" bson:"mark,omitempty"`
+	UpdatedAt int64              `json:"updatedAt,omitempty" bson:"updatedAt,omitempty"`
+}
+
+// TaskMark is the status which the task instance is marked as manually instead of executing it
+type TaskMark struct {
+	Status   TaskInstanceStatus `json:"status,omitempty" bson:"status,omitempty"`
+	Reason   string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	Operator string             `json:"operator,omitempty" bson:"operator,omitempty"`
+	MarkedAt int64              `json:"markedAt,omitempty" bson:"markedAt,omitempty"`
+}
+
+// Validate
+func (m *TaskMark) Validate() error {
+	if m.Status != TaskInstanceStatusSuccess && m.Status != TaskInstanceStatusSkipped {
+		return fmt.Errorf("you can only mark task instance as success or skipped")
+	}
+	return nil
+}
+
 // TraceInfo
 type TraceInfo struct {
 	Time    int64  `json:"time,omitempty" bson:"time,omitempty"`
@@ -163,6 +384,11 @@ type TraceInfo struct {
 
 // NewTaskInstance
 func NewTaskInstance(dagInsId string, t Task) *TaskInstance {
+	// task instances are created when dag instance starts running, so sla is counted from now
+	var slaDueAt int64
+	if t.SlaSecs > 0 {
+		slaDueAt = time.Now().Add(time.Duration(t.SlaSecs) * time.Second).Unix()
+	}
 	return &TaskInstance{
 		TaskID:      t.ID,
 		DagInsID:    dagInsId,
@@ -173,9 +399,110 @@ func NewTaskInstance(dagInsId string, t Task) *TaskInstance {
 		Params:      t.Params,
 		Status:      TaskInstanceStatusInit,
 		PreChecks:   t.PreChecks,
+		ForEach:     t.ForEach,
+		TriggerRule: t.TriggerRule,
+		Retry:       t.Retry,
+		SlaSecs:     t.SlaSecs,
+		SlaDueAt:    slaDueAt,
+	}
+}
+
+// Expand build the mapped task instances of for-each task, and the task will depend on all of them,
+// so that the downstream tasks can depend on the whole group.
+// Mapped task instances are chained by MaxParallel, so there are MaxParallel lanes at most,
+// the chained one runs after the previous one is done, no matter it is succeed or failed.
+func (t *TaskInstance) Expand(items []string) ([]*TaskInstance, error) {
+	parallel := len(items)
+	if t.ForEach.MaxParallel > 0 && t.ForEach.MaxParallel < parallel {
+		parallel = t.ForEach.MaxParallel
+	}
+
+	var mapped []*TaskInstance
+	var mappedIds []string
+	for i, item := range items {
+		params, err := DagInstanceVars{
+			VarKeyForEachItem:  {Value: item},
+			VarKeyForEachIndex: {Value: strconv.Itoa(i)},
+		}.Render(copyParams(t.Params))
+		if err != nil {
+			return nil, fmt.Errorf("render params of item[%s] failed: %w", item, err)
+		}
+
+		dependOn, triggerRule := t.DependOn, t.TriggerRule
+		if i >= parallel {
+			dependOn, triggerRule = []string{MappedTaskID(t.TaskID, i-parallel)}, TriggerRuleAllDone
+		}
+		mapped = append(mapped, &TaskInstance{
+			TaskID:      MappedTaskID(t.TaskID, i),
+			DagInsID:    t.DagInsID,
+			Name:        t.Name,
+			DependOn:    dependOn,
+			ActionName:  t.ActionName,
+			TimeoutSecs: t.TimeoutSecs,
+			Params:      params,
+			Status:      TaskInstanceStatusInit,
+			PreChecks:   copyPreChecks(t.PreChecks),
+			MappedFrom:  t.TaskID,
+			Item:        item,
+			TriggerRule: triggerRule,
+			Retry:       t.Retry,
+			SlaSecs:     t.SlaSecs,
+			SlaDueAt:    t.SlaDueAt,
+		})
+		mappedIds = append(mappedIds, MappedTaskID(t.TaskID, i))
+	}
+
+	t.DependOn = mappedIds
+	t.Expanded = true
+	return mapped, nil
+}
+
+func copyParams(params map[string]interface{}) map[string]interface{} {
+	if params == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		ret[k] = copyParamValue(v)
+	}
+	return ret
+}
+
+func copyParamValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return copyParams(val)
+	case []interface{}:
+		ret := make([]interface{}, len(val))
+		for i := range val {
+			ret[i] = copyParamValue(val[i])
+		}
+		return ret
+	default:
+		return v
 	}
 }
 
+func copyPreChecks(checks PreChecks) PreChecks {
+	if checks == nil {
+		return nil
+	}
+	ret := make(PreChecks, len(checks))
+	for k, c := range checks {
+		if c == nil {
+			ret[k] = nil
+			continue
+		}
+		conditions := make([]TaskCondition, len(c.Conditions))
+		for i := range c.Conditions {
+			conditions[i] = c.Conditions[i]
+			conditions[i].Values = append([]string(nil), c.Conditions[i].Values...)
+		}
+		ret[k] = &Check{Conditions: conditions, Act: c.Act}
+	}
+	return ret
+}
+
 // GetGraphID
 func (t *TaskInstance) GetGraphID() string {
 	return t.TaskID
@@ -196,6 +523,11 @@ func (t *TaskInstance) GetStatus() TaskInstanceStatus {
 	return t.Status
 }
 
+// GetTriggerRule
+func (t *TaskInstance) GetTriggerRule() TriggerRule {
+	return t.TriggerRule
+}
+
 // InitialDep
 func (t *TaskInstance) InitialDep(ctx run.ExecuteContext, patch func(*TaskInstance) error, dagIns *DagInstance) {
 	t.Patch = patch
@@ -206,7 +538,14 @@ func (t *TaskInstance) InitialDep(ctx run.ExecuteContext, patch func(*TaskInstan
 // SetStatus will persist task instance
 func (t *TaskInstance) SetStatus(s TaskInstanceStatus) error {
 	t.Status = s
-	patch := &TaskInstance{BaseInfo: BaseInfo{ID: t.ID}, Status: t.Status, Reason: t.Reason}
+	patch := &TaskInstance{
+		BaseInfo:    BaseInfo{ID: t.ID},
+		Status:      t.Status,
+		Reason:      t.Reason,
+		Branch:      t.Branch,
+		Attempt:     t.Attempt,
+		NextRetryAt: t.NextRetryAt,
+	}
 	if len(t.bufTraces) != 0 {
 		patch.Traces = append(t.Traces, t.bufTraces...)
 	}
@@ -267,6 +606,14 @@ func (t *TaskInstance) Run(params interface{}, act run.Action) (err error) {
 		if err := act.Run(t.Context, params); err != nil {
 			return fmt.Errorf("run failed: %w", err)
 		}
+		branchAct, ok := act.(run.BranchAction)
+		if ok {
+			taskIds, err := branchAct.Branch(t.Context, params)
+			if err != nil {
+				return fmt.Errorf("run branch failed: %w", err)
+			}
+			t.Branch = &Branch{ChosenTaskIDs: taskIds}
+		}
 
 		if err := t.SetStatus(TaskInstanceStatusEnding); err != nil {
 			return err
@@ -299,6 +646,58 @@ func (t *TaskInstance) Run(params interface{}, act run.Action) (err error) {
 	return nil
 }
 
+// TryAutoRetry increase the attempt and set the time of next retry if retry policy allows,
+// caller should set the status to retrying when it returns true
+func (t *TaskInstance) TryAutoRetry(failure RetryOn) bool {
+	if t.Retry == nil || !t.Retry.CanRetry(t.Attempt, failure) {
+		return false
+	}
+	t.NextRetryAt = time.Now().Add(t.Retry.Backoff(t.Attempt)).Unix()
+	t.Attempt++
+	return true
+}
+
+// Rerun keep the current run as history and reset the task instance to init,
+// the expanded for-each task will not be expanded again
+func (t *TaskInstance) Rerun() {
+	t.History = append(t.History, TaskInstanceRun{
+		Status:    t.Status,
+		Reason:    t.Reason,
+		Attempt:   t.Attempt,
+		Traces:    t.Traces,
+		Mark:      t.Mark,
+		UpdatedAt: t.UpdatedAt,
+	})
+	t.Status = TaskInstanceStatusInit
+	t.Reason = ""
+	t.Traces = nil
+	t.Mark = nil
+	t.Branch = nil
+	t.Attempt = 0
+	t.NextRetryAt = 0
+	t.SlaMissed = false
+	t.SlaDueAt = 0
+	if t.SlaSecs > 0 {
+		t.SlaDueAt = time.Now().Add(time.Duration(t.SlaSecs) * time.Second).Unix()
+	}
+}
+
+// MarkAs change the status of task instance by the mark without executing it
+func (t *TaskInstance) MarkAs(mark *TaskMark) {
+	t.Status = mark.Status
+	t.Reason = mark.Reason
+	t.Mark = mark
+	t.NextRetryAt = 0
+}
+
+// RetryDelay return how long the retrying task instance should wait before executing
+func (t *TaskInstance) RetryDelay() time.Duration {
+	if t.Status != TaskInstanceStatusRetrying || t.NextRetryAt == 0 {
+		return 0
+	}
+	return time.Until(time.Unix(t.NextRetryAt, 0))
+}
+
 // DoPreCheck
 func (t *TaskInstance) DoPreCheck(dagIns *DagInstance) (isActive bool, err error) {
 	if t.PreChecks == nil || t.IsLastState() {
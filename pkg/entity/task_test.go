@@ -332,6 +332,68 @@ func TestTaskInstance_Run(t *testing.T) {
 	}
 }
 
+type testBranchAction struct {
+	taskIds []string
+	err     error
+}
+
+func (a *testBranchAction) Name() string {
+	return "testBranchAction"
+}
+
+func (a *testBranchAction) Run(ctx run.ExecuteContext, params interface{}) error {
+	return nil
+}
+
+func (a *testBranchAction) Branch(ctx run.ExecuteContext, params interface{}) ([]string, error) {
+	return a.taskIds, a.err
+}
+
+func TestTaskInstance_RunBranch(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveAction    *testBranchAction
+		wantErr       error
+		wantSaveTasks []TaskInstance
+	}{
+		{
+			caseDesc:   "normal",
+			giveAction: &testBranchAction{taskIds: []string{"x"}},
+			wantSaveTasks: []TaskInstance{
+				{BaseInfo: BaseInfo{ID: "test-task"}, Status: TaskInstanceStatusRunning},
+				{BaseInfo: BaseInfo{ID: "test-task"}, Status: TaskInstanceStatusEnding, Branch: &Branch{ChosenTaskIDs: []string{"x"}}},
+				{BaseInfo: BaseInfo{ID: "test-task"}, Status: TaskInstanceStatusSuccess, Branch: &Branch{ChosenTaskIDs: []string{"x"}}},
+			},
+		},
+		{
+			caseDesc:   "branch failed",
+			giveAction: &testBranchAction{err: fmt.Errorf("failed")},
+			wantErr:    fmt.Errorf("run branch failed: %w", fmt.Errorf("failed")),
+			wantSaveTasks: []TaskInstance{
+				{BaseInfo: BaseInfo{ID: "test-task"}, Status: TaskInstanceStatusRunning},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var saveTasks []TaskInstance
+			taskIns := &TaskInstance{
+				BaseInfo: BaseInfo{ID: "test-task"},
+				Status:   TaskInstanceStatusInit,
+				Patch: func(instance *TaskInstance) error {
+					saveTasks = append(saveTasks, *instance)
+					return nil
+				},
+			}
+
+			err := taskIns.Run(nil, tc.giveAction)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantSaveTasks, saveTasks)
+		})
+	}
+}
+
 func TestTaskConditionSource_BuildKvGetter(t *testing.T) {
 	tests := []struct {
 		caseDesc   string
@@ -767,3 +829,307 @@ func TestTaskInstance_DoPreCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestForEach_Items(t *testing.T) {
+	dagIns := &DagInstance{
+		Vars: DagInstanceVars{
+			"csv":  DagInstanceVar{Value: " n1, n2,,n3 "},
+			"json": DagInstanceVar{Value: `["n1", "n 2"]`},
+			"bad":  DagInstanceVar{Value: `["n1"`},
+		},
+		ShareData: &ShareData{Dict: map[string]string{"nodes": "n1"}},
+	}
+
+	tests := []struct {
+		caseDesc    string
+		giveForEach *ForEach
+		wantItems   []string
+		wantErr     string
+	}{
+		{
+			caseDesc:    "comma-separated",
+			giveForEach: &ForEach{Source: TaskConditionSourceVars, Key: "csv"},
+			wantItems:   []string{"n1", "n2", "n3"},
+		},
+		{
+			caseDesc:    "json array",
+			giveForEach: &ForEach{Source: TaskConditionSourceVars, Key: "json"},
+			wantItems:   []string{"n1", "n 2"},
+		},
+		{
+			caseDesc:    "share data",
+			giveForEach: &ForEach{Source: TaskConditionSourceShareData, Key: "nodes"},
+			wantItems:   []string{"n1"},
+		},
+		{
+			caseDesc:    "invalid json",
+			giveForEach: &ForEach{Source: TaskConditionSourceVars, Key: "bad"},
+			wantErr:     `for-each items[["n1"] is not a valid json array: unexpected end of JSON input`,
+		},
+		{
+			caseDesc:    "not found",
+			giveForEach: &ForEach{Source: TaskConditionSourceShareData, Key: "csv"},
+			wantErr:     "for-each key[csv] is not found in share-data",
+		},
+		{
+			caseDesc:    "invalid source",
+			giveForEach: &ForEach{Source: "test", Key: "csv"},
+			wantErr:     "for-each source[test] is invalid",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			items, err := tc.giveForEach.Items(dagIns)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantItems, items)
+		})
+	}
+}
+
+func TestTaskInstance_Expand(t *testing.T) {
+	taskIns := &TaskInstance{
+		TaskID:      "group",
+		DagInsID:    "dag-ins",
+		Name:        "group",
+		DependOn:    []string{"start"},
+		ActionName:  "act",
+		TimeoutSecs: 10,
+		Params: map[string]interface{}{
+			"node":  "{{ff_item}}",
+			"index": []interface{}{"{{ff_item_index}}"},
+		},
+		PreChecks: PreChecks{
+			"check": {Act: ActiveActionSkip, Conditions: []TaskCondition{{Source: TaskConditionSourceVars, Key: "k"}}},
+		},
+		ForEach: &ForEach{MaxParallel: 2},
+	}
+
+	mapped, err := taskIns.Expand([]string{"n1", "n2", "n3"})
+	assert.NoError(t, err)
+	newMapped := func(idx int, item string, dependOn []string, rule TriggerRule) *TaskInstance {
+		return &TaskInstance{
+			TaskID:      fmt.Sprintf("group[%d]", idx),
+			DagInsID:    "dag-ins",
+			Name:        "group",
+			DependOn:    dependOn,
+			ActionName:  "act",
+			TimeoutSecs: 10,
+			Params: map[string]interface{}{
+				"node":  item,
+				"index": []interface{}{fmt.Sprint(idx)},
+			},
+			Status:      TaskInstanceStatusInit,
+			PreChecks:   taskIns.PreChecks,
+			MappedFrom:  "group",
+			Item:        item,
+			TriggerRule: rule,
+		}
+	}
+	assert.Equal(t, []*TaskInstance{
+		newMapped(0, "n1", []string{"start"}, ""),
+		newMapped(1, "n2", []string{"start"}, ""),
+		// the chained one is not affected by the failure of previous one
+		newMapped(2, "n3", []string{"group[0]"}, TriggerRuleAllDone),
+	}, mapped)
+	assert.Equal(t, []string{"group[0]", "group[1]", "group[2]"}, taskIns.DependOn)
+	assert.True(t, taskIns.Expanded)
+	assert.Equal(t, "{{ff_item}}", taskIns.Params["node"])
+
+	// the pre checks are not shared with the for-each task
+	mapped[0].PreChecks["check"].Conditions[0].Key = "changed"
+	assert.Equal(t, "k", taskIns.PreChecks["check"].Conditions[0].Key)
+	assert.Equal(t, "k", mapped[1].PreChecks["check"].Conditions[0].Key)
+}
+
+func TestRetryPolicy_CanRetry(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		givePolicy  *RetryPolicy
+		giveAttempt int
+		giveFailure RetryOn
+		wantRetry   bool
+	}{
+		{
+			caseDesc:    "first retry",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3},
+			giveFailure: RetryOnError,
+			wantRetry:   true,
+		},
+		{
+			caseDesc:    "reach max attempts",
+			givePolicy:  &RetryPolicy{MaxAttempts: 3},
+			giveAttempt: 2,
+			giveFailure: RetryOnError,
+			wantRetry:   false,
+		},
+		{
+			caseDesc:    "no retry",
+			givePolicy:  &RetryPolicy{},
+			giveFailure: RetryOnError,
+			wantRetry:   false,
+		},
+		{
+			caseDesc:    "match retry on",
+			givePolicy:  &RetryPolicy{MaxAttempts: 2, RetryOn: []RetryOn{RetryOnError, RetryOnTimeout}},
+			giveFailure: RetryOnTimeout,
+			wantRetry:   true,
+		},
+		{
+			caseDesc:    "not match retry on",
+			givePolicy:  &RetryPolicy{MaxAttempts: 2, RetryOn: []RetryOn{RetryOnTimeout}},
+			giveFailure: RetryOnError,
+			wantRetry:   false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantRetry, tc.givePolicy.CanRetry(tc.giveAttempt, tc.giveFailure))
+		})
+	}
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		givePolicy  *RetryPolicy
+		giveAttempt int
+		wantBackoff time.Duration
+	}{
+		{
+			caseDesc:    "default",
+			givePolicy:  &RetryPolicy{},
+			wantBackoff: time.Second,
+		},
+		{
+			caseDesc:    "default multiplier",
+			givePolicy:  &RetryPolicy{InitialIntervalSecs: 3},
+			giveAttempt: 2,
+			wantBackoff: 12 * time.Second,
+		},
+		{
+			caseDesc:    "custom multiplier",
+			givePolicy:  &RetryPolicy{InitialIntervalSecs: 2, Multiplier: 1.5},
+			giveAttempt: 1,
+			wantBackoff: 3 * time.Second,
+		},
+		{
+			caseDesc:    "limited by max interval",
+			givePolicy:  &RetryPolicy{InitialIntervalSecs: 1, MaxIntervalSecs: 60},
+			giveAttempt: 100,
+			wantBackoff: time.Minute,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantBackoff, tc.givePolicy.Backoff(tc.giveAttempt))
+		})
+	}
+}
+
+func TestTaskInstance_TryAutoRetry(t *testing.T) {
+	taskIns := &TaskInstance{Retry: &RetryPolicy{MaxAttempts: 2, InitialIntervalSecs: 10}}
+	now := time.Now().Unix()
+	assert.True(t, taskIns.TryAutoRetry(RetryOnError))
+	assert.Equal(t, 1, taskIns.Attempt)
+	assert.GreaterOrEqual(t, taskIns.NextRetryAt, now+10)
+
+	taskIns.Status = TaskInstanceStatusRetrying
+	assert.Greater(t, int64(taskIns.RetryDelay()), int64(9*time.Second))
+	assert.False(t, taskIns.TryAutoRetry(RetryOnError))
+	assert.Equal(t, 1, taskIns.Attempt)
+
+	assert.False(t, (&TaskInstance{}).TryAutoRetry(RetryOnError))
+}
+
+func TestNewTaskInstance_Sla(t *testing.T) {
+	taskIns := NewTaskInstance("dag-ins", Task{ID: "task", SlaSecs: 30})
+	assert.Equal(t, 30, taskIns.SlaSecs)
+	assert.InDelta(t, time.Now().Unix()+30, taskIns.SlaDueAt, 1)
+
+	assert.Zero(t, NewTaskInstance("dag-ins", Task{ID: "task"}).SlaDueAt)
+}
+
+func TestTaskInstance_Rerun(t *testing.T) {
+	taskIns := &TaskInstance{
+		BaseInfo:    BaseInfo{ID: "task", UpdatedAt: 100},
+		Status:      TaskInstanceStatusSuccess,
+		Reason:      "done",
+		Traces:      []TraceInfo{{Time: 1, Message: "run"}},
+		Branch:      &Branch{ChosenTaskIDs: []string{"x"}},
+		Attempt:     1,
+		NextRetryAt: 200,
+		SlaSecs:     30,
+		SlaDueAt:    300,
+		SlaMissed:   true,
+		Mark:        &TaskMark{Status: TaskInstanceStatusSuccess, Reason: "done"},
+		History:     []TaskInstanceRun{{Status: TaskInstanceStatusFailed}},
+	}
+	taskIns.Rerun()
+	assert.Equal(t, TaskInstanceStatusInit, taskIns.Status)
+	assert.Empty(t, taskIns.Reason)
+	assert.Nil(t, taskIns.Traces)
+	assert.Nil(t, taskIns.Branch)
+	assert.Nil(t, taskIns.Mark)
+	assert.Zero(t, taskIns.Attempt)
+	assert.Zero(t, taskIns.NextRetryAt)
+	assert.False(t, taskIns.SlaMissed)
+	assert.InDelta(t, time.Now().Unix()+30, taskIns.SlaDueAt, 1)
+	assert.Equal(t, []TaskInstanceRun{
+		{Status: TaskInstanceStatusFailed},
+		{
+			Status:    TaskInstanceStatusSuccess,
+			Reason:    "done",
+			Attempt:   1,
+			Traces:    []TraceInfo{{Time: 1, Message: "run"}},
+			Mark:      &TaskMark{Status: TaskInstanceStatusSuccess, Reason: "done"},
+			UpdatedAt: 100,
+		},
+	}, taskIns.History)
+}
+
+func TestTaskInstance_MarkAs(t *testing.T) {
+	mark := &TaskMark{Status: TaskInstanceStatusSkipped, Reason: "fixed by hand", Operator: "admin", MarkedAt: 100}
+	taskIns := &TaskInstance{Status: TaskInstanceStatusFailed, Reason: "failed", NextRetryAt: 200}
+	taskIns.MarkAs(mark)
+	assert.Equal(t, &TaskInstance{
+		Status: TaskInstanceStatusSkipped,
+		Reason: "fixed by hand",
+		Mark:   mark,
+	}, taskIns)
+}
+
+func TestTaskMark_Validate(t *testing.T) {
+	tests := []struct {
+		caseDesc   string
+		giveStatus TaskInstanceStatus
+		wantErr    error
+	}{
+		{
+			caseDesc:   "success",
+			giveStatus: TaskInstanceStatusSuccess,
+		},
+		{
+			caseDesc:   "skipped",
+			giveStatus: TaskInstanceStatusSkipped,
+		},
+		{
+			caseDesc:   "failed",
+			giveStatus: TaskInstanceStatusFailed,
+			wantErr:    fmt.Errorf("you can only mark task instance as success or skipped"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			err := (&TaskMark{Status: tc.giveStatus}).Validate()
+			assert.Equal(t, tc.wantErr, err)
+		})
+	}
+}
@@ -12,6 +12,7 @@ const (
 	KeyLeaderChanged                = "LeaderChanged"
 	KeyDispatchInitDagInsCompleted  = "DispatchInitDagInsCompleted"
 	KeyParseScheduleDagInsCompleted = "ParseScheduleDagInsCompleted"
+	KeySlaMissed                    = "SlaMissed"
 )
 
 // DagInstanceUpdated will raise when dag instance he updated
@@ -87,3 +88,15 @@ type ParseScheduleDagInsCompleted struct {
 func (e *ParseScheduleDagInsCompleted) Topic() []string {
 	return []string{KeyParseScheduleDagInsCompleted}
 }
+
+// SlaMissed will raise when leader find a dag instance or task instance is not completed before its sla,
+// TaskIns is nil when the dag instance missed its sla
+type SlaMissed struct {
+	DagIns  *entity.DagInstance
+	TaskIns *entity.TaskInstance
+}
+
+// Topic
+func (e *SlaMissed) Topic() []string {
+	return []string{KeySlaMissed}
+}
@@ -55,6 +55,11 @@ var (
 		"The count of parse scheduled dag instance failed.",
 		[]string{"worker_key"}, nil,
 	)
+	slaMissedCountDesc = prometheus.NewDesc(
+		"fastflow_leader_sla_missed_total",
+		"The count of dag instances or task instances which missed sla.",
+		[]string{"worker_key", "type"}, nil,
+	)
 )
 
 // ExecutorCollector
@@ -150,11 +155,14 @@ func (c *ExecutorCollector) Collect(ch chan<- prometheus.Metric) {
 type LeaderCollector struct {
 	DispatchElapsedMs   int64
 	DispatchFailedCount int64
+
+	SlaMissedDagCount  uint64
+	SlaMissedTaskCount uint64
 }
 
 // Topic is goevent's topic
 func (c *LeaderCollector) Topic() []string {
-	return []string{event.KeyDispatchInitDagInsCompleted}
+	return []string{event.KeyDispatchInitDagInsCompleted, event.KeySlaMissed}
 }
 
 // Handle is goevent's handler
@@ -165,6 +173,14 @@ func (c *LeaderCollector) Handle(cxt context.Context, e goevent.Event) {
 			atomic.AddInt64(&c.DispatchFailedCount, 1)
 		}
 	}
+
+	if slaEvent, ok := e.(*event.SlaMissed); ok {
+		if slaEvent.TaskIns != nil {
+			atomic.AddUint64(&c.SlaMissedTaskCount, 1)
+		} else {
+			atomic.AddUint64(&c.SlaMissedDagCount, 1)
+		}
+	}
 }
 
 // Describe
@@ -186,6 +202,18 @@ func (c *LeaderCollector) Collect(ch chan<- prometheus.Metric) {
 		float64(c.DispatchFailedCount),
 		mod.GetKeeper().WorkerKey(),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		slaMissedCountDesc,
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.SlaMissedDagCount)),
+		mod.GetKeeper().WorkerKey(), "dag",
+	)
+	ch <- prometheus.MustNewConstMetric(
+		slaMissedCountDesc,
+		prometheus.CounterValue,
+		float64(atomic.LoadUint64(&c.SlaMissedTaskCount)),
+		mod.GetKeeper().WorkerKey(), "task",
+	)
 }
 
 // HttpHandler used to handle metrics request
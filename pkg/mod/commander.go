@@ -8,6 +8,15 @@ import (
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+)
+
+const (
+	// maxBackfillCount is the max count of dag instances created by one backfill
+	maxBackfillCount = 1000
+	// defaultIdempotencyWindow is the window of idempotency key if it is not specified
+	defaultIdempotencyWindow = 24 * time.Hour
 )
 
 var _ Commander = (*DefCommander)(nil)
@@ -17,16 +26,31 @@ type DefCommander struct {
 }
 
 // RunDag
-func (c *DefCommander) RunDag(dagId string, specVars map[string]string) (*entity.DagInstance, error) {
+func (c *DefCommander) RunDag(dagId string, specVars map[string]string, ops ...RunOptSetter) (*entity.DagInstance, error) {
+	opt := initRunOption(ops)
 	dag, err := GetStore().GetDag(dagId)
 	if err != nil {
 		return nil, err
 	}
 
-	dagIns, err := dag.Run(entity.TriggerManually, specVars)
+	dagIns, err := dag.Run(opt.trigger, specVars)
 	if err != nil {
 		return nil, err
 	}
+	if opt.priority != nil {
+		dagIns.Priority = *opt.priority
+	}
+	if opt.timeout != nil {
+		dagIns.TimeoutSecs = int(opt.timeout.Seconds())
+	}
+	if opt.runAt.After(time.Now()) {
+		dagIns.Status = entity.DagInstanceStatusPending
+		dagIns.RunAt = opt.runAt.Unix()
+	}
+	if opt.idempotencyKey != "" {
+		dagIns.IdempotencyKey = opt.idempotencyKey
+		return createIdempotentDagIns(dagIns, opt.idempotencyWindow)
+	}
 
 	if err := GetStore().CreateDagIns(dagIns); err != nil {
 		return nil, err
@@ -34,6 +58,110 @@ func (c *DefCommander) RunDag(dagId string, specVars map[string]string) (*entity
 	return dagIns, nil
 }
 
+// createIdempotentDagIns create the dag instance, if its idempotency key is held by another instance,
+// return that one when it is created within the window, otherwise release the key and create again
+func createIdempotentDagIns(dagIns *entity.DagInstance, window time.Duration) (*entity.DagInstance, error) {
+	for i := 0; i < 2; i++ {
+		err := GetStore().CreateDagIns(dagIns)
+		if err == nil {
+			return dagIns, nil
+		}
+		if !errors.Is(err, data.ErrDataConflicted) {
+			return nil, err
+		}
+
+		existed, lErr := GetStore().ListDagInstance(&ListDagInstanceInput{
+			DagID:          dagIns.DagID,
+			IdempotencyKey: dagIns.IdempotencyKey,
+		})
+		if lErr != nil {
+			return nil, lErr
+		}
+		if len(existed) == 0 {
+			// the key was released by other caller just now
+			continue
+		}
+		if time.Since(time.Unix(existed[0].CreatedAt, 0)) < window {
+			return existed[0], nil
+		}
+		if err := GetStore().PatchDagIns(&entity.DagInstance{
+			BaseInfo:       existed[0].BaseInfo,
+			IdempotencyKey: "",
+		}, "IdempotencyKey"); err != nil {
+			return nil, fmt.Errorf("release idempotency key failed: %w", err)
+		}
+	}
+	return nil, fmt.Errorf("idempotency key[%s] of dag[%s] is still conflicted: %w",
+		dagIns.IdempotencyKey, dagIns.DagID, data.ErrDataConflicted)
+}
+
+// RunDagAt create a pending dag instance, it will be dispatched after the given time
+func (c *DefCommander) RunDagAt(
+	dagId string, specVars map[string]string, runAt time.Time, ops ...RunOptSetter) (*entity.DagInstance, error) {
+	return c.RunDag(dagId, specVars, append([]RunOptSetter{runAtTime(runAt)}, ops...)...)
+}
+
+// RunDagAfter create a pending dag instance, it will be dispatched after the given delay
+func (c *DefCommander) RunDagAfter(
+	dagId string, specVars map[string]string, delay time.Duration, ops ...RunOptSetter) (*entity.DagInstance, error) {
+	return c.RunDagAt(dagId, specVars, time.Now().Add(delay), ops...)
+}
+
+// CancelPendingDagIns cancel a pending dag instance before it starts
+func (c *DefCommander) CancelPendingDagIns(dagInsId string) error {
+	dagIns, err := GetStore().GetDagInstance(dagInsId)
+	if err != nil {
+		return err
+	}
+	if err := dagIns.CancelPending(); err != nil {
+		return err
+	}
+	// the instance may be promoted by dispatcher meanwhile
+	err = GetStore().PatchDagInsIf(&entity.DagInstance{
+		BaseInfo: dagIns.BaseInfo,
+		Status:   dagIns.Status,
+	}, &PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending}})
+	if errors.Is(err, data.ErrDataConflicted) {
+		return fmt.Errorf("dag instance[%s] is not pending anymore: %w", dagInsId, err)
+	}
+	return err
+}
+
+// Backfill create one dag instance per cron point in the range (from, to],
+// the points which already have instances will be skipped
+func (c *DefCommander) Backfill(dagId string, from, to time.Time) ([]*entity.DagInstance, error) {
+	dag, err := GetStore().GetDag(dagId)
+	if err != nil {
+		return nil, err
+	}
+
+	points, err := dag.CronTimes(from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) > maxBackfillCount {
+		return nil, fmt.Errorf("backfill range has %d points, it exceeds the limit %d", len(points), maxBackfillCount)
+	}
+
+	var ret []*entity.DagInstance
+	for _, p := range points {
+		dagIns, err := dag.RunScheduled(entity.TriggerBackfill, p)
+		if err != nil {
+			return nil, err
+		}
+		// share id with cron instance, so a point will not be run twice
+		dagIns.ID = CronDagInsID(dag.ID, p)
+		if err := GetStore().CreateDagIns(dagIns); err != nil {
+			if errors.Is(err, data.ErrDataConflicted) {
+				continue
+			}
+			return nil, err
+		}
+		ret = append(ret, dagIns)
+	}
+	return ret, nil
+}
+
 // RetryDagIns
 func (c *DefCommander) RetryDagIns(dagInsId string, ops ...CommandOptSetter) error {
 	return c.autoLoopDagTasks(
@@ -58,6 +186,94 @@ func (c *DefCommander) RetryTask(taskInsIds []string, ops ...CommandOptSetter) e
 	}, opt)
 }
 
+// RerunFrom rerun a task instance of finished dag instance even if it is succeeded,
+// the tasks depend on it will be rerun too if includeDownstream is true
+func (c *DefCommander) RerunFrom(taskInsId string, includeDownstream bool, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		IDs: []string{taskInsId},
+	})
+	if err != nil {
+		return err
+	}
+	if len(taskIns) == 0 {
+		return fmt.Errorf("id[%s] does not found task instance", taskInsId)
+	}
+
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: taskIns[0].DagInsID,
+	})
+	if err != nil {
+		return err
+	}
+	taskInsIds, err := rerunTaskInsIds(tasks, taskInsId, includeDownstream)
+	if err != nil {
+		return err
+	}
+
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if !isWorkerAlive {
+			aliveNodes, err := GetKeeper().AliveNodes()
+			if err != nil {
+				return err
+			}
+			dagIns.Worker = aliveNodes[rand.Intn(len(aliveNodes))]
+		}
+		return dagIns.Rerun(taskInsIds)
+	}, opt)
+}
+
+// MarkTask mark the failed, canceled or blocked task instances as success or skipped without executing them,
+// then the dag instance will continue
+func (c *DefCommander) MarkTask(
+	taskInsIds []string, status entity.TaskInstanceStatus, reason string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	mark := &entity.TaskMark{
+		Status:   status,
+		Reason:   reason,
+		Operator: opt.operator,
+		MarkedAt: time.Now().Unix(),
+	}
+	return executeCommand(taskInsIds, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if !isWorkerAlive {
+			aliveNodes, err := GetKeeper().AliveNodes()
+			if err != nil {
+				return err
+			}
+			dagIns.Worker = aliveNodes[rand.Intn(len(aliveNodes))]
+		}
+		return dagIns.MarkTasks(taskInsIds, mark)
+	}, opt)
+}
+
+// rerunTaskInsIds return the ids of task instances which should be rerun,
+// mapped task instances of the expanded for-each task are included, otherwise the group will not run them again
+func rerunTaskInsIds(tasks []*entity.TaskInstance, taskInsId string, includeDownstream bool) ([]string, error) {
+	ids := []string{taskInsId}
+	if includeDownstream {
+		root, err := BuildRootNode(MapTaskInsToGetter(tasks))
+		if err != nil {
+			return nil, fmt.Errorf("build task tree failed: %w", err)
+		}
+		descendants, _ := root.GetDescendantIds(taskInsId)
+		ids = append(ids, descendants...)
+	}
+
+	taskMap := getTasksMap(tasks)
+	groups := map[string]bool{}
+	for _, id := range ids {
+		if t, ok := taskMap[id]; ok && t.Expanded {
+			groups[t.TaskID] = true
+		}
+	}
+	for _, t := range tasks {
+		if groups[t.MappedFrom] && !utils.StringsContain(ids, t.ID) {
+			ids = append(ids, t.ID)
+		}
+	}
+	return ids, nil
+}
+
 // CancelTask
 func (c *DefCommander) CancelTask(taskInsIds []string, ops ...CommandOptSetter) error {
 	opt := initOption(ops)
@@ -69,6 +285,41 @@ func (c *DefCommander) CancelTask(taskInsIds []string, ops ...CommandOptSetter)
 	}, opt)
 }
 
+// CancelDagIns cancel all unfinished tasks of a dag instance and mark it canceled,
+// the leader will finish it if the worker is not healthy or it is not dispatched yet
+func (c *DefCommander) CancelDagIns(dagInsId, reason string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	dagIns, err := GetStore().GetDagInstance(dagInsId)
+	if err != nil {
+		return err
+	}
+	// the instance may be dispatched or completed meanwhile
+	cond := &PatchDagInsCondition{
+		Status: []entity.DagInstanceStatus{dagIns.Status},
+		Worker: dagIns.Worker,
+	}
+	if err := dagIns.CancelAll(reason); err != nil {
+		return err
+	}
+	err = GetStore().PatchDagInsIf(&entity.DagInstance{
+		BaseInfo: dagIns.BaseInfo,
+		Status:   dagIns.Status,
+		Reason:   dagIns.Reason,
+		Cmd:      dagIns.Cmd,
+	}, cond)
+	if errors.Is(err, data.ErrDataConflicted) {
+		return fmt.Errorf("dag instance[%s] has been changed, please retry: %w", dagInsId, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opt.isSync {
+		return ensureCmdExecuted(dagInsId, opt)
+	}
+	return nil
+}
+
 // ContinueDagIns using to continue a blocked dag instance
 func (c *DefCommander) ContinueDagIns(dagInsId string, ops ...CommandOptSetter) error {
 	return c.autoLoopDagTasks(
@@ -93,6 +344,69 @@ func (c *DefCommander) ContinueTask(taskInsIds []string, ops ...CommandOptSetter
 	}, opt)
 }
 
+// PauseDagIns stop pushing new tasks of a running dag instance, the running tasks will not be affected
+func (c *DefCommander) PauseDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagInsCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if !isWorkerAlive {
+			return fmt.Errorf("worker is not healthy, you can not pause it")
+		}
+		return dagIns.Pause()
+	}, opt)
+}
+
+// ResumeDagIns continue a paused dag instance from where it stopped
+func (c *DefCommander) ResumeDagIns(dagInsId string, ops ...CommandOptSetter) error {
+	opt := initOption(ops)
+	return executeDagInsCommand(dagInsId, func(dagIns *entity.DagInstance, isWorkerAlive bool) error {
+		if !isWorkerAlive {
+			aliveNodes, err := GetKeeper().AliveNodes()
+			if err != nil {
+				return err
+			}
+			dagIns.Worker = aliveNodes[rand.Intn(len(aliveNodes))]
+		}
+		return dagIns.Resume()
+	}, opt)
+}
+
+// ListDagVersion list the versions of a dag, sorted by version
+func (c *DefCommander) ListDagVersion(dagId string) ([]*entity.DagVersion, error) {
+	return GetStore().ListDagVersion(dagId)
+}
+
+// DiffDagVersion compare two versions of a dag
+func (c *DefCommander) DiffDagVersion(dagId string, from, to int) (*entity.DagDiff, error) {
+	fromVer, err := GetStore().GetDagVersion(dagId, from)
+	if err != nil {
+		return nil, err
+	}
+	toVer, err := GetStore().GetDagVersion(dagId, to)
+	if err != nil {
+		return nil, err
+	}
+	return entity.DiffDag(&fromVer.Dag, &toVer.Dag)
+}
+
+// RollbackDag update the dag to the definition of an old version, it creates a new version
+// and the status of dag is kept, the running instances are not affected as they are pinned to their versions
+func (c *DefCommander) RollbackDag(dagId string, version int) error {
+	ver, err := GetStore().GetDagVersion(dagId, version)
+	if err != nil {
+		return err
+	}
+	dag, err := GetStore().GetDag(dagId)
+	if err != nil {
+		return err
+	}
+
+	rollback := ver.Dag
+	rollback.BaseInfo = dag.BaseInfo
+	rollback.Status = dag.Status
+	rollback.Version = dag.Version
+	return GetStore().UpdateDag(&rollback)
+}
+
 func (c *DefCommander) autoLoopDagTasks(
 	dagInsId string,
 	status []entity.TaskInstanceStatus,
@@ -127,6 +441,21 @@ func initOption(opSetter []CommandOptSetter) (opt CommandOption) {
 	return
 }
 
+func initRunOption(opSetter []RunOptSetter) (opt RunOption) {
+	opt.trigger = entity.TriggerManually
+	opt.idempotencyWindow = defaultIdempotencyWindow
+	for _, op := range opSetter {
+		op(&opt)
+	}
+	return
+}
+
+func runAtTime(runAt time.Time) RunOptSetter {
+	return func(opt *RunOption) {
+		opt.runAt = runAt
+	}
+}
+
 func executeCommand(
 	taskInsIds []string,
 	perform func(dagIns *entity.DagInstance, isWorkerAlive bool) error,
@@ -166,6 +495,13 @@ func executeCommand(
 		}
 	}
 
+	return executeDagInsCommand(dagInsId, perform, opt)
+}
+
+func executeDagInsCommand(
+	dagInsId string,
+	perform func(dagIns *entity.DagInstance, isWorkerAlive bool) error,
+	opt CommandOption) error {
 	dagIns, err := GetStore().GetDagInstance(dagInsId)
 	if err != nil {
 		return err
@@ -6,6 +6,8 @@ import (
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -15,6 +17,7 @@ func TestDefCommander_RunDag(t *testing.T) {
 		caseDesc      string
 		giveDagId     string
 		giveVars      map[string]string
+		giveOps       []RunOptSetter
 		giveDag       *entity.Dag
 		giveGetErr    error
 		giveCreateErr error
@@ -38,6 +41,65 @@ func TestDefCommander_RunDag(t *testing.T) {
 				ShareData: &entity.ShareData{},
 			},
 		},
+		{
+			caseDesc:  "dag priority",
+			giveDagId: "test-dag",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Priority: 5,
+				Status:   entity.DagStatusNormal,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Priority:  5,
+				Status:    entity.DagInstanceStatusInit,
+				ShareData: &entity.ShareData{},
+			},
+		},
+		{
+			caseDesc:  "override priority",
+			giveDagId: "test-dag",
+			giveOps:   []RunOptSetter{RunPriority(-1)},
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				Priority: 5,
+				Status:   entity.DagStatusNormal,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Priority:  -1,
+				Status:    entity.DagInstanceStatusInit,
+				ShareData: &entity.ShareData{},
+			},
+		},
+		{
+			caseDesc:  "override timeout",
+			giveDagId: "test-dag",
+			giveOps:   []RunOptSetter{RunTimeout(time.Minute)},
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{
+					ID: "test-dag",
+				},
+				TimeoutSecs: 10,
+				Status:      entity.DagStatusNormal,
+			},
+			wantDagIns: &entity.DagInstance{
+				DagID:       "test-dag",
+				Vars:        entity.DagInstanceVars{},
+				Trigger:     entity.TriggerManually,
+				Status:      entity.DagInstanceStatusInit,
+				ShareData:   &entity.ShareData{},
+				TimeoutSecs: 60,
+			},
+		},
 		{
 			caseDesc:   "get failed",
 			giveDagId:  "test-dag",
@@ -89,7 +151,7 @@ func TestDefCommander_RunDag(t *testing.T) {
 			SetStore(mStore)
 
 			c := &DefCommander{}
-			dagIns, err := c.RunDag(tc.giveDagId, tc.giveVars)
+			dagIns, err := c.RunDag(tc.giveDagId, tc.giveVars, tc.giveOps...)
 			assert.Equal(t, tc.wantErr, err)
 			if err == nil {
 				assert.Equal(t, tc.wantDagIns, dagIns)
@@ -99,6 +161,333 @@ func TestDefCommander_RunDag(t *testing.T) {
 	}
 }
 
+func TestDefCommander_RunDagAt(t *testing.T) {
+	giveDag := &entity.Dag{
+		BaseInfo: entity.BaseInfo{ID: "test-dag"},
+		Status:   entity.DagStatusNormal,
+	}
+	runAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		caseDesc string
+		call     func(c *DefCommander) (*entity.DagInstance, error)
+		wantIns  *entity.DagInstance
+	}{
+		{
+			caseDesc: "run at",
+			call: func(c *DefCommander) (*entity.DagInstance, error) {
+				return c.RunDagAt("test-dag", nil, runAt)
+			},
+			wantIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Status:    entity.DagInstanceStatusPending,
+				ShareData: &entity.ShareData{},
+				RunAt:     runAt.Unix(),
+			},
+		},
+		{
+			caseDesc: "run at past time",
+			call: func(c *DefCommander) (*entity.DagInstance, error) {
+				return c.RunDagAt("test-dag", nil, time.Now().Add(-time.Hour), RunTrigger(entity.TriggerWebhook))
+			},
+			wantIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerWebhook,
+				Status:    entity.DagInstanceStatusInit,
+				ShareData: &entity.ShareData{},
+			},
+		},
+		{
+			caseDesc: "run after",
+			call: func(c *DefCommander) (*entity.DagInstance, error) {
+				return c.RunDagAfter("test-dag", nil, time.Hour)
+			},
+			wantIns: &entity.DagInstance{
+				DagID:     "test-dag",
+				Vars:      entity.DagInstanceVars{},
+				Trigger:   entity.TriggerManually,
+				Status:    entity.DagInstanceStatusPending,
+				ShareData: &entity.ShareData{},
+				RunAt:     runAt.Unix(),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("GetDag", "test-dag").Return(giveDag, nil)
+			mStore.On("CreateDagIns", mock.Anything).Return(nil)
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			dagIns, err := tc.call(c)
+			assert.NoError(t, err)
+			assert.InDelta(t, tc.wantIns.RunAt, dagIns.RunAt, 1)
+			dagIns.RunAt = tc.wantIns.RunAt
+			assert.Equal(t, tc.wantIns, dagIns)
+		})
+	}
+}
+
+func TestDefCommander_RunDagIdempotency(t *testing.T) {
+	now := time.Now().Unix()
+	conflictErr := fmt.Errorf("conflicted: %w", data.ErrDataConflicted)
+	tests := []struct {
+		caseDesc      string
+		giveCreateErr []error
+		giveExisted   []*entity.DagInstance
+		giveListErr   error
+		wantDagInsID  string
+		wantPatched   bool
+		wantErr       error
+	}{
+		{
+			caseDesc:      "new key",
+			giveCreateErr: []error{nil},
+			wantDagInsID:  "new",
+		},
+		{
+			caseDesc:      "repeated within window",
+			giveCreateErr: []error{conflictErr},
+			giveExisted: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "existed", CreatedAt: now - 60}, IdempotencyKey: "key"},
+			},
+			wantDagInsID: "existed",
+		},
+		{
+			caseDesc:      "repeated out of window",
+			giveCreateErr: []error{conflictErr, nil},
+			giveExisted: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "existed", CreatedAt: now - 7200}, IdempotencyKey: "key"},
+			},
+			wantDagInsID: "new",
+			wantPatched:  true,
+		},
+		{
+			caseDesc:      "create failed",
+			giveCreateErr: []error{fmt.Errorf("create failed")},
+			wantErr:       fmt.Errorf("create failed"),
+		},
+		{
+			caseDesc:      "list failed",
+			giveCreateErr: []error{conflictErr},
+			giveListErr:   fmt.Errorf("list failed"),
+			wantErr:       fmt.Errorf("list failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			createCnt := 0
+			var patched *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("GetDag", "test-dag").Return(&entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "test-dag"},
+				Status:   entity.DagStatusNormal,
+			}, nil)
+			mStore.On("CreateDagIns", mock.Anything).Return(func(dagIns *entity.DagInstance) error {
+				assert.Equal(t, "key", dagIns.IdempotencyKey)
+				err := tc.giveCreateErr[createCnt]
+				createCnt++
+				if err == nil {
+					dagIns.ID = "new"
+				}
+				return err
+			})
+			mStore.On("ListDagInstance", &ListDagInstanceInput{
+				DagID:          "test-dag",
+				IdempotencyKey: "key",
+			}).Return(tc.giveExisted, tc.giveListErr)
+			mStore.On("PatchDagIns", mock.Anything, "IdempotencyKey").Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			dagIns, err := c.RunDag("test-dag", nil, RunIdempotencyKey("key", time.Hour))
+			assert.Equal(t, tc.wantErr, err)
+			if err == nil {
+				assert.Equal(t, tc.wantDagInsID, dagIns.ID)
+			}
+			assert.Equal(t, len(tc.giveCreateErr), createCnt)
+			if tc.wantPatched {
+				assert.Equal(t, &entity.DagInstance{BaseInfo: tc.giveExisted[0].BaseInfo}, patched)
+			} else {
+				assert.Nil(t, patched)
+			}
+		})
+	}
+}
+
+func TestDefCommander_CancelPendingDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveDagIns   *entity.DagInstance
+		giveGetErr   error
+		givePatchErr error
+		wantErr      error
+		wantPatched  *entity.DagInstance
+	}{
+		{
+			caseDesc: "normal",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins"},
+				Status:   entity.DagInstanceStatusPending,
+			},
+			wantPatched: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins"},
+				Status:   entity.DagInstanceStatusCanceled,
+			},
+		},
+		{
+			caseDesc: "promoted meanwhile",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins"},
+				Status:   entity.DagInstanceStatusPending,
+			},
+			givePatchErr: data.ErrDataConflicted,
+			wantErr:      fmt.Errorf("dag instance[ins] is not pending anymore: %w", data.ErrDataConflicted),
+			wantPatched: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins"},
+				Status:   entity.DagInstanceStatusCanceled,
+			},
+		},
+		{
+			caseDesc: "not pending",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins"},
+				Status:   entity.DagInstanceStatusRunning,
+			},
+			wantErr: fmt.Errorf("you can only cancel a pending dag instance"),
+		},
+		{
+			caseDesc:   "get failed",
+			giveGetErr: fmt.Errorf("get failed"),
+			wantErr:    fmt.Errorf("get failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("GetDagInstance", "ins").Return(tc.giveDagIns, tc.giveGetErr)
+			mStore.On("PatchDagInsIf", mock.Anything, &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending},
+			}).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+			}).Return(tc.givePatchErr)
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			err := c.CancelPendingDagIns("ins")
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatched, patched)
+		})
+	}
+}
+
+func TestDefCommander_Backfill(t *testing.T) {
+	giveFrom := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		caseDesc      string
+		giveDag       *entity.Dag
+		giveTo        time.Time
+		giveGetErr    error
+		giveCreateErr map[string]error
+		wantErr       error
+		wantIDs       []string
+	}{
+		{
+			caseDesc: "normal",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveTo: giveFrom.Add(3 * time.Hour),
+			wantIDs: []string{
+				CronDagInsID("dag", giveFrom.Add(time.Hour)),
+				CronDagInsID("dag", giveFrom.Add(2*time.Hour)),
+				CronDagInsID("dag", giveFrom.Add(3*time.Hour)),
+			},
+		},
+		{
+			caseDesc: "skip existed",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveTo: giveFrom.Add(2 * time.Hour),
+			giveCreateErr: map[string]error{
+				CronDagInsID("dag", giveFrom.Add(time.Hour)): data.ErrDataConflicted,
+			},
+			wantIDs: []string{
+				CronDagInsID("dag", giveFrom.Add(2*time.Hour)),
+			},
+		},
+		{
+			caseDesc: "create failed",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveTo: giveFrom.Add(2 * time.Hour),
+			giveCreateErr: map[string]error{
+				CronDagInsID("dag", giveFrom.Add(time.Hour)): fmt.Errorf("create failed"),
+			},
+			wantErr: fmt.Errorf("create failed"),
+		},
+		{
+			caseDesc: "exceed limit",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "* * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveTo:  giveFrom.Add(24 * time.Hour),
+			wantErr: fmt.Errorf("backfill range has 1440 points, it exceeds the limit 1000"),
+		},
+		{
+			caseDesc:   "get failed",
+			giveDag:    &entity.Dag{BaseInfo: entity.BaseInfo{ID: "dag"}},
+			giveGetErr: fmt.Errorf("get failed"),
+			wantErr:    fmt.Errorf("get failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("GetDag", tc.giveDag.ID).Return(tc.giveDag, tc.giveGetErr)
+			mStore.On("CreateDagIns", mock.Anything).Return(func(dagIns *entity.DagInstance) error {
+				assert.Equal(t, entity.TriggerBackfill, dagIns.Trigger)
+				assert.NotEmpty(t, dagIns.Vars[entity.VarKeyScheduleTime].Value)
+				return tc.giveCreateErr[dagIns.ID]
+			})
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			ret, err := c.Backfill(tc.giveDag.ID, giveFrom, tc.giveTo)
+			assert.Equal(t, tc.wantErr, err)
+			var ids []string
+			for _, dagIns := range ret {
+				ids = append(ids, dagIns.ID)
+			}
+			assert.Equal(t, tc.wantIDs, ids)
+		})
+	}
+}
+
 func TestDefCommander_OpDagIns(t *testing.T) {
 	tests := []struct {
 		caseDesc      string
@@ -329,6 +718,502 @@ func TestDefCommander_OpTask(t *testing.T) {
 	}
 }
 
+func TestDefCommander_PauseResumeDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveStatus       entity.DagInstanceStatus
+		giveIsAlive      bool
+		giveAliveNodes   []string
+		giveOp           string
+		wantErr          error
+		wantUpdateDagIns *entity.DagInstance
+	}{
+		{
+			caseDesc:    "pause",
+			giveStatus:  entity.DagInstanceStatusRunning,
+			giveIsAlive: true,
+			giveOp:      entity.CommandNamePause,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "1",
+				Cmd:      &entity.Command{Name: entity.CommandNamePause},
+			},
+		},
+		{
+			caseDesc:    "pause not running",
+			giveStatus:  entity.DagInstanceStatusPaused,
+			giveIsAlive: true,
+			giveOp:      entity.CommandNamePause,
+			wantErr:     fmt.Errorf("you can only pause a running dag instance"),
+		},
+		{
+			caseDesc:    "pause unhealthy worker",
+			giveStatus:  entity.DagInstanceStatusRunning,
+			giveIsAlive: false,
+			giveOp:      entity.CommandNamePause,
+			wantErr:     fmt.Errorf("worker is not healthy, you can not pause it"),
+		},
+		{
+			caseDesc:    "resume",
+			giveStatus:  entity.DagInstanceStatusPaused,
+			giveIsAlive: true,
+			giveOp:      entity.CommandNameResume,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "1",
+				Cmd:      &entity.Command{Name: entity.CommandNameResume},
+			},
+		},
+		{
+			caseDesc:       "resume unhealthy worker",
+			giveStatus:     entity.DagInstanceStatusPaused,
+			giveIsAlive:    false,
+			giveAliveNodes: []string{"2"},
+			giveOp:         entity.CommandNameResume,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "2",
+				Cmd:      &entity.Command{Name: entity.CommandNameResume},
+			},
+		},
+		{
+			caseDesc:    "resume not paused",
+			giveStatus:  entity.DagInstanceStatusRunning,
+			giveIsAlive: true,
+			giveOp:      entity.CommandNameResume,
+			wantErr:     fmt.Errorf("you can only resume a paused dag instance"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("GetDagInstance", "dagIns").Return(&entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "1",
+				Status:   tc.giveStatus,
+			}, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeep := &MockKeeper{}
+			mKeep.On("IsAlive", "1").Return(tc.giveIsAlive, nil)
+			mKeep.On("AliveNodes").Return(tc.giveAliveNodes, nil)
+			SetKeeper(mKeep)
+
+			c := &DefCommander{}
+			var err error
+			if tc.giveOp == entity.CommandNamePause {
+				err = c.PauseDagIns("dagIns")
+			} else {
+				err = c.ResumeDagIns("dagIns")
+			}
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantUpdateDagIns, patched)
+		})
+	}
+}
+
+func TestDefCommander_CancelDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc         string
+		giveStatus       entity.DagInstanceStatus
+		giveWorker       string
+		giveGetErr       error
+		givePatchErr     error
+		wantErr          error
+		wantCond         *PatchDagInsCondition
+		wantUpdateDagIns *entity.DagInstance
+	}{
+		{
+			caseDesc:   "normal",
+			giveStatus: entity.DagInstanceStatusRunning,
+			giveWorker: "1",
+			wantCond: &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+				Worker: "1",
+			},
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Status:   entity.DagInstanceStatusCanceled,
+				Reason:   "cancel by user",
+				Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+			},
+		},
+		{
+			caseDesc:   "paused",
+			giveStatus: entity.DagInstanceStatusPaused,
+			giveWorker: "1",
+			wantCond: &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPaused},
+				Worker: "1",
+			},
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Status:   entity.DagInstanceStatusCanceled,
+				Reason:   "cancel by user",
+				Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+			},
+		},
+		{
+			caseDesc:   "not dispatched",
+			giveStatus: entity.DagInstanceStatusInit,
+			wantCond: &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
+			},
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Status:   entity.DagInstanceStatusCanceled,
+				Reason:   "cancel by user",
+				Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+			},
+		},
+		{
+			caseDesc:     "changed meanwhile",
+			giveStatus:   entity.DagInstanceStatusScheduled,
+			giveWorker:   "1",
+			givePatchErr: data.ErrDataConflicted,
+			wantErr: fmt.Errorf("dag instance[dagIns] has been changed, please retry: %w",
+				data.ErrDataConflicted),
+			wantCond: &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
+				Worker: "1",
+			},
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Status:   entity.DagInstanceStatusCanceled,
+				Reason:   "cancel by user",
+				Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+			},
+		},
+		{
+			caseDesc:   "pending",
+			giveStatus: entity.DagInstanceStatusPending,
+			wantErr:    fmt.Errorf("you should cancel a pending dag instance by CancelPending"),
+		},
+		{
+			caseDesc:   "already finished",
+			giveStatus: entity.DagInstanceStatusSuccess,
+			wantErr:    fmt.Errorf("you can only cancel a unfinished dag instance"),
+		},
+		{
+			caseDesc:   "get failed",
+			giveGetErr: fmt.Errorf("get failed"),
+			wantErr:    fmt.Errorf("get failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.DagInstance
+			var cond *PatchDagInsCondition
+			mStore := &MockStore{}
+			mStore.On("GetDagInstance", "dagIns").Return(&entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   tc.giveWorker,
+				Status:   tc.giveStatus,
+			}, tc.giveGetErr)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+				cond = args.Get(1).(*PatchDagInsCondition)
+			}).Return(tc.givePatchErr)
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			err := c.CancelDagIns("dagIns", "cancel by user")
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantUpdateDagIns, patched)
+			assert.Equal(t, tc.wantCond, cond)
+		})
+	}
+}
+
+func TestDefCommander_RerunFrom(t *testing.T) {
+	newTask := func(id string, dependOn ...string) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			TaskID:   id,
+			DagInsID: "dagIns",
+			DependOn: dependOn,
+			Status:   entity.TaskInstanceStatusSuccess,
+		}
+	}
+	group := newTask("group", "group-0", "group-1")
+	group.Expanded = true
+	mapped0, mapped1 := newTask("group-0", "start"), newTask("group-1", "start")
+	mapped0.MappedFrom, mapped1.MappedFrom = "group", "group"
+	tasks := []*entity.TaskInstance{
+		newTask("start"),
+		newTask("x", "start"),
+		newTask("x-child", "x"),
+		mapped0,
+		mapped1,
+		group,
+		newTask("end", "group"),
+	}
+
+	tests := []struct {
+		caseDesc              string
+		giveTaskInsId         string
+		giveIncludeDownstream bool
+		giveDagStatus         entity.DagInstanceStatus
+		wantErr               error
+		wantCmd               *entity.Command
+	}{
+		{
+			caseDesc:      "only the task",
+			giveTaskInsId: "x",
+			giveDagStatus: entity.DagInstanceStatusSuccess,
+			wantCmd: &entity.Command{
+				Name:             entity.CommandNameRerun,
+				TargetTaskInsIDs: []string{"x"},
+			},
+		},
+		{
+			caseDesc:              "include downstream",
+			giveTaskInsId:         "x",
+			giveIncludeDownstream: true,
+			giveDagStatus:         entity.DagInstanceStatusSuccess,
+			wantCmd: &entity.Command{
+				Name:             entity.CommandNameRerun,
+				TargetTaskInsIDs: []string{"x", "x-child"},
+			},
+		},
+		{
+			caseDesc:      "expanded for-each task",
+			giveTaskInsId: "group",
+			giveDagStatus: entity.DagInstanceStatusFailed,
+			wantCmd: &entity.Command{
+				Name:             entity.CommandNameRerun,
+				TargetTaskInsIDs: []string{"group", "group-0", "group-1"},
+			},
+		},
+		{
+			caseDesc:      "task not found",
+			giveTaskInsId: "unknown",
+			wantErr:       fmt.Errorf("id[unknown] does not found task instance"),
+		},
+		{
+			caseDesc:      "dag instance is running",
+			giveTaskInsId: "x",
+			giveDagStatus: entity.DagInstanceStatusRunning,
+			wantErr:       fmt.Errorf("you can only rerun a finished dag instance"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+				if input.DagInsID != "" {
+					return tasks
+				}
+				var ret []*entity.TaskInstance
+				for _, t := range tasks {
+					if utils.StringsContain(input.IDs, t.ID) {
+						ret = append(ret, t)
+					}
+				}
+				return ret
+			}, nil)
+			mStore.On("GetDagInstance", "dagIns").Return(&entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "1",
+				Status:   tc.giveDagStatus,
+			}, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeep := &MockKeeper{}
+			mKeep.On("IsAlive", "1").Return(true, nil)
+			SetKeeper(mKeep)
+
+			c := &DefCommander{}
+			err := c.RerunFrom(tc.giveTaskInsId, tc.giveIncludeDownstream)
+			assert.Equal(t, tc.wantErr, err)
+			if tc.wantCmd != nil {
+				assert.Equal(t, tc.wantCmd, patched.Cmd)
+			}
+		})
+	}
+}
+
+func TestDefCommander_MarkTask(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveStatus    entity.TaskInstanceStatus
+		giveDagStatus entity.DagInstanceStatus
+		giveIsAlive   bool
+		wantErr       error
+		wantWorker    string
+		wantMark      *entity.TaskMark
+	}{
+		{
+			caseDesc:      "normal",
+			giveStatus:    entity.TaskInstanceStatusSuccess,
+			giveDagStatus: entity.DagInstanceStatusFailed,
+			giveIsAlive:   true,
+			wantWorker:    "1",
+			wantMark:      &entity.TaskMark{Status: entity.TaskInstanceStatusSuccess, Reason: "fixed", Operator: "admin"},
+		},
+		{
+			caseDesc:      "unhealthy worker",
+			giveStatus:    entity.TaskInstanceStatusSkipped,
+			giveDagStatus: entity.DagInstanceStatusRunning,
+			wantWorker:    "2",
+			wantMark:      &entity.TaskMark{Status: entity.TaskInstanceStatusSkipped, Reason: "fixed", Operator: "admin"},
+		},
+		{
+			caseDesc:      "invalid status",
+			giveStatus:    entity.TaskInstanceStatusFailed,
+			giveDagStatus: entity.DagInstanceStatusFailed,
+			giveIsAlive:   true,
+			wantErr:       fmt.Errorf("you can only mark task instance as success or skipped"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", &ListTaskInstanceInput{IDs: []string{"task"}}).Return([]*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task"}, DagInsID: "dagIns"},
+			}, nil)
+			mStore.On("GetDagInstance", "dagIns").Return(&entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dagIns"},
+				Worker:   "1",
+				Status:   tc.giveDagStatus,
+			}, nil)
+			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				patched = args.Get(0).(*entity.DagInstance)
+			}).Return(nil)
+			SetStore(mStore)
+
+			mKeep := &MockKeeper{}
+			mKeep.On("IsAlive", "1").Return(tc.giveIsAlive, nil)
+			mKeep.On("AliveNodes").Return([]string{"2"}, nil)
+			SetKeeper(mKeep)
+
+			c := &DefCommander{}
+			err := c.MarkTask([]string{"task"}, tc.giveStatus, "fixed", CommOperator("admin"))
+			assert.Equal(t, tc.wantErr, err)
+			if tc.wantMark == nil {
+				assert.Nil(t, patched)
+				return
+			}
+			assert.Equal(t, tc.wantWorker, patched.Worker)
+			assert.InDelta(t, time.Now().Unix(), patched.Cmd.Mark.MarkedAt, 1)
+			patched.Cmd.Mark.MarkedAt = 0
+			assert.Equal(t, &entity.Command{
+				Name:             entity.CommandNameMark,
+				TargetTaskInsIDs: []string{"task"},
+				Mark:             tc.wantMark,
+			}, patched.Cmd)
+		})
+	}
+}
+
+func TestDefCommander_DiffDagVersion(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		giveTo   int
+		wantDiff *entity.DagDiff
+		wantErr  error
+	}{
+		{
+			caseDesc: "normal",
+			giveTo:   2,
+			wantDiff: &entity.DagDiff{Fields: []string{"desc"}, AddedTasks: []string{"t2"}},
+		},
+		{
+			caseDesc: "version not found",
+			giveTo:   3,
+			wantErr:  fmt.Errorf("not found"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("GetDagVersion", "dag", 1).Return(&entity.DagVersion{
+				Dag: entity.Dag{Tasks: []entity.Task{{ID: "t1"}}},
+			}, nil)
+			mStore.On("GetDagVersion", "dag", 2).Return(&entity.DagVersion{
+				Dag: entity.Dag{Desc: "desc", Tasks: []entity.Task{{ID: "t1"}, {ID: "t2"}}},
+			}, nil)
+			mStore.On("GetDagVersion", "dag", 3).Return(nil, fmt.Errorf("not found"))
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			diff, err := c.DiffDagVersion("dag", 1, tc.giveTo)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantDiff, diff)
+		})
+	}
+}
+
+func TestDefCommander_RollbackDag(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveVersion   int
+		wantUpdateDag *entity.Dag
+		wantErr       error
+	}{
+		{
+			caseDesc:    "normal",
+			giveVersion: 1,
+			wantUpdateDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag", CreatedAt: 2},
+				Name:     "old",
+				Status:   entity.DagStatusStopped,
+				Version:  3,
+			},
+		},
+		{
+			caseDesc:    "version not found",
+			giveVersion: 2,
+			wantErr:     fmt.Errorf("not found"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var updated *entity.Dag
+			mStore := &MockStore{}
+			mStore.On("GetDagVersion", "dag", 1).Return(&entity.DagVersion{
+				Dag: entity.Dag{
+					BaseInfo: entity.BaseInfo{ID: "dag", CreatedAt: 1},
+					Name:     "old",
+					Status:   entity.DagStatusNormal,
+					Version:  1,
+				},
+			}, nil)
+			mStore.On("GetDagVersion", "dag", 2).Return(nil, fmt.Errorf("not found"))
+			mStore.On("GetDag", "dag").Return(&entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag", CreatedAt: 2},
+				Name:     "new",
+				Status:   entity.DagStatusStopped,
+				Version:  3,
+			}, nil)
+			mStore.On("UpdateDag", mock.Anything).Run(func(args mock.Arguments) {
+				updated = args.Get(0).(*entity.Dag)
+			}).Return(nil)
+			SetStore(mStore)
+
+			c := &DefCommander{}
+			err := c.RollbackDag("dag", tc.giveVersion)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantUpdateDag, updated)
+		})
+	}
+}
+
 func TestDefCommander_CancelTask(t *testing.T) {
 
 }
@@ -368,6 +1253,65 @@ func TestDefCommander_initOption(t *testing.T) {
 	}
 }
 
+func TestDefCommander_initRunOption(t *testing.T) {
+	priority := 3
+	timeout := time.Minute
+	tests := []struct {
+		caseDesc   string
+		giveSetter []RunOptSetter
+		wantOpt    RunOption
+	}{
+		{
+			caseDesc:   "default value",
+			giveSetter: []RunOptSetter{},
+			wantOpt: RunOption{
+				trigger:           entity.TriggerManually,
+				idempotencyWindow: defaultIdempotencyWindow,
+			},
+		},
+		{
+			caseDesc: "specified value",
+			giveSetter: []RunOptSetter{
+				RunTrigger(entity.TriggerWebhook),
+				RunIdempotencyKey("key", time.Hour),
+			},
+			wantOpt: RunOption{
+				trigger:           entity.TriggerWebhook,
+				idempotencyKey:    "key",
+				idempotencyWindow: time.Hour,
+			},
+		},
+		{
+			caseDesc: "specified priority",
+			giveSetter: []RunOptSetter{
+				RunPriority(3),
+			},
+			wantOpt: RunOption{
+				trigger:           entity.TriggerManually,
+				idempotencyWindow: defaultIdempotencyWindow,
+				priority:          &priority,
+			},
+		},
+		{
+			caseDesc: "specified timeout",
+			giveSetter: []RunOptSetter{
+				RunTimeout(time.Minute),
+			},
+			wantOpt: RunOption{
+				trigger:           entity.TriggerManually,
+				idempotencyWindow: defaultIdempotencyWindow,
+				timeout:           &timeout,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			opt := initRunOption(tc.giveSetter)
+			assert.Equal(t, tc.wantOpt, opt)
+		})
+	}
+}
+
 func TestDefCommander_executeCommand(t *testing.T) {
 	tests := []struct {
 		caseDesc         string
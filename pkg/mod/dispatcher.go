@@ -1,27 +1,37 @@
 package mod
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
 	"github.com/shiningrush/fastflow/pkg/event"
 	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/utils"
 	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/shiningrush/goevent"
 )
 
+const dispatchBatchSize = 1000
+
 // DefDispatcher
 type DefDispatcher struct {
-	closeCh chan struct{}
+	strategy DispatchStrategy
+	closeCh  chan struct{}
 
 	wg sync.WaitGroup
 }
 
-// NewDefDispatcher
-func NewDefDispatcher() *DefDispatcher {
+// NewDefDispatcher the default strategy is LeastLoadedStrategy
+func NewDefDispatcher(strategy DispatchStrategy) *DefDispatcher {
+	if strategy == nil {
+		strategy = NewLeastLoadedStrategy()
+	}
 	return &DefDispatcher{
-		closeCh: make(chan struct{}),
+		strategy: strategy,
+		closeCh:  make(chan struct{}),
 	}
 }
 
@@ -55,35 +65,184 @@ func (d *DefDispatcher) WatchInitDags() {
 
 // Do dispatch
 func (d *DefDispatcher) Do() error {
-	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
-		Status: []entity.DagInstanceStatus{
-			entity.DagInstanceStatusInit,
-		},
-		Limit: 1000,
-	})
+	// pending instances should not block the dispatching of others
+	if err := d.promotePendingDagIns(); err != nil {
+		log.Errorf("promote pending dag instances failed: %s", err)
+	}
+
+	// workers are loaded when the first instance is assigned
+	var matcher *workerMatcher
+	workerMap := map[string]*WorkerInfo{}
+	assign := func(dagIns *entity.DagInstance) (bool, error) {
+		if matcher == nil {
+			candidates, err := loadCandidates()
+			if err != nil {
+				return false, err
+			}
+			for i := range candidates {
+				workerMap[candidates[i].Key] = candidates[i]
+			}
+			matcher = newWorkerMatcher(candidates)
+		}
+
+		matched, reason := matcher.match(dagIns.NodeSelector)
+		if len(matched) == 0 {
+			// leave it in queue, and tell user why it is not dispatched
+			return false, d.markUnmatched(dagIns, reason)
+		}
+
+		key := d.strategy.Pick(dagIns, matched)
+		if w, ok := workerMap[key]; ok {
+			w.QueuedTaskCnt++
+		}
+		dagIns.Status = entity.DagInstanceStatusScheduled
+		dagIns.Worker = key
+		dagIns.Reason = ""
+		return true, nil
+	}
+
+	scheduled, err := d.listDispatchableDagIns(assign)
 	if err != nil {
 		return err
 	}
-	if len(dagIns) == 0 {
+	if len(scheduled) == 0 {
 		return nil
 	}
 
-	nodes, err := GetKeeper().AliveNodes()
+	for i := range scheduled {
+		// only patch the instance which is still init, so the instance canceled meanwhile will not be run
+		err := GetStore().PatchDagInsIf(&entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: scheduled[i].ID},
+			Status:   scheduled[i].Status,
+			Worker:   scheduled[i].Worker,
+			Reason:   scheduled[i].Reason,
+		}, &PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit}}, "Reason")
+		if err != nil && !errors.Is(err, data.ErrDataConflicted) {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCandidates return the copies of alive workers which can accept dag instances,
+// they are copied because we will change their load
+func loadCandidates() ([]*WorkerInfo, error) {
+	workers, err := GetKeeper().AliveWorkers()
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	candidates := make([]*WorkerInfo, 0, len(workers))
+	for i := range workers {
+		// draining worker is going to exit, should not accept new dag instances
+		if workers[i].Draining {
+			continue
+		}
+		w := *workers[i]
+		candidates = append(candidates, &w)
 	}
-	if len(nodes) == 0 {
-		return data.ErrNoAliveNodes
+	if len(candidates) == 0 {
+		return nil, data.ErrNoAliveNodes
 	}
+	return candidates, nil
+}
 
-	for i := range dagIns {
-		dagIns[i].Status = entity.DagInstanceStatusScheduled
-		dagIns[i].Worker = nodes[i%len(nodes)]
+func (d *DefDispatcher) markUnmatched(dagIns *entity.DagInstance, reason string) error {
+	if dagIns.Reason == reason {
+		return nil
+	}
+	return GetStore().PatchDagIns(&entity.DagInstance{
+		BaseInfo: dagIns.BaseInfo,
+		Reason:   reason,
+	})
+}
+
+// listDispatchableDagIns list init dag instances order by priority and then FIFO, and assign them to workers,
+// the ones exceed "MaxActiveRuns" of their dag will be left to wait, return the assigned instances.
+// the quota of dag is consumed only when the instance is assigned, so the unassigned ones will not hold it
+func (d *DefDispatcher) listDispatchableDagIns(
+	assign func(dagIns *entity.DagInstance) (bool, error)) ([]*entity.DagInstance, error) {
+	limiter := newActiveRunsLimiter()
+	var saturatedDagIDs []string
+	// the listed instances of unsaturated dags are still init, they are skipped by offset when listing again
+	listedCnt := map[string]int64{}
+	var ret []*entity.DagInstance
+	for {
+		var offset int64
+		for dagId, cnt := range listedCnt {
+			if !utils.StringsContain(saturatedDagIDs, dagId) {
+				offset += cnt
+			}
+		}
+		dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+			Status: []entity.DagInstanceStatus{
+				entity.DagInstanceStatusInit,
+			},
+			ExcludeDagIDs: saturatedDagIDs,
+			SortBy:        []string{"-priority", "createdAt"},
+			Limit:         dispatchBatchSize,
+			Offset:        offset,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		hasSaturated := false
+		for i := range dagIns {
+			listedCnt[dagIns[i].DagID]++
+			allowed, err := limiter.allow(dagIns[i].DagID)
+			if err != nil {
+				return nil, err
+			}
+			if !allowed {
+				hasSaturated = true
+				if !utils.StringsContain(saturatedDagIDs, dagIns[i].DagID) {
+					saturatedDagIDs = append(saturatedDagIDs, dagIns[i].DagID)
+				}
+				continue
+			}
+
+			assigned, err := assign(dagIns[i])
+			if err != nil {
+				return nil, err
+			}
+			if assigned {
+				limiter.consume(dagIns[i].DagID)
+				ret = append(ret, dagIns[i])
+			}
+		}
+
+		// the excess instances of saturated dags may occupy the whole batch,
+		// so we need list again without the saturated dags
+		if !hasSaturated || len(dagIns) < dispatchBatchSize || len(ret) >= dispatchBatchSize {
+			return ret, nil
+		}
 	}
+}
 
-	if err := GetStore().BatchUpdateDagIns(dagIns); err != nil {
+// promotePendingDagIns move the pending dag instances which reach their start time to init
+func (d *DefDispatcher) promotePendingDagIns() error {
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Status: []entity.DagInstanceStatus{
+			entity.DagInstanceStatusPending,
+		},
+		RunAtEnd: time.Now().Unix(),
+		Limit:    1000,
+	})
+	if err != nil {
 		return err
 	}
+
+	for i := range dagIns {
+		// only patch status when it is still pending, so the instance canceled meanwhile will not be run
+		err := GetStore().PatchDagInsIf(&entity.DagInstance{
+			BaseInfo: dagIns[i].BaseInfo,
+			Status:   entity.DagInstanceStatusInit,
+		}, &PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending}})
+		if err != nil && !errors.Is(err, data.ErrDataConflicted) {
+			log.Errorf("promote pending dag instance[%s] failed: %s", dagIns[i].ID, err)
+		}
+	}
 	return nil
 }
 
@@ -98,3 +257,109 @@ func (d *DefDispatcher) Close() {
 	close(d.closeCh)
 	d.wg.Wait()
 }
+
+// workerMatcher used to filter workers by node selector
+type workerMatcher struct {
+	workers []*WorkerInfo
+	// cache the matched workers of selector expressions
+	cache map[string][]*WorkerInfo
+	// cache the reason of unmatched selector expressions
+	reasons map[string]string
+}
+
+func newWorkerMatcher(workers []*WorkerInfo) *workerMatcher {
+	return &workerMatcher{
+		workers: workers,
+		cache:   map[string][]*WorkerInfo{},
+		reasons: map[string]string{},
+	}
+}
+
+// match return the workers matched the selector, if no one matched, return the reason
+func (m *workerMatcher) match(selector string) ([]*WorkerInfo, string) {
+	if selector == "" {
+		return m.workers, ""
+	}
+	if matched, ok := m.cache[selector]; ok {
+		return matched, m.reasons[selector]
+	}
+
+	var matched []*WorkerInfo
+	selectors, err := data.PareSelectors(selector)
+	if err != nil {
+		m.reasons[selector] = fmt.Sprintf("node selector[%s] is invalid: %s", selector, err)
+	} else {
+		for _, w := range m.workers {
+			if data.MatchSelectors(selectors, w.Labels) {
+				matched = append(matched, w)
+			}
+		}
+		if len(matched) == 0 {
+			m.reasons[selector] = fmt.Sprintf("no alive worker matches node selector[%s]", selector)
+		}
+	}
+	m.cache[selector] = matched
+	return matched, m.reasons[selector]
+}
+
+// activeRunsLimiter used to limit the active instances of each dag according to its "MaxActiveRuns"
+type activeRunsLimiter struct {
+	// remaining quota of dags, negative means no limit
+	remaining map[string]int
+}
+
+func newActiveRunsLimiter() *activeRunsLimiter {
+	return &activeRunsLimiter{
+		remaining: map[string]int{},
+	}
+}
+
+// allow return if an instance of the dag can be dispatched, it does not consume the quota
+func (l *activeRunsLimiter) allow(dagId string) (bool, error) {
+	remaining, ok := l.remaining[dagId]
+	if !ok {
+		var err error
+		if remaining, err = l.initQuota(dagId); err != nil {
+			return false, err
+		}
+		l.remaining[dagId] = remaining
+	}
+	return remaining != 0, nil
+}
+
+// consume take a quota of the dag after its instance is dispatched
+func (l *activeRunsLimiter) consume(dagId string) {
+	if l.remaining[dagId] > 0 {
+		l.remaining[dagId]--
+	}
+}
+
+func (l *activeRunsLimiter) initQuota(dagId string) (int, error) {
+	dag, err := GetStore().GetDag(dagId)
+	if err != nil {
+		if errors.Is(err, data.ErrDataNotFound) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	if dag.MaxActiveRuns <= 0 {
+		return -1, nil
+	}
+
+	cnt, err := GetStore().CountDagInstance(&ListDagInstanceInput{
+		DagID: dagId,
+		Status: []entity.DagInstanceStatus{
+			entity.DagInstanceStatusScheduled,
+			entity.DagInstanceStatusRunning,
+			entity.DagInstanceStatusBlocked,
+			entity.DagInstanceStatusPaused,
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if remaining := dag.MaxActiveRuns - int(cnt); remaining > 0 {
+		return remaining, nil
+	}
+	return 0, nil
+}
@@ -14,16 +14,15 @@ import (
 
 func TestDefDispatcher_Do(t *testing.T) {
 	tests := []struct {
-		caseDesc              string
-		giveListRet           []*entity.DagInstance
-		giveListErr           error
-		giveAliveNodes        []string
-		giveAliveErr          error
-		giveBatchUpdateErr    error
-		wantErr               error
-		wantAliveNodeCalled   bool
-		wantBatchUpdateCalled bool
-		wantBatchUpdateInput  []*entity.DagInstance
+		caseDesc            string
+		giveListRet         []*entity.DagInstance
+		giveListErr         error
+		giveAliveNodes      []string
+		giveAliveErr        error
+		givePatchErr        error
+		wantErr             error
+		wantAliveNodeCalled bool
+		wantPatched         []*entity.DagInstance
 	}{
 		{
 			caseDesc: "sanity",
@@ -35,7 +34,7 @@ func TestDefDispatcher_Do(t *testing.T) {
 			},
 			giveAliveNodes:      []string{"worker-1", "worker-2", "worker-3"},
 			wantAliveNodeCalled: true,
-			wantBatchUpdateInput: []*entity.DagInstance{
+			wantPatched: []*entity.DagInstance{
 				{
 					Status: entity.DagInstanceStatusScheduled,
 					Worker: "worker-1",
@@ -53,7 +52,6 @@ func TestDefDispatcher_Do(t *testing.T) {
 					Worker: "worker-1",
 				},
 			},
-			wantBatchUpdateCalled: true,
 		},
 		{
 			caseDesc:    "list failed",
@@ -79,63 +77,74 @@ func TestDefDispatcher_Do(t *testing.T) {
 			wantAliveNodeCalled: true,
 		},
 		{
-			caseDesc:           "batch update failed",
-			giveListRet:        []*entity.DagInstance{{}},
-			giveAliveNodes:     []string{"node"},
-			giveBatchUpdateErr: fmt.Errorf("batch update failed"),
-			wantErr:            fmt.Errorf("batch update failed"),
-			wantBatchUpdateInput: []*entity.DagInstance{
+			caseDesc:       "patch failed",
+			giveListRet:    []*entity.DagInstance{{}},
+			giveAliveNodes: []string{"node"},
+			givePatchErr:   fmt.Errorf("patch failed"),
+			wantErr:        fmt.Errorf("patch failed"),
+			wantPatched: []*entity.DagInstance{
 				{Status: entity.DagInstanceStatusScheduled, Worker: "node"},
 			},
-			wantAliveNodeCalled:   true,
-			wantBatchUpdateCalled: true,
+			wantAliveNodeCalled: true,
+		},
+		{
+			caseDesc:       "canceled meanwhile",
+			giveListRet:    []*entity.DagInstance{{}, {}},
+			giveAliveNodes: []string{"node"},
+			givePatchErr:   fmt.Errorf("conflicted: %w", data.ErrDataConflicted),
+			wantPatched: []*entity.DagInstance{
+				{Status: entity.DagInstanceStatusScheduled, Worker: "node"},
+				{Status: entity.DagInstanceStatusScheduled, Worker: "node"},
+			},
+			wantAliveNodeCalled: true,
 		},
 	}
 
 	for _, tc := range tests {
-		calledList, calledAlive, calledBatch := false, false, false
+		calledList, calledAlive := false, false
+		var patched []*entity.DagInstance
 		litInput := &ListDagInstanceInput{
 			Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
+			SortBy: []string{"-priority", "createdAt"},
 			Limit:  1000,
 		}
-		d := NewDefDispatcher()
+		d := NewDefDispatcher(nil)
 		mStore := &MockStore{}
+		mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, nil)
+		mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
 		mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
 			calledList = true
 			assert.Equal(t, litInput, args.Get(0), tc.caseDesc)
 		}).Return(tc.giveListRet, tc.giveListErr)
-		mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
-			calledBatch = true
-			assert.Equal(t, tc.wantBatchUpdateInput, args.Get(0), tc.caseDesc)
-		}).Return(tc.giveBatchUpdateErr)
+		mStore.On("PatchDagInsIf", mock.Anything, &PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit}}, "Reason").Run(func(args mock.Arguments) {
+			patched = append(patched, args.Get(0).(*entity.DagInstance))
+		}).Return(tc.givePatchErr)
 		SetStore(mStore)
 
 		mKeeper := &MockKeeper{}
-		mKeeper.On("AliveNodes").Run(func(args mock.Arguments) {
+		mKeeper.On("AliveWorkers").Run(func(args mock.Arguments) {
 			calledAlive = true
-		}).Return(tc.giveAliveNodes, tc.giveAliveErr)
+		}).Return(toWorkers(tc.giveAliveNodes), tc.giveAliveErr)
 		SetKeeper(mKeeper)
 
 		err := d.Do()
 		assert.Equal(t, tc.wantErr, err, tc.caseDesc)
 		assert.True(t, calledList, tc.caseDesc)
 		assert.Equal(t, tc.wantAliveNodeCalled, calledAlive, tc.caseDesc)
-		assert.Equal(t, tc.wantBatchUpdateCalled, calledBatch, tc.caseDesc)
+		assert.Equal(t, tc.wantPatched, patched, tc.caseDesc)
 	}
 }
 
 func TestDefDispatcher_InitAndClose(t *testing.T) {
 	tests := []struct {
-		caseDesc              string
-		giveListRet           []*entity.DagInstance
-		giveListErr           error
-		giveAliveNodes        []string
-		giveAliveErr          error
-		giveBatchUpdateErr    error
-		wantAliveNodeCalled   bool
-		wantBatchUpdateCalled bool
-		wantLogCalled         bool
-		wantBatchUpdateInput  []*entity.DagInstance
+		caseDesc            string
+		giveListRet         []*entity.DagInstance
+		giveListErr         error
+		giveAliveNodes      []string
+		giveAliveErr        error
+		wantAliveNodeCalled bool
+		wantLogCalled       bool
+		wantPatched         []*entity.DagInstance
 	}{
 		{
 			caseDesc: "sanity",
@@ -144,13 +153,12 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 			},
 			giveAliveNodes:      []string{"node"},
 			wantAliveNodeCalled: true,
-			wantBatchUpdateInput: []*entity.DagInstance{
+			wantPatched: []*entity.DagInstance{
 				{
 					Status: entity.DagInstanceStatusScheduled,
 					Worker: "node",
 				},
 			},
-			wantBatchUpdateCalled: true,
 		},
 		{
 			caseDesc:      "list failed",
@@ -161,27 +169,33 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
-			calledList, calledAlive, calledBatch, calledLog := false, false, false, false
+			calledList, calledAlive, calledLog := false, false, false
+			var patched []*entity.DagInstance
 			litInput := &ListDagInstanceInput{
 				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusInit},
+				SortBy: []string{"-priority", "createdAt"},
 				Limit:  1000,
 			}
-			d := NewDefDispatcher()
+			d := NewDefDispatcher(nil)
 			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, nil)
+			mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
 			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
 				calledList = true
 				assert.Equal(t, litInput, args.Get(0), tc.caseDesc)
 			}).Return(tc.giveListRet, tc.giveListErr)
-			mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
-				calledBatch = true
-				assert.Equal(t, tc.wantBatchUpdateInput, args.Get(0), tc.caseDesc)
-			}).Return(tc.giveBatchUpdateErr)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+				// dispatcher runs every second, only check the first time
+				if patched == nil {
+					patched = append(patched, args.Get(0).(*entity.DagInstance))
+				}
+			}).Return(nil)
 			SetStore(mStore)
 
 			mKeeper := &MockKeeper{}
-			mKeeper.On("AliveNodes").Run(func(args mock.Arguments) {
+			mKeeper.On("AliveWorkers").Run(func(args mock.Arguments) {
 				calledAlive = true
-			}).Return(tc.giveAliveNodes, tc.giveAliveErr)
+			}).Return(toWorkers(tc.giveAliveNodes), tc.giveAliveErr)
 			SetKeeper(mKeeper)
 
 			mLogger := &log.MockLogger{}
@@ -195,8 +209,401 @@ func TestDefDispatcher_InitAndClose(t *testing.T) {
 			assert.True(t, calledList, tc.caseDesc)
 			assert.Equal(t, calledLog, tc.wantLogCalled, tc.caseDesc)
 			assert.Equal(t, tc.wantAliveNodeCalled, calledAlive, tc.caseDesc)
-			assert.Equal(t, tc.wantBatchUpdateCalled, calledBatch, tc.caseDesc)
+			assert.Equal(t, tc.wantPatched, patched, tc.caseDesc)
 		})
 	}
 	log.SetLogger(&log.StdoutLogger{})
 }
+
+func isListPendingInput(input *ListDagInstanceInput) bool {
+	return len(input.Status) == 1 && input.Status[0] == entity.DagInstanceStatusPending
+}
+
+func TestDefDispatcher_promotePendingDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveListRet  []*entity.DagInstance
+		giveListErr  error
+		givePatchErr map[string]error
+		wantErr      error
+		wantPatched  []*entity.DagInstance
+	}{
+		{
+			caseDesc: "sanity",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusPending, DagID: "dag"},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusPending, DagID: "dag"},
+			},
+			wantPatched: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusInit},
+			},
+		},
+		{
+			caseDesc:    "list failed",
+			giveListErr: fmt.Errorf("list failed"),
+			wantErr:     fmt.Errorf("list failed"),
+		},
+		{
+			caseDesc: "patch failed or conflicted",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusPending},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusPending},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, Status: entity.DagInstanceStatusPending},
+			},
+			givePatchErr: map[string]error{
+				"ins1": fmt.Errorf("patch failed"),
+				"ins2": fmt.Errorf("canceled: %w", data.ErrDataConflicted),
+			},
+			wantPatched: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "ins1"}, Status: entity.DagInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "ins2"}, Status: entity.DagInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "ins3"}, Status: entity.DagInstanceStatusInit},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched []*entity.DagInstance
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				input := args.Get(0).(*ListDagInstanceInput)
+				assert.Equal(t, []entity.DagInstanceStatus{entity.DagInstanceStatusPending}, input.Status)
+				assert.InDelta(t, time.Now().Unix(), input.RunAtEnd, 1)
+			}).Return(tc.giveListRet, tc.giveListErr)
+			mStore.On("PatchDagInsIf", mock.Anything, &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending},
+			}).Run(func(args mock.Arguments) {
+				patched = append(patched, args.Get(0).(*entity.DagInstance))
+			}).Return(func(dagIns *entity.DagInstance, cond *PatchDagInsCondition, fields ...string) error {
+				return tc.givePatchErr[dagIns.ID]
+			})
+			SetStore(mStore)
+
+			d := NewDefDispatcher(nil)
+			err := d.promotePendingDagIns()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatched, patched)
+		})
+	}
+}
+
+func assignAll(*entity.DagInstance) (bool, error) {
+	return true, nil
+}
+
+func TestDefDispatcher_listDispatchableDagIns(t *testing.T) {
+	newIns := func(id, dagId string) *entity.DagInstance {
+		return &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: id}, DagID: dagId}
+	}
+	tests := []struct {
+		caseDesc     string
+		giveDags     map[string]*entity.Dag
+		giveCounts   map[string]int64
+		giveListRets [][]*entity.DagInstance
+		giveGetErr   error
+		wantIDs      []string
+		wantErr      error
+		wantExcludes [][]string
+	}{
+		{
+			caseDesc: "no limit",
+			giveDags: map[string]*entity.Dag{"dag1": {}},
+			giveListRets: [][]*entity.DagInstance{
+				{newIns("1", "dag1"), newIns("2", "dag1")},
+			},
+			wantIDs:      []string{"1", "2"},
+			wantExcludes: [][]string{nil},
+		},
+		{
+			caseDesc: "limit with active runs",
+			giveDags: map[string]*entity.Dag{
+				"dag1": {MaxActiveRuns: 2},
+				"dag2": {MaxActiveRuns: 1},
+				"dag3": {},
+			},
+			giveCounts: map[string]int64{"dag1": 1, "dag2": 1},
+			giveListRets: [][]*entity.DagInstance{
+				{newIns("1", "dag1"), newIns("2", "dag2"), newIns("3", "dag1"), newIns("4", "dag3")},
+			},
+			wantIDs:      []string{"1", "4"},
+			wantExcludes: [][]string{nil},
+		},
+		{
+			caseDesc:     "dag not found",
+			giveGetErr:   data.ErrDataNotFound,
+			giveListRets: [][]*entity.DagInstance{{newIns("1", "dag1")}},
+			wantIDs:      []string{"1"},
+			wantExcludes: [][]string{nil},
+		},
+		{
+			caseDesc:     "get dag failed",
+			giveGetErr:   fmt.Errorf("get failed"),
+			giveListRets: [][]*entity.DagInstance{{newIns("1", "dag1")}},
+			wantErr:      fmt.Errorf("get failed"),
+			wantExcludes: [][]string{nil},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var excludes [][]string
+			listCnt := 0
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(func(input *ListDagInstanceInput) []*entity.DagInstance {
+				assert.Equal(t, []string{"-priority", "createdAt"}, input.SortBy)
+				excludes = append(excludes, input.ExcludeDagIDs)
+				ret := tc.giveListRets[listCnt]
+				listCnt++
+				return ret
+			}, nil)
+			mStore.On("GetDag", mock.Anything).Return(func(dagId string) *entity.Dag {
+				return tc.giveDags[dagId]
+			}, tc.giveGetErr)
+			mStore.On("CountDagInstance", mock.Anything).Return(func(input *ListDagInstanceInput) int64 {
+				assert.Equal(t, []entity.DagInstanceStatus{
+					entity.DagInstanceStatusScheduled,
+					entity.DagInstanceStatusRunning,
+					entity.DagInstanceStatusBlocked,
+					entity.DagInstanceStatusPaused,
+				}, input.Status)
+				return tc.giveCounts[input.DagID]
+			}, nil)
+			SetStore(mStore)
+
+			d := NewDefDispatcher(nil)
+			ret, err := d.listDispatchableDagIns(assignAll)
+			assert.Equal(t, tc.wantErr, err)
+			var ids []string
+			for _, ins := range ret {
+				ids = append(ids, ins.ID)
+			}
+			assert.Equal(t, tc.wantIDs, ids)
+			assert.Equal(t, tc.wantExcludes, excludes)
+		})
+	}
+}
+
+func TestDefDispatcher_listDispatchableDagIns_Relist(t *testing.T) {
+	firstBatch := []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "other-0"}, DagID: "other"},
+	}
+	for i := 1; i < dispatchBatchSize; i++ {
+		firstBatch = append(firstBatch, &entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: fmt.Sprintf("busy-%d", i)},
+			DagID:    "busy",
+		})
+	}
+	secondBatch := []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "other-1"}, DagID: "other"},
+	}
+
+	var excludes [][]string
+	var offsets []int64
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.Anything).Return(func(input *ListDagInstanceInput) []*entity.DagInstance {
+		excludes = append(excludes, input.ExcludeDagIDs)
+		offsets = append(offsets, input.Offset)
+		if len(input.ExcludeDagIDs) == 0 {
+			return firstBatch
+		}
+		return secondBatch
+	}, nil)
+	mStore.On("GetDag", "busy").Return(&entity.Dag{MaxActiveRuns: 1}, nil)
+	mStore.On("GetDag", "other").Return(&entity.Dag{}, nil)
+	mStore.On("CountDagInstance", mock.Anything).Return(int64(0), nil)
+	SetStore(mStore)
+
+	d := NewDefDispatcher(nil)
+	ret, err := d.listDispatchableDagIns(assignAll)
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.DagInstance{firstBatch[0], firstBatch[1], secondBatch[0]}, ret)
+	// only the saturated dag is excluded, the listed instances of the other dag are skipped by offset
+	assert.Equal(t, [][]string{nil, {"busy"}}, excludes)
+	assert.Equal(t, []int64{0, 1}, offsets)
+}
+
+func TestDefDispatcher_listDispatchableDagIns_Unassigned(t *testing.T) {
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.Anything).Return([]*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "unmatched"}, DagID: "dag"},
+		{BaseInfo: entity.BaseInfo{ID: "matched-1"}, DagID: "dag"},
+		{BaseInfo: entity.BaseInfo{ID: "matched-2"}, DagID: "dag"},
+	}, nil)
+	mStore.On("GetDag", "dag").Return(&entity.Dag{MaxActiveRuns: 1}, nil)
+	mStore.On("CountDagInstance", mock.Anything).Return(int64(0), nil)
+	SetStore(mStore)
+
+	var tried []string
+	d := NewDefDispatcher(nil)
+	ret, err := d.listDispatchableDagIns(func(dagIns *entity.DagInstance) (bool, error) {
+		tried = append(tried, dagIns.ID)
+		return dagIns.ID != "unmatched", nil
+	})
+	assert.NoError(t, err)
+	// the unassigned instance should not consume the quota
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, "matched-1", ret[0].ID)
+	assert.Equal(t, []string{"unmatched", "matched-1"}, tried)
+
+	_, err = d.listDispatchableDagIns(func(dagIns *entity.DagInstance) (bool, error) {
+		return false, fmt.Errorf("assign failed")
+	})
+	assert.Equal(t, fmt.Errorf("assign failed"), err)
+}
+
+func TestDefDispatcher_Do_WithLoad(t *testing.T) {
+	workers := []*WorkerInfo{
+		{Key: "busy", WorkerLoad: WorkerLoad{RunningTaskCnt: 8, ExecutorWorkerCnt: 10}},
+		{Key: "idle", WorkerLoad: WorkerLoad{RunningTaskCnt: 1, ExecutorWorkerCnt: 10}},
+	}
+	dagIns := []*entity.DagInstance{{}, {}, {}, {}, {}, {}, {}, {}}
+
+	var updated []*entity.DagInstance
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, nil)
+	mStore.On("ListDagInstance", mock.Anything).Return(dagIns, nil)
+	mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
+	mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+		updated = append(updated, args.Get(0).(*entity.DagInstance))
+	}).Return(nil)
+	SetStore(mStore)
+	mKeeper := &MockKeeper{}
+	mKeeper.On("AliveWorkers").Return(workers, nil)
+	SetKeeper(mKeeper)
+
+	err := NewDefDispatcher(nil).Do()
+	assert.NoError(t, err)
+	cnt := map[string]int{}
+	for _, ins := range updated {
+		cnt[ins.Worker]++
+	}
+	// idle worker should take instances until its load reach the busy one
+	assert.Equal(t, map[string]int{"busy": 1, "idle": 7}, cnt)
+	// the load of workers returned by keeper should not be changed
+	assert.Equal(t, 0, workers[0].QueuedTaskCnt)
+	assert.Equal(t, 0, workers[1].QueuedTaskCnt)
+}
+
+func TestDefDispatcher_Do_PromoteFailed(t *testing.T) {
+	var updated []*entity.DagInstance
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, fmt.Errorf("list failed"))
+	mStore.On("ListDagInstance", mock.Anything).Return([]*entity.DagInstance{{}}, nil)
+	mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
+	mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+		updated = append(updated, args.Get(0).(*entity.DagInstance))
+	}).Return(nil)
+	SetStore(mStore)
+	mKeeper := &MockKeeper{}
+	mKeeper.On("AliveWorkers").Return([]*WorkerInfo{{Key: "w1"}}, nil)
+	SetKeeper(mKeeper)
+
+	err := NewDefDispatcher(nil).Do()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(updated))
+}
+
+func toWorkers(keys []string) []*WorkerInfo {
+	if keys == nil {
+		return nil
+	}
+	workers := []*WorkerInfo{}
+	for _, key := range keys {
+		workers = append(workers, &WorkerInfo{Key: key})
+	}
+	return workers
+}
+
+func TestDefDispatcher_Do_NodeSelector(t *testing.T) {
+	workers := []*WorkerInfo{
+		{Key: "w1", Labels: map[string]string{"zone": "bj"}},
+		{Key: "w2", Labels: map[string]string{"zone": "sh", "gpu": "true"}},
+	}
+	dagIns := []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "any"}},
+		{BaseInfo: entity.BaseInfo{ID: "gpu"}, NodeSelector: "gpu=true", Reason: "old reason"},
+		{BaseInfo: entity.BaseInfo{ID: "bj"}, NodeSelector: "zone in (bj, gz)"},
+		{BaseInfo: entity.BaseInfo{ID: "none"}, NodeSelector: "zone=gz"},
+		{BaseInfo: entity.BaseInfo{ID: "marked"}, NodeSelector: "zone=gz",
+			Reason: "no alive worker matches node selector[zone=gz]"},
+		{BaseInfo: entity.BaseInfo{ID: "invalid"}, NodeSelector: "zone>gz"},
+	}
+
+	var updated []*entity.DagInstance
+	var patched []*entity.DagInstance
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, nil)
+	mStore.On("ListDagInstance", mock.Anything).Return(dagIns, nil)
+	mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
+	mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+		updated = append(updated, args.Get(0).(*entity.DagInstance))
+	}).Return(nil)
+	mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+		patched = append(patched, args.Get(0).(*entity.DagInstance))
+	}).Return(nil)
+	SetStore(mStore)
+	mKeeper := &MockKeeper{}
+	mKeeper.On("AliveWorkers").Return(workers, nil)
+	SetKeeper(mKeeper)
+
+	err := NewDefDispatcher(NewRoundRobinStrategy()).Do()
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "any"}, Status: entity.DagInstanceStatusScheduled, Worker: "w1"},
+		{BaseInfo: entity.BaseInfo{ID: "gpu"}, Status: entity.DagInstanceStatusScheduled, Worker: "w2"},
+		{BaseInfo: entity.BaseInfo{ID: "bj"}, Status: entity.DagInstanceStatusScheduled, Worker: "w1"},
+	}, updated)
+	assert.Equal(t, []*entity.DagInstance{
+		{BaseInfo: entity.BaseInfo{ID: "none"}, Reason: "no alive worker matches node selector[zone=gz]"},
+		{BaseInfo: entity.BaseInfo{ID: "invalid"},
+			Reason: "node selector[zone>gz] is invalid: selector string 'zone>gz' operator is not '=' or 'in'"},
+	}, patched)
+}
+
+func TestDefDispatcher_Do_Draining(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		giveWorkers []*WorkerInfo
+		wantErr     error
+		wantWorkers []string
+	}{
+		{
+			caseDesc: "skip draining worker",
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", Draining: true},
+				{Key: "w2"},
+			},
+			wantWorkers: []string{"w2", "w2"},
+		},
+		{
+			caseDesc: "all workers are draining",
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", Draining: true},
+			},
+			wantErr: data.ErrNoAliveNodes,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var updated []string
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.MatchedBy(isListPendingInput)).Return(nil, nil)
+			mStore.On("ListDagInstance", mock.Anything).Return([]*entity.DagInstance{{}, {}}, nil)
+			mStore.On("GetDag", mock.Anything).Return(&entity.Dag{}, nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+				updated = append(updated, args.Get(0).(*entity.DagInstance).Worker)
+			}).Return(nil)
+			SetStore(mStore)
+			mKeeper := &MockKeeper{}
+			mKeeper.On("AliveWorkers").Return(tc.giveWorkers, nil)
+			SetKeeper(mKeeper)
+
+			err := NewDefDispatcher(NewRoundRobinStrategy()).Do()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantWorkers, updated)
+		})
+	}
+}
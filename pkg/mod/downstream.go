@@ -0,0 +1,58 @@
+package mod
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+)
+
+// DownstreamDagInsID return the id of dag instance triggered by upstream, it is deterministic so that
+// a completion of upstream instance will not trigger the same dag twice, but the upstream instance
+// reopened by retry or rerun has a new generation, so it can trigger again when it completes
+func DownstreamDagInsID(upstream *entity.DagInstance, dagId string) string {
+	if upstream.Generation == 0 {
+		return fmt.Sprintf("upstream-%s-%s", upstream.ID, dagId)
+	}
+	return fmt.Sprintf("upstream-%s@%d-%s", upstream.ID, upstream.Generation, dagId)
+}
+
+// TriggerDownstreamDags run the dags which depend on the dag of the completed instance
+func TriggerDownstreamDags(upstream *entity.DagInstance) ([]*entity.DagInstance, error) {
+	dags, err := GetStore().ListDag(&ListDagInput{
+		Status:        []entity.DagStatus{entity.DagStatusNormal},
+		DependOnDagID: upstream.DagID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list downstream dags failed: %w", err)
+	}
+
+	var ret []*entity.DagInstance
+	for _, dag := range dags {
+		dagIns, err := dag.RunByUpstream(upstream)
+		if err != nil {
+			return nil, fmt.Errorf("run downstream dag[%s] failed: %w", dag.ID, err)
+		}
+		if dagIns == nil {
+			continue
+		}
+
+		dagIns.ID = DownstreamDagInsID(upstream, dag.ID)
+		if err := GetStore().CreateDagIns(dagIns); err != nil {
+			if errors.Is(err, data.ErrDataConflicted) {
+				continue
+			}
+			return nil, fmt.Errorf("create downstream dag instance failed: %w", err)
+		}
+		ret = append(ret, dagIns)
+	}
+	return ret, nil
+}
+
+func triggerDownstreamDags(upstream *entity.DagInstance) {
+	if _, err := TriggerDownstreamDags(upstream); err != nil {
+		log.Errorf("dag instance[%s] trigger downstream dags failed: %s", upstream.ID, err)
+	}
+}
@@ -0,0 +1,122 @@
+package mod
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDownstreamDagInsID(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveUpstream *entity.DagInstance
+		wantID       string
+	}{
+		{
+			caseDesc:     "first completion",
+			giveUpstream: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "up-ins"}},
+			wantID:       "upstream-up-ins-down",
+		},
+		{
+			caseDesc:     "reopened completion",
+			giveUpstream: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "up-ins"}, Generation: 2},
+			wantID:       "upstream-up-ins@2-down",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantID, DownstreamDagInsID(tc.giveUpstream, "down"))
+		})
+	}
+}
+
+func TestTriggerDownstreamDags(t *testing.T) {
+	upstream := &entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "up-ins"},
+		DagID:    "up",
+		Status:   entity.DagInstanceStatusSuccess,
+		ShareData: &entity.ShareData{Dict: map[string]string{
+			"output": "value",
+		}},
+	}
+	newDag := func(id string, dep entity.DagDependency) *entity.Dag {
+		return &entity.Dag{
+			BaseInfo:      entity.BaseInfo{ID: id},
+			Status:        entity.DagStatusNormal,
+			Vars:          entity.DagVars{"input": {}},
+			DependsOnDags: []entity.DagDependency{dep},
+		}
+	}
+
+	tests := []struct {
+		caseDesc      string
+		giveDags      []*entity.Dag
+		giveListErr   error
+		giveCreateErr map[string]error
+		wantCreated   []*entity.DagInstance
+		wantErr       error
+	}{
+		{
+			caseDesc: "normal",
+			giveDags: []*entity.Dag{
+				newDag("down1", entity.DagDependency{DagID: "up", VarsMapping: map[string]string{"input": "output"}}),
+				newDag("down2", entity.DagDependency{DagID: "up", On: []entity.DagInstanceStatus{entity.DagInstanceStatusFailed}}),
+				newDag("down3", entity.DagDependency{DagID: "up"}),
+			},
+			giveCreateErr: map[string]error{
+				"upstream-up-ins-down3": data.ErrDataConflicted,
+			},
+			wantCreated: []*entity.DagInstance{
+				{
+					BaseInfo:       entity.BaseInfo{ID: "upstream-up-ins-down1"},
+					DagID:          "down1",
+					Trigger:        entity.TriggerUpstream,
+					Vars:           entity.DagInstanceVars{"input": {Value: "value"}},
+					ShareData:      &entity.ShareData{},
+					Status:         entity.DagInstanceStatusInit,
+					ParentDagInsID: "up-ins",
+				},
+			},
+		},
+		{
+			caseDesc:    "list failed",
+			giveListErr: fmt.Errorf("list failed"),
+			wantErr:     fmt.Errorf("list downstream dags failed: %w", fmt.Errorf("list failed")),
+		},
+		{
+			caseDesc: "create failed",
+			giveDags: []*entity.Dag{
+				newDag("down1", entity.DagDependency{DagID: "up"}),
+			},
+			giveCreateErr: map[string]error{
+				"upstream-up-ins-down1": fmt.Errorf("create failed"),
+			},
+			wantErr: fmt.Errorf("create downstream dag instance failed: %w", fmt.Errorf("create failed")),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("ListDag", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, &ListDagInput{
+					Status:        []entity.DagStatus{entity.DagStatusNormal},
+					DependOnDagID: "up",
+				}, args.Get(0))
+			}).Return(tc.giveDags, tc.giveListErr)
+			mStore.On("CreateDagIns", mock.Anything).Return(func(dagIns *entity.DagInstance) error {
+				return tc.giveCreateErr[dagIns.ID]
+			})
+			SetStore(mStore)
+
+			created, err := TriggerDownstreamDags(upstream)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantCreated, created)
+		})
+	}
+}
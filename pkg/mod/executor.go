@@ -2,9 +2,11 @@ package mod
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/render"
@@ -21,13 +23,20 @@ import (
 const (
 	ReasonSuccessAfterCanceled = "success after canceled"
 	ReasonParentCancel         = "parent success but already be canceled"
+	ReasonTriggerRuleNotMeet   = "trigger rule can never be meet"
+	ReasonUpstreamFailed       = "upstream task failed or canceled"
+	ReasonCanceledInBackoff    = "canceled when waiting for retry"
 )
 
 // DefExecutor
 type DefExecutor struct {
+	// runningCnt must be the first field to keep 64-bit alignment for atomic operations
+	runningCnt int64
+
 	cancelMap    sync.Map
+	delayMap     sync.Map // retrying task instances which are waiting for backoff
 	workerNumber int
-	workerQueue  chan *entity.TaskInstance
+	workerQueue  *taskQueue
 	workerWg     sync.WaitGroup
 	initWg       sync.WaitGroup
 	timeout      time.Duration
@@ -49,7 +58,7 @@ type initPayload struct {
 func NewDefExecutor(timeout time.Duration, workers int) *DefExecutor {
 	return &DefExecutor{
 		workerNumber: workers,
-		workerQueue:  make(chan *entity.TaskInstance),
+		workerQueue:  newTaskQueue(workers),
 		timeout:      timeout,
 		initQueue:    make(chan *initPayload),
 		closeCh:      make(chan struct{}, 1),
@@ -69,7 +78,11 @@ func (e *DefExecutor) Init() {
 }
 
 func (e *DefExecutor) subWorkerQueue() {
-	for taskIns := range e.workerQueue {
+	for {
+		taskIns, ok := e.workerQueue.Pop()
+		if !ok {
+			break
+		}
 		e.workerDo(taskIns)
 	}
 	e.workerWg.Done()
@@ -82,6 +95,9 @@ func (e *DefExecutor) CancelTaskIns(taskInsIds []string) error {
 			e.cancelMap.Delete(id)
 			cancel.(context.CancelFunc)()
 		}
+		if cancel, ok := e.delayMap.Load(id); ok {
+			cancel.(context.CancelFunc)()
+		}
 	}
 
 	return nil
@@ -115,7 +131,17 @@ func (e *DefExecutor) initWorkerTask(dagIns *entity.DagInstance, taskIns *entity
 			return GetStore().PatchTaskIns(instance)
 		}, dagIns)
 	e.cancelMap.Store(taskIns.ID, cancel)
-	e.workerQueue <- taskIns
+	// high priority task will be executed first when workers are all busy
+	e.workerQueue.Push(taskIns, dagIns.Priority)
+}
+
+// Load return the current load of executor
+func (e *DefExecutor) Load() WorkerLoad {
+	return WorkerLoad{
+		RunningTaskCnt:    int(atomic.LoadInt64(&e.runningCnt)),
+		QueuedTaskCnt:     e.workerQueue.Len(),
+		ExecutorWorkerCnt: e.workerNumber,
+	}
 }
 
 // Push task to execute
@@ -140,6 +166,11 @@ func (e *DefExecutor) Push(dagIns *entity.DagInstance, taskIns *entity.TaskInsta
 		return
 	}
 
+	if delay := taskIns.RetryDelay(); delay > 0 {
+		e.delayPush(dagIns, taskIns, delay)
+		return
+	}
+
 	e.lock.RLock()
 	defer e.lock.RUnlock()
 
@@ -160,6 +191,42 @@ func (e *DefExecutor) Push(dagIns *entity.DagInstance, taskIns *entity.TaskInsta
 	}
 }
 
+// delayPush push the retrying task instance again after backoff,
+// the backoff is persisted in task instance so it still works after worker restarts
+func (e *DefExecutor) delayPush(dagIns *entity.DagInstance, taskIns *entity.TaskInstance, delay time.Duration) {
+	c, cancel := context.WithCancel(context.TODO())
+	if _, loaded := e.delayMap.LoadOrStore(taskIns.ID, cancel); loaded {
+		cancel()
+		return
+	}
+
+	go func() {
+		defer e.delayMap.Delete(taskIns.ID)
+		defer cancel()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-e.closeCh:
+		case <-timer.C:
+			taskIns.NextRetryAt = 0
+			e.Push(dagIns, taskIns)
+		case <-c.Done():
+			taskIns.Status = entity.TaskInstanceStatusCanceled
+			taskIns.Reason = ReasonCanceledInBackoff
+			if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+				BaseInfo: taskIns.BaseInfo,
+				Status:   taskIns.Status,
+				Reason:   taskIns.Reason,
+			}); err != nil {
+				log.Errorf("patch task[%s] failed: %s", taskIns.ID, err)
+				return
+			}
+			GetParser().EntryTaskIns(taskIns)
+		}
+	}()
+}
+
 func (e *DefExecutor) workerDo(taskIns *entity.TaskInstance) {
 	switch taskIns.Status {
 	case entity.TaskInstanceStatusInit, entity.TaskInstanceStatusEnding,
@@ -172,7 +239,9 @@ func (e *DefExecutor) workerDo(taskIns *entity.TaskInstance) {
 	goevent.Publish(&event.TaskBegin{
 		TaskIns: taskIns,
 	})
+	atomic.AddInt64(&e.runningCnt, 1)
 	err := e.runAction(taskIns)
+	atomic.AddInt64(&e.runningCnt, -1)
 	e.handleTaskError(taskIns, err)
 	e.cancelMap.Delete(taskIns.ID)
 	GetParser().EntryTaskIns(taskIns)
@@ -267,7 +336,7 @@ func (e *DefExecutor) Close() {
 
 	close(e.initQueue)
 	e.initWg.Wait()
-	close(e.workerQueue)
+	e.workerQueue.Close()
 	e.workerWg.Wait()
 }
 
@@ -278,9 +347,13 @@ func (e *DefExecutor) handleTaskError(taskIns *entity.TaskInstance, err error) {
 		setStatus := entity.TaskInstanceStatusFailed
 		if !ok {
 			setStatus = entity.TaskInstanceStatusCanceled
+		} else if taskIns.TryAutoRetry(failureKind(taskIns)) {
+			setStatus = entity.TaskInstanceStatusRetrying
+			taskIns.Trace(fmt.Sprintf("attempt %d failed: %s, retry at %s",
+				taskIns.Attempt, err, time.Unix(taskIns.NextRetryAt, 0).Format(time.RFC3339)),
+				run.TraceOpPersistAfterAction)
 		}
 
-		taskIns.Reason = err.Error()
 		if err := taskIns.SetStatus(setStatus); err != nil {
 			log.Error("set status failed",
 				"task_id", taskIns.ID,
@@ -300,3 +373,10 @@ func (e *DefExecutor) handleTaskError(taskIns *entity.TaskInstance, err error) {
 		log.Errorf("tag canceled task instance[%s] failed: %s", taskIns.ID, pErr)
 	}
 }
+
+func failureKind(taskIns *entity.TaskInstance) entity.RetryOn {
+	if taskIns.Context != nil && errors.Is(taskIns.Context.Context().Err(), context.DeadlineExceeded) {
+		return entity.RetryOnTimeout
+	}
+	return entity.RetryOnError
+}
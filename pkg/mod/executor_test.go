@@ -115,7 +115,7 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 		{
 			name: "sync trace",
 			giveExecutor: &DefExecutor{
-				workerQueue: make(chan *entity.TaskInstance, 1),
+				workerQueue: newTaskQueue(1),
 				timeout:     time.Second,
 				initQueue:   make(chan *initPayload, 1),
 			},
@@ -150,7 +150,7 @@ func TestDefExecutor_initWorkerTask(t *testing.T) {
 			name:         "after action trace",
 			giveTraceOpt: run.TraceOpPersistAfterAction,
 			giveExecutor: &DefExecutor{
-				workerQueue: make(chan *entity.TaskInstance, 1),
+				workerQueue: newTaskQueue(1),
 				timeout:     time.Second,
 				initQueue:   make(chan *initPayload, 1),
 			},
@@ -808,3 +808,104 @@ func TestDefExecutor_renderParams(t *testing.T) {
 		})
 	}
 }
+
+func TestDefExecutor_handleTaskErrorRetry(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		giveTaskIns *entity.TaskInstance
+		isCancel    bool
+		wantStatus  entity.TaskInstanceStatus
+		wantAttempt int
+	}{
+		{
+			caseDesc: "retry",
+			giveTaskIns: &entity.TaskInstance{
+				Retry: &entity.RetryPolicy{MaxAttempts: 2},
+			},
+			wantStatus:  entity.TaskInstanceStatusRetrying,
+			wantAttempt: 1,
+		},
+		{
+			caseDesc: "reach max attempts",
+			giveTaskIns: &entity.TaskInstance{
+				Retry:   &entity.RetryPolicy{MaxAttempts: 2},
+				Attempt: 1,
+			},
+			wantStatus:  entity.TaskInstanceStatusFailed,
+			wantAttempt: 1,
+		},
+		{
+			caseDesc: "not retry on error",
+			giveTaskIns: &entity.TaskInstance{
+				Retry: &entity.RetryPolicy{MaxAttempts: 2, RetryOn: []entity.RetryOn{entity.RetryOnTimeout}},
+			},
+			wantStatus: entity.TaskInstanceStatusFailed,
+		},
+		{
+			caseDesc: "canceled",
+			giveTaskIns: &entity.TaskInstance{
+				Retry: &entity.RetryPolicy{MaxAttempts: 2},
+			},
+			isCancel:   true,
+			wantStatus: entity.TaskInstanceStatusCanceled,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched *entity.TaskInstance
+			tc.giveTaskIns.Patch = func(instance *entity.TaskInstance) error {
+				patched = instance
+				return nil
+			}
+			e := &DefExecutor{}
+			if !tc.isCancel {
+				e.cancelMap.Store(tc.giveTaskIns.ID, nil)
+			}
+			e.handleTaskError(tc.giveTaskIns, fmt.Errorf("failed"))
+			assert.Equal(t, tc.wantStatus, patched.Status)
+			assert.Equal(t, tc.wantAttempt, patched.Attempt)
+			assert.Equal(t, "failed", patched.Reason)
+			if tc.wantStatus == entity.TaskInstanceStatusRetrying {
+				assert.NotZero(t, patched.NextRetryAt)
+				assert.Len(t, patched.Traces, 1)
+			}
+		})
+	}
+}
+
+func TestDefExecutor_delayPush(t *testing.T) {
+	mStore := &MockStore{}
+	mStore.On("PatchTaskIns", mock.Anything).Return(nil)
+	SetStore(mStore)
+	entryCh := make(chan *entity.TaskInstance, 1)
+	mParser := &MockParser{}
+	mParser.On("EntryTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+		entryCh <- args.Get(0).(*entity.TaskInstance)
+	})
+	SetParser(mParser)
+
+	e := NewDefExecutor(time.Minute, 1)
+	taskIns := &entity.TaskInstance{
+		BaseInfo:    entity.BaseInfo{ID: "task"},
+		Status:      entity.TaskInstanceStatusRetrying,
+		NextRetryAt: time.Now().Add(time.Hour).Unix(),
+	}
+	e.Push(&entity.DagInstance{ShareData: &entity.ShareData{}}, taskIns)
+	_, ok := e.delayMap.Load("task")
+	assert.True(t, ok)
+
+	assert.NoError(t, e.CancelTaskIns([]string{"task"}))
+	select {
+	case got := <-entryCh:
+		assert.Equal(t, entity.TaskInstanceStatusCanceled, got.Status)
+		assert.Equal(t, ReasonCanceledInBackoff, got.Reason)
+	case <-time.After(time.Second):
+		assert.Fail(t, "task instance is not canceled")
+	}
+	mStore.AssertCalled(t, "PatchTaskIns", &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task"},
+		Status:   entity.TaskInstanceStatusCanceled,
+		Reason:   ReasonCanceledInBackoff,
+	})
+}
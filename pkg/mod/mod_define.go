@@ -19,12 +19,24 @@ var (
 
 // Commander used to execute command
 type Commander interface {
-	RunDag(dagId string, specVar map[string]string) (*entity.DagInstance, error)
+	RunDag(dagId string, specVar map[string]string, ops ...RunOptSetter) (*entity.DagInstance, error)
+	RunDagAt(dagId string, specVar map[string]string, runAt time.Time, ops ...RunOptSetter) (*entity.DagInstance, error)
+	RunDagAfter(dagId string, specVar map[string]string, delay time.Duration, ops ...RunOptSetter) (*entity.DagInstance, error)
+	CancelPendingDagIns(dagInsId string) error
+	Backfill(dagId string, from, to time.Time) ([]*entity.DagInstance, error)
 	RetryDagIns(dagInsId string, ops ...CommandOptSetter) error
 	RetryTask(taskInsIds []string, ops ...CommandOptSetter) error
 	CancelTask(taskInsIds []string, ops ...CommandOptSetter) error
+	CancelDagIns(dagInsId, reason string, ops ...CommandOptSetter) error
+	RerunFrom(taskInsId string, includeDownstream bool, ops ...CommandOptSetter) error
+	MarkTask(taskInsIds []string, status entity.TaskInstanceStatus, reason string, ops ...CommandOptSetter) error
 	ContinueDagIns(dagInsId string, ops ...CommandOptSetter) error
 	ContinueTask(taskInsIds []string, ops ...CommandOptSetter) error
+	PauseDagIns(dagInsId string, ops ...CommandOptSetter) error
+	ResumeDagIns(dagInsId string, ops ...CommandOptSetter) error
+	ListDagVersion(dagId string) ([]*entity.DagVersion, error)
+	DiffDagVersion(dagId string, from, to int) (*entity.DagDiff, error)
+	RollbackDag(dagId string, version int) error
 }
 
 // CommandOption
@@ -39,6 +51,8 @@ type CommandOption struct {
 	// syncInterval is just work at sync mode, it is the interval of watch dag instance
 	// default is 500ms
 	syncInterval time.Duration
+	// operator is who execute the command, it is recorded when marking tasks
+	operator string
 }
 type CommandOptSetter func(opt *CommandOption)
 
@@ -70,6 +84,61 @@ var (
 			}
 		}
 	}
+	// CommOperator is who execute the command, it is recorded when marking tasks
+	CommOperator = func(operator string) CommandOptSetter {
+		return func(opt *CommandOption) {
+			opt.operator = operator
+		}
+	}
+)
+
+// RunOption
+type RunOption struct {
+	// trigger will be recorded on the dag instance, default is "manually"
+	trigger entity.Trigger
+	// runAt means the dag instance will be pending until this time
+	runAt time.Time
+	// idempotencyKey make the runs with same key within idempotencyWindow return the same dag instance
+	idempotencyKey    string
+	idempotencyWindow time.Duration
+	// priority will override the priority of dag if it is not nil
+	priority *int
+	// timeout will override the timeout of dag if it is not nil
+	timeout *time.Duration
+}
+type RunOptSetter func(opt *RunOption)
+
+var (
+	// RunTrigger set the trigger of dag instance, default is "manually"
+	RunTrigger = func(trigger entity.Trigger) RunOptSetter {
+		return func(opt *RunOption) {
+			if trigger != "" {
+				opt.trigger = trigger
+			}
+		}
+	}
+	// RunIdempotencyKey make the runs with same key return the existed dag instance
+	// if it is created within the window, zero window means 24h
+	RunIdempotencyKey = func(key string, window time.Duration) RunOptSetter {
+		return func(opt *RunOption) {
+			opt.idempotencyKey = key
+			if window > 0 {
+				opt.idempotencyWindow = window
+			}
+		}
+	}
+	// RunPriority override the priority of dag for this run, higher is first
+	RunPriority = func(priority int) RunOptSetter {
+		return func(opt *RunOption) {
+			opt.priority = &priority
+		}
+	}
+	// RunTimeout override the timeout of dag for this run, zero means no limit
+	RunTimeout = func(timeout time.Duration) RunOptSetter {
+		return func(opt *RunOption) {
+			opt.timeout = &timeout
+		}
+	}
 )
 
 // SetCommander
@@ -86,6 +155,27 @@ func GetCommander() Commander {
 type Executor interface {
 	Push(dagIns *entity.DagInstance, taskIns *entity.TaskInstance)
 	CancelTaskIns(taskInsIds []string) error
+	Load() WorkerLoad
+}
+
+// WorkerLoad is the load of a worker, it will be reported by keeper's heartbeat
+type WorkerLoad struct {
+	// RunningTaskCnt is the count of task instances which are executing
+	RunningTaskCnt int `json:"runningTaskCnt,omitempty" bson:"runningTaskCnt,omitempty"`
+	// QueuedTaskCnt is the count of task instances which are waiting for idle executor worker
+	QueuedTaskCnt int `json:"queuedTaskCnt,omitempty" bson:"queuedTaskCnt,omitempty"`
+	// ExecutorWorkerCnt is the configured count of executor workers
+	ExecutorWorkerCnt int `json:"executorWorkerCnt,omitempty" bson:"executorWorkerCnt,omitempty"`
+}
+
+// WorkerInfo is an alive worker and its load
+type WorkerInfo struct {
+	Key        string `json:"key" bson:"_id"`
+	WorkerLoad `bson:",inline"`
+	// Labels used to match the node selector of dag instance
+	Labels map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+	// Draining worker does not accept new dag instances
+	Draining bool `json:"draining,omitempty" bson:"draining,omitempty"`
 }
 
 // SetExecutor
@@ -111,6 +201,7 @@ type Store interface {
 	BatchCreatTaskIns(taskIns []*entity.TaskInstance) error
 	PatchTaskIns(taskIns *entity.TaskInstance) error
 	PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...string) error
+	PatchDagInsIf(dagIns *entity.DagInstance, cond *PatchDagInsCondition, mustsPatchFields ...string) error
 	UpdateDag(dagIns *entity.Dag) error
 	UpdateDagIns(dagIns *entity.DagInstance) error
 	UpdateTaskIns(taskIns *entity.TaskInstance) error
@@ -119,25 +210,55 @@ type Store interface {
 	GetTaskIns(taskIns string) (*entity.TaskInstance, error)
 	GetDag(dagId string) (*entity.Dag, error)
 	GetDagInstance(dagInsId string) (*entity.DagInstance, error)
+	GetDagSchedule(dagId string) (*entity.DagSchedule, error)
+	UpsertDagSchedule(schedule *entity.DagSchedule) error
+	GetDagVersion(dagId string, version int) (*entity.DagVersion, error)
+	ListDagVersion(dagId string) ([]*entity.DagVersion, error)
+	ListDag(input *ListDagInput) ([]*entity.Dag, error)
 	ListDagInstance(input *ListDagInstanceInput) ([]*entity.DagInstance, error)
+	CountDagInstance(input *ListDagInstanceInput) (int64, error)
 	ListTaskInstance(input *ListTaskInstanceInput) ([]*entity.TaskInstance, error)
 	Marshal(obj interface{}) ([]byte, error)
 	Unmarshal(bytes []byte, ptr interface{}) error
 }
 
+// PatchDagInsCondition is the precondition of patching dag instance, the empty fields are ignored
+type PatchDagInsCondition struct {
+	// Status means the stored status must be one of them
+	Status []entity.DagInstanceStatus
+	// Worker means the stored worker must be it
+	Worker string
+}
+
 // ListDagInput
 type ListDagInput struct {
+	Status []entity.DagStatus
+	// query dags which have cron expression
+	HasCron bool
+	// query dags which depend on the dag
+	DependOnDagID string
 }
 
 // ListDagInstanceInput
 type ListDagInstanceInput struct {
-	Worker     string
-	DagID      string
-	UpdatedEnd int64
-	Status     []entity.DagInstanceStatus
-	HasCmd     bool
-	Limit      int64
-	Offset     int64
+	Worker          string
+	DagID           string
+	ParentDagInsID  string
+	ParentTaskInsID string
+	ExcludeDagIDs   []string
+	ExcludeWorkers  []string
+	UpdatedEnd      int64
+	RunAtEnd        int64
+	DeadlineEnd     int64
+	SlaMissEnd      int64
+	Status          []entity.DagInstanceStatus
+	HasCmd          bool
+	Limit           int64
+	Offset          int64
+	// SortBy is the field names to sort, add prefix "-" means descending, such as "-createdAt"
+	SortBy []string
+	// IdempotencyKey should be used with DagID, because the key is unique within a dag
+	IdempotencyKey string
 }
 
 // ListTaskInstanceInput
@@ -146,7 +267,9 @@ type ListTaskInstanceInput struct {
 	DagInsID string
 	Status   []entity.TaskInstanceStatus
 	// query expired tasks(it will calculate task's timeout)
-	Expired     bool
+	Expired bool
+	// query the tasks which sla is due before it and not marked as missed
+	SlaMissEnd  int64
 	SelectField []string
 }
 
@@ -166,9 +289,12 @@ type Keeper interface {
 	IsLeader() bool
 	IsAlive(workerKey string) (bool, error)
 	AliveNodes() ([]string, error)
+	AliveWorkers() ([]*WorkerInfo, error)
 	WorkerKey() string
 	WorkerNumber() int
 	NewMutex(key string) DistributedMutex
+	// SetDraining mark the worker as draining, then dispatcher will not dispatch dag instances to it
+	SetDraining(draining bool)
 }
 
 // SetKeeper
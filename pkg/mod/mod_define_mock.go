@@ -54,6 +54,20 @@ func (_m *MockExecutor) Push(data *entity.DagInstance, taskIns *entity.TaskInsta
 	_m.Called(data, taskIns)
 }
 
+// Load provides a mock function with given fields:
+func (_m *MockExecutor) Load() WorkerLoad {
+	ret := _m.Called()
+
+	var r0 WorkerLoad
+	if rf, ok := ret.Get(0).(func() WorkerLoad); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(WorkerLoad)
+	}
+
+	return r0
+}
+
 // MockKeeper is an autogenerated mock type for the Keeper type
 type MockKeeper struct {
 	mock.Mock
@@ -82,6 +96,29 @@ func (_m *MockKeeper) AliveNodes() ([]string, error) {
 	return r0, r1
 }
 
+// AliveWorkers provides a mock function with given fields:
+func (_m *MockKeeper) AliveWorkers() ([]*WorkerInfo, error) {
+	ret := _m.Called()
+
+	var r0 []*WorkerInfo
+	if rf, ok := ret.Get(0).(func() []*WorkerInfo); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*WorkerInfo)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 func (_m *MockKeeper) IsAlive(workerKey string) (bool, error) {
 	ret := _m.Called(workerKey)
 	return ret.Bool(0), ret.Error(1)
@@ -150,6 +187,11 @@ func (_m *MockKeeper) NewMutex(key string) DistributedMutex {
 	return r0
 }
 
+// SetDraining provides a mock function with given fields: draining
+func (_m *MockKeeper) SetDraining(draining bool) {
+	_m.Called(draining)
+}
+
 // MockStore is an autogenerated mock type for the Store type
 type MockStore struct {
 	mock.Mock
@@ -299,6 +341,112 @@ func (_m *MockStore) GetTaskIns(taskIns string) (*entity.TaskInstance, error) {
 	return r0, r1
 }
 
+// GetDagSchedule provides a mock function with given fields: dagId
+func (_m *MockStore) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := _m.Called(dagId)
+
+	var r0 *entity.DagSchedule
+	if rf, ok := ret.Get(0).(func(string) *entity.DagSchedule); ok {
+		r0 = rf(dagId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*entity.DagSchedule)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(dagId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// UpsertDagSchedule provides a mock function with given fields: schedule
+func (_m *MockStore) UpsertDagSchedule(schedule *entity.DagSchedule) error {
+	ret := _m.Called(schedule)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*entity.DagSchedule) error); ok {
+		r0 = rf(schedule)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// GetDagVersion provides a mock function with given fields: dagId, version
+func (_m *MockStore) GetDagVersion(dagId string, version int) (*entity.DagVersion, error) {
+	ret := _m.Called(dagId, version)
+
+	var r0 *entity.DagVersion
+	if rf, ok := ret.Get(0).(func(string, int) *entity.DagVersion); ok {
+		r0 = rf(dagId, version)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*entity.DagVersion)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string, int) error); ok {
+		r1 = rf(dagId, version)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListDagVersion provides a mock function with given fields: dagId
+func (_m *MockStore) ListDagVersion(dagId string) ([]*entity.DagVersion, error) {
+	ret := _m.Called(dagId)
+
+	var r0 []*entity.DagVersion
+	if rf, ok := ret.Get(0).(func(string) []*entity.DagVersion); ok {
+		r0 = rf(dagId)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*entity.DagVersion)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(dagId)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// ListDag provides a mock function with given fields: input
+func (_m *MockStore) ListDag(input *ListDagInput) ([]*entity.Dag, error) {
+	ret := _m.Called(input)
+
+	var r0 []*entity.Dag
+	if rf, ok := ret.Get(0).(func(*ListDagInput) []*entity.Dag); ok {
+		r0 = rf(input)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]*entity.Dag)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*ListDagInput) error); ok {
+		r1 = rf(input)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ListDagInstance provides a mock function with given fields: input
 func (_m *MockStore) ListDagInstance(input *ListDagInstanceInput) ([]*entity.DagInstance, error) {
 	ret := _m.Called(input)
@@ -322,6 +470,27 @@ func (_m *MockStore) ListDagInstance(input *ListDagInstanceInput) ([]*entity.Dag
 	return r0, r1
 }
 
+// CountDagInstance provides a mock function with given fields: input
+func (_m *MockStore) CountDagInstance(input *ListDagInstanceInput) (int64, error) {
+	ret := _m.Called(input)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(*ListDagInstanceInput) int64); ok {
+		r0 = rf(input)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(*ListDagInstanceInput) error); ok {
+		r1 = rf(input)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // ListTaskInstance provides a mock function with given fields: input
 func (_m *MockStore) ListTaskInstance(input *ListTaskInstanceInput) ([]*entity.TaskInstance, error) {
 	ret := _m.Called(input)
@@ -380,6 +549,27 @@ func (_m *MockStore) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ..
 	return r0
 }
 
+// PatchDagInsIf provides a mock function with given fields: dagIns, cond, mustsPatchFields
+func (_m *MockStore) PatchDagInsIf(dagIns *entity.DagInstance, cond *PatchDagInsCondition, mustsPatchFields ...string) error {
+	_va := make([]interface{}, len(mustsPatchFields))
+	for _i := range mustsPatchFields {
+		_va[_i] = mustsPatchFields[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, dagIns, cond)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(*entity.DagInstance, *PatchDagInsCondition, ...string) error); ok {
+		r0 = rf(dagIns, cond, mustsPatchFields...)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // UpdateDagIns provides a mock function with given fields: dagIns
 func (_m *MockStore) UpdateDag(dag *entity.Dag) error {
 	ret := _m.Called(dag)
@@ -432,9 +622,10 @@ func (_m *MockStore) Unmarshal(bytes []byte, ptr interface{}) error {
 }
 
 type MockTaskInfoGetter struct {
-	ID     string
-	Depend []string
-	Status entity.TaskInstanceStatus
+	ID          string
+	Depend      []string
+	Status      entity.TaskInstanceStatus
+	TriggerRule entity.TriggerRule
 }
 
 // GetDepend provides a mock function with given fields:
@@ -456,3 +647,8 @@ func (_m *MockTaskInfoGetter) GetID() string {
 func (_m *MockTaskInfoGetter) GetStatus() entity.TaskInstanceStatus {
 	return _m.Status
 }
+
+// GetTriggerRule provides a mock function with given fields:
+func (_m *MockTaskInfoGetter) GetTriggerRule() entity.TriggerRule {
+	return _m.TriggerRule
+}
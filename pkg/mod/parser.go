@@ -1,38 +1,81 @@
 package mod
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
 	"github.com/shiningrush/fastflow/pkg/event"
 	"github.com/shiningrush/fastflow/pkg/log"
 	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/shiningrush/goevent"
 	"github.com/spaolacci/murmur3"
 )
 
+const (
+	ReasonHandedOff   = "handed off by draining worker"
+	ReasonInterrupted = "interrupted because the worker exited"
+)
+
+// InterruptedTaskPolicy decide what to do with the task instances which were running when their worker exited
+type InterruptedTaskPolicy string
+
+const (
+	// InterruptedTaskPolicyFail fail the task instance, it is still retried automatically if it has retry policy
+	InterruptedTaskPolicyFail InterruptedTaskPolicy = "fail"
+	// InterruptedTaskPolicyRetry execute the task instance again at once
+	InterruptedTaskPolicyRetry InterruptedTaskPolicy = "retry"
+	// InterruptedTaskPolicyResume treat the action as completed and resume the task instance at ending
+	InterruptedTaskPolicyResume InterruptedTaskPolicy = "resume"
+)
+
+// Validate
+func (p InterruptedTaskPolicy) Validate() error {
+	switch p {
+	case InterruptedTaskPolicyFail, InterruptedTaskPolicyRetry, InterruptedTaskPolicyResume:
+		return nil
+	}
+	return fmt.Errorf("interrupted task policy[%s] is invalid", p)
+}
+
+var (
+	drainCheckInterval = time.Second
+	handOffTimeout     = 5 * time.Second
+)
+
 // DefParser
 type DefParser struct {
 	workerNumber int
-	workerQueue  []chan *entity.TaskInstance
+	workerQueue  []*taskQueue
 	workerWg     sync.WaitGroup
 	taskTrees    sync.Map
+	pausedDagIns sync.Map
 	taskTimeout  time.Duration
+	draining     int32
+	// expiredTaskIns records the task instances canceled by expire command, they will be failed when they exit
+	expiredTaskIns sync.Map
+
+	interruptedPolicy InterruptedTaskPolicy
 
 	closeCh chan struct{}
 	lock    sync.RWMutex
 }
 
 // NewDefParser
-func NewDefParser(workerNumber int, taskTimeout time.Duration) *DefParser {
+func NewDefParser(workerNumber int, taskTimeout time.Duration, interruptedPolicy InterruptedTaskPolicy) *DefParser {
 	return &DefParser{
-		workerNumber: workerNumber,
-		workerWg:     sync.WaitGroup{},
-		closeCh:      make(chan struct{}),
-		taskTimeout:  taskTimeout,
+		workerNumber:      workerNumber,
+		workerWg:          sync.WaitGroup{},
+		closeCh:           make(chan struct{}),
+		taskTimeout:       taskTimeout,
+		interruptedPolicy: interruptedPolicy,
 	}
 }
 
@@ -45,9 +88,9 @@ func (p *DefParser) Init() {
 
 	for i := 0; i < p.workerNumber; i++ {
 		p.workerWg.Add(1)
-		ch := make(chan *entity.TaskInstance, 50)
-		p.workerQueue = append(p.workerQueue, ch)
-		go p.goWorker(ch)
+		q := newTaskQueue(50)
+		p.workerQueue = append(p.workerQueue, q)
+		go p.goWorker(q)
 	}
 	if err := p.initialRunningDagIns(); err != nil {
 		log.Fatalf("parser init dags failed: %s", err)
@@ -71,6 +114,11 @@ func (p *DefParser) startWatcher(do func() error) {
 }
 
 func (p *DefParser) watchScheduledDagIns() (err error) {
+	if p.isDraining() {
+		// scheduled dag instances will be handed off
+		return nil
+	}
+
 	start := time.Now()
 	e := &event.ParseScheduleDagInsCompleted{}
 	defer func() {
@@ -92,8 +140,13 @@ func (p *DefParser) watchScheduledDagIns() (err error) {
 		return
 	}
 	for i := range dagIns {
-		if err = p.parseScheduleDagIns(dagIns[i]); err != nil {
-			return
+		if pErr := p.parseScheduleDagIns(dagIns[i]); pErr != nil {
+			// the instance is canceled or taken over by others meanwhile,
+			// and a broken instance should not block the others
+			if !errors.Is(pErr, data.ErrDataConflicted) {
+				log.Errorf("parse scheduled dag instance[%s] failed: %s", dagIns[i].ID, pErr)
+			}
+			continue
 		}
 		p.InitialDagIns(dagIns[i])
 	}
@@ -122,8 +175,12 @@ func (p *DefParser) watchDagInsCmd() (err error) {
 	return nil
 }
 
-func (p *DefParser) goWorker(queue <-chan *entity.TaskInstance) {
-	for taskIns := range queue {
+func (p *DefParser) goWorker(queue *taskQueue) {
+	for {
+		taskIns, ok := queue.Pop()
+		if !ok {
+			break
+		}
 		if err := p.workerDo(taskIns); err != nil {
 			p.handleErr(fmt.Errorf("worker do failed: %w", err))
 		}
@@ -136,6 +193,7 @@ func (p *DefParser) initialRunningDagIns() error {
 		Worker: GetKeeper().WorkerKey(),
 		Status: []entity.DagInstanceStatus{
 			entity.DagInstanceStatusRunning,
+			entity.DagInstanceStatusPaused,
 		},
 	})
 	if err != nil {
@@ -143,11 +201,61 @@ func (p *DefParser) initialRunningDagIns() error {
 	}
 
 	for _, d := range dagIns {
+		// the task instances are interrupted if this worker restarted
+		if err := p.recoverInterruptedDagIns(d); err != nil {
+			return err
+		}
+		if d.Status == entity.DagInstanceStatusPaused {
+			// the tasks will be pushed by InitialDagIns when dag instance is resumed
+			p.pausedDagIns.Store(d.ID, struct{}{})
+			continue
+		}
 		p.InitialDagIns(d)
 	}
 	return nil
 }
 
+// recoverInterruptedDagIns recover the running task instances of the dag instance,
+// it is used when the worker starts to own a dag instance which was executed by an exited worker
+func (p *DefParser) recoverInterruptedDagIns(dagIns *entity.DagInstance) error {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+	})
+	if err != nil {
+		return err
+	}
+	return p.recoverInterruptedTaskIns(tasks)
+}
+
+// recoverInterruptedTaskIns change the running task instances by the interrupted task policy,
+// the worker executing them has exited, so nobody will complete them
+func (p *DefParser) recoverInterruptedTaskIns(tasks []*entity.TaskInstance) error {
+	for _, t := range tasks {
+		if t.Status != entity.TaskInstanceStatusRunning {
+			continue
+		}
+
+		t.Reason = ReasonInterrupted
+		switch p.interruptedPolicy {
+		case InterruptedTaskPolicyRetry:
+			t.Status = entity.TaskInstanceStatusRetrying
+			t.NextRetryAt = 0
+		case InterruptedTaskPolicyResume:
+			t.Status = entity.TaskInstanceStatusEnding
+		default:
+			t.Status = entity.TaskInstanceStatusFailed
+			if t.TryAutoRetry(entity.RetryOnError) {
+				t.Status = entity.TaskInstanceStatusRetrying
+			}
+		}
+		if err := GetStore().UpdateTaskIns(t); err != nil {
+			return fmt.Errorf("recover interrupted task instance[%s] failed: %w", t.ID, err)
+		}
+	}
+	return nil
+}
+
 // InitialDagIns
 func (p *DefParser) InitialDagIns(dagIns *entity.DagInstance) {
 	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
@@ -172,6 +280,19 @@ func (p *DefParser) InitialDagIns(dagIns *entity.DagInstance) {
 		DagIns: dagIns,
 		Root:   root,
 	}
+	// the worker may crash before skipping the unchosen branches, so we should check it again
+	for _, t := range tasks {
+		if t.Status == entity.TaskInstanceStatusSuccess && t.Branch != nil {
+			if _, err := p.skipUnchosenBranches(tree, t, tasks); err != nil {
+				log.Errorf("dag instance[%s] skip unchosen branches failed: %s", dagIns.ID, err)
+				return
+			}
+		}
+	}
+	if _, err := p.skipUnreachableTasks(tree); err != nil {
+		log.Errorf("dag instance[%s] skip unreachable tasks failed: %s", dagIns.ID, err)
+		return
+	}
 	executableTaskIds := tree.Root.GetExecutableTaskIds()
 	if len(executableTaskIds) == 0 {
 		sts, taskInsId := tree.Root.ComputeStatus()
@@ -194,14 +315,17 @@ func (p *DefParser) InitialDagIns(dagIns *entity.DagInstance) {
 			log.Errorf("patch dag instance[%s] failed: %s", dagIns.ID, err)
 			return
 		}
+		triggerDownstreamDags(dagIns)
 		return
 	}
 
 	p.taskTrees.Store(dagIns.ID, tree)
 	taskMap := getTasksMap(tasks)
+	var executables []*entity.TaskInstance
 	for _, tid := range executableTaskIds {
-		GetExecutor().Push(dagIns, taskMap[tid])
+		executables = append(executables, taskMap[tid])
 	}
+	p.pushTaskIns(tree, executables)
 }
 
 func getTasksMap(tasks []*entity.TaskInstance) map[string]*entity.TaskInstance {
@@ -213,14 +337,48 @@ func getTasksMap(tasks []*entity.TaskInstance) map[string]*entity.TaskInstance {
 }
 
 func (p *DefParser) executeNext(taskIns *entity.TaskInstance) error {
+	if p.isDraining() {
+		// the worker taking over the dag instance will continue it by InitialDagIns
+		return nil
+	}
+	_, expired := p.expiredTaskIns.Load(taskIns.ID)
+	if expired {
+		// the task instance entered by expire command is still running, keep it until its goroutine exits
+		if taskIns.Status != entity.TaskInstanceStatusRunning {
+			p.expiredTaskIns.Delete(taskIns.ID)
+		}
+		if err := failExpiredTaskIns(taskIns); err != nil {
+			return err
+		}
+	}
 	tree, ok := p.getTaskTree(taskIns.DagInsID)
 	if !ok {
+		if taskIns.Status == entity.TaskInstanceStatusCanceled || expired {
+			// the tree is deleted when the whole dag instance is canceled or failed by expired task
+			return nil
+		}
 		return fmt.Errorf("dag instance[%s] does not found task tree", taskIns.DagInsID)
 	}
+	var branchIds []string
+	if taskIns.Status == entity.TaskInstanceStatusSuccess && taskIns.Branch != nil {
+		var err error
+		if branchIds, err = p.skipUnchosenBranches(tree, taskIns, nil); err != nil {
+			return err
+		}
+	}
 	ids, find := tree.Root.GetNextTaskIds(taskIns)
 	if !find {
 		return fmt.Errorf("task instance[%s] does not found normal node", taskIns.ID)
 	}
+	ruleIds, err := p.skipUnreachableTasks(tree)
+	if err != nil {
+		return err
+	}
+	for _, id := range append(branchIds, ruleIds...) {
+		if !utils.StringsContain(ids, id) {
+			ids = append(ids, id)
+		}
+	}
 	// only the tasks which is not success has no next task ids
 	if len(ids) == 0 {
 		treeStatus, taskId := tree.Root.ComputeStatus()
@@ -228,6 +386,11 @@ func (p *DefParser) executeNext(taskIns *entity.TaskInstance) error {
 		case TreeStatusRunning:
 			return nil
 		case TreeStatusFailed:
+			if tree.DagIns.IsTimeout() {
+				// tasks are canceled by watch dog, keep the reason of timeout
+				tree.DagIns.Fail(tree.DagIns.TimeoutReason())
+				break
+			}
 			tree.DagIns.Fail(fmt.Sprintf("task[%s] failed or canceled", taskId))
 		case TreeStatusBlocked:
 			tree.DagIns.Block(fmt.Sprintf("task[%s] blocked", taskId))
@@ -237,34 +400,255 @@ func (p *DefParser) executeNext(taskIns *entity.TaskInstance) error {
 
 		// tree has already completed, delete from map
 		p.taskTrees.Delete(taskIns.DagInsID)
-		if err := GetStore().PatchDagIns(&entity.DagInstance{
+		p.pausedDagIns.Delete(taskIns.DagInsID)
+		// the instance may be canceled meanwhile, its final status should not be overwritten
+		err := GetStore().PatchDagInsIf(&entity.DagInstance{
 			BaseInfo: entity.BaseInfo{ID: tree.DagIns.ID},
 			Status:   tree.DagIns.Status,
 			Reason:   tree.DagIns.Reason,
-		}); err != nil {
+		}, &PatchDagInsCondition{Status: unfinishedDagInsStatus})
+		if errors.Is(err, data.ErrDataConflicted) {
+			log.Infof("dag instance[%s] has already completed, ignore the status of its tree", tree.DagIns.ID)
+			return nil
+		}
+		if err != nil {
 			return err
 		}
+		triggerDownstreamDags(tree.DagIns)
 
 		return nil
 	}
 	if taskIns.Reason == ReasonSuccessAfterCanceled {
 		return p.cancelChildTasks(tree, ids)
 	}
+	if _, paused := p.pausedDagIns.Load(taskIns.DagInsID); paused {
+		// the tasks will be pushed by InitialDagIns when dag instance is resumed
+		return nil
+	}
+
+	return p.pushTasks(tree, ids)
+}
+
+// skipUnchosenBranches skip the downstream tasks which are not chosen by branch task,
+// it returns the task instance ids which become executable because of skipping
+func (p *DefParser) skipUnchosenBranches(
+	tree *TaskTree, branchTaskIns *entity.TaskInstance, tasks []*entity.TaskInstance) ([]string, error) {
+	if tasks == nil {
+		var err error
+		tasks, err = GetStore().ListTaskInstance(&ListTaskInstanceInput{
+			DagInsID: tree.DagIns.ID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var chosenIds []string
+	for _, t := range tasks {
+		if utils.StringsContain(branchTaskIns.Branch.ChosenTaskIDs, t.TaskID) {
+			chosenIds = append(chosenIds, t.ID)
+		}
+	}
+	skipped, executable := tree.Root.SkipUnchosenBranches(branchTaskIns.ID, chosenIds)
+	for _, id := range skipped {
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			Status:   entity.TaskInstanceStatusSkipped,
+			Reason:   fmt.Sprintf("branch is not chosen by task[%s]", branchTaskIns.TaskID),
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return executable, nil
+}
 
-	return p.pushTasks(tree.DagIns, ids)
+// skipUnreachableTasks skip or cancel the tasks whose trigger rule can never be meet,
+// it returns the task instance ids which become executable because of them
+func (p *DefParser) skipUnreachableTasks(tree *TaskTree) ([]string, error) {
+	skipped, canceled, executable := tree.Root.SkipUnreachableTasks()
+	for _, id := range skipped {
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			Status:   entity.TaskInstanceStatusSkipped,
+			Reason:   ReasonTriggerRuleNotMeet,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, id := range canceled {
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			Status:   entity.TaskInstanceStatusCanceled,
+			Reason:   ReasonUpstreamFailed,
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return executable, nil
 }
 
-func (p *DefParser) pushTasks(dagIns *entity.DagInstance, ids []string) error {
+func (p *DefParser) pushTasks(tree *TaskTree, ids []string) error {
 	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
 		IDs: ids,
 	})
 	if err != nil {
 		return err
 	}
+	p.pushTaskIns(tree, tasks)
+	return nil
+}
+
+// pushTaskIns push task instances to executor, the for-each tasks are handled by parser itself
+func (p *DefParser) pushTaskIns(tree *TaskTree, tasks []*entity.TaskInstance) {
+	if p.isDraining() {
+		return
+	}
+	for _, t := range tasks {
+		if t.ForEach == nil {
+			GetExecutor().Push(tree.DagIns, t)
+			continue
+		}
+		if err := p.parseForEachTask(tree, t); err != nil {
+			log.Errorf("dag instance[%s] parse for-each task[%s] failed: %s", tree.DagIns.ID, t.ID, err)
+		}
+	}
+}
+
+// parseForEachTask expand the for-each task when it is executable at first time,
+// and the next time it is executable means the mapped task instances are completed,
+// its status is derived from them.
+func (p *DefParser) parseForEachTask(tree *TaskTree, taskIns *entity.TaskInstance) error {
+	if taskIns.Expanded {
+		status, reason, err := mappedTasksResult(taskIns)
+		if err != nil {
+			return err
+		}
+		if status == "" {
+			// it will be executable again when the rest are completed
+			return nil
+		}
+		return p.completeForEachTask(taskIns, status, reason)
+	}
+
+	isActive, err := taskIns.DoPreCheck(tree.DagIns)
+	if err != nil {
+		return err
+	}
+	if isActive {
+		return p.completeForEachTask(taskIns, taskIns.Status, "")
+	}
+
+	items, err := taskIns.ForEach.Items(tree.DagIns)
+	if err != nil {
+		return p.completeForEachTask(taskIns, entity.TaskInstanceStatusFailed, err.Error())
+	}
+	if len(items) == 0 {
+		return p.completeForEachTask(taskIns, entity.TaskInstanceStatusSuccess, "no items to expand")
+	}
+	return p.expandForEachTask(tree, taskIns, items)
+}
+
+// mappedTasksResult return the status of for-each task according to its mapped task instances,
+// the status is empty if some of them are not completed
+func mappedTasksResult(taskIns *entity.TaskInstance) (entity.TaskInstanceStatus, string, error) {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: taskIns.DagInsID,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	status, reason := entity.TaskInstanceStatusSuccess, ""
 	for _, t := range tasks {
-		GetExecutor().Push(dagIns, t)
+		if t.MappedFrom != taskIns.TaskID {
+			continue
+		}
+		switch t.Status {
+		case entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped:
+		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
+			if status == entity.TaskInstanceStatusSuccess {
+				status = entity.TaskInstanceStatusFailed
+				reason = fmt.Sprintf("mapped task[%s] is %s", t.TaskID, t.Status)
+			}
+		default:
+			return "", "", nil
+		}
 	}
+	return status, reason, nil
+}
 
+func (p *DefParser) completeForEachTask(taskIns *entity.TaskInstance, status entity.TaskInstanceStatus, reason string) error {
+	taskIns.Status = status
+	taskIns.Reason = reason
+	if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: taskIns.BaseInfo,
+		Status:   taskIns.Status,
+		Reason:   taskIns.Reason,
+	}); err != nil {
+		return err
+	}
+	p.EntryTaskIns(taskIns)
+	return nil
+}
+
+func (p *DefParser) expandForEachTask(tree *TaskTree, taskIns *entity.TaskInstance, items []string) error {
+	mapped, err := taskIns.Expand(items)
+	if err != nil {
+		return p.completeForEachTask(taskIns, entity.TaskInstanceStatusFailed, err.Error())
+	}
+
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: tree.DagIns.ID,
+	})
+	if err != nil {
+		return err
+	}
+	// some mapped task instances may be created before worker crashed
+	existed := map[string]bool{}
+	for _, t := range tasks {
+		existed[t.TaskID] = true
+	}
+	var needCreate []*entity.TaskInstance
+	for _, t := range mapped {
+		if !existed[t.TaskID] {
+			needCreate = append(needCreate, t)
+		}
+	}
+	if len(needCreate) > 0 {
+		if err := GetStore().BatchCreatTaskIns(needCreate); err != nil {
+			return err
+		}
+	}
+	if err := GetStore().UpdateTaskIns(taskIns); err != nil {
+		return err
+	}
+
+	tasks, err = GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: tree.DagIns.ID,
+	})
+	if err != nil {
+		return err
+	}
+	root, err := BuildRootNode(MapTaskInsToGetter(tasks))
+	if err != nil {
+		return fmt.Errorf("build task tree failed: %w", err)
+	}
+	tree.Root = root
+
+	if p.isDraining() {
+		// the worker taking over the dag instance will push the mapped tasks by InitialDagIns
+		return nil
+	}
+	if _, paused := p.pausedDagIns.Load(tree.DagIns.ID); paused {
+		// the mapped tasks will be pushed by InitialDagIns when dag instance is resumed
+		return nil
+	}
+	taskMap := getTasksMap(tasks)
+	for _, tid := range root.GetExecutableTaskIds() {
+		if t := taskMap[tid]; t.MappedFrom == taskIns.TaskID {
+			GetExecutor().Push(tree.DagIns, t)
+		}
+	}
 	return nil
 }
 
@@ -295,7 +679,11 @@ func (p *DefParser) cancelChildTasks(tree *TaskTree, ids []string) error {
 		return nil
 	}
 	tree.DagIns.Fail(fmt.Sprintf("task instance[%s] canceled", strings.Join(ids, ",")))
-	return GetStore().PatchDagIns(tree.DagIns)
+	if err := GetStore().PatchDagIns(tree.DagIns); err != nil {
+		return err
+	}
+	triggerDownstreamDags(tree.DagIns)
+	return nil
 }
 
 func (p *DefParser) getTaskTree(dagInsId string) (*TaskTree, bool) {
@@ -330,27 +718,50 @@ func (p *DefParser) sendToChannel(mod int, taskIns *entity.TaskInstance, newRout
 	default:
 	}
 
+	// high priority task will be parsed first when queue is saturated
+	priority := p.taskInsPriority(taskIns)
 	if !newRoutineWhenFull {
-		p.workerQueue[mod] <- taskIns
+		p.workerQueue[mod].Push(taskIns, priority)
 		return
 	}
 
-	select {
 	// ensure that same dag instance handled by same worker, so avoid parallel writing
-	case p.workerQueue[mod] <- taskIns:
-	// if queue is full, we can do it in a new goroutine to prevent deadlock
-	default:
+	if !p.workerQueue[mod].TryPush(taskIns, priority) {
+		// if queue is full, we can do it in a new goroutine to prevent deadlock
 		go p.sendToChannel(mod, taskIns, false)
 	}
 }
 
+func (p *DefParser) taskInsPriority(taskIns *entity.TaskInstance) int {
+	if taskIns.RelatedDagInstance != nil {
+		return taskIns.RelatedDagInstance.Priority
+	}
+	if tree, ok := p.getTaskTree(taskIns.DagInsID); ok {
+		return tree.DagIns.Priority
+	}
+	return 0
+}
+
 func (p *DefParser) workerDo(taskIns *entity.TaskInstance) error {
 	return p.executeNext(taskIns)
 }
 
+// getInsDag return the dag version which the instance is pinned to,
+// the instances created before versioning use the latest dag
+func getInsDag(dagIns *entity.DagInstance) (*entity.Dag, error) {
+	if dagIns.DagVersion == 0 {
+		return GetStore().GetDag(dagIns.DagID)
+	}
+	ver, err := GetStore().GetDagVersion(dagIns.DagID, dagIns.DagVersion)
+	if err != nil {
+		return nil, fmt.Errorf("get version %d of dag[%s] failed: %w", dagIns.DagVersion, dagIns.DagID, err)
+	}
+	return &ver.Dag, nil
+}
+
 func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 	if dagIns.Status == entity.DagInstanceStatusScheduled {
-		dag, err := GetStore().GetDag(dagIns.DagID)
+		dag, err := getInsDag(dagIns)
 		if err != nil {
 			return err
 		}
@@ -381,6 +792,9 @@ func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 					if dag.Tasks[i].TimeoutSecs == 0 {
 						dag.Tasks[i].TimeoutSecs = int(p.taskTimeout.Seconds())
 					}
+					if dag.Tasks[i].Retry == nil {
+						dag.Tasks[i].Retry = dag.Retry
+					}
 					needInitTaskIns = append(needInitTaskIns, entity.NewTaskInstance(dagIns.ID, dag.Tasks[i]))
 				}
 			}
@@ -388,12 +802,21 @@ func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 				return err
 			}
 		}
+		// the dag instance may be failed over from a dead worker
+		if err := p.recoverInterruptedTaskIns(tasks); err != nil {
+			return err
+		}
 
 		dagIns.Run()
-		if err := GetStore().PatchDagIns(&entity.DagInstance{
+		if err := GetStore().PatchDagInsIf(&entity.DagInstance{
 			BaseInfo: dagIns.BaseInfo,
 			Status:   dagIns.Status,
 			Reason:   dagIns.Reason,
+			Deadline: dagIns.Deadline,
+			SlaDueAt: dagIns.SlaDueAt,
+		}, &PatchDagInsCondition{
+			Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
+			Worker: dagIns.Worker,
 		}, "Reason"); err != nil {
 			return err
 		}
@@ -403,9 +826,12 @@ func (p *DefParser) parseScheduleDagIns(dagIns *entity.DagInstance) error {
 
 func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 	if dagIns.Cmd != nil {
+		needInitial := false
 		switch dagIns.Cmd.Name {
 		case entity.CommandNameRetry:
-			err = p.loopTaskThenInitialDagIns(
+			// retried instance has a new deadline
+			dagIns.Deadline = 0
+			needInitial, err = p.loopTaskIns(
 				dagIns,
 				[]entity.TaskInstanceStatus{entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled},
 				func(t *entity.TaskInstance) bool {
@@ -416,6 +842,52 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 
 					t.Status = entity.TaskInstanceStatusRetrying
 					t.Reason = ""
+					// manual retry is executed immediately and starts a new round of automatic retries
+					t.Attempt = 0
+					t.NextRetryAt = 0
+					return true
+				})
+			if err != nil {
+				return
+			}
+		case entity.CommandNameRerun:
+			// rerun instance has a new deadline
+			dagIns.Deadline = 0
+			needInitial, err = p.loopTaskIns(
+				dagIns,
+				[]entity.TaskInstanceStatus{
+					entity.TaskInstanceStatusSuccess,
+					entity.TaskInstanceStatusFailed,
+					entity.TaskInstanceStatusCanceled,
+					entity.TaskInstanceStatusSkipped,
+				},
+				func(t *entity.TaskInstance) bool {
+					t.Rerun()
+					return true
+				})
+			if err != nil {
+				return
+			}
+		case entity.CommandNameMark:
+			if dagIns.Cmd.Mark == nil {
+				log.Errorf("command[%s] has no mark, ignore it", dagIns.Cmd.Name)
+				break
+			}
+			needInitial, err = p.loopTaskIns(
+				dagIns,
+				[]entity.TaskInstanceStatus{
+					entity.TaskInstanceStatusFailed,
+					entity.TaskInstanceStatusCanceled,
+					entity.TaskInstanceStatusBlocked,
+				},
+				func(t *entity.TaskInstance) bool {
+					if t.Status != entity.TaskInstanceStatusFailed &&
+						t.Status != entity.TaskInstanceStatusCanceled &&
+						t.Status != entity.TaskInstanceStatusBlocked {
+						return false
+					}
+
+					t.MarkAs(dagIns.Cmd.Mark)
 					return true
 				})
 			if err != nil {
@@ -425,8 +897,39 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 			if err := GetExecutor().CancelTaskIns(dagIns.Cmd.TargetTaskInsIDs); err != nil {
 				return err
 			}
+		case entity.CommandNameExpire:
+			if err := p.expireTaskIns(dagIns.Cmd.TargetTaskInsIDs); err != nil {
+				return err
+			}
+		case entity.CommandNameCancelDagIns:
+			// the tree will never complete after its tasks are canceled, so delete it at once
+			p.taskTrees.Delete(dagIns.ID)
+			p.pausedDagIns.Delete(dagIns.ID)
+			var ids []string
+			ids, err = cancelUnfinishedTaskIns(dagIns)
+			if err != nil {
+				return
+			}
+			if err := GetExecutor().CancelTaskIns(ids); err != nil {
+				return err
+			}
+			triggerDownstreamDags(dagIns)
+		case entity.CommandNamePause:
+			p.pausedDagIns.Store(dagIns.ID, struct{}{})
+			dagIns.Status = entity.DagInstanceStatusPaused
+		case entity.CommandNameResume:
+			p.pausedDagIns.Delete(dagIns.ID)
+			// no tree means the instance is paused before the worker restarted or took it over,
+			// so the running tasks are left by an exited worker
+			if _, ok := p.taskTrees.Load(dagIns.ID); !ok {
+				if err = p.recoverInterruptedDagIns(dagIns); err != nil {
+					return
+				}
+			}
+			dagIns.Run()
+			needInitial = true
 		case entity.CommandNameContinue:
-			err = p.loopTaskThenInitialDagIns(
+			needInitial, err = p.loopTaskIns(
 				dagIns,
 				[]entity.TaskInstanceStatus{entity.TaskInstanceStatusBlocked},
 				func(t *entity.TaskInstance) bool {
@@ -447,28 +950,64 @@ func (p *DefParser) parseCmd(dagIns *entity.DagInstance) (err error) {
 
 		dagIns.Cmd = nil
 		if err := GetStore().PatchDagIns(&entity.DagInstance{
-			BaseInfo: dagIns.BaseInfo,
-			Status:   dagIns.Status,
-			Cmd:      dagIns.Cmd,
-			Reason:   dagIns.Reason,
+			BaseInfo:   dagIns.BaseInfo,
+			Status:     dagIns.Status,
+			Cmd:        dagIns.Cmd,
+			Reason:     dagIns.Reason,
+			Deadline:   dagIns.Deadline,
+			SlaDueAt:   dagIns.SlaDueAt,
+			Generation: dagIns.Generation,
 		}, "Cmd", "Reason"); err != nil {
 			return err
 		}
+		// push tasks after the running status and generation are saved,
+		// otherwise the final patch of a fast task will be conflicted with them
+		if needInitial {
+			p.InitialDagIns(dagIns)
+		}
 	}
 	return nil
 }
 
-func (p *DefParser) loopTaskThenInitialDagIns(
-	dagIns *entity.DagInstance,
-	status []entity.TaskInstanceStatus,
-	loopFunc func(*entity.TaskInstance) bool) (err error) {
+// expireTaskIns cancel the expired task instances, they are failed when their goroutines exit.
+// If the command comes again, the goroutines ignore the cancellation, then fail them directly.
+func (p *DefParser) expireTaskIns(taskInsIds []string) error {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		IDs:    taskInsIds,
+		Status: []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+	})
+	if err != nil {
+		return err
+	}
 
-	hasAnyTaskChanged := false
-	defer func() {
-		if err == nil && hasAnyTaskChanged {
-			p.InitialDagIns(dagIns)
+	var cancelIds []string
+	for _, t := range tasks {
+		if _, loaded := p.expiredTaskIns.LoadOrStore(t.ID, struct{}{}); !loaded {
+			cancelIds = append(cancelIds, t.ID)
+			continue
 		}
-	}()
+		p.EntryTaskIns(t)
+	}
+	return GetExecutor().CancelTaskIns(cancelIds)
+}
+
+// failExpiredTaskIns fail the task instance by the reason of watch dog
+func failExpiredTaskIns(taskIns *entity.TaskInstance) error {
+	taskIns.Status = entity.TaskInstanceStatusFailed
+	taskIns.Reason = DefFailedReason
+	return GetStore().PatchTaskIns(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: taskIns.ID},
+		Status:   taskIns.Status,
+		Reason:   taskIns.Reason,
+	})
+}
+
+// loopTaskIns update the task instances changed by loopFunc and run the dag instance,
+// it returns true if any task instance is changed, then the dag instance should be initialed again
+func (p *DefParser) loopTaskIns(
+	dagIns *entity.DagInstance,
+	status []entity.TaskInstanceStatus,
+	loopFunc func(*entity.TaskInstance) bool) (bool, error) {
 
 	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
 		DagInsID: dagIns.ID,
@@ -476,21 +1015,211 @@ func (p *DefParser) loopTaskThenInitialDagIns(
 		Status:   status,
 	})
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	hasAnyTaskChanged := false
 	for _, t := range taskIns {
 		if taskChanged := loopFunc(t); !taskChanged {
 			continue
 		}
 
 		if err := GetStore().UpdateTaskIns(t); err != nil {
-			return err
+			return false, err
 		}
 		hasAnyTaskChanged = true
 	}
+	if hasAnyTaskChanged {
+		if err := resetUpstreamFailedTaskIns(dagIns); err != nil {
+			return false, err
+		}
+	}
+	// the finished instance is reopened, it will trigger downstream dags again when it completes
+	if dagIns.IsTerminal() {
+		dagIns.Generation++
+	}
 	dagIns.Run()
-	return
+	return hasAnyTaskChanged, nil
+}
+
+// resetUpstreamFailedTaskIns reset the task instances canceled by upstream failure to init,
+// because their upstream tasks may be retried or marked, the ones still unreachable will be canceled again
+func resetUpstreamFailedTaskIns(dagIns *entity.DagInstance) error {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusCanceled},
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		if t.Reason != ReasonUpstreamFailed {
+			continue
+		}
+		t.Status = entity.TaskInstanceStatusInit
+		t.Reason = ""
+		if err := GetStore().UpdateTaskIns(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drain stop parsing scheduled dag instances and pushing task instances, wait for the executing task instances
+// until ctx is done, then hand the unfinished dag instances of this worker over to other workers.
+// It returns the error of ctx if the task instances do not complete in time, they are canceled and will be executed again.
+func (p *DefParser) Drain(ctx context.Context) error {
+	atomic.StoreInt32(&p.draining, 1)
+	waitErr := waitExecutorIdle(ctx)
+
+	handOffCtx, cancel := context.WithTimeout(context.Background(), handOffTimeout)
+	defer cancel()
+	if err := p.handOff(handOffCtx); err != nil {
+		return fmt.Errorf("hand off dag instances failed: %w", err)
+	}
+	return waitErr
+}
+
+func (p *DefParser) isDraining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// handOff reset the scheduled and running dag instances to init, so that dispatcher will dispatch them to other workers,
+// the blocked and paused ones are handed to other workers directly to keep their status
+func (p *DefParser) handOff(ctx context.Context) error {
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Worker: GetKeeper().WorkerKey(),
+		Status: []entity.DagInstanceStatus{
+			entity.DagInstanceStatusScheduled,
+			entity.DagInstanceStatusRunning,
+			entity.DagInstanceStatusBlocked,
+			entity.DagInstanceStatusPaused,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var taskInsIds []string
+	for _, d := range dagIns {
+		p.taskTrees.Delete(d.ID)
+		p.pausedDagIns.Delete(d.ID)
+		// the ending tasks have finished their actions, they are continued by the worker taking over
+		tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+			DagInsID: d.ID,
+			Status: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusInit,
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusRetrying,
+				entity.TaskInstanceStatusContinue,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			taskInsIds = append(taskInsIds, t.ID)
+		}
+	}
+
+	if len(taskInsIds) > 0 {
+		if err := GetExecutor().CancelTaskIns(taskInsIds); err != nil {
+			return err
+		}
+		if err := waitExecutorIdle(ctx); err != nil {
+			log.Warnf("wait for canceled task instances failed: %s", err)
+		}
+
+		// the interrupted task instances will be executed again by the worker taking over
+		interrupted, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+			IDs: taskInsIds,
+			Status: []entity.TaskInstanceStatus{
+				entity.TaskInstanceStatusRunning,
+				entity.TaskInstanceStatusCanceled,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range interrupted {
+			if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+				BaseInfo: t.BaseInfo,
+				Status:   entity.TaskInstanceStatusInit,
+				Reason:   ReasonHandedOff,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var matcher *workerMatcher
+	for _, d := range dagIns {
+		patch := &entity.DagInstance{
+			BaseInfo: d.BaseInfo,
+			Status:   entity.DagInstanceStatusInit,
+			Reason:   ReasonHandedOff,
+		}
+		if d.Status == entity.DagInstanceStatusBlocked || d.Status == entity.DagInstanceStatusPaused {
+			if matcher == nil {
+				if matcher, err = newHandOffMatcher(); err != nil {
+					return err
+				}
+			}
+			matched, _ := matcher.match(d.NodeSelector)
+			if len(matched) == 0 {
+				log.Warnf("dag instance[%s] has no worker to hand off, keep it in this worker", d.ID)
+				continue
+			}
+			// keep the reason, it tells why the instance is blocked or paused
+			patch = &entity.DagInstance{
+				BaseInfo: d.BaseInfo,
+				Status:   d.Status,
+				Worker:   matched[rand.Intn(len(matched))].Key,
+			}
+		}
+
+		// the instance may be canceled meanwhile, it should not be dispatched again
+		err := GetStore().PatchDagInsIf(patch, &PatchDagInsCondition{
+			Status: []entity.DagInstanceStatus{d.Status},
+			Worker: d.Worker,
+		})
+		if err != nil && !errors.Is(err, data.ErrDataConflicted) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHandOffMatcher return the matcher of alive workers which are not draining
+func newHandOffMatcher() (*workerMatcher, error) {
+	workers, err := GetKeeper().AliveWorkers()
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*WorkerInfo
+	for _, w := range workers {
+		if !w.Draining && w.Key != GetKeeper().WorkerKey() {
+			candidates = append(candidates, w)
+		}
+	}
+	return newWorkerMatcher(candidates), nil
+}
+
+// waitExecutorIdle wait until the executor has no running or queued task instances
+func waitExecutorIdle(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		load := GetExecutor().Load()
+		if load.RunningTaskCnt+load.QueuedTaskCnt == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 // Close
@@ -506,7 +1235,7 @@ func (p *DefParser) Close() {
 	}
 	close(p.closeCh)
 	for i := range p.workerQueue {
-		close(p.workerQueue[i])
+		p.workerQueue[i].Close()
 	}
 	p.workerWg.Wait()
 }
@@ -1,6 +1,7 @@
 package mod
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -9,6 +10,8 @@ import (
 
 	"github.com/shiningrush/fastflow/pkg/entity"
 	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/utils"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -194,6 +197,7 @@ func TestDefParser_cancelChildTask(t *testing.T) {
 				calledPatchDag = true
 				assert.Equal(t, tc.wantPatchDagIns, args.Get(0))
 			}).Return(tc.givePatchDagErr)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
 			SetStore(mStore)
 
 			tc.giveParser.taskTrees.Store(tc.giveDagIns.ID, tree)
@@ -289,6 +293,33 @@ func TestDefParser_executeNext(t *testing.T) {
 			wantPatchStatus: entity.DagInstanceStatusSuccess,
 			wantDelete:      true,
 		},
+		{
+			caseDesc:   "canceled meanwhile",
+			giveParser: &DefParser{},
+			giveTaskTreeMap: map[string]*TaskTree{
+				"dag1": {
+					DagIns: &entity.DagInstance{
+						BaseInfo: entity.BaseInfo{ID: "dag1"},
+						Status:   entity.DagInstanceStatusRunning,
+					},
+					Root: &TaskNode{
+						TaskInsID: "task-ins-id",
+						Status:    entity.TaskInstanceStatusSuccess,
+					},
+				},
+			},
+			giveTaskIns: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "task-ins-id",
+				},
+				DagInsID: "dag1",
+				Status:   entity.TaskInstanceStatusSuccess,
+			},
+			givePatchErr:    fmt.Errorf("dag instance[dag1] does not match the condition: %w", data.ErrDataConflicted),
+			wantPatchCalled: true,
+			wantPatchStatus: entity.DagInstanceStatusSuccess,
+			wantDelete:      true,
+		},
 		{
 			caseDesc:   "branch failed",
 			giveParser: &DefParser{},
@@ -412,19 +443,27 @@ func TestDefParser_executeNext(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
 			for k, v := range tc.giveTaskTreeMap {
+				linkParents(v.Root)
 				tc.giveParser.taskTrees.Store(k, v)
 			}
 
 			preTask := &entity.TaskInstance{}
 			calledPatch, calledList, calledPush := false, false, false
 			mStore := &MockStore{}
-			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 				calledPatch = true
 				assert.Equal(t, tc.wantPatchStatus, args.Get(0).(*entity.DagInstance).Status)
+				assert.Equal(t, &PatchDagInsCondition{Status: unfinishedDagInsStatus}, args.Get(1))
 			}).Return(tc.givePatchErr)
 			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
 				calledList = true
 			}).Return([]*entity.TaskInstance{preTask}, tc.giveListErr)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patched := args.Get(0).(*entity.TaskInstance)
+				assert.Equal(t, entity.TaskInstanceStatusCanceled, patched.Status)
+				assert.Equal(t, ReasonUpstreamFailed, patched.Reason)
+			}).Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
 			SetStore(mStore)
 
 			mExecutor := &MockExecutor{}
@@ -446,6 +485,375 @@ func TestDefParser_executeNext(t *testing.T) {
 	}
 }
 
+// linkParents fill the parents of literal task nodes, trigger rules depend on them
+func linkParents(node *TaskNode) {
+	for _, c := range node.children {
+		if len(c.parents) == 0 {
+			c.AppendParent(node)
+		}
+		linkParents(c)
+	}
+}
+
+func TestDefParser_executeNextBranch(t *testing.T) {
+	newTask := func(id string, status entity.TaskInstanceStatus, dependOn ...string) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id + "-ins"},
+			TaskID:   id,
+			DagInsID: "dag1",
+			DependOn: dependOn,
+			Status:   status,
+		}
+	}
+
+	tests := []struct {
+		caseDesc        string
+		giveChosen      []string
+		wantSkipped     []string
+		wantPushed      []string
+		wantPatchStatus entity.DagInstanceStatus
+	}{
+		{
+			caseDesc:    "choose one branch",
+			giveChosen:  []string{"x"},
+			wantSkipped: []string{"y-ins"},
+			wantPushed:  []string{"x-ins"},
+		},
+		{
+			caseDesc:        "choose nothing",
+			wantSkipped:     []string{"x-ins", "y-ins", "join-ins"},
+			wantPatchStatus: entity.DagInstanceStatusSuccess,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			tasks := []*entity.TaskInstance{
+				newTask("branch", entity.TaskInstanceStatusRunning),
+				newTask("x", entity.TaskInstanceStatusInit, "branch"),
+				newTask("y", entity.TaskInstanceStatusInit, "branch"),
+				newTask("join", entity.TaskInstanceStatusInit, "x", "y"),
+			}
+			p := &DefParser{}
+			p.taskTrees.Store("dag1", &TaskTree{
+				DagIns: &entity.DagInstance{
+					BaseInfo: entity.BaseInfo{ID: "dag1"},
+					Status:   entity.DagInstanceStatusRunning,
+				},
+				Root: MustBuildRootNode(MapTaskInsToGetter(tasks)),
+			})
+
+			var skipped, pushed []string
+			var patchStatus entity.DagInstanceStatus
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+				if len(input.IDs) == 0 {
+					return tasks
+				}
+				var ret []*entity.TaskInstance
+				for _, t := range tasks {
+					if utils.StringsContain(input.IDs, t.ID) {
+						ret = append(ret, t)
+					}
+				}
+				return ret
+			}, nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patch := args.Get(0).(*entity.TaskInstance)
+				assert.Equal(t, entity.TaskInstanceStatusSkipped, patch.Status)
+				assert.Equal(t, "branch is not chosen by task[branch]", patch.Reason)
+				skipped = append(skipped, patch.ID)
+			}).Return(nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patchStatus = args.Get(0).(*entity.DagInstance).Status
+			}).Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
+			SetStore(mStore)
+
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+			})
+			SetExecutor(mExecutor)
+
+			branch := newTask("branch", entity.TaskInstanceStatusSuccess)
+			branch.Branch = &entity.Branch{ChosenTaskIDs: tc.giveChosen}
+			err := p.executeNext(branch)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantSkipped, skipped)
+			assert.Equal(t, tc.wantPushed, pushed)
+			assert.Equal(t, tc.wantPatchStatus, patchStatus)
+		})
+	}
+}
+
+func TestDefParser_executeNextTriggerRule(t *testing.T) {
+	tasks := []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, TaskID: "task1", DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning},
+		{BaseInfo: entity.BaseInfo{ID: "notify"}, TaskID: "notify", DagInsID: "dag1", DependOn: []string{"task1"},
+			Status: entity.TaskInstanceStatusInit, TriggerRule: entity.TriggerRuleOneFailed},
+		{BaseInfo: entity.BaseInfo{ID: "final"}, TaskID: "final", DagInsID: "dag1", DependOn: []string{"notify"},
+			Status: entity.TaskInstanceStatusInit},
+	}
+	p := &DefParser{}
+	p.taskTrees.Store("dag1", &TaskTree{
+		DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+		Root:   MustBuildRootNode(MapTaskInsToGetter(tasks)),
+	})
+
+	var pushed []string
+	mStore := &MockStore{}
+	mStore.On("PatchTaskIns", &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "notify"},
+		Status:   entity.TaskInstanceStatusSkipped,
+		Reason:   ReasonTriggerRuleNotMeet,
+	}).Return(nil)
+	mStore.On("ListTaskInstance", &ListTaskInstanceInput{IDs: []string{"final"}}).Return(tasks[2:], nil)
+	SetStore(mStore)
+	mExecutor := &MockExecutor{}
+	mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+	})
+	SetExecutor(mExecutor)
+
+	err := p.executeNext(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task1"},
+		DagInsID: "dag1",
+		Status:   entity.TaskInstanceStatusSuccess,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"final"}, pushed)
+	mStore.AssertExpectations(t)
+}
+
+func TestDefParser_executeNextPaused(t *testing.T) {
+	tasks := []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, TaskID: "task1", DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, TaskID: "task2", DagInsID: "dag1", DependOn: []string{"task1"},
+			Status: entity.TaskInstanceStatusInit},
+	}
+	p := &DefParser{}
+	p.taskTrees.Store("dag1", &TaskTree{
+		DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusPaused},
+		Root:   MustBuildRootNode(MapTaskInsToGetter(tasks)),
+	})
+	p.pausedDagIns.Store("dag1", struct{}{})
+
+	mStore := &MockStore{}
+	SetStore(mStore)
+	mExecutor := &MockExecutor{}
+	SetExecutor(mExecutor)
+
+	err := p.executeNext(&entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task1"},
+		DagInsID: "dag1",
+		Status:   entity.TaskInstanceStatusSuccess,
+	})
+	assert.NoError(t, err)
+	mExecutor.AssertNotCalled(t, "Push", mock.Anything, mock.Anything)
+	mStore.AssertNotCalled(t, "ListTaskInstance", mock.Anything)
+}
+
+func TestDefParser_parseForEachTask(t *testing.T) {
+	newGroup := func(expanded bool) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: "group-ins"},
+			TaskID:   "group",
+			DagInsID: "dag1",
+			DependOn: []string{"start"},
+			Params:   map[string]interface{}{"node": "{{ff_item}}"},
+			Status:   entity.TaskInstanceStatusInit,
+			ForEach: &entity.ForEach{
+				Source:      entity.TaskConditionSourceVars,
+				Key:         "nodes",
+				MaxParallel: 2,
+			},
+			Expanded: expanded,
+		}
+	}
+	start := &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "start-ins"},
+		TaskID:   "start",
+		DagInsID: "dag1",
+		Status:   entity.TaskInstanceStatusSuccess,
+	}
+
+	tests := []struct {
+		caseDesc        string
+		giveTaskIns     *entity.TaskInstance
+		giveNodes       string
+		giveMissKey     bool
+		giveExisted     []*entity.TaskInstance
+		givePaused      bool
+		giveDraining    bool
+		wantCreated     []string
+		wantPushed      []string
+		wantPatchStatus entity.TaskInstanceStatus
+		wantPatchReason string
+		wantDependOn    []string
+		wantWaiting     bool
+	}{
+		{
+			caseDesc:     "expand",
+			giveTaskIns:  newGroup(false),
+			giveNodes:    "n1, n2,n3",
+			wantCreated:  []string{"group[0]", "group[1]", "group[2]"},
+			wantPushed:   []string{"n1", "n2"},
+			wantDependOn: []string{"group[0]", "group[1]", "group[2]"},
+		},
+		{
+			caseDesc:    "some mapped task instances existed",
+			giveTaskIns: newGroup(false),
+			giveNodes:   `["n1","n2","n3"]`,
+			giveExisted: []*entity.TaskInstance{
+				{
+					BaseInfo:   entity.BaseInfo{ID: "group[0]-ins"},
+					TaskID:     "group[0]",
+					DagInsID:   "dag1",
+					DependOn:   []string{"start"},
+					Params:     map[string]interface{}{"node": "n1"},
+					Status:     entity.TaskInstanceStatusInit,
+					MappedFrom: "group",
+				},
+			},
+			wantCreated:  []string{"group[1]", "group[2]"},
+			wantPushed:   []string{"n1", "n2"},
+			wantDependOn: []string{"group[0]", "group[1]", "group[2]"},
+		},
+		{
+			caseDesc:     "expand while paused",
+			giveTaskIns:  newGroup(false),
+			giveNodes:    "n1,n2",
+			givePaused:   true,
+			wantCreated:  []string{"group[0]", "group[1]"},
+			wantDependOn: []string{"group[0]", "group[1]"},
+		},
+		{
+			caseDesc:     "expand while draining",
+			giveTaskIns:  newGroup(false),
+			giveNodes:    "n1,n2",
+			giveDraining: true,
+			wantCreated:  []string{"group[0]", "group[1]"},
+			wantDependOn: []string{"group[0]", "group[1]"},
+		},
+		{
+			caseDesc:        "no items",
+			giveTaskIns:     newGroup(false),
+			giveNodes:       "",
+			wantPatchStatus: entity.TaskInstanceStatusSuccess,
+			wantPatchReason: "no items to expand",
+		},
+		{
+			caseDesc:        "key not found",
+			giveTaskIns:     newGroup(false),
+			giveMissKey:     true,
+			wantPatchStatus: entity.TaskInstanceStatusFailed,
+			wantPatchReason: "for-each key[nodes] is not found in vars",
+		},
+		{
+			caseDesc:    "all mapped completed",
+			giveTaskIns: newGroup(true),
+			giveExisted: []*entity.TaskInstance{
+				{TaskID: "group[0]", MappedFrom: "group", Status: entity.TaskInstanceStatusSuccess},
+				{TaskID: "group[1]", MappedFrom: "group", Status: entity.TaskInstanceStatusSkipped},
+			},
+			wantPatchStatus: entity.TaskInstanceStatusSuccess,
+		},
+		{
+			caseDesc:    "some mapped failed",
+			giveTaskIns: newGroup(true),
+			giveExisted: []*entity.TaskInstance{
+				{TaskID: "group[0]", MappedFrom: "group", Status: entity.TaskInstanceStatusSuccess},
+				{TaskID: "group[1]", MappedFrom: "group", Status: entity.TaskInstanceStatusFailed},
+				{TaskID: "group[2]", MappedFrom: "group", Status: entity.TaskInstanceStatusCanceled},
+			},
+			wantPatchStatus: entity.TaskInstanceStatusFailed,
+			wantPatchReason: "mapped task[group[1]] is failed",
+		},
+		{
+			caseDesc:    "some mapped not completed",
+			giveTaskIns: newGroup(true),
+			giveExisted: []*entity.TaskInstance{
+				{TaskID: "group[0]", MappedFrom: "group", Status: entity.TaskInstanceStatusFailed},
+				{TaskID: "group[1]", MappedFrom: "group", Status: entity.TaskInstanceStatusRunning},
+			},
+			wantWaiting: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			stored := append([]*entity.TaskInstance{start, tc.giveTaskIns}, tc.giveExisted...)
+			var created []string
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+				return stored
+			}, nil)
+			mStore.On("BatchCreatTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				for _, ins := range args.Get(0).([]*entity.TaskInstance) {
+					ins.ID = ins.TaskID + "-ins"
+					created = append(created, ins.TaskID)
+					stored = append(stored, ins)
+				}
+			}).Return(nil)
+			mStore.On("UpdateTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				assert.Equal(t, tc.wantDependOn, args.Get(0).(*entity.TaskInstance).DependOn)
+				assert.True(t, args.Get(0).(*entity.TaskInstance).Expanded)
+			}).Return(nil)
+			mStore.On("PatchTaskIns", mock.Anything).Return(nil)
+			SetStore(mStore)
+
+			var pushed []string
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				pushed = append(pushed, args.Get(1).(*entity.TaskInstance).Params["node"].(string))
+			})
+			SetExecutor(mExecutor)
+
+			dagIns := &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Vars:     entity.DagInstanceVars{},
+				Status:   entity.DagInstanceStatusRunning,
+			}
+			if !tc.giveMissKey {
+				dagIns.Vars["nodes"] = entity.DagInstanceVar{Value: tc.giveNodes}
+			}
+			q := newTaskQueue(10)
+			p := &DefParser{workerNumber: 1, workerQueue: []*taskQueue{q}, closeCh: make(chan struct{})}
+			if tc.givePaused {
+				p.pausedDagIns.Store("dag1", struct{}{})
+			}
+			if tc.giveDraining {
+				p.draining = 1
+			}
+			tree := &TaskTree{DagIns: dagIns}
+
+			err := p.parseForEachTask(tree, tc.giveTaskIns)
+			assert.NoError(t, err)
+			if tc.wantWaiting {
+				mStore.AssertNotCalled(t, "PatchTaskIns", mock.Anything)
+				assert.Equal(t, 0, q.Len())
+				return
+			}
+			assert.Equal(t, tc.wantCreated, created)
+			assert.Equal(t, tc.wantPushed, pushed)
+			if tc.wantPatchStatus != "" {
+				mStore.AssertCalled(t, "PatchTaskIns", &entity.TaskInstance{
+					BaseInfo: tc.giveTaskIns.BaseInfo,
+					Status:   tc.wantPatchStatus,
+					Reason:   tc.wantPatchReason,
+				})
+				entry, ok := q.Pop()
+				assert.True(t, ok)
+				assert.Equal(t, tc.giveTaskIns, entry)
+				return
+			}
+			assert.Equal(t, 0, q.Len())
+			assert.NotNil(t, tree.Root)
+		})
+	}
+}
+
 func TestDefParser_EntryTaskIns(t *testing.T) {
 	tests := []struct {
 		caseDesc       string
@@ -532,12 +940,15 @@ func TestDefParser_EntryTaskIns(t *testing.T) {
 			tc.giveParser.closeCh = make(chan struct{})
 			tc.giveParser.workerNumber = tc.giveWorkerNum
 			for i := 0; i < tc.giveParser.workerNumber; i++ {
-				// if you make a block channel, will cause select failed
-				q := make(chan *entity.TaskInstance, 1)
+				q := newTaskQueue(1)
 				tc.giveParser.workerQueue = append(tc.giveParser.workerQueue, q)
 				tc.giveParser.workerWg.Add(1)
-				go func(idx int, queue <-chan *entity.TaskInstance) {
-					for task := range queue {
+				go func(idx int, queue *taskQueue) {
+					for {
+						task, ok := queue.Pop()
+						if !ok {
+							break
+						}
 						if tc.giveWorkerCost > 0 {
 							time.Sleep(tc.giveWorkerCost)
 						}
@@ -616,7 +1027,8 @@ func TestDefParser_InitialDagIns(t *testing.T) {
 			giveDagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test-dag"}},
 			giveTaskIns: []*entity.TaskInstance{
 				{BaseInfo: entity.BaseInfo{ID: "root-1-ins"}, TaskID: "root-1", Status: entity.TaskInstanceStatusFailed},
-				{BaseInfo: entity.BaseInfo{ID: "r1-child-1-ins"}, TaskID: "r1-child-1", Status: entity.TaskInstanceStatusSuccess, DependOn: []string{"root-1"}},
+				{BaseInfo: entity.BaseInfo{ID: "r1-child-1-ins"}, TaskID: "r1-child-1", Status: entity.TaskInstanceStatusFailed, DependOn: []string{"root-1"},
+					TriggerRule: entity.TriggerRuleAllDone},
 				{BaseInfo: entity.BaseInfo{ID: "r1-child-2-ins"}, TaskID: "r1-child-2", Status: entity.TaskInstanceStatusSuccess, DependOn: []string{"root-1"}},
 				{BaseInfo: entity.BaseInfo{ID: "root-2-ins"}, TaskID: "root-2", Status: entity.TaskInstanceStatusSuccess},
 			},
@@ -682,6 +1094,7 @@ func TestDefParser_InitialDagIns(t *testing.T) {
 				patchCalled = true
 				assert.Equal(t, tc.wantPatchDagIns, args.Get(0))
 			}).Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
 			SetStore(mStore)
 
 			mLog := &log.MockLogger{}
@@ -713,11 +1126,14 @@ func TestDefParser_WatchScheduledDagIns(t *testing.T) {
 		giveWorkerKey       string
 		giveListRet         []*entity.DagInstance
 		giveListErr         error
+		giveGetRet          *entity.Dag
 		giveGetErr          error
+		givePatchErr        error
 		wantErr             error
 		wantListInput       *ListDagInstanceInput
 		wantGetCalled       bool
 		wantGetDagInsCalled bool
+		wantPatched         []string
 	}{
 		{
 			caseDesc:      "sanity",
@@ -753,16 +1169,43 @@ func TestDefParser_WatchScheduledDagIns(t *testing.T) {
 			giveWorkerKey: "test",
 			giveListRet: []*entity.DagInstance{
 				{
-					Status: entity.DagInstanceStatusScheduled,
+					BaseInfo: entity.BaseInfo{ID: "broken"},
+					DagID:    "broken",
+					Status:   entity.DagInstanceStatusScheduled,
+				},
+				{
+					BaseInfo: entity.BaseInfo{ID: "dagIns"},
+					Worker:   "test",
+					Status:   entity.DagInstanceStatusScheduled,
 				},
 			},
+			giveGetRet: &entity.Dag{},
 			giveGetErr: fmt.Errorf("get failed"),
-			wantErr:    fmt.Errorf("watch scheduled dag ins failed: %w", fmt.Errorf("get failed")),
 			wantListInput: &ListDagInstanceInput{
 				Worker: "test",
 				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
 			},
 			wantGetCalled: true,
+			wantPatched:   []string{"dagIns"},
+		},
+		{
+			caseDesc:      "canceled meanwhile",
+			giveWorkerKey: "test",
+			giveListRet: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dagIns"},
+					Worker:   "test",
+					Status:   entity.DagInstanceStatusScheduled,
+				},
+			},
+			giveGetRet:   &entity.Dag{},
+			givePatchErr: fmt.Errorf("dag instance[dagIns] does not match the condition: %w", data.ErrDataConflicted),
+			wantListInput: &ListDagInstanceInput{
+				Worker: "test",
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
+			},
+			wantGetCalled: true,
+			wantPatched:   []string{"dagIns"},
 		},
 	}
 
@@ -779,7 +1222,17 @@ func TestDefParser_WatchScheduledDagIns(t *testing.T) {
 			}).Return(nil, nil)
 			mStore.On("GetDag", mock.Anything).Run(func(args mock.Arguments) {
 				calledGet = true
-			}).Return(nil, tc.giveGetErr)
+			}).Return(tc.giveGetRet, func(dagId string) error {
+				// only the dag of broken instance is failed to get
+				if dagId == "broken" || tc.giveGetRet == nil {
+					return tc.giveGetErr
+				}
+				return nil
+			})
+			var patched []string
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, "Reason").Run(func(args mock.Arguments) {
+				patched = append(patched, args.Get(0).(*entity.DagInstance).ID)
+			}).Return(tc.givePatchErr)
 			SetStore(mStore)
 
 			mKeeper := &MockKeeper{}
@@ -794,9 +1247,14 @@ func TestDefParser_WatchScheduledDagIns(t *testing.T) {
 			assert.True(t, calledList)
 			assert.True(t, calledKeeper)
 			assert.Equal(t, tc.wantGetCalled, calledGet)
+			assert.Equal(t, tc.wantPatched, patched)
 			if err == nil {
 				assert.True(t, calledListTask)
 			}
+			if tc.givePatchErr != nil {
+				_, initialized := p.taskTrees.Load("dagIns")
+				assert.False(t, initialized)
+			}
 		})
 	}
 }
@@ -910,13 +1368,13 @@ func TestDefParser_PublisherDo(t *testing.T) {
 			giveWorkerKey: "test1",
 			wantListInput: &ListDagInstanceInput{
 				Worker: "test1",
-				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning, entity.DagInstanceStatusPaused},
 			},
 			wantPublishList: []string{"test1", "test2"},
 		},
 		{
 			wantListInput: &ListDagInstanceInput{
-				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning, entity.DagInstanceStatusPaused},
 			},
 			giveListErr: fmt.Errorf("list failed"),
 			wantErr:     fmt.Errorf("list failed"),
@@ -944,7 +1402,10 @@ func TestDefParser_PublisherDo(t *testing.T) {
 			assert.Equal(t, tc.wantListInput, args.Get(0))
 		}).Return(tc.giveListRet, tc.giveListErr)
 		mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
-			queue <- args.Get(0).(*ListTaskInstanceInput).DagInsID
+			// skip listing the interrupted tasks
+			if input := args.Get(0).(*ListTaskInstanceInput); len(input.Status) == 0 {
+				queue <- input.DagInsID
+			}
 		}).Return(nil, nil)
 		SetStore(mStore)
 
@@ -1100,9 +1561,13 @@ func TestDefParser_ParseScheduleDagIns(t *testing.T) {
 				assert.Equal(t, tc.wantBatchCreateTaskInput, args.Get(0))
 			}).Return(tc.giveBatchCreateTaskErr)
 
-			mStore.On("PatchDagIns", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
 				calledUpdateDagIns = true
 				assert.Equal(t, tc.wantPatchDagInsInput, args.Get(0))
+				assert.Equal(t, &PatchDagInsCondition{
+					Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
+					Worker: tc.giveDagIns.Worker,
+				}, args.Get(1))
 			}).Return(tc.giveUpdateDagInsErr)
 			SetStore(mStore)
 
@@ -1126,6 +1591,7 @@ func TestDefParser_ParseCmd(t *testing.T) {
 	tests := []struct {
 		caseDesc             string
 		giveDagIns           *entity.DagInstance
+		giveTreeLoaded       bool
 		giveTask             []*entity.TaskInstance
 		giveTaskErr          error
 		giveUpdateTaskErr    error
@@ -1141,6 +1607,7 @@ func TestDefParser_ParseCmd(t *testing.T) {
 		wantUpdateDagCalled  bool
 		wantCancelCalled     bool
 		wantListCallCnt      int
+		wantPaused           bool
 	}{
 		{
 			caseDesc: "retry failed task",
@@ -1151,10 +1618,10 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			giveTask: []*entity.TaskInstance{
 				{Status: entity.TaskInstanceStatusFailed, Reason: "failed reason"},
 			},
-			wantListCallCnt:      2,
+			wantListCallCnt:      3,
 			wantUpdateTask:       &entity.TaskInstance{Status: entity.TaskInstanceStatusRetrying},
 			wantUpdateTaskCalled: true,
-			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning, Generation: 1},
 			wantUpdateDagCalled:  true,
 		},
 		{
@@ -1166,10 +1633,10 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			giveTask: []*entity.TaskInstance{
 				{Status: entity.TaskInstanceStatusCanceled, Reason: "canceled reason"},
 			},
-			wantListCallCnt:      2,
+			wantListCallCnt:      3,
 			wantUpdateTask:       &entity.TaskInstance{Status: entity.TaskInstanceStatusRetrying},
 			wantUpdateTaskCalled: true,
-			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning, Generation: 1},
 			wantUpdateDagCalled:  true,
 		},
 		{
@@ -1199,6 +1666,50 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			wantUpdateDagIns:    &entity.DagInstance{},
 			wantUpdateDagCalled: true,
 		},
+		{
+			caseDesc: "rerun succeeded task",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusSuccess,
+				Cmd:    &entity.Command{Name: entity.CommandNameRerun, TargetTaskInsIDs: []string{"task1"}}},
+			wantGetTaskId: "task1",
+			giveTask: []*entity.TaskInstance{
+				{Status: entity.TaskInstanceStatusSuccess, Reason: "success reason"},
+			},
+			wantListCallCnt: 3,
+			wantUpdateTask: &entity.TaskInstance{
+				Status:  entity.TaskInstanceStatusInit,
+				History: []entity.TaskInstanceRun{{Status: entity.TaskInstanceStatusSuccess, Reason: "success reason"}},
+			},
+			wantUpdateTaskCalled: true,
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning, Generation: 1},
+			wantUpdateDagCalled:  true,
+		},
+		{
+			caseDesc: "mark failed task",
+			giveDagIns: &entity.DagInstance{
+				Status: entity.DagInstanceStatusFailed,
+				Cmd: &entity.Command{
+					Name:             entity.CommandNameMark,
+					TargetTaskInsIDs: []string{"task1"},
+					Mark:             &entity.TaskMark{Status: entity.TaskInstanceStatusSuccess, Reason: "fixed", Operator: "admin"},
+				}},
+			wantGetTaskId: "task1",
+			giveTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, TaskID: "task1", Status: entity.TaskInstanceStatusFailed, Reason: "failed reason"},
+				{BaseInfo: entity.BaseInfo{ID: "task2"}, TaskID: "task2", DependOn: []string{"task1"}, Status: entity.TaskInstanceStatusInit},
+			},
+			wantListCallCnt: 3,
+			wantUpdateTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "task1"},
+				TaskID:   "task1",
+				Status:   entity.TaskInstanceStatusSuccess,
+				Reason:   "fixed",
+				Mark:     &entity.TaskMark{Status: entity.TaskInstanceStatusSuccess, Reason: "fixed", Operator: "admin"},
+			},
+			wantUpdateTaskCalled: true,
+			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning, Generation: 1},
+			wantUpdateDagCalled:  true,
+		},
 		{
 			caseDesc:          "cancel failed",
 			giveDagIns:        &entity.DagInstance{Cmd: &entity.Command{Name: entity.CommandNameCancel, TargetTaskInsIDs: []string{"task1"}}},
@@ -1216,7 +1727,7 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			giveTask: []*entity.TaskInstance{
 				{Status: entity.TaskInstanceStatusBlocked},
 			},
-			wantListCallCnt:      2,
+			wantListCallCnt:      3,
 			wantUpdateTask:       &entity.TaskInstance{Status: entity.TaskInstanceStatusContinue},
 			wantUpdateTaskCalled: true,
 			wantUpdateDagIns:     &entity.DagInstance{Status: entity.DagInstanceStatusRunning},
@@ -1230,6 +1741,46 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			wantErr:         fmt.Errorf("get task failed"),
 			wantListCallCnt: 1,
 		},
+		{
+			caseDesc: "pause",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusRunning,
+				Cmd:      &entity.Command{Name: entity.CommandNamePause}},
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusPaused,
+			},
+			wantUpdateDagCalled: true,
+			wantPaused:          true,
+		},
+		{
+			caseDesc: "resume",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusPaused,
+				Cmd:      &entity.Command{Name: entity.CommandNameResume}},
+			giveTreeLoaded:  true,
+			wantListCallCnt: 1,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusRunning,
+			},
+			wantUpdateDagCalled: true,
+		},
+		{
+			caseDesc: "resume after worker restarted",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusPaused,
+				Cmd:      &entity.Command{Name: entity.CommandNameResume}},
+			wantListCallCnt: 2,
+			wantUpdateDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+				Status:   entity.DagInstanceStatusRunning,
+			},
+			wantUpdateDagCalled: true,
+		},
 		{
 			caseDesc:   "no cmd",
 			giveDagIns: &entity.DagInstance{},
@@ -1240,13 +1791,46 @@ func TestDefParser_ParseCmd(t *testing.T) {
 		t.Run(tc.caseDesc, func(t *testing.T) {
 			calledUpdateTask, calledCancel, calledUpdateDag := false, false, false
 			listTaskCallCnt := 0
+			var cmdName entity.CommandName
+			if tc.giveDagIns.Cmd != nil {
+				cmdName = tc.giveDagIns.Cmd.Name
+			}
 			mStore := &MockStore{}
 			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
 				listTaskCallCnt++
+				if args.Get(0).(*ListTaskInstanceInput).Status == nil {
+					// tasks are pushed by InitialDagIns after the running status is saved
+					assert.True(t, calledUpdateDag)
+				}
+				if cmdName == entity.CommandNameResume {
+					if !tc.giveTreeLoaded && listTaskCallCnt == 1 {
+						assert.Equal(t, &ListTaskInstanceInput{
+							DagInsID: tc.giveDagIns.ID,
+							Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+						}, args.Get(0))
+						return
+					}
+					assert.Equal(t, &ListTaskInstanceInput{DagInsID: tc.giveDagIns.ID}, args.Get(0))
+					return
+				}
 				if listTaskCallCnt == 1 {
 					status := []entity.TaskInstanceStatus{entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled}
-					if tc.giveDagIns.Cmd.Name == entity.CommandNameContinue {
+					switch cmdName {
+					case entity.CommandNameContinue:
 						status = []entity.TaskInstanceStatus{entity.TaskInstanceStatusBlocked}
+					case entity.CommandNameMark:
+						status = []entity.TaskInstanceStatus{
+							entity.TaskInstanceStatusFailed,
+							entity.TaskInstanceStatusCanceled,
+							entity.TaskInstanceStatusBlocked,
+						}
+					case entity.CommandNameRerun:
+						status = []entity.TaskInstanceStatus{
+							entity.TaskInstanceStatusSuccess,
+							entity.TaskInstanceStatusFailed,
+							entity.TaskInstanceStatusCanceled,
+							entity.TaskInstanceStatusSkipped,
+						}
 					}
 
 					assert.Equal(t, &ListTaskInstanceInput{
@@ -1254,6 +1838,12 @@ func TestDefParser_ParseCmd(t *testing.T) {
 						Status: status,
 					}, args.Get(0))
 				}
+				if listTaskCallCnt == 2 {
+					assert.Equal(t, &ListTaskInstanceInput{
+						DagInsID: tc.giveDagIns.ID,
+						Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusCanceled},
+					}, args.Get(0))
+				}
 			}).Return(tc.giveTask, tc.giveTaskErr)
 
 			mStore.On("UpdateTaskIns", mock.Anything).Run(func(args mock.Arguments) {
@@ -1279,16 +1869,556 @@ func TestDefParser_ParseCmd(t *testing.T) {
 			SetExecutor(mExecutor)
 
 			parser := &DefParser{}
+			if tc.giveDagIns.Status == entity.DagInstanceStatusPaused {
+				parser.pausedDagIns.Store(tc.giveDagIns.ID, struct{}{})
+			}
+			if tc.giveTreeLoaded {
+				parser.taskTrees.Store(tc.giveDagIns.ID, &TaskTree{DagIns: tc.giveDagIns})
+			}
 			err := parser.parseCmd(tc.giveDagIns)
 			assert.Equal(t, tc.wantErr, err)
 			assert.Equal(t, tc.wantListCallCnt, listTaskCallCnt)
 			assert.Equal(t, tc.wantUpdateTaskCalled, calledUpdateTask)
 			assert.Equal(t, tc.wantCancelCalled, calledCancel)
 			assert.Equal(t, tc.wantUpdateDagCalled, calledUpdateDag)
+			_, paused := parser.pausedDagIns.Load(tc.giveDagIns.ID)
+			assert.Equal(t, tc.wantPaused, paused)
+		})
+	}
+}
+
+func TestDefParser_resetUpstreamFailedTaskIns(t *testing.T) {
+	mStore := &MockStore{}
+	mStore.On("ListTaskInstance", &ListTaskInstanceInput{
+		DagInsID: "dag1",
+		Status:   []entity.TaskInstanceStatus{entity.TaskInstanceStatusCanceled},
+	}).Return([]*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusCanceled, Reason: "cancel by user"},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, Status: entity.TaskInstanceStatusCanceled, Reason: ReasonUpstreamFailed},
+	}, nil)
+	mStore.On("UpdateTaskIns", &entity.TaskInstance{
+		BaseInfo: entity.BaseInfo{ID: "task2"},
+		Status:   entity.TaskInstanceStatusInit,
+	}).Return(nil)
+	SetStore(mStore)
+
+	err := resetUpstreamFailedTaskIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}})
+	assert.NoError(t, err)
+	mStore.AssertNumberOfCalls(t, "UpdateTaskIns", 1)
+}
+
+func TestDefParser_ParseCmdCancelDagIns(t *testing.T) {
+	dagIns := &entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "dag1"},
+		Status:   entity.DagInstanceStatusCanceled,
+		Reason:   "cancel by user",
+		Cmd:      &entity.Command{Name: entity.CommandNameCancelDagIns},
+	}
+	var patchedTask []*entity.TaskInstance
+	mStore := &MockStore{}
+	mStore.On("ListTaskInstance", &ListTaskInstanceInput{
+		DagInsID: "dag1",
+		Status:   unfinishedTaskInsStatus,
+	}).Return([]*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusRunning},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, Status: entity.TaskInstanceStatusBlocked},
+	}, nil)
+	mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+		patchedTask = append(patchedTask, args.Get(0).(*entity.TaskInstance))
+	}).Return(nil)
+	mStore.On("PatchDagIns", &entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "dag1"},
+		Status:   entity.DagInstanceStatusCanceled,
+		Reason:   "cancel by user",
+	}, "Cmd", "Reason").Return(nil)
+	mStore.On("ListDag", mock.Anything).Return(nil, nil)
+	SetStore(mStore)
+	mExecutor := &MockExecutor{}
+	mExecutor.On("CancelTaskIns", []string{"task1", "task2"}).Return(nil)
+	SetExecutor(mExecutor)
+
+	p := &DefParser{}
+	p.taskTrees.Store("dag1", &TaskTree{DagIns: dagIns})
+	p.pausedDagIns.Store("dag1", struct{}{})
+	err := p.parseCmd(dagIns)
+	assert.NoError(t, err)
+	assert.Equal(t, []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusCanceled, Reason: "cancel by user"},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, Status: entity.TaskInstanceStatusCanceled, Reason: "cancel by user"},
+	}, patchedTask)
+	mStore.AssertExpectations(t)
+	mExecutor.AssertExpectations(t)
+	_, ok := p.taskTrees.Load("dag1")
+	assert.False(t, ok)
+	_, ok = p.pausedDagIns.Load("dag1")
+	assert.False(t, ok)
+
+	// the canceled tasks of a canceled dag instance have nothing to do
+	err = p.executeNext(&entity.TaskInstance{DagInsID: "dag1", Status: entity.TaskInstanceStatusCanceled})
+	assert.NoError(t, err)
+}
+
+func TestDefParser_ParseCmdExpire(t *testing.T) {
+	tests := []struct {
+		caseDesc string
+		// the goroutine ignores the cancellation, so the command comes again
+		giveIgnoreCancel bool
+	}{
+		{
+			caseDesc: "canceled",
+		},
+		{
+			caseDesc:         "ignore cancellation",
+			giveIgnoreCancel: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			tasks := []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, TaskID: "task1", DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning},
+			}
+			newDagIns := func() *entity.DagInstance {
+				return &entity.DagInstance{
+					BaseInfo: entity.BaseInfo{ID: "dag1"},
+					Status:   entity.DagInstanceStatusRunning,
+					Cmd:      &entity.Command{Name: entity.CommandNameExpire, TargetTaskInsIDs: []string{"task1"}},
+				}
+			}
+			var patchedTask []*entity.TaskInstance
+			mStore := &MockStore{}
+			mStore.On("ListTaskInstance", &ListTaskInstanceInput{
+				IDs:    []string{"task1"},
+				Status: []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
+			}).Return(func(*ListTaskInstanceInput) []*entity.TaskInstance {
+				return []*entity.TaskInstance{
+					{BaseInfo: entity.BaseInfo{ID: "task1"}, DagInsID: "dag1", Status: entity.TaskInstanceStatusRunning},
+				}
+			}, nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchedTask = append(patchedTask, args.Get(0).(*entity.TaskInstance))
+			}).Return(nil)
+			mStore.On("PatchDagIns", mock.Anything).Return(nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Return(nil)
+			mStore.On("PatchDagIns", mock.Anything, "Cmd", "Reason").Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
+			SetStore(mStore)
+			mExecutor := &MockExecutor{}
+			mExecutor.On("CancelTaskIns", []string{"task1"}).Return(nil)
+			mExecutor.On("CancelTaskIns", []string(nil)).Return(nil)
+			SetExecutor(mExecutor)
+
+			p := &DefParser{
+				workerNumber: 1,
+				workerQueue:  []*taskQueue{newTaskQueue(10)},
+				closeCh:      make(chan struct{}),
+			}
+			p.taskTrees.Store("dag1", &TaskTree{
+				DagIns: &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+				Root:   MustBuildRootNode(MapTaskInsToGetter(tasks)),
+			})
+			err := p.parseCmd(newDagIns())
+			assert.NoError(t, err)
+			mExecutor.AssertCalled(t, "CancelTaskIns", []string{"task1"})
+			assert.Empty(t, patchedTask)
+
+			if tc.giveIgnoreCancel {
+				err = p.parseCmd(newDagIns())
+				assert.NoError(t, err)
+				taskIns, ok := p.workerQueue[0].Pop()
+				assert.True(t, ok)
+				err = p.executeNext(taskIns)
+				assert.NoError(t, err)
+				_, ok = p.expiredTaskIns.Load("task1")
+				assert.True(t, ok)
+			}
+
+			// the goroutine exits after canceled
+			err = p.executeNext(&entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "task1"},
+				DagInsID: "dag1",
+				Status:   entity.TaskInstanceStatusCanceled,
+			})
+			assert.NoError(t, err)
+			_, ok := p.expiredTaskIns.Load("task1")
+			assert.False(t, ok)
+			_, ok = p.taskTrees.Load("dag1")
+			assert.False(t, ok)
+			assert.Equal(t, &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{ID: "task1"},
+				Status:   entity.TaskInstanceStatusFailed,
+				Reason:   DefFailedReason,
+			}, patchedTask[len(patchedTask)-1])
+			mStore.AssertCalled(t, "PatchDagInsIf", &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusFailed,
+				Reason:   "task[task1] failed or canceled",
+			}, &PatchDagInsCondition{Status: unfinishedDagInsStatus})
 		})
 	}
 }
 
+func TestDefParser_Drain(t *testing.T) {
+	drainCheckInterval, handOffTimeout = 10*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		drainCheckInterval, handOffTimeout = time.Second, 5*time.Second
+		log.SetLogger(&log.StdoutLogger{})
+	}()
+
+	tests := []struct {
+		caseDesc        string
+		giveLoad        WorkerLoad
+		giveInterrupted []*entity.TaskInstance
+		wantErr         error
+		wantPatchedTask []*entity.TaskInstance
+	}{
+		{
+			caseDesc: "executor is idle",
+		},
+		{
+			caseDesc: "tasks are interrupted",
+			giveLoad: WorkerLoad{RunningTaskCnt: 1},
+			giveInterrupted: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusCanceled},
+			},
+			wantErr: context.DeadlineExceeded,
+			wantPatchedTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusInit, Reason: ReasonHandedOff},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patchedTask []*entity.TaskInstance
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", &ListDagInstanceInput{
+				Worker: "worker-1",
+				Status: []entity.DagInstanceStatus{
+					entity.DagInstanceStatusScheduled,
+					entity.DagInstanceStatusRunning,
+					entity.DagInstanceStatusBlocked,
+					entity.DagInstanceStatusPaused,
+				},
+			}).Return([]*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusRunning},
+			}, nil)
+			mStore.On("ListTaskInstance", mock.MatchedBy(func(input *ListTaskInstanceInput) bool {
+				return input.DagInsID == "dag1"
+			})).Return([]*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "task1"}, Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "task2"}, Status: entity.TaskInstanceStatusInit},
+			}, nil)
+			mStore.On("ListTaskInstance", &ListTaskInstanceInput{
+				IDs: []string{"task1", "task2"},
+				Status: []entity.TaskInstanceStatus{
+					entity.TaskInstanceStatusRunning,
+					entity.TaskInstanceStatusCanceled,
+				},
+			}).Return(tc.giveInterrupted, nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchedTask = append(patchedTask, args.Get(0).(*entity.TaskInstance))
+			}).Return(nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Return(nil)
+			SetStore(mStore)
+			mKeeper := &MockKeeper{}
+			mKeeper.On("WorkerKey").Return("worker-1")
+			SetKeeper(mKeeper)
+			mExecutor := &MockExecutor{}
+			mExecutor.On("Load").Return(tc.giveLoad)
+			mExecutor.On("CancelTaskIns", []string{"task1", "task2"}).Return(nil)
+			SetExecutor(mExecutor)
+			mLog := &log.MockLogger{}
+			mLog.On("Warnf", mock.Anything, mock.Anything)
+			log.SetLogger(mLog)
+
+			p := &DefParser{}
+			p.taskTrees.Store("dag1", &TaskTree{})
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			err := p.Drain(ctx)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatchedTask, patchedTask)
+			mStore.AssertCalled(t, "PatchDagInsIf", &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "dag1"},
+				Status:   entity.DagInstanceStatusInit,
+				Reason:   ReasonHandedOff,
+			}, &PatchDagInsCondition{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning},
+			})
+			mExecutor.AssertExpectations(t)
+			_, ok := p.taskTrees.Load("dag1")
+			assert.False(t, ok)
+
+			// the completed tasks are left to the worker taking over
+			err = p.executeNext(&entity.TaskInstance{DagInsID: "dag1", Status: entity.TaskInstanceStatusSuccess})
+			assert.NoError(t, err)
+			err = p.watchScheduledDagIns()
+			assert.NoError(t, err)
+			mExecutor.AssertNotCalled(t, "Push", mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestDefParser_handOff(t *testing.T) {
+	defer log.SetLogger(&log.StdoutLogger{})
+
+	tests := []struct {
+		caseDesc     string
+		giveDagIns   []*entity.DagInstance
+		giveWorkers  []*WorkerInfo
+		wantPatched  []*entity.DagInstance
+		wantCond     []*PatchDagInsCondition
+		wantWarnCall bool
+	}{
+		{
+			caseDesc: "blocked and paused keep status",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag1"}, Worker: "worker-1", Status: entity.DagInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "dag2"}, Worker: "worker-1", Status: entity.DagInstanceStatusBlocked, Reason: "task[t1] blocked"},
+				{BaseInfo: entity.BaseInfo{ID: "dag3"}, Worker: "worker-1", Status: entity.DagInstanceStatusPaused, NodeSelector: "zone=bj"},
+			},
+			giveWorkers: []*WorkerInfo{
+				{Key: "worker-1", Draining: true},
+				{Key: "worker-2", Labels: map[string]string{"zone": "bj"}},
+				{Key: "worker-3", Draining: true, Labels: map[string]string{"zone": "bj"}},
+			},
+			wantPatched: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag1"}, Status: entity.DagInstanceStatusInit, Reason: ReasonHandedOff},
+				{BaseInfo: entity.BaseInfo{ID: "dag2"}, Status: entity.DagInstanceStatusBlocked, Worker: "worker-2"},
+				{BaseInfo: entity.BaseInfo{ID: "dag3"}, Status: entity.DagInstanceStatusPaused, Worker: "worker-2"},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}, Worker: "worker-1"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusBlocked}, Worker: "worker-1"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPaused}, Worker: "worker-1"},
+			},
+		},
+		{
+			caseDesc: "no worker matched",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag3"}, Worker: "worker-1", Status: entity.DagInstanceStatusPaused, NodeSelector: "zone=gz"},
+			},
+			giveWorkers: []*WorkerInfo{
+				{Key: "worker-1", Draining: true, Labels: map[string]string{"zone": "gz"}},
+				{Key: "worker-2", Labels: map[string]string{"zone": "bj"}},
+			},
+			wantWarnCall: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patched []*entity.DagInstance
+			var patchedCond []*PatchDagInsCondition
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Return(tc.giveDagIns, nil)
+			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
+				// the ending tasks are neither canceled nor reset
+				assert.NotContains(t, args.Get(0).(*ListTaskInstanceInput).Status, entity.TaskInstanceStatusEnding)
+			}).Return(nil, nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patched = append(patched, args.Get(0).(*entity.DagInstance))
+				patchedCond = append(patchedCond, args.Get(1).(*PatchDagInsCondition))
+			}).Return(nil)
+			SetStore(mStore)
+			mKeeper := &MockKeeper{}
+			mKeeper.On("WorkerKey").Return("worker-1")
+			mKeeper.On("AliveWorkers").Return(tc.giveWorkers, nil)
+			SetKeeper(mKeeper)
+			calledWarn := false
+			mLog := &log.MockLogger{}
+			mLog.On("Warnf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				calledWarn = true
+			})
+			log.SetLogger(mLog)
+
+			p := &DefParser{}
+			err := p.handOff(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantPatched, patched)
+			assert.Equal(t, tc.wantCond, patchedCond)
+			assert.Equal(t, tc.wantWarnCall, calledWarn)
+		})
+	}
+}
+
+func TestDefParser_getInsDag(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		giveDagIns  *entity.DagInstance
+		giveVerErr  error
+		wantDagName string
+		wantErr     error
+	}{
+		{
+			caseDesc:    "pinned version",
+			giveDagIns:  &entity.DagInstance{DagID: "dag", DagVersion: 1},
+			wantDagName: "v1",
+		},
+		{
+			caseDesc:    "no version",
+			giveDagIns:  &entity.DagInstance{DagID: "dag"},
+			wantDagName: "latest",
+		},
+		{
+			caseDesc:   "version not found",
+			giveDagIns: &entity.DagInstance{DagID: "dag", DagVersion: 1},
+			giveVerErr: fmt.Errorf("not found"),
+			wantErr:    fmt.Errorf("get version 1 of dag[dag] failed: %w", fmt.Errorf("not found")),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			mStore := &MockStore{}
+			mStore.On("GetDag", "dag").Return(&entity.Dag{Name: "latest", Version: 2}, nil)
+			mStore.On("GetDagVersion", "dag", 1).Return(&entity.DagVersion{
+				Dag: entity.Dag{Name: "v1", Version: 1},
+			}, tc.giveVerErr)
+			SetStore(mStore)
+
+			dag, err := getInsDag(tc.giveDagIns)
+			assert.Equal(t, tc.wantErr, err)
+			if tc.wantErr == nil {
+				assert.Equal(t, tc.wantDagName, dag.Name)
+			}
+		})
+	}
+}
+
+func TestDefParser_recoverInterruptedTaskIns(t *testing.T) {
+	tests := []struct {
+		caseDesc    string
+		givePolicy  InterruptedTaskPolicy
+		giveTask    *entity.TaskInstance
+		wantUpdated bool
+		wantStatus  entity.TaskInstanceStatus
+		wantAttempt int
+	}{
+		{
+			caseDesc:    "fail",
+			givePolicy:  InterruptedTaskPolicyFail,
+			giveTask:    &entity.TaskInstance{Status: entity.TaskInstanceStatusRunning},
+			wantUpdated: true,
+			wantStatus:  entity.TaskInstanceStatusFailed,
+		},
+		{
+			caseDesc:   "fail with retry policy",
+			givePolicy: InterruptedTaskPolicyFail,
+			giveTask: &entity.TaskInstance{Status: entity.TaskInstanceStatusRunning,
+				Retry: &entity.RetryPolicy{MaxAttempts: 2}},
+			wantUpdated: true,
+			wantStatus:  entity.TaskInstanceStatusRetrying,
+			wantAttempt: 1,
+		},
+		{
+			caseDesc:    "retry",
+			givePolicy:  InterruptedTaskPolicyRetry,
+			giveTask:    &entity.TaskInstance{Status: entity.TaskInstanceStatusRunning, NextRetryAt: 1},
+			wantUpdated: true,
+			wantStatus:  entity.TaskInstanceStatusRetrying,
+		},
+		{
+			caseDesc:    "resume",
+			givePolicy:  InterruptedTaskPolicyResume,
+			giveTask:    &entity.TaskInstance{Status: entity.TaskInstanceStatusRunning},
+			wantUpdated: true,
+			wantStatus:  entity.TaskInstanceStatusEnding,
+		},
+		{
+			caseDesc:   "not running",
+			givePolicy: InterruptedTaskPolicyFail,
+			giveTask:   &entity.TaskInstance{Status: entity.TaskInstanceStatusInit},
+			wantStatus: entity.TaskInstanceStatusInit,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			updated := false
+			mStore := &MockStore{}
+			mStore.On("UpdateTaskIns", tc.giveTask).Run(func(args mock.Arguments) {
+				updated = true
+			}).Return(nil)
+			SetStore(mStore)
+
+			p := &DefParser{interruptedPolicy: tc.givePolicy}
+			err := p.recoverInterruptedTaskIns([]*entity.TaskInstance{tc.giveTask})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantUpdated, updated)
+			assert.Equal(t, tc.wantStatus, tc.giveTask.Status)
+			assert.Equal(t, tc.wantAttempt, tc.giveTask.Attempt)
+			if tc.wantUpdated {
+				assert.Equal(t, ReasonInterrupted, tc.giveTask.Reason)
+			}
+			if tc.givePolicy == InterruptedTaskPolicyRetry {
+				assert.Equal(t, int64(0), tc.giveTask.NextRetryAt)
+			}
+		})
+	}
+}
+
+func TestDefParser_RestartWhilePaused(t *testing.T) {
+	dagIns := &entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "dag-ins"},
+		Worker:   "worker",
+		Status:   entity.DagInstanceStatusPaused,
+	}
+	tasks := []*entity.TaskInstance{
+		{BaseInfo: entity.BaseInfo{ID: "task1"}, TaskID: "task1", DagInsID: "dag-ins", Status: entity.TaskInstanceStatusRunning},
+		{BaseInfo: entity.BaseInfo{ID: "task2"}, TaskID: "task2", DagInsID: "dag-ins", DependOn: []string{"task1"},
+			Status: entity.TaskInstanceStatusInit},
+	}
+
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.Anything).Return([]*entity.DagInstance{dagIns}, nil)
+	mStore.On("ListTaskInstance", mock.Anything).Return(func(input *ListTaskInstanceInput) []*entity.TaskInstance {
+		var ret []*entity.TaskInstance
+		for _, t := range tasks {
+			if len(input.Status) == 0 || input.Status[0] == t.Status {
+				ret = append(ret, t)
+			}
+		}
+		return ret
+	}, nil)
+	var updated []string
+	mStore.On("UpdateTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+		updated = append(updated, args.Get(0).(*entity.TaskInstance).ID)
+	}).Return(nil)
+	mStore.On("PatchDagIns", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	SetStore(mStore)
+
+	mKeeper := &MockKeeper{}
+	mKeeper.On("WorkerKey").Return("worker")
+	SetKeeper(mKeeper)
+
+	var pushed []string
+	mExecutor := &MockExecutor{}
+	mExecutor.On("Push", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		pushed = append(pushed, args.Get(1).(*entity.TaskInstance).ID)
+	})
+	SetExecutor(mExecutor)
+
+	// the worker restarts while the dag instance is paused
+	p := &DefParser{interruptedPolicy: InterruptedTaskPolicyRetry}
+	err := p.initialRunningDagIns()
+	assert.NoError(t, err)
+	_, paused := p.pausedDagIns.Load("dag-ins")
+	assert.True(t, paused)
+	assert.Equal(t, []string{"task1"}, updated)
+	assert.Equal(t, entity.TaskInstanceStatusRetrying, tasks[0].Status)
+	assert.Nil(t, pushed)
+
+	dagIns.Cmd = &entity.Command{Name: entity.CommandNameResume}
+	err = p.parseCmd(dagIns)
+	assert.NoError(t, err)
+	_, paused = p.pausedDagIns.Load("dag-ins")
+	assert.False(t, paused)
+	assert.Equal(t, entity.DagInstanceStatusRunning, dagIns.Status)
+	assert.Equal(t, []string{"task1"}, pushed)
+}
+
 func TestDefParser(t *testing.T) {
 	pubDagIns := []*entity.DagInstance{
 		{},
@@ -1297,7 +2427,8 @@ func TestDefParser(t *testing.T) {
 		{Status: entity.TaskInstanceStatusInit},
 	}
 	wg := sync.WaitGroup{}
-	wg.Add(4)
+	// list task instances twice, the first time is for recovering interrupted tasks
+	wg.Add(5)
 	mStore := &MockStore{}
 	mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
 		wg.Done()
@@ -1319,7 +2450,7 @@ func TestDefParser(t *testing.T) {
 	})
 	SetExecutor(mExecutor)
 
-	def := NewDefParser(100, time.Second)
+	def := NewDefParser(100, time.Second, InterruptedTaskPolicyFail)
 	def.Init()
 	wg.Wait()
 	def.Close()
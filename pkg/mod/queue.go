@@ -0,0 +1,139 @@
+package mod
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+)
+
+// taskQueue is a bounded blocking queue of task instances,
+// the one with higher priority will be popped first, and same priority ones keep FIFO order
+type taskQueue struct {
+	items    taskQueueItems
+	seq      uint64
+	capacity int
+	closed   bool
+
+	mutex    sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+}
+
+func newTaskQueue(capacity int) *taskQueue {
+	q := &taskQueue{
+		capacity: capacity,
+	}
+	q.notEmpty = sync.NewCond(&q.mutex)
+	q.notFull = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push will block until the queue is not full, return false if queue is closed
+func (q *taskQueue) Push(taskIns *entity.TaskInstance, priority int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && q.capacity > 0 && len(q.items) >= q.capacity {
+		q.notFull.Wait()
+	}
+	return q.push(taskIns, priority)
+}
+
+// TryPush will return false immediately if queue is full or closed
+func (q *taskQueue) TryPush(taskIns *entity.TaskInstance, priority int) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.capacity > 0 && len(q.items) >= q.capacity {
+		return false
+	}
+	return q.push(taskIns, priority)
+}
+
+func (q *taskQueue) push(taskIns *entity.TaskInstance, priority int) bool {
+	if q.closed {
+		return false
+	}
+
+	q.seq++
+	heap.Push(&q.items, &taskQueueItem{
+		taskIns:  taskIns,
+		priority: priority,
+		seq:      q.seq,
+	})
+	q.notEmpty.Signal()
+	return true
+}
+
+// Pop will block until the queue is not empty,
+// return false if queue is closed and all items are popped
+func (q *taskQueue) Pop() (*entity.TaskInstance, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && len(q.items) == 0 {
+		q.notEmpty.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	item := heap.Pop(&q.items).(*taskQueueItem)
+	q.notFull.Signal()
+	return item.taskIns, true
+}
+
+// Len
+func (q *taskQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// Close the queue, the items remained can still be popped
+func (q *taskQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+type taskQueueItem struct {
+	taskIns  *entity.TaskInstance
+	priority int
+	seq      uint64
+}
+
+// taskQueueItems implement heap.Interface
+type taskQueueItems []*taskQueueItem
+
+func (items taskQueueItems) Len() int {
+	return len(items)
+}
+
+func (items taskQueueItems) Less(i, j int) bool {
+	if items[i].priority != items[j].priority {
+		return items[i].priority > items[j].priority
+	}
+	return items[i].seq < items[j].seq
+}
+
+func (items taskQueueItems) Swap(i, j int) {
+	items[i], items[j] = items[j], items[i]
+}
+
+func (items *taskQueueItems) Push(x interface{}) {
+	*items = append(*items, x.(*taskQueueItem))
+}
+
+func (items *taskQueueItems) Pop() interface{} {
+	old := *items
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*items = old[:n-1]
+	return item
+}
@@ -0,0 +1,79 @@
+package mod
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskQueue_Pop(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		givePriority []int
+		wantIDs      []string
+	}{
+		{
+			caseDesc:     "same priority",
+			givePriority: []int{0, 0, 0},
+			wantIDs:      []string{"0", "1", "2"},
+		},
+		{
+			caseDesc:     "different priority",
+			givePriority: []int{0, 1, -1, 1, 2},
+			wantIDs:      []string{"4", "1", "3", "0", "2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			q := newTaskQueue(len(tc.givePriority))
+			for i, p := range tc.givePriority {
+				ok := q.Push(&entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: fmt.Sprint(i)}}, p)
+				assert.True(t, ok)
+			}
+			q.Close()
+
+			var ids []string
+			for {
+				taskIns, ok := q.Pop()
+				if !ok {
+					break
+				}
+				ids = append(ids, taskIns.ID)
+			}
+			assert.Equal(t, tc.wantIDs, ids)
+		})
+	}
+}
+
+func TestTaskQueue_Block(t *testing.T) {
+	q := newTaskQueue(1)
+	assert.True(t, q.TryPush(&entity.TaskInstance{}, 0))
+	assert.False(t, q.TryPush(&entity.TaskInstance{}, 0))
+
+	pushed := make(chan bool)
+	go func() {
+		pushed <- q.Push(&entity.TaskInstance{}, 0)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push should be blocked when queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, ok := q.Pop()
+	assert.True(t, ok)
+	assert.True(t, <-pushed)
+	assert.Equal(t, 1, q.Len())
+
+	q.Close()
+	assert.False(t, q.Push(&entity.TaskInstance{}, 0))
+	assert.False(t, q.TryPush(&entity.TaskInstance{}, 0))
+	_, ok = q.Pop()
+	assert.True(t, ok)
+	_, ok = q.Pop()
+	assert.False(t, ok)
+}
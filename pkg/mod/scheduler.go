@@ -0,0 +1,155 @@
+package mod
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+)
+
+// cronMissedTolerance is the max delay of a cron point which will not be treated as missed
+const cronMissedTolerance = time.Minute
+
+// DefScheduler used to create dag instances according to the cron expression of dag,
+// it should only work on leader node
+type DefScheduler struct {
+	closeCh chan struct{}
+
+	wg sync.WaitGroup
+}
+
+// NewDefScheduler
+func NewDefScheduler() *DefScheduler {
+	return &DefScheduler{
+		closeCh: make(chan struct{}),
+	}
+}
+
+// Init
+func (s *DefScheduler) Init() {
+	s.wg.Add(1)
+	go s.WatchCronDags()
+}
+
+// WatchCronDags
+func (s *DefScheduler) WatchCronDags() {
+	closed := false
+	timerCh := time.Tick(time.Second)
+	for !closed {
+		select {
+		case <-s.closeCh:
+			closed = true
+		case <-timerCh:
+			if err := s.Do(); err != nil {
+				s.handleErr(err)
+			}
+		}
+	}
+	s.wg.Done()
+}
+
+// Do schedule all cron dags
+func (s *DefScheduler) Do() error {
+	dags, err := GetStore().ListDag(&ListDagInput{
+		Status:  []entity.DagStatus{entity.DagStatusNormal},
+		HasCron: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, dag := range dags {
+		// a broken dag should not block others
+		if err := s.scheduleDag(dag, now); err != nil {
+			s.handleErr(fmt.Errorf("schedule dag[%s] failed: %w", dag.ID, err))
+		}
+	}
+	return nil
+}
+
+func (s *DefScheduler) scheduleDag(dag *entity.Dag, now time.Time) error {
+	dagSch, err := GetStore().GetDagSchedule(dag.ID)
+	if err != nil {
+		if !errors.Is(err, data.ErrDataNotFound) {
+			return err
+		}
+		if _, err := dag.CronSchedule(); err != nil {
+			return err
+		}
+		// first time we meet the dag, start counting from now
+		return GetStore().UpsertDagSchedule(&entity.DagSchedule{
+			BaseInfo:    entity.BaseInfo{ID: dag.ID},
+			LastFiredAt: now.Unix(),
+		})
+	}
+
+	points, err := dag.CronTimes(time.Unix(dagSch.LastFiredAt, 0), now)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return nil
+	}
+
+	for _, p := range catchUpPoints(dag, points, now) {
+		dagIns, err := dag.RunScheduled(entity.TriggerCron, p)
+		if err != nil {
+			return err
+		}
+		// the id is determined by fire time, so a new leader will not fire the same point
+		// again even if previous leader crashed before persisting schedule
+		dagIns.ID = CronDagInsID(dag.ID, p)
+		if err := GetStore().CreateDagIns(dagIns); err != nil && !errors.Is(err, data.ErrDataConflicted) {
+			return err
+		}
+	}
+
+	dagSch.LastFiredAt = points[len(points)-1].Unix()
+	return GetStore().UpsertDagSchedule(dagSch)
+}
+
+// catchUpPoints pick the points which should be fired according to the catch-up policy of dag
+func catchUpPoints(dag *entity.Dag, points []time.Time, now time.Time) []time.Time {
+	latest := points[len(points)-1]
+	switch dag.CatchUp {
+	case entity.CatchUpNone:
+		// the latest point is not a missed one if it is just passed
+		if now.Sub(latest) <= cronMissedTolerance {
+			return []time.Time{latest}
+		}
+		return nil
+	case entity.CatchUpAll:
+		limit := dag.CatchUpLimit
+		if limit <= 0 {
+			limit = entity.DefaultCatchUpLimit
+		}
+		if len(points) > limit {
+			return points[len(points)-limit:]
+		}
+		return points
+	default:
+		return []time.Time{latest}
+	}
+}
+
+// CronDagInsID return the id of dag instance which fired by cron at the given time
+func CronDagInsID(dagId string, fireAt time.Time) string {
+	return fmt.Sprintf("cron-%s-%d", dagId, fireAt.Unix())
+}
+
+func (s *DefScheduler) handleErr(err error) {
+	log.Error("schedule cron dag failed",
+		"module", "scheduler",
+		"err", err)
+}
+
+// Close component
+func (s *DefScheduler) Close() {
+	close(s.closeCh)
+	s.wg.Wait()
+}
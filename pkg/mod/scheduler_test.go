@@ -0,0 +1,255 @@
+package mod
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDefScheduler_scheduleDag(t *testing.T) {
+	now := time.Date(2022, 1, 1, 10, 30, 30, 0, time.UTC)
+	tests := []struct {
+		caseDesc          string
+		giveDag           *entity.Dag
+		giveSchedule      *entity.DagSchedule
+		giveGetErr        error
+		giveCreateErr     error
+		wantErr           error
+		wantCreatedTimes  []time.Time
+		wantUpsertFiredAt int64
+	}{
+		{
+			caseDesc: "first meet",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "* * * * *",
+				Status:   entity.DagStatusNormal,
+			},
+			giveGetErr:        data.ErrDataNotFound,
+			wantUpsertFiredAt: now.Unix(),
+		},
+		{
+			caseDesc: "first meet with invalid cron",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "invalid",
+				Status:   entity.DagStatusNormal,
+			},
+			giveGetErr: data.ErrDataNotFound,
+			wantErr:    fmt.Errorf("parse cron[invalid] failed: %w", fmt.Errorf("expected 5 to 6 fields, found 1: [invalid]")),
+		},
+		{
+			caseDesc: "fire latest point",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "*/10 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: now.Add(-time.Hour).Unix(),
+			},
+			wantCreatedTimes:  []time.Time{time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC)},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "six fields",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0/20 * * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: now.Add(-15 * time.Second).Unix(),
+			},
+			wantCreatedTimes:  []time.Time{time.Date(2022, 1, 1, 10, 30, 20, 0, time.UTC)},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 20, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up all",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "*/10 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+				CatchUp:  entity.CatchUpAll,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(),
+			},
+			wantCreatedTimes: []time.Time{
+				time.Date(2022, 1, 1, 10, 10, 0, 0, time.UTC),
+				time.Date(2022, 1, 1, 10, 20, 0, 0, time.UTC),
+				time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC),
+			},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up all with limit",
+			giveDag: &entity.Dag{
+				BaseInfo:     entity.BaseInfo{ID: "dag"},
+				Cron:         "*/10 * * * *",
+				Timezone:     "UTC",
+				Status:       entity.DagStatusNormal,
+				CatchUp:      entity.CatchUpAll,
+				CatchUpLimit: 2,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(),
+			},
+			wantCreatedTimes: []time.Time{
+				time.Date(2022, 1, 1, 10, 20, 0, 0, time.UTC),
+				time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC),
+			},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up none with just passed point",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "*/10 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+				CatchUp:  entity.CatchUpNone,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(),
+			},
+			wantCreatedTimes:  []time.Time{time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC)},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "catch up none with missed points",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0 * * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+				CatchUp:  entity.CatchUpNone,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: time.Date(2022, 1, 1, 8, 0, 0, 0, time.UTC).Unix(),
+			},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "not due",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "0 * * * *",
+				Status:   entity.DagStatusNormal,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: time.Date(2022, 1, 1, 10, 0, 0, 0, time.UTC).Unix(),
+			},
+		},
+		{
+			caseDesc: "fired by previous leader",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "30 10 * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: now.Add(-24 * time.Hour).Unix(),
+			},
+			giveCreateErr:     fmt.Errorf("conflicted: %w", data.ErrDataConflicted),
+			wantCreatedTimes:  []time.Time{time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC)},
+			wantUpsertFiredAt: time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC).Unix(),
+		},
+		{
+			caseDesc: "create failed",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "30 10 * * *",
+				Timezone: "UTC",
+				Status:   entity.DagStatusNormal,
+			},
+			giveSchedule: &entity.DagSchedule{
+				BaseInfo:    entity.BaseInfo{ID: "dag"},
+				LastFiredAt: now.Add(-24 * time.Hour).Unix(),
+			},
+			giveCreateErr:    fmt.Errorf("create failed"),
+			wantErr:          fmt.Errorf("create failed"),
+			wantCreatedTimes: []time.Time{time.Date(2022, 1, 1, 10, 30, 0, 0, time.UTC)},
+		},
+		{
+			caseDesc: "get schedule failed",
+			giveDag: &entity.Dag{
+				BaseInfo: entity.BaseInfo{ID: "dag"},
+				Cron:     "* * * * *",
+				Status:   entity.DagStatusNormal,
+			},
+			giveGetErr: fmt.Errorf("get failed"),
+			wantErr:    fmt.Errorf("get failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var createdIns []*entity.DagInstance
+			var upsertFiredAt int64
+			mStore := &MockStore{}
+			mStore.On("GetDagSchedule", tc.giveDag.ID).Return(tc.giveSchedule, tc.giveGetErr)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				createdIns = append(createdIns, args.Get(0).(*entity.DagInstance))
+			}).Return(tc.giveCreateErr)
+			mStore.On("UpsertDagSchedule", mock.Anything).Run(func(args mock.Arguments) {
+				sch := args.Get(0).(*entity.DagSchedule)
+				assert.Equal(t, tc.giveDag.ID, sch.ID)
+				upsertFiredAt = sch.LastFiredAt
+			}).Return(nil)
+			SetStore(mStore)
+
+			s := NewDefScheduler()
+			err := s.scheduleDag(tc.giveDag, now)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, len(tc.wantCreatedTimes), len(createdIns))
+			for i, p := range tc.wantCreatedTimes {
+				if i >= len(createdIns) {
+					break
+				}
+				assert.Equal(t, CronDagInsID(tc.giveDag.ID, p), createdIns[i].ID)
+				assert.Equal(t, entity.TriggerCron, createdIns[i].Trigger)
+				assert.Equal(t, p.Format(time.RFC3339), createdIns[i].Vars[entity.VarKeyScheduleTime].Value)
+			}
+			assert.Equal(t, tc.wantUpsertFiredAt, upsertFiredAt)
+		})
+	}
+}
+
+func TestDefScheduler_Do(t *testing.T) {
+	mStore := &MockStore{}
+	mStore.On("ListDag", &ListDagInput{
+		Status:  []entity.DagStatus{entity.DagStatusNormal},
+		HasCron: true,
+	}).Return([]*entity.Dag{
+		{BaseInfo: entity.BaseInfo{ID: "broken"}, Cron: "invalid", Status: entity.DagStatusNormal},
+		{BaseInfo: entity.BaseInfo{ID: "dag"}, Cron: "* * * * *", Status: entity.DagStatusNormal},
+	}, nil)
+	mStore.On("GetDagSchedule", mock.Anything).Return(nil, data.ErrDataNotFound)
+	mStore.On("UpsertDagSchedule", mock.Anything).Run(func(args mock.Arguments) {
+		assert.Equal(t, "dag", args.Get(0).(*entity.DagSchedule).ID)
+	}).Return(nil)
+	SetStore(mStore)
+
+	s := NewDefScheduler()
+	err := s.Do()
+	assert.NoError(t, err)
+	mStore.AssertNumberOfCalls(t, "UpsertDagSchedule", 1)
+}
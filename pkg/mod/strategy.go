@@ -0,0 +1,112 @@
+package mod
+
+import (
+	"github.com/shiningrush/fastflow/pkg/entity"
+)
+
+// DispatchStrategy used to choose a worker for the dag instance
+type DispatchStrategy interface {
+	// Pick return the key of chosen worker, the workers will never be empty.
+	// after each picking, dispatcher will increase the "QueuedTaskCnt" of the chosen one,
+	// so the instances dispatched in the same round can be considered
+	Pick(dagIns *entity.DagInstance, workers []*WorkerInfo) string
+}
+
+// RoundRobinStrategy dispatch dag instances to workers in turn, it ignores the load of workers
+type RoundRobinStrategy struct {
+	next int
+}
+
+// NewRoundRobinStrategy
+func NewRoundRobinStrategy() *RoundRobinStrategy {
+	return &RoundRobinStrategy{}
+}
+
+// Pick
+func (s *RoundRobinStrategy) Pick(dagIns *entity.DagInstance, workers []*WorkerInfo) string {
+	key := workers[s.next%len(workers)].Key
+	s.next = (s.next + 1) % len(workers)
+	return key
+}
+
+// LeastLoadedStrategy dispatch dag instance to the worker which has the lowest ratio of
+// busy tasks(running and queued) to executor workers
+type LeastLoadedStrategy struct{}
+
+// NewLeastLoadedStrategy
+func NewLeastLoadedStrategy() *LeastLoadedStrategy {
+	return &LeastLoadedStrategy{}
+}
+
+// Pick
+func (s *LeastLoadedStrategy) Pick(dagIns *entity.DagInstance, workers []*WorkerInfo) string {
+	chosen := workers[0]
+	for _, w := range workers[1:] {
+		if loadRatio(w) < loadRatio(chosen) {
+			chosen = w
+		}
+	}
+	return chosen.Key
+}
+
+func loadRatio(w *WorkerInfo) float64 {
+	capacity := w.ExecutorWorkerCnt
+	// the worker of old version does not report its capacity
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return float64(w.RunningTaskCnt+w.QueuedTaskCnt) / float64(capacity)
+}
+
+// WeightedStrategy dispatch dag instances to workers in proportion to their weights,
+// it uses smooth weighted round-robin, so the instances will not crowd into one worker
+type WeightedStrategy struct {
+	// weights of workers, key is the worker key,
+	// if a worker is not in it, its "ExecutorWorkerCnt" will be used
+	weights map[string]int
+	current map[string]int
+}
+
+// NewWeightedStrategy
+func NewWeightedStrategy(weights map[string]int) *WeightedStrategy {
+	return &WeightedStrategy{
+		weights: weights,
+		current: map[string]int{},
+	}
+}
+
+// Pick
+func (s *WeightedStrategy) Pick(dagIns *entity.DagInstance, workers []*WorkerInfo) string {
+	total := 0
+	var chosen string
+	alive := map[string]struct{}{}
+	for _, w := range workers {
+		weight := s.weight(w)
+		total += weight
+		s.current[w.Key] += weight
+		alive[w.Key] = struct{}{}
+		if chosen == "" || s.current[w.Key] > s.current[chosen] {
+			chosen = w.Key
+		}
+	}
+	s.current[chosen] -= total
+
+	// clean the dead workers
+	for key := range s.current {
+		if _, ok := alive[key]; !ok {
+			delete(s.current, key)
+		}
+	}
+	return chosen
+}
+
+func (s *WeightedStrategy) weight(w *WorkerInfo) int {
+	weight, ok := s.weights[w.Key]
+	if !ok {
+		weight = w.ExecutorWorkerCnt
+	}
+	if weight <= 0 {
+		return 1
+	}
+	return weight
+}
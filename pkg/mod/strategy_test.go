@@ -0,0 +1,91 @@
+package mod
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatchStrategy_Pick(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveStrategy DispatchStrategy
+		giveWorkers  []*WorkerInfo
+		givePickCnt  int
+		wantKeys     []string
+	}{
+		{
+			caseDesc:     "round robin",
+			giveStrategy: NewRoundRobinStrategy(),
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", WorkerLoad: WorkerLoad{RunningTaskCnt: 100}},
+				{Key: "w2"},
+				{Key: "w3"},
+			},
+			givePickCnt: 4,
+			wantKeys:    []string{"w1", "w2", "w3", "w1"},
+		},
+		{
+			caseDesc:     "least loaded",
+			giveStrategy: NewLeastLoadedStrategy(),
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", WorkerLoad: WorkerLoad{RunningTaskCnt: 2, ExecutorWorkerCnt: 4}},
+				{Key: "w2", WorkerLoad: WorkerLoad{RunningTaskCnt: 3, QueuedTaskCnt: 1, ExecutorWorkerCnt: 10}},
+				{Key: "w3", WorkerLoad: WorkerLoad{RunningTaskCnt: 1, ExecutorWorkerCnt: 1}},
+			},
+			givePickCnt: 3,
+			wantKeys:    []string{"w2", "w2", "w2"},
+		},
+		{
+			caseDesc:     "least loaded without capacity",
+			giveStrategy: NewLeastLoadedStrategy(),
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", WorkerLoad: WorkerLoad{RunningTaskCnt: 2}},
+				{Key: "w2", WorkerLoad: WorkerLoad{RunningTaskCnt: 1}},
+			},
+			givePickCnt: 1,
+			wantKeys:    []string{"w2"},
+		},
+		{
+			caseDesc:     "weighted by executor workers",
+			giveStrategy: NewWeightedStrategy(nil),
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1", WorkerLoad: WorkerLoad{ExecutorWorkerCnt: 2}},
+				{Key: "w2", WorkerLoad: WorkerLoad{ExecutorWorkerCnt: 1}},
+			},
+			givePickCnt: 6,
+			wantKeys:    []string{"w1", "w2", "w1", "w1", "w2", "w1"},
+		},
+		{
+			caseDesc:     "weighted by specified weights",
+			giveStrategy: NewWeightedStrategy(map[string]int{"w1": 5, "w2": 1, "w3": 1}),
+			giveWorkers: []*WorkerInfo{
+				{Key: "w1"},
+				{Key: "w2"},
+				{Key: "w3", WorkerLoad: WorkerLoad{ExecutorWorkerCnt: 100}},
+			},
+			givePickCnt: 7,
+			wantKeys:    []string{"w1", "w1", "w2", "w1", "w3", "w1", "w1"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var keys []string
+			for i := 0; i < tc.givePickCnt; i++ {
+				keys = append(keys, tc.giveStrategy.Pick(nil, tc.giveWorkers))
+			}
+			assert.Equal(t, tc.wantKeys, keys)
+		})
+	}
+}
+
+func TestWeightedStrategy_Pick_WorkerChanged(t *testing.T) {
+	s := NewWeightedStrategy(nil)
+	s.Pick(nil, []*WorkerInfo{{Key: "w1"}, {Key: "w2"}})
+	assert.Equal(t, "w3", s.Pick(nil, []*WorkerInfo{{Key: "w3"}}))
+	_, ok := s.current["w1"]
+	assert.False(t, ok)
+	_, ok = s.current["w2"]
+	assert.False(t, ok)
+}
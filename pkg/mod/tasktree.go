@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/utils"
 )
 
 const (
@@ -17,6 +18,7 @@ type TaskInfoGetter interface {
 	GetID() string
 	GetGraphID() string
 	GetStatus() entity.TaskInstanceStatus
+	GetTriggerRule() entity.TriggerRule
 }
 
 // MapTaskInsToGetter
@@ -99,6 +101,9 @@ func buildGraphNodeMap(tasks []TaskInfoGetter) (map[string]*TaskNode, error) {
 		if _, ok := m[tasks[i].GetGraphID()]; ok {
 			return nil, fmt.Errorf("task id is repeat, id: %s", tasks[i].GetGraphID())
 		}
+		if err := tasks[i].GetTriggerRule().Validate(); err != nil {
+			return nil, fmt.Errorf("task[%s] %w", tasks[i].GetGraphID(), err)
+		}
 		m[tasks[i].GetGraphID()] = NewTaskNodeFromGetter(tasks[i])
 	}
 	return m, nil
@@ -113,15 +118,17 @@ type TaskTree struct {
 // NewTaskNodeFromGetter
 func NewTaskNodeFromGetter(instance TaskInfoGetter) *TaskNode {
 	return &TaskNode{
-		TaskInsID: instance.GetID(),
-		Status:    instance.GetStatus(),
+		TaskInsID:   instance.GetID(),
+		Status:      instance.GetStatus(),
+		TriggerRule: instance.GetTriggerRule(),
 	}
 }
 
 // TaskNode
 type TaskNode struct {
-	TaskInsID string
-	Status    entity.TaskInstanceStatus
+	TaskInsID   string
+	Status      entity.TaskInstanceStatus
+	TriggerRule entity.TriggerRule
 
 	children []*TaskNode
 	parents  []*TaskNode
@@ -181,32 +188,62 @@ func bfsCheckCycle(waitQueue []*TaskNode, visited map[string]struct{}, incomplet
 	return
 }
 
-// ComputeStatus
+// ComputeStatus return running if there are any tasks could be executed,
+// otherwise the tree is completed and the status depends on the first failed or blocked task.
+// A failed task fails the tree only when its failure is not handled by the downstream tasks,
+// such as it has no downstream tasks, so the tree succeeds if the all_done cleanup tasks succeed.
 func (t *TaskNode) ComputeStatus() (status TreeStatus, srcTaskInsId string) {
+	var runningId, failedId, blockedId string
+	failedFirst, unhandled := false, false
 	walkNode(t, func(node *TaskNode) bool {
 		switch node.Status {
 		case entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
-			status = TreeStatusFailed
-			srcTaskInsId = node.TaskInsID
-			return true
+			if failedId == "" {
+				failedId, failedFirst = node.TaskInsID, blockedId == ""
+			}
+			if !node.isFailureHandled() {
+				unhandled = true
+			}
 		case entity.TaskInstanceStatusBlocked:
-			status = TreeStatusBlocked
-			srcTaskInsId = node.TaskInsID
-			return true
+			if blockedId == "" {
+				blockedId = node.TaskInsID
+			}
 		case entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped:
-			return true
 		default:
-			status = TreeStatusRunning
-			srcTaskInsId = node.TaskInsID
+			runningId = node.TaskInsID
 			return false
 		}
+		return true
 	}, false)
-	if srcTaskInsId != "" {
-		return
+	if runningId != "" {
+		return TreeStatusRunning, runningId
+	}
+	if unhandled && failedFirst {
+		return TreeStatusFailed, failedId
+	}
+	if blockedId != "" {
+		return TreeStatusBlocked, blockedId
+	}
+	if unhandled {
+		return TreeStatusFailed, failedId
 	}
 	return TreeStatusSuccess, ""
 }
 
+// isFailureHandled means the failed task has downstream tasks and all of them are completed,
+// the failed downstream tasks will be checked by themselves
+func (t *TaskNode) isFailureHandled() bool {
+	if len(t.children) == 0 {
+		return false
+	}
+	for _, c := range t.children {
+		if !c.IsCompleted() {
+			return false
+		}
+	}
+	return true
+}
+
 func walkNode(root *TaskNode, walkFunc func(node *TaskNode) bool, walkChildrenIgnoreStatus bool) {
 	dfsWalk(root, walkFunc, walkChildrenIgnoreStatus)
 }
@@ -222,13 +259,11 @@ func dfsWalk(
 		}
 	}
 
-	// we cannot execute children, but should execute brother nodes
-	if !walkChildrenIgnoreStatus && !root.CanExecuteChild() {
-		return true
-	}
 	for _, c := range root.children {
-		// if children's parent is not just root, we must check it
-		if len(c.parents) > 1 && !c.CanBeExecuted() {
+		// we cannot execute the children whose trigger rule is not meet, but should execute brother nodes,
+		// the skipped or canceled children should be walked because their trigger rule may be never meet
+		if !walkChildrenIgnoreStatus && c.Status != entity.TaskInstanceStatusSkipped &&
+			c.Status != entity.TaskInstanceStatusCanceled && !c.CanBeExecuted() {
 			continue
 		}
 
@@ -249,23 +284,146 @@ func (t *TaskNode) AppendParent(task *TaskNode) {
 	t.parents = append(t.parents, task)
 }
 
-// CanExecuteChild
+// CanExecuteChild means the task is completed without failure, so children with default trigger rule can be executed
 func (t *TaskNode) CanExecuteChild() bool {
 	return t.Status == entity.TaskInstanceStatusSuccess || t.Status == entity.TaskInstanceStatusSkipped
 }
 
-// CanBeExecuted check whether task could be executed
+// IsCompleted means the task is in final status
+func (t *TaskNode) IsCompleted() bool {
+	switch t.Status {
+	case entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped,
+		entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusCanceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsFailed means the task is failed or canceled
+func (t *TaskNode) IsFailed() bool {
+	return t.Status == entity.TaskInstanceStatusFailed || t.Status == entity.TaskInstanceStatusCanceled
+}
+
+// CanBeExecuted check whether the trigger rule of task is meet
 func (t *TaskNode) CanBeExecuted() bool {
 	if len(t.parents) == 0 {
 		return true
 	}
 
+	var success, skipped, failed, completed int
 	for _, p := range t.parents {
-		if !p.CanExecuteChild() {
-			return false
+		switch {
+		case p.Status == entity.TaskInstanceStatusSuccess:
+			success++
+		case p.Status == entity.TaskInstanceStatusSkipped:
+			skipped++
+		case p.IsFailed():
+			failed++
+		}
+		if p.IsCompleted() {
+			completed++
 		}
 	}
-	return true
+
+	switch t.TriggerRule {
+	case entity.TriggerRuleAllSuccess:
+		return success == len(t.parents)
+	case entity.TriggerRuleAllDone:
+		return completed == len(t.parents)
+	case entity.TriggerRuleOneSuccess:
+		return success > 0
+	case entity.TriggerRuleOneFailed:
+		return failed > 0
+	case entity.TriggerRuleAlways:
+		return true
+	default:
+		return success+skipped == len(t.parents)
+	}
+}
+
+// CanNeverBeExecuted means the trigger rule of task can never be meet, such as one_failed task
+// whose upstream tasks are all success, or the default rule task whose upstream task is failed.
+// Failed upstream task is final because the automatic retry does not fail it, the manual retry will reset
+// the downstream tasks canceled by it.
+func (t *TaskNode) CanNeverBeExecuted() bool {
+	if len(t.parents) == 0 || t.CanBeExecuted() {
+		return false
+	}
+
+	switch t.TriggerRule {
+	// a skipped or failed upstream task will never be success
+	case entity.TriggerRuleAllSuccess:
+		for _, p := range t.parents {
+			if p.Status == entity.TaskInstanceStatusSkipped || p.IsFailed() {
+				return true
+			}
+		}
+		return false
+	case entity.TriggerRuleOneSuccess, entity.TriggerRuleOneFailed:
+		for _, p := range t.parents {
+			if !p.IsCompleted() {
+				return false
+			}
+		}
+		return true
+	case entity.TriggerRuleAllDone, entity.TriggerRuleAlways:
+		return false
+	default:
+		return t.hasFailedParent()
+	}
+}
+
+func (t *TaskNode) hasFailedParent() bool {
+	for _, p := range t.parents {
+		if p.IsFailed() {
+			return true
+		}
+	}
+	return false
+}
+
+// SkipUnreachableTasks mark the tasks which can never be executed as skipped until nothing changed,
+// the ones never be executed because of upstream failure are marked as canceled, so that the failure is passed down.
+// It returns the skipped and canceled task instance ids and the ones become executable because of them.
+func (t *TaskNode) SkipUnreachableTasks() (skipped, canceled, executable []string) {
+	var nodes []*TaskNode
+	visited := map[string]bool{}
+	walkNode(t, func(node *TaskNode) bool {
+		if !visited[node.TaskInsID] {
+			visited[node.TaskInsID] = true
+			nodes = append(nodes, node)
+		}
+		return true
+	}, true)
+
+	var changedNodes []*TaskNode
+	for changed := true; changed; {
+		changed = false
+		for _, n := range nodes {
+			if n.Status != entity.TaskInstanceStatusInit || !n.CanNeverBeExecuted() {
+				continue
+			}
+			if n.hasFailedParent() {
+				n.Status = entity.TaskInstanceStatusCanceled
+				canceled = append(canceled, n.TaskInsID)
+			} else {
+				n.Status = entity.TaskInstanceStatusSkipped
+				skipped = append(skipped, n.TaskInsID)
+			}
+			changedNodes = append(changedNodes, n)
+			changed = true
+		}
+	}
+
+	for _, n := range changedNodes {
+		for _, c := range n.children {
+			if c.Executable() && !utils.StringsContain(executable, c.TaskInsID) {
+				executable = append(executable, c.TaskInsID)
+			}
+		}
+	}
+	return
 }
 
 // GetExecutableTaskIds is unique task id map
@@ -286,14 +444,11 @@ func (t *TaskNode) GetNextTaskIds(completedOrRetryTask *entity.TaskInstance) (ex
 			find = true
 			node.Status = completedOrRetryTask.Status
 
-			if node.Status == entity.TaskInstanceStatusInit {
+			if node.Status == entity.TaskInstanceStatusInit || node.Status == entity.TaskInstanceStatusRetrying {
 				executable = append(executable, node.TaskInsID)
 				return false
 			}
 
-			if !node.CanExecuteChild() {
-				return false
-			}
 			for i := range node.children {
 				if node.children[i].Executable() {
 					executable = append(executable, node.children[i].TaskInsID)
@@ -307,22 +462,100 @@ func (t *TaskNode) GetNextTaskIds(completedOrRetryTask *entity.TaskInstance) (ex
 	return
 }
 
+// GetDescendantIds return the ids of task instances which depend on the given one directly or indirectly
+func (t *TaskNode) GetDescendantIds(taskInsId string) (descendants []string, find bool) {
+	var start *TaskNode
+	walkNode(t, func(node *TaskNode) bool {
+		if node.TaskInsID == taskInsId {
+			start = node
+			return false
+		}
+		return true
+	}, true)
+	if start == nil {
+		return
+	}
+
+	visited := map[string]bool{}
+	waitQueue := append([]*TaskNode{}, start.children...)
+	for len(waitQueue) > 0 {
+		cur := waitQueue[0]
+		waitQueue = waitQueue[1:]
+		if visited[cur.TaskInsID] {
+			continue
+		}
+		visited[cur.TaskInsID] = true
+		descendants = append(descendants, cur.TaskInsID)
+		waitQueue = append(waitQueue, cur.children...)
+	}
+	return descendants, true
+}
+
+// SkipUnchosenBranches mark the children of branch task which are not chosen as skipped,
+// and their descendants will be skipped recursively only if all parents are skipped, so the join node can still run.
+// It returns the skipped task instance ids and the ones become executable because of skipping.
+func (t *TaskNode) SkipUnchosenBranches(branchTaskInsId string, chosenTaskInsIds []string) (skipped, executable []string) {
+	var branch *TaskNode
+	walkNode(t, func(node *TaskNode) bool {
+		if node.TaskInsID == branchTaskInsId {
+			branch = node
+			return false
+		}
+		return true
+	}, true)
+	if branch == nil {
+		return
+	}
+
+	var waitQueue, skippedNodes []*TaskNode
+	for _, c := range branch.children {
+		if !utils.StringsContain(chosenTaskInsIds, c.TaskInsID) {
+			waitQueue = append(waitQueue, c)
+		}
+	}
+	for len(waitQueue) > 0 {
+		cur := waitQueue[0]
+		waitQueue = waitQueue[1:]
+		// only the task which is not started can be skipped
+		if cur.Status != entity.TaskInstanceStatusInit {
+			continue
+		}
+		cur.Status = entity.TaskInstanceStatusSkipped
+		skipped = append(skipped, cur.TaskInsID)
+		skippedNodes = append(skippedNodes, cur)
+		for _, c := range cur.children {
+			if c.isAllParentsSkipped() {
+				waitQueue = append(waitQueue, c)
+			}
+		}
+	}
+
+	for _, n := range skippedNodes {
+		for _, c := range n.children {
+			if c.Executable() && !utils.StringsContain(executable, c.TaskInsID) {
+				executable = append(executable, c.TaskInsID)
+			}
+		}
+	}
+	return
+}
+
+func (t *TaskNode) isAllParentsSkipped() bool {
+	for _, p := range t.parents {
+		if p.Status != entity.TaskInstanceStatusSkipped {
+			return false
+		}
+	}
+	return true
+}
+
 // Executable
 func (t *TaskNode) Executable() bool {
 	if t.Status == entity.TaskInstanceStatusInit ||
 		t.Status == entity.TaskInstanceStatusRetrying ||
 		t.Status == entity.TaskInstanceStatusContinue ||
 		t.Status == entity.TaskInstanceStatusEnding {
-		if len(t.parents) == 0 {
-			return true
-		}
-
-		for i := range t.parents {
-			if !t.parents[i].CanExecuteChild() {
-				return false
-			}
-		}
-		return true
+		return t.CanBeExecuted()
 	}
 	return false
 }
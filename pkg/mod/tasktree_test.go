@@ -209,6 +209,22 @@ func TestBuildRootNode(t *testing.T) {
 			wantRoot: nil,
 			wantErr:  fmt.Errorf("does not find task[r1-child1] depend: root2"),
 		},
+		{
+			caseDesc: "invalid trigger rule",
+			giveDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "id",
+				},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{
+					TaskID:      "root1",
+					TriggerRule: "test",
+				},
+			},
+			wantRoot: nil,
+			wantErr:  fmt.Errorf("task[root1] %w", fmt.Errorf("trigger rule[test] is invalid")),
+		},
 		{
 			caseDesc: "no start nodes",
 			giveDagIns: &entity.DagInstance{
@@ -529,6 +545,37 @@ func TestTaskNode_GetNextTaskIds(t *testing.T) {
 			},
 			wantFind: true,
 		},
+		{
+			caseDesc: "root task retrying",
+			giveTask: &entity.TaskInstance{
+				BaseInfo: entity.BaseInfo{
+					ID: "root",
+				},
+				Status: entity.TaskInstanceStatusRetrying,
+			},
+			giveTasks: []*MockTaskInfoGetter{
+				{
+					ID:     "root",
+					Status: entity.TaskInstanceStatusRunning,
+				},
+				{
+					ID:     "child1",
+					Status: entity.TaskInstanceStatusInit,
+					Depend: []string{"root"},
+				},
+			},
+			wantTaskNode: &TaskNode{
+				TaskInsID: "root",
+				Status:    entity.TaskInstanceStatusRetrying,
+				children: []*TaskNode{
+					{TaskInsID: "child1", Status: entity.TaskInstanceStatusInit},
+				},
+			},
+			wantRet: []string{
+				"root",
+			},
+			wantFind: true,
+		},
 		{
 			caseDesc: "child task succeed",
 			giveTask: &entity.TaskInstance{
@@ -967,6 +1014,281 @@ func TestTaskNode_GetExecutableTaskIds(t *testing.T) {
 	}
 }
 
+func TestTaskNode_SkipUnchosenBranches(t *testing.T) {
+	newTask := func(id string, status entity.TaskInstanceStatus, dependOn ...string) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			TaskID:   id,
+			DependOn: dependOn,
+			Status:   status,
+		}
+	}
+
+	tests := []struct {
+		caseDesc       string
+		giveTasks      []*entity.TaskInstance
+		giveChosen     []string
+		wantSkipped    []string
+		wantExecutable []string
+	}{
+		{
+			caseDesc: "join node still run",
+			giveTasks: []*entity.TaskInstance{
+				newTask("branch", entity.TaskInstanceStatusSuccess),
+				newTask("x", entity.TaskInstanceStatusInit, "branch"),
+				newTask("y", entity.TaskInstanceStatusInit, "branch"),
+				newTask("y-child", entity.TaskInstanceStatusInit, "y"),
+				newTask("join", entity.TaskInstanceStatusInit, "x", "y-child"),
+			},
+			giveChosen:  []string{"x"},
+			wantSkipped: []string{"y", "y-child"},
+		},
+		{
+			caseDesc: "join node become executable",
+			giveTasks: []*entity.TaskInstance{
+				newTask("other", entity.TaskInstanceStatusSuccess),
+				newTask("branch", entity.TaskInstanceStatusSuccess),
+				newTask("y", entity.TaskInstanceStatusInit, "branch"),
+				newTask("join", entity.TaskInstanceStatusInit, "other", "y"),
+			},
+			wantSkipped:    []string{"y"},
+			wantExecutable: []string{"join"},
+		},
+		{
+			caseDesc: "all parents skipped",
+			giveTasks: []*entity.TaskInstance{
+				newTask("branch", entity.TaskInstanceStatusSuccess),
+				newTask("x", entity.TaskInstanceStatusInit, "branch"),
+				newTask("y", entity.TaskInstanceStatusInit, "branch"),
+				newTask("z", entity.TaskInstanceStatusInit, "branch"),
+				newTask("join", entity.TaskInstanceStatusInit, "x", "y"),
+			},
+			giveChosen:  []string{"z"},
+			wantSkipped: []string{"x", "y", "join"},
+		},
+		{
+			caseDesc: "started task should not be skipped",
+			giveTasks: []*entity.TaskInstance{
+				newTask("branch", entity.TaskInstanceStatusSuccess),
+				newTask("x", entity.TaskInstanceStatusSuccess, "branch"),
+				newTask("x-child", entity.TaskInstanceStatusInit, "x"),
+			},
+		},
+		{
+			caseDesc: "branch not found",
+			giveTasks: []*entity.TaskInstance{
+				newTask("root", entity.TaskInstanceStatusSuccess),
+				newTask("x", entity.TaskInstanceStatusInit, "root"),
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			root := MustBuildRootNode(MapTaskInsToGetter(tc.giveTasks))
+			skipped, executable := root.SkipUnchosenBranches("branch", tc.giveChosen)
+			assert.Equal(t, tc.wantSkipped, skipped)
+			assert.Equal(t, tc.wantExecutable, executable)
+		})
+	}
+}
+
+func TestTaskNode_GetDescendantIds(t *testing.T) {
+	newTask := func(id string, dependOn ...string) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			TaskID:   id,
+			DependOn: dependOn,
+			Status:   entity.TaskInstanceStatusSuccess,
+		}
+	}
+	root := MustBuildRootNode(MapTaskInsToGetter([]*entity.TaskInstance{
+		newTask("start"),
+		newTask("x", "start"),
+		newTask("y", "start"),
+		newTask("x-child", "x"),
+		newTask("join", "x-child", "y"),
+		newTask("other"),
+	}))
+
+	tests := []struct {
+		caseDesc        string
+		giveTaskInsId   string
+		wantDescendants []string
+		wantFind        bool
+	}{
+		{
+			caseDesc:        "middle task",
+			giveTaskInsId:   "x",
+			wantDescendants: []string{"x-child", "join"},
+			wantFind:        true,
+		},
+		{
+			caseDesc:        "shared descendants",
+			giveTaskInsId:   "start",
+			wantDescendants: []string{"x", "y", "x-child", "join"},
+			wantFind:        true,
+		},
+		{
+			caseDesc:      "leaf task",
+			giveTaskInsId: "other",
+			wantFind:      true,
+		},
+		{
+			caseDesc:      "not found",
+			giveTaskInsId: "unknown",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			descendants, find := root.GetDescendantIds(tc.giveTaskInsId)
+			assert.Equal(t, tc.wantDescendants, descendants)
+			assert.Equal(t, tc.wantFind, find)
+		})
+	}
+}
+
+func TestTaskNode_CanBeExecuted(t *testing.T) {
+	newNode := func(rule entity.TriggerRule, parentStatus ...entity.TaskInstanceStatus) *TaskNode {
+		n := &TaskNode{Status: entity.TaskInstanceStatusInit, TriggerRule: rule}
+		for _, s := range parentStatus {
+			n.AppendParent(&TaskNode{Status: s})
+		}
+		return n
+	}
+	success, skipped, failed, running := entity.TaskInstanceStatusSuccess, entity.TaskInstanceStatusSkipped,
+		entity.TaskInstanceStatusFailed, entity.TaskInstanceStatusRunning
+
+	tests := []struct {
+		caseDesc      string
+		giveTaskNode  *TaskNode
+		wantExecuted  bool
+		wantNeverMeet bool
+	}{
+		{caseDesc: "default", giveTaskNode: newNode("", success, skipped), wantExecuted: true},
+		{caseDesc: "default with failed", giveTaskNode: newNode("", success, failed), wantNeverMeet: true},
+		{caseDesc: "none_failed", giveTaskNode: newNode(entity.TriggerRuleNoneFailed, skipped, skipped), wantExecuted: true},
+		{caseDesc: "all_success", giveTaskNode: newNode(entity.TriggerRuleAllSuccess, success, success), wantExecuted: true},
+		{caseDesc: "all_success with skipped", giveTaskNode: newNode(entity.TriggerRuleAllSuccess, success, skipped), wantNeverMeet: true},
+		{caseDesc: "all_success with failed", giveTaskNode: newNode(entity.TriggerRuleAllSuccess, skipped, failed), wantNeverMeet: true},
+		{caseDesc: "all_done", giveTaskNode: newNode(entity.TriggerRuleAllDone, success, failed, skipped), wantExecuted: true},
+		{caseDesc: "all_done with running", giveTaskNode: newNode(entity.TriggerRuleAllDone, failed, running)},
+		{caseDesc: "none_failed with failed", giveTaskNode: newNode(entity.TriggerRuleNoneFailed, skipped, failed), wantNeverMeet: true},
+		{caseDesc: "one_success", giveTaskNode: newNode(entity.TriggerRuleOneSuccess, success, running), wantExecuted: true},
+		{caseDesc: "one_success with all skipped", giveTaskNode: newNode(entity.TriggerRuleOneSuccess, skipped, skipped), wantNeverMeet: true},
+		{caseDesc: "one_success with failed", giveTaskNode: newNode(entity.TriggerRuleOneSuccess, skipped, failed), wantNeverMeet: true},
+		{caseDesc: "one_success with running", giveTaskNode: newNode(entity.TriggerRuleOneSuccess, failed, running)},
+		{caseDesc: "one_failed", giveTaskNode: newNode(entity.TriggerRuleOneFailed, failed, running), wantExecuted: true},
+		{caseDesc: "one_failed with running", giveTaskNode: newNode(entity.TriggerRuleOneFailed, success, running)},
+		{caseDesc: "one_failed with all success", giveTaskNode: newNode(entity.TriggerRuleOneFailed, success, success), wantNeverMeet: true},
+		{caseDesc: "always", giveTaskNode: newNode(entity.TriggerRuleAlways, running, failed), wantExecuted: true},
+		{caseDesc: "no parents", giveTaskNode: newNode(entity.TriggerRuleOneFailed), wantExecuted: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantExecuted, tc.giveTaskNode.CanBeExecuted())
+			assert.Equal(t, tc.wantNeverMeet, tc.giveTaskNode.CanNeverBeExecuted())
+		})
+	}
+}
+
+func TestTaskNode_TriggerRule(t *testing.T) {
+	newTask := func(id string, status entity.TaskInstanceStatus, rule entity.TriggerRule, dependOn ...string) *entity.TaskInstance {
+		return &entity.TaskInstance{
+			BaseInfo:    entity.BaseInfo{ID: id},
+			TaskID:      id,
+			DependOn:    dependOn,
+			Status:      status,
+			TriggerRule: rule,
+		}
+	}
+
+	tests := []struct {
+		caseDesc       string
+		giveTasks      []*entity.TaskInstance
+		wantSkipped    []string
+		wantCanceled   []string
+		wantExecutable []string
+		wantStatus     TreeStatus
+		wantSrcId      string
+	}{
+		{
+			caseDesc: "cleanup after failure",
+			giveTasks: []*entity.TaskInstance{
+				newTask("task1", entity.TaskInstanceStatusFailed, ""),
+				newTask("task2", entity.TaskInstanceStatusInit, "", "task1"),
+				newTask("cleanup", entity.TaskInstanceStatusInit, entity.TriggerRuleAllDone, "task1"),
+				newTask("notify", entity.TaskInstanceStatusInit, entity.TriggerRuleOneFailed, "task1"),
+			},
+			wantCanceled:   []string{"task2"},
+			wantExecutable: []string{"cleanup", "notify"},
+			wantStatus:     TreeStatusRunning,
+			wantSrcId:      "cleanup",
+		},
+		{
+			caseDesc: "failed after cleanup",
+			giveTasks: []*entity.TaskInstance{
+				newTask("task1", entity.TaskInstanceStatusFailed, ""),
+				newTask("task2", entity.TaskInstanceStatusInit, "", "task1"),
+				newTask("cleanup", entity.TaskInstanceStatusSuccess, entity.TriggerRuleAllDone, "task1"),
+			},
+			wantCanceled: []string{"task2"},
+			wantStatus:   TreeStatusFailed,
+			wantSrcId:    "task1",
+		},
+		{
+			caseDesc: "success after cleanup",
+			giveTasks: []*entity.TaskInstance{
+				newTask("task1", entity.TaskInstanceStatusFailed, ""),
+				newTask("cleanup", entity.TaskInstanceStatusSuccess, entity.TriggerRuleAllDone, "task1"),
+				newTask("notify", entity.TaskInstanceStatusSuccess, entity.TriggerRuleOneFailed, "task1"),
+			},
+			wantStatus: TreeStatusSuccess,
+		},
+		{
+			caseDesc: "all_success below failed task",
+			giveTasks: []*entity.TaskInstance{
+				newTask("task1", entity.TaskInstanceStatusFailed, ""),
+				newTask("task2", entity.TaskInstanceStatusInit, entity.TriggerRuleAllSuccess, "task1"),
+				newTask("task3", entity.TaskInstanceStatusInit, "", "task2"),
+				newTask("final", entity.TaskInstanceStatusInit, entity.TriggerRuleAllDone, "task3"),
+			},
+			wantCanceled:   []string{"task2", "task3"},
+			wantExecutable: []string{"final"},
+			wantStatus:     TreeStatusRunning,
+			wantSrcId:      "final",
+		},
+		{
+			caseDesc: "skip notification when succeed",
+			giveTasks: []*entity.TaskInstance{
+				newTask("task1", entity.TaskInstanceStatusSuccess, ""),
+				newTask("notify", entity.TaskInstanceStatusInit, entity.TriggerRuleOneFailed, "task1"),
+				newTask("notify-child", entity.TaskInstanceStatusInit, entity.TriggerRuleAllSuccess, "notify"),
+				newTask("final", entity.TaskInstanceStatusInit, "", "notify"),
+			},
+			wantSkipped:    []string{"notify", "notify-child"},
+			wantExecutable: []string{"final"},
+			wantStatus:     TreeStatusRunning,
+			wantSrcId:      "final",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			root := MustBuildRootNode(MapTaskInsToGetter(tc.giveTasks))
+			skipped, canceled, _ := root.SkipUnreachableTasks()
+			assert.Equal(t, tc.wantSkipped, skipped)
+			assert.Equal(t, tc.wantCanceled, canceled)
+			assert.Equal(t, tc.wantExecutable, root.GetExecutableTaskIds())
+			status, srcId := root.ComputeStatus()
+			assert.Equal(t, tc.wantStatus, status)
+			assert.Equal(t, tc.wantSrcId, srcId)
+		})
+	}
+}
+
 func TestTaskNode_Executable(t *testing.T) {
 	tests := []struct {
 		caseDesc     string
@@ -1,16 +1,38 @@
 package mod
 
 import (
+	"errors"
 	"fmt"
+	"math/rand"
 	"sync"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/event"
 	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/shiningrush/goevent"
 )
 
 const DefFailedReason = "force failed by watch dog because it execute too long"
 
+var unfinishedTaskInsStatus = []entity.TaskInstanceStatus{
+	entity.TaskInstanceStatusInit,
+	entity.TaskInstanceStatusRunning,
+	entity.TaskInstanceStatusEnding,
+	entity.TaskInstanceStatusRetrying,
+	entity.TaskInstanceStatusBlocked,
+	entity.TaskInstanceStatusContinue,
+}
+
+var unfinishedDagInsStatus = []entity.DagInstanceStatus{
+	entity.DagInstanceStatusInit,
+	entity.DagInstanceStatusScheduled,
+	entity.DagInstanceStatusRunning,
+	entity.DagInstanceStatusBlocked,
+	entity.DagInstanceStatusPaused,
+}
+
 // DefWatchDog
 type DefWatchDog struct {
 	dagScheduledTimeout time.Duration
@@ -33,6 +55,14 @@ func (wd *DefWatchDog) Init() {
 	go wd.watchWrapper(wd.handleExpiredTaskIns)
 	wd.wg.Add(1)
 	go wd.watchWrapper(wd.handleLeftBehindDagIns)
+	wd.wg.Add(1)
+	go wd.watchWrapper(wd.handleTimeoutDagIns)
+	wd.wg.Add(1)
+	go wd.watchWrapper(wd.handleSlaMissed)
+	wd.wg.Add(1)
+	go wd.watchWrapper(wd.handleCanceledDagIns)
+	wd.wg.Add(1)
+	go wd.watchWrapper(wd.handleDeadWorkerDagIns)
 }
 
 // Close
@@ -57,6 +87,8 @@ func (wd *DefWatchDog) watchWrapper(do func() error) {
 	wd.wg.Done()
 }
 
+// handleExpiredTaskIns send expire command to the workers of expired task instances,
+// the worker will cancel them and fail them, then finalize the dag instance
 func (wd *DefWatchDog) handleExpiredTaskIns() error {
 	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
 		Status:  []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
@@ -69,20 +101,29 @@ func (wd *DefWatchDog) handleExpiredTaskIns() error {
 		return nil
 	}
 
+	var dagInsIds []string
+	expiredIds := map[string][]string{}
 	for i := range taskIns {
-		if err := GetStore().PatchDagIns(&entity.DagInstance{
-			BaseInfo: entity.BaseInfo{ID: taskIns[i].DagInsID},
-			Status:   entity.DagInstanceStatusFailed,
-		}); err != nil {
-			return fmt.Errorf("patch expired dag instance[%s] failed: %s", taskIns[i].DagInsID, err)
+		if _, ok := expiredIds[taskIns[i].DagInsID]; !ok {
+			dagInsIds = append(dagInsIds, taskIns[i].DagInsID)
 		}
+		expiredIds[taskIns[i].DagInsID] = append(expiredIds[taskIns[i].DagInsID], taskIns[i].ID)
+	}
 
-		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
-			BaseInfo: entity.BaseInfo{ID: taskIns[i].ID},
-			Status:   entity.TaskInstanceStatusFailed,
-			Reason:   DefFailedReason,
+	for _, id := range dagInsIds {
+		dagIns, err := GetStore().GetDagInstance(id)
+		if err != nil {
+			return fmt.Errorf("get dag instance[%s] of expired tasks failed: %w", id, err)
+		}
+		// wait for the current command completed, the tasks will be expired next time
+		if err := dagIns.Expire(expiredIds[id]); err != nil {
+			continue
+		}
+		if err := GetStore().PatchDagIns(&entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: id},
+			Cmd:      dagIns.Cmd,
 		}); err != nil {
-			return fmt.Errorf("patch expired task[%s] failed: %s", taskIns[i].ID, err)
+			return fmt.Errorf("patch expired dag instance[%s] failed: %w", id, err)
 		}
 	}
 	return nil
@@ -96,19 +137,259 @@ func (wd *DefWatchDog) handleLeftBehindDagIns() error {
 	if err != nil {
 		return err
 	}
-	if len(dagIns) == 0 {
+	for i := range dagIns {
+		// the instance may be started or canceled meanwhile, it should not be dispatched again
+		err := GetStore().PatchDagInsIf(&entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: dagIns[i].ID},
+			Status:   entity.DagInstanceStatusInit,
+		}, &PatchDagInsCondition{
+			Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
+			Worker: dagIns[i].Worker,
+		})
+		if err != nil && !errors.Is(err, data.ErrDataConflicted) {
+			return fmt.Errorf("reset left behind dag instance[%s] failed: %w", dagIns[i].ID, err)
+		}
+	}
+	return nil
+}
+
+// handleDeadWorkerDagIns reset the running dag instances whose worker is dead to init,
+// so that dispatcher will dispatch them to healthy workers, and the paused ones are handed to healthy workers
+// directly to keep them paused. The interrupted tasks are recovered by the parser taking over them.
+func (wd *DefWatchDog) handleDeadWorkerDagIns() error {
+	// draining workers are still alive, they will hand off their dag instances by themselves
+	workers, err := GetKeeper().AliveWorkers()
+	if err != nil {
+		return err
+	}
+	if len(workers) == 0 {
+		// leader is also a worker, keeper must be unhealthy now
 		return nil
 	}
+	aliveKeys := make([]string, 0, len(workers))
+	var candidates []*WorkerInfo
+	for _, w := range workers {
+		aliveKeys = append(aliveKeys, w.Key)
+		if !w.Draining {
+			candidates = append(candidates, w)
+		}
+	}
 
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Status:         []entity.DagInstanceStatus{entity.DagInstanceStatusRunning, entity.DagInstanceStatusPaused},
+		ExcludeWorkers: aliveKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	matcher := newWorkerMatcher(candidates)
 	for i := range dagIns {
-		dagIns[i].Status = entity.DagInstanceStatusInit
+		patch := &entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: dagIns[i].ID},
+			Status:   entity.DagInstanceStatusInit,
+			Reason:   fmt.Sprintf("worker[%s] is dead, wait for failover", dagIns[i].Worker),
+		}
+		if dagIns[i].Status == entity.DagInstanceStatusPaused {
+			matched, _ := matcher.match(dagIns[i].NodeSelector)
+			if len(matched) == 0 {
+				// it will be handed to a healthy worker when it is resumed
+				continue
+			}
+			patch.Status = entity.DagInstanceStatusPaused
+			patch.Worker = matched[rand.Intn(len(matched))].Key
+			patch.Reason = fmt.Sprintf("worker[%s] is dead, taken over by worker[%s]", dagIns[i].Worker, patch.Worker)
+		}
+
+		// the instance may be reassigned by others meanwhile, or the worker is alive again and changes it
+		if err := GetStore().PatchDagInsIf(patch, &PatchDagInsCondition{
+			Status: []entity.DagInstanceStatus{dagIns[i].Status},
+			Worker: dagIns[i].Worker,
+		}); err != nil {
+			if errors.Is(err, data.ErrDataConflicted) {
+				continue
+			}
+			return fmt.Errorf("patch dag instance[%s] of dead worker failed: %w", dagIns[i].ID, err)
+		}
 	}
-	if err := GetStore().BatchUpdateDagIns(dagIns); err != nil {
+	return nil
+}
+
+// handleTimeoutDagIns fail the dag instances which exceed deadline and trigger their downstream dags,
+// the tasks in executor are canceled by command and the waiting ones are canceled directly
+func (wd *DefWatchDog) handleTimeoutDagIns() error {
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Status:      []entity.DagInstanceStatus{entity.DagInstanceStatusRunning, entity.DagInstanceStatusBlocked, entity.DagInstanceStatusPaused},
+		DeadlineEnd: time.Now().Unix(),
+	})
+	if err != nil {
 		return err
 	}
+
+	for i := range dagIns {
+		// the pending command must be consumed first, otherwise the cancel command cannot be sent,
+		// so retry it in the next tick
+		if dagIns[i].Cmd != nil {
+			continue
+		}
+		tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+			DagInsID: dagIns[i].ID,
+			Status:   unfinishedTaskInsStatus,
+		})
+		if err != nil {
+			return fmt.Errorf("list tasks of timeout dag instance[%s] failed: %w", dagIns[i].ID, err)
+		}
+
+		cond := &PatchDagInsCondition{Status: []entity.DagInstanceStatus{dagIns[i].Status}}
+		dagIns[i].Timeout()
+		var executingIds []string
+		for _, t := range tasks {
+			if t.Status != entity.TaskInstanceStatusBlocked {
+				executingIds = append(executingIds, t.ID)
+			}
+			// init task may be still queued in executor, so it is also canceled by command
+			if t.Status == entity.TaskInstanceStatusInit || t.Status == entity.TaskInstanceStatusBlocked {
+				if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+					BaseInfo: entity.BaseInfo{ID: t.ID},
+					Status:   entity.TaskInstanceStatusCanceled,
+					Reason:   dagIns[i].Reason,
+				}); err != nil {
+					return fmt.Errorf("patch task of timeout dag instance[%s] failed: %w", dagIns[i].ID, err)
+				}
+			}
+		}
+
+		patch := &entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: dagIns[i].ID},
+			Status:   dagIns[i].Status,
+			Reason:   dagIns[i].Reason,
+		}
+		// the worker will cancel the executing tasks when it receives the command
+		if len(executingIds) > 0 {
+			patch.Cmd = &entity.Command{
+				Name:             entity.CommandNameCancel,
+				TargetTaskInsIDs: executingIds,
+			}
+		}
+		if err := GetStore().PatchDagInsIf(patch, cond); err != nil {
+			// the instance is completed or canceled meanwhile, it is not timeout anymore
+			if errors.Is(err, data.ErrDataConflicted) {
+				continue
+			}
+			return fmt.Errorf("patch timeout dag instance[%s] failed: %w", dagIns[i].ID, err)
+		}
+		// the worker ignores the status computed from canceled tasks, so downstream is triggered here
+		triggerDownstreamDags(dagIns[i])
+	}
+	return nil
+}
+
+// handleSlaMissed mark the dag instances and task instances which are not completed before sla,
+// they are not failed but only recorded and notified by event
+func (wd *DefWatchDog) handleSlaMissed() error {
+	now := time.Now().Unix()
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Status:     []entity.DagInstanceStatus{entity.DagInstanceStatusRunning, entity.DagInstanceStatusBlocked, entity.DagInstanceStatusPaused},
+		SlaMissEnd: now,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range dagIns {
+		dagIns[i].SlaMissed = true
+		if err := GetStore().PatchDagIns(&entity.DagInstance{
+			BaseInfo:  entity.BaseInfo{ID: dagIns[i].ID},
+			SlaMissed: true,
+		}); err != nil {
+			return fmt.Errorf("patch sla missed dag instance[%s] failed: %w", dagIns[i].ID, err)
+		}
+		goevent.Publish(&event.SlaMissed{DagIns: dagIns[i]})
+	}
+
+	taskIns, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		Status:     unfinishedTaskInsStatus,
+		SlaMissEnd: now,
+	})
+	if err != nil {
+		return err
+	}
+	for i := range taskIns {
+		taskIns[i].SlaMissed = true
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo:  entity.BaseInfo{ID: taskIns[i].ID},
+			SlaMissed: true,
+		}); err != nil {
+			return fmt.Errorf("patch sla missed task[%s] failed: %w", taskIns[i].ID, err)
+		}
+		dagIns, err := GetStore().GetDagInstance(taskIns[i].DagInsID)
+		if err != nil {
+			return fmt.Errorf("get dag instance of sla missed task[%s] failed: %w", taskIns[i].ID, err)
+		}
+		goevent.Publish(&event.SlaMissed{DagIns: dagIns, TaskIns: taskIns[i]})
+	}
 	return nil
 }
 
+// handleCanceledDagIns finish the canceled dag instances whose worker is not healthy,
+// the healthy worker will do it by itself when it receives the command
+func (wd *DefWatchDog) handleCanceledDagIns() error {
+	dagIns, err := GetStore().ListDagInstance(&ListDagInstanceInput{
+		Status: []entity.DagInstanceStatus{entity.DagInstanceStatusCanceled},
+		HasCmd: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range dagIns {
+		if dagIns[i].Cmd.Name != entity.CommandNameCancelDagIns {
+			continue
+		}
+		isAlive, err := GetKeeper().IsAlive(dagIns[i].Worker)
+		if err != nil {
+			return err
+		}
+		if isAlive {
+			continue
+		}
+
+		if _, err := cancelUnfinishedTaskIns(dagIns[i]); err != nil {
+			return err
+		}
+		if err := GetStore().PatchDagIns(&entity.DagInstance{
+			BaseInfo: entity.BaseInfo{ID: dagIns[i].ID},
+		}, "Cmd"); err != nil {
+			return fmt.Errorf("patch canceled dag instance[%s] failed: %w", dagIns[i].ID, err)
+		}
+		triggerDownstreamDags(dagIns[i])
+	}
+	return nil
+}
+
+// cancelUnfinishedTaskIns mark all unfinished tasks of the dag instance canceled, it returns their ids
+func cancelUnfinishedTaskIns(dagIns *entity.DagInstance) ([]string, error) {
+	tasks, err := GetStore().ListTaskInstance(&ListTaskInstanceInput{
+		DagInsID: dagIns.ID,
+		Status:   unfinishedTaskInsStatus,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list tasks of canceled dag instance[%s] failed: %w", dagIns.ID, err)
+	}
+
+	var ids []string
+	for _, t := range tasks {
+		if err := GetStore().PatchTaskIns(&entity.TaskInstance{
+			BaseInfo: entity.BaseInfo{ID: t.ID},
+			Status:   entity.TaskInstanceStatusCanceled,
+			Reason:   dagIns.Reason,
+		}); err != nil {
+			return nil, fmt.Errorf("patch task of canceled dag instance[%s] failed: %w", dagIns.ID, err)
+		}
+		ids = append(ids, t.ID)
+	}
+	return ids, nil
+}
+
 func (wd *DefWatchDog) handleErr(err error) {
 	log.Error("here are some errors",
 		"module", "watchdog",
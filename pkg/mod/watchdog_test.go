@@ -1,29 +1,32 @@
 package mod
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/event"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/shiningrush/goevent"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
 
 func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 	tests := []struct {
-		caseDesc            string
-		giveWd              *DefWatchDog
-		giveListTasks       []*entity.TaskInstance
-		giveListTasksErr    error
-		giveDagPatchErr     error
-		giveTaskPatchErr    error
-		wantErr             error
-		wantListInput       *ListTaskInstanceInput
-		wantPatchDagCalled  bool
-		wantPatchDag        map[int]*entity.DagInstance
-		wantPatchTaskCalled bool
-		wantPatchTask       map[int]*entity.TaskInstance
+		caseDesc           string
+		giveWd             *DefWatchDog
+		giveListTasks      []*entity.TaskInstance
+		giveListTasksErr   error
+		giveDagIns         map[string]*entity.DagInstance
+		giveGetDagErr      error
+		giveDagPatchErr    error
+		wantErr            error
+		wantListInput      *ListTaskInstanceInput
+		wantPatchDagCalled bool
+		wantPatchDag       map[int]*entity.DagInstance
 	}{
 		{
 			caseDesc: "normal",
@@ -31,8 +34,15 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 				closeCh: make(chan struct{}),
 			},
 			giveListTasks: []*entity.TaskInstance{
-				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusRunning},
 				{BaseInfo: entity.BaseInfo{ID: "2"}, DagInsID: "dag-2", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "3"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "4"}, DagInsID: "dag-3", Status: entity.TaskInstanceStatusRunning},
+			},
+			giveDagIns: map[string]*entity.DagInstance{
+				"dag-1": {BaseInfo: entity.BaseInfo{ID: "dag-1"}},
+				"dag-2": {BaseInfo: entity.BaseInfo{ID: "dag-2"}},
+				"dag-3": {BaseInfo: entity.BaseInfo{ID: "dag-3"}, Cmd: &entity.Command{Name: entity.CommandNameCancel}},
 			},
 			wantListInput: &ListTaskInstanceInput{
 				Status:  []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
@@ -41,27 +51,14 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 			wantPatchDag: map[int]*entity.DagInstance{
 				0: {
 					BaseInfo: entity.BaseInfo{ID: "dag-1"},
-					Status:   entity.DagInstanceStatusFailed,
+					Cmd:      &entity.Command{Name: entity.CommandNameExpire, TargetTaskInsIDs: []string{"1", "3"}},
 				},
 				1: {
 					BaseInfo: entity.BaseInfo{ID: "dag-2"},
-					Status:   entity.DagInstanceStatusFailed,
+					Cmd:      &entity.Command{Name: entity.CommandNameExpire, TargetTaskInsIDs: []string{"2"}},
 				},
 			},
 			wantPatchDagCalled: true,
-			wantPatchTask: map[int]*entity.TaskInstance{
-				0: {
-					BaseInfo: entity.BaseInfo{ID: "1"},
-					Status:   entity.TaskInstanceStatusFailed,
-					Reason:   DefFailedReason,
-				},
-				1: {
-					BaseInfo: entity.BaseInfo{ID: "2"},
-					Status:   entity.TaskInstanceStatusFailed,
-					Reason:   DefFailedReason,
-				},
-			},
-			wantPatchTaskCalled: true,
 		},
 		{
 			caseDesc: "list failed",
@@ -76,37 +73,32 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 			},
 		},
 		{
-			caseDesc: "patch dag failed",
+			caseDesc: "get dag failed",
 			giveWd: &DefWatchDog{
 				closeCh: make(chan struct{}),
 			},
 			giveListTasks: []*entity.TaskInstance{
-				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusInit},
-				{BaseInfo: entity.BaseInfo{ID: "2"}, DagInsID: "dag-2", Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusRunning},
 			},
+			giveGetDagErr: fmt.Errorf("get failed"),
 			wantListInput: &ListTaskInstanceInput{
 				Status:  []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
 				Expired: true,
 			},
-			wantPatchDag: map[int]*entity.DagInstance{
-				0: {
-					BaseInfo: entity.BaseInfo{ID: "dag-1"},
-					Status:   entity.DagInstanceStatusFailed,
-				},
-			},
-			wantPatchDagCalled: true,
-			giveDagPatchErr:    fmt.Errorf("patch failed"),
-			wantErr:            fmt.Errorf("patch expired dag instance[dag-1] failed: patch failed"),
+			wantErr: fmt.Errorf("get dag instance[dag-1] of expired tasks failed: %w", fmt.Errorf("get failed")),
 		},
 		{
-			caseDesc: "patch task failed",
+			caseDesc: "patch dag failed",
 			giveWd: &DefWatchDog{
 				closeCh: make(chan struct{}),
 			},
 			giveListTasks: []*entity.TaskInstance{
-				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "1"}, DagInsID: "dag-1", Status: entity.TaskInstanceStatusRunning},
 				{BaseInfo: entity.BaseInfo{ID: "2"}, DagInsID: "dag-2", Status: entity.TaskInstanceStatusRunning},
 			},
+			giveDagIns: map[string]*entity.DagInstance{
+				"dag-1": {BaseInfo: entity.BaseInfo{ID: "dag-1"}},
+			},
 			wantListInput: &ListTaskInstanceInput{
 				Status:  []entity.TaskInstanceStatus{entity.TaskInstanceStatusRunning},
 				Expired: true,
@@ -114,20 +106,12 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 			wantPatchDag: map[int]*entity.DagInstance{
 				0: {
 					BaseInfo: entity.BaseInfo{ID: "dag-1"},
-					Status:   entity.DagInstanceStatusFailed,
+					Cmd:      &entity.Command{Name: entity.CommandNameExpire, TargetTaskInsIDs: []string{"1"}},
 				},
 			},
 			wantPatchDagCalled: true,
-			wantPatchTask: map[int]*entity.TaskInstance{
-				0: {
-					BaseInfo: entity.BaseInfo{ID: "1"},
-					Status:   entity.TaskInstanceStatusFailed,
-					Reason:   DefFailedReason,
-				},
-			},
-			wantPatchTaskCalled: true,
-			giveTaskPatchErr:    fmt.Errorf("patch failed"),
-			wantErr:             fmt.Errorf("patch expired task[1] failed: patch failed"),
+			giveDagPatchErr:    fmt.Errorf("patch failed"),
+			wantErr:            fmt.Errorf("patch expired dag instance[dag-1] failed: %w", fmt.Errorf("patch failed")),
 		},
 		{
 			caseDesc: "no record",
@@ -144,30 +128,26 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.caseDesc, func(t *testing.T) {
-			calledList, calledDagPatch, calledTaskPatch := false, false, false
+			calledList, calledDagPatch := false, false
 			mStore := &MockStore{}
-			patchDagCnt, patchTaskCnt := 0, 0
+			patchDagCnt := 0
 			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
 				calledList = true
 				assert.Equal(t, tc.wantListInput, args.Get(0))
 			}).Return(tc.giveListTasks, tc.giveListTasksErr)
+			mStore.On("GetDagInstance", mock.Anything).Return(func(id string) *entity.DagInstance {
+				return tc.giveDagIns[id]
+			}, tc.giveGetDagErr)
 			mStore.On("PatchDagIns", mock.Anything).Run(func(args mock.Arguments) {
 				calledDagPatch = true
 				assert.Equal(t, tc.wantPatchDag[patchDagCnt], args.Get(0))
 				patchDagCnt++
 			}).Return(tc.giveDagPatchErr)
-
-			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
-				calledTaskPatch = true
-				assert.Equal(t, tc.wantPatchTask[patchTaskCnt], args.Get(0))
-				patchTaskCnt++
-			}).Return(tc.giveTaskPatchErr)
 			SetStore(mStore)
 
 			err := tc.giveWd.handleExpiredTaskIns()
 			assert.Equal(t, tc.wantErr, err)
 			assert.True(t, calledList)
-			assert.Equal(t, tc.wantPatchTaskCalled, calledTaskPatch)
 			assert.Equal(t, tc.wantPatchDagCalled, calledDagPatch)
 		})
 	}
@@ -175,102 +155,98 @@ func TestDefWatchDog_HandleExpiredTaskIns(t *testing.T) {
 
 func TestDefWatchDog_HandleLeftBehindDagIns(t *testing.T) {
 	tests := []struct {
-		caseDesc           string
-		giveWd             *DefWatchDog
-		giveListRet        []*entity.DagInstance
-		giveListRetErr     error
-		giveBatchUpdateErr error
-		wantErr            error
-		wantListInput      *ListDagInstanceInput
-		wantBatchInput     []*entity.DagInstance
-		wantBatchCalled    bool
+		caseDesc       string
+		giveListRet    []*entity.DagInstance
+		giveListRetErr error
+		givePatchErr   error
+		wantErr        error
+		wantPatched    []*entity.DagInstance
+		wantCond       []*PatchDagInsCondition
 	}{
 		{
 			caseDesc: "sanity",
-			giveWd: &DefWatchDog{
-				dagScheduledTimeout: time.Minute,
-				closeCh:             make(chan struct{}),
-			},
 			giveListRet: []*entity.DagInstance{
-				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit},
-				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusRunning},
-			},
-			wantListInput: &ListDagInstanceInput{
-				Status:     []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
-				UpdatedEnd: time.Now().Add(-1 * time.Minute).Unix(),
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusScheduled, Worker: "w1"},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusScheduled, Worker: "w2"},
 			},
-			wantBatchInput: []*entity.DagInstance{
+			wantPatched: []*entity.DagInstance{
 				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit},
 				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusInit},
 			},
-			wantBatchCalled: true,
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "w1"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "w2"},
+			},
 		},
 		{
-			caseDesc: "list failed",
-			giveWd: &DefWatchDog{
-				dagScheduledTimeout: time.Minute,
-				closeCh:             make(chan struct{}),
-			},
+			caseDesc:       "list failed",
 			giveListRetErr: fmt.Errorf("list failed"),
 			wantErr:        fmt.Errorf("list failed"),
-			wantListInput: &ListDagInstanceInput{
-				Status:     []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
-				UpdatedEnd: time.Now().Add(-1 * time.Minute).Unix(),
-			},
 		},
 		{
 			caseDesc: "update failed",
-			giveWd: &DefWatchDog{
-				dagScheduledTimeout: time.Minute,
-				closeCh:             make(chan struct{}),
-			},
 			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusScheduled, Worker: "w1"},
+			},
+			givePatchErr: fmt.Errorf("patch failed"),
+			wantErr:      fmt.Errorf("reset left behind dag instance[1] failed: %w", fmt.Errorf("patch failed")),
+			wantPatched: []*entity.DagInstance{
 				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit},
 			},
-			wantListInput: &ListDagInstanceInput{
-				Status:     []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
-				UpdatedEnd: time.Now().Add(-1 * time.Minute).Unix(),
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "w1"},
 			},
-			wantBatchInput: []*entity.DagInstance{
+		},
+		{
+			caseDesc: "started meanwhile",
+			giveListRet: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusScheduled, Worker: "w1"},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusScheduled, Worker: "w2"},
+			},
+			givePatchErr: fmt.Errorf("conflicted: %w", data.ErrDataConflicted),
+			wantPatched: []*entity.DagInstance{
 				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.DagInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.DagInstanceStatusInit},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "w1"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, Worker: "w2"},
 			},
-			giveBatchUpdateErr: fmt.Errorf("batch update failed"),
-			wantErr:            fmt.Errorf("batch update failed"),
-			wantBatchCalled:    true,
 		},
 		{
-			caseDesc: "no record",
-			giveWd: &DefWatchDog{
-				dagScheduledTimeout: time.Minute,
-				closeCh:             make(chan struct{}),
-			},
+			caseDesc:    "no record",
 			giveListRet: []*entity.DagInstance{},
-			wantListInput: &ListDagInstanceInput{
-				Status:     []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled},
-				UpdatedEnd: time.Now().Add(-1 * time.Minute).Unix(),
-			},
-			wantBatchCalled: false,
 		},
 	}
 
 	for _, tc := range tests {
-		calledList, calledBatch := false, false
-		mStore := &MockStore{}
-		mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
-			calledList = true
-			assert.Equal(t, tc.wantListInput, args.Get(0), tc.caseDesc)
-		}).Return(tc.giveListRet, tc.giveListRetErr)
-
-		mStore.On("BatchUpdateDagIns", mock.Anything).Run(func(args mock.Arguments) {
-			calledBatch = true
-			assert.Equal(t, tc.wantBatchInput, args.Get(0), tc.caseDesc)
-		}).Return(tc.giveBatchUpdateErr)
-		SetStore(mStore)
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			calledList := false
+			var patched []*entity.DagInstance
+			var patchedCond []*PatchDagInsCondition
+			wd := &DefWatchDog{
+				dagScheduledTimeout: time.Minute,
+				closeCh:             make(chan struct{}),
+			}
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				calledList = true
+				input := args.Get(0).(*ListDagInstanceInput)
+				assert.Equal(t, []entity.DagInstanceStatus{entity.DagInstanceStatusScheduled}, input.Status)
+				assert.InDelta(t, time.Now().Add(-1*time.Minute).Unix(), input.UpdatedEnd, 1)
+			}).Return(tc.giveListRet, tc.giveListRetErr)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patched = append(patched, args.Get(0).(*entity.DagInstance))
+				patchedCond = append(patchedCond, args.Get(1).(*PatchDagInsCondition))
+			}).Return(tc.givePatchErr)
+			SetStore(mStore)
 
-		err := tc.giveWd.handleLeftBehindDagIns()
-		assert.Equal(t, tc.wantErr, err, tc.caseDesc)
-		assert.True(t, calledList, tc.caseDesc)
-		assert.Equal(t, tc.wantBatchCalled, calledBatch)
+			err := wd.handleLeftBehindDagIns()
+			assert.Equal(t, tc.wantErr, err)
+			assert.True(t, calledList)
+			assert.Equal(t, tc.wantPatched, patched)
+			assert.Equal(t, tc.wantCond, patchedCond)
+		})
 	}
 }
 
@@ -285,9 +261,484 @@ func TestDefWatchDog(t *testing.T) {
 	}).Return(nil, nil)
 	SetStore(mStore)
 
+	mKeeper := &MockKeeper{}
+	mKeeper.On("AliveWorkers").Return(nil, nil)
+	SetKeeper(mKeeper)
+
 	wDog := NewDefWatchDog(time.Minute)
 	wDog.Init()
 	time.Sleep(3 * time.Second)
 	wDog.Close()
 	assert.True(t, calledListDag, calledListTask)
 }
+
+func TestDefWatchDog_HandleTimeoutDagIns(t *testing.T) {
+	reason := "dag instance is timeout, it runs more than 10 seconds"
+	tests := []struct {
+		caseDesc       string
+		giveDagIns     []*entity.DagInstance
+		giveTasks      []*entity.TaskInstance
+		giveListErr    error
+		givePatchErr   error
+		giveDownstream []*entity.Dag
+		wantPatchDag   []*entity.DagInstance
+		wantCond       []*PatchDagInsCondition
+		wantPatchTask  []*entity.TaskInstance
+		wantCreated    []string
+		wantErr        error
+	}{
+		{
+			caseDesc: "normal",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, DagID: "dag", Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.TaskInstanceStatusInit},
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.TaskInstanceStatusBlocked},
+			},
+			giveDownstream: []*entity.Dag{
+				{
+					BaseInfo: entity.BaseInfo{ID: "down"},
+					DependsOnDags: []entity.DagDependency{
+						{DagID: "dag", On: []entity.DagInstanceStatus{entity.DagInstanceStatusFailed}},
+					},
+					Status: entity.DagStatusNormal,
+				},
+			},
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.TaskInstanceStatusCanceled, Reason: reason},
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.TaskInstanceStatusCanceled, Reason: reason},
+			},
+			wantPatchDag: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dag-1"},
+					Status:   entity.DagInstanceStatusFailed,
+					Reason:   reason,
+					Cmd: &entity.Command{
+						Name:             entity.CommandNameCancel,
+						TargetTaskInsIDs: []string{"1", "2"},
+					},
+				},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			},
+			wantCreated: []string{"upstream-dag-1-down"},
+		},
+		{
+			caseDesc: "blocked without executing tasks",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusBlocked, TimeoutSecs: 10},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.TaskInstanceStatusBlocked},
+			},
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "3"}, Status: entity.TaskInstanceStatusCanceled, Reason: reason},
+			},
+			wantPatchDag: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dag-1"},
+					Status:   entity.DagInstanceStatusFailed,
+					Reason:   reason,
+				},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusBlocked}},
+			},
+		},
+		{
+			caseDesc: "command is pending",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-cmd"}, Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10,
+					Cmd: &entity.Command{Name: entity.CommandNamePause}},
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.TaskInstanceStatusRunning},
+			},
+			wantPatchDag: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dag-2"},
+					Status:   entity.DagInstanceStatusFailed,
+					Reason:   reason,
+					Cmd: &entity.Command{
+						Name:             entity.CommandNameCancel,
+						TargetTaskInsIDs: []string{"1"},
+					},
+				},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			},
+		},
+		{
+			caseDesc: "completed meanwhile",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, DagID: "dag", Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10},
+			},
+			giveDownstream: []*entity.Dag{
+				{
+					BaseInfo: entity.BaseInfo{ID: "down"},
+					DependsOnDags: []entity.DagDependency{
+						{DagID: "dag", On: []entity.DagInstanceStatus{entity.DagInstanceStatusFailed}},
+					},
+					Status: entity.DagStatusNormal,
+				},
+			},
+			givePatchErr: fmt.Errorf("dag instance[dag-1] does not match the condition: %w", data.ErrDataConflicted),
+			wantPatchDag: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dag-1"},
+					Status:   entity.DagInstanceStatusFailed,
+					Reason:   reason,
+				},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			},
+		},
+		{
+			caseDesc: "patch failed",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10},
+			},
+			givePatchErr: fmt.Errorf("patch failed"),
+			wantPatchDag: []*entity.DagInstance{
+				{
+					BaseInfo: entity.BaseInfo{ID: "dag-1"},
+					Status:   entity.DagInstanceStatusFailed,
+					Reason:   reason,
+				},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}},
+			},
+			wantErr: fmt.Errorf("patch timeout dag instance[dag-1] failed: %w", fmt.Errorf("patch failed")),
+		},
+		{
+			caseDesc: "list tasks failed",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusRunning, TimeoutSecs: 10},
+			},
+			giveListErr: fmt.Errorf("list failed"),
+			wantErr:     fmt.Errorf("list tasks of timeout dag instance[dag-1] failed: %w", fmt.Errorf("list failed")),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patchedDag []*entity.DagInstance
+			var patchedCond []*PatchDagInsCondition
+			var patchedTask []*entity.TaskInstance
+			var created []string
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				input := args.Get(0).(*ListDagInstanceInput)
+				assert.Equal(t, []entity.DagInstanceStatus{
+					entity.DagInstanceStatusRunning, entity.DagInstanceStatusBlocked, entity.DagInstanceStatusPaused}, input.Status)
+				assert.InDelta(t, time.Now().Unix(), input.DeadlineEnd, 1)
+			}).Return(tc.giveDagIns, nil)
+			mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
+				// the instance with pending command is skipped before canceling its tasks
+				assert.NotEqual(t, "dag-cmd", args.Get(0).(*ListTaskInstanceInput).DagInsID)
+			}).Return(tc.giveTasks, tc.giveListErr)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+				patchedDag = append(patchedDag, args.Get(0).(*entity.DagInstance))
+				patchedCond = append(patchedCond, args.Get(1).(*PatchDagInsCondition))
+			}).Return(tc.givePatchErr)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchedTask = append(patchedTask, args.Get(0).(*entity.TaskInstance))
+			}).Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(tc.giveDownstream, nil)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				created = append(created, args.Get(0).(*entity.DagInstance).ID)
+			}).Return(nil)
+			SetStore(mStore)
+
+			wd := &DefWatchDog{closeCh: make(chan struct{})}
+			err := wd.handleTimeoutDagIns()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantPatchDag, patchedDag)
+			assert.Equal(t, tc.wantCond, patchedCond)
+			assert.Equal(t, tc.wantPatchTask, patchedTask)
+			assert.Equal(t, tc.wantCreated, created)
+		})
+	}
+}
+
+func TestDefWatchDog_HandleCanceledDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveDagIns    []*entity.DagInstance
+		giveIsAlive   bool
+		giveTasks     []*entity.TaskInstance
+		wantPatchTask []*entity.TaskInstance
+		wantPatchDag  []*entity.DagInstance
+	}{
+		{
+			caseDesc: "unhealthy worker",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Worker: "w1", Status: entity.DagInstanceStatusCanceled,
+					Reason: "cancel by user", Cmd: &entity.Command{Name: entity.CommandNameCancelDagIns}},
+			},
+			giveTasks: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.TaskInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.TaskInstanceStatusInit},
+			},
+			wantPatchTask: []*entity.TaskInstance{
+				{BaseInfo: entity.BaseInfo{ID: "1"}, Status: entity.TaskInstanceStatusCanceled, Reason: "cancel by user"},
+				{BaseInfo: entity.BaseInfo{ID: "2"}, Status: entity.TaskInstanceStatusCanceled, Reason: "cancel by user"},
+			},
+			wantPatchDag: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}},
+			},
+		},
+		{
+			caseDesc: "healthy worker",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Worker: "w1", Status: entity.DagInstanceStatusCanceled,
+					Cmd: &entity.Command{Name: entity.CommandNameCancelDagIns}},
+			},
+			giveIsAlive: true,
+		},
+		{
+			caseDesc: "other command",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Worker: "w1", Status: entity.DagInstanceStatusCanceled,
+					Cmd: &entity.Command{Name: entity.CommandNameCancel}},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var patchedDag []*entity.DagInstance
+			var patchedTask []*entity.TaskInstance
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", &ListDagInstanceInput{
+				Status: []entity.DagInstanceStatus{entity.DagInstanceStatusCanceled},
+				HasCmd: true,
+			}).Return(tc.giveDagIns, nil)
+			mStore.On("ListTaskInstance", &ListTaskInstanceInput{
+				DagInsID: "dag-1",
+				Status:   unfinishedTaskInsStatus,
+			}).Return(tc.giveTasks, nil)
+			mStore.On("PatchDagIns", mock.Anything, "Cmd").Run(func(args mock.Arguments) {
+				patchedDag = append(patchedDag, args.Get(0).(*entity.DagInstance))
+			}).Return(nil)
+			mStore.On("PatchTaskIns", mock.Anything).Run(func(args mock.Arguments) {
+				patchedTask = append(patchedTask, args.Get(0).(*entity.TaskInstance))
+			}).Return(nil)
+			mStore.On("ListDag", mock.Anything).Return(nil, nil)
+			SetStore(mStore)
+
+			mKeeper := &MockKeeper{}
+			mKeeper.On("IsAlive", "w1").Return(tc.giveIsAlive, nil)
+			SetKeeper(mKeeper)
+
+			wd := &DefWatchDog{closeCh: make(chan struct{})}
+			err := wd.handleCanceledDagIns()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantPatchDag, patchedDag)
+			assert.Equal(t, tc.wantPatchTask, patchedTask)
+		})
+	}
+}
+
+func TestDefWatchDog_HandleDeadWorkerDagIns(t *testing.T) {
+	tests := []struct {
+		caseDesc     string
+		giveDagIns   []*entity.DagInstance
+		giveWorkers  []*WorkerInfo
+		giveAliveErr error
+		givePatchErr map[string]error
+		wantErr      error
+		wantExcluded []string
+		wantPatchDag []*entity.DagInstance
+		wantCond     []*PatchDagInsCondition
+	}{
+		{
+			caseDesc: "sanity",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Worker: "w2", Status: entity.DagInstanceStatusRunning},
+			},
+			giveWorkers:  []*WorkerInfo{{Key: "w1"}, {Key: "w3", Draining: true}},
+			wantExcluded: []string{"w1", "w3"},
+			wantPatchDag: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Status: entity.DagInstanceStatusInit,
+					Reason: "worker[w2] is dead, wait for failover"},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}, Worker: "w2"},
+			},
+		},
+		{
+			caseDesc: "paused",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Worker: "w2", Status: entity.DagInstanceStatusPaused},
+				{BaseInfo: entity.BaseInfo{ID: "dag-4"}, Worker: "w4", Status: entity.DagInstanceStatusPaused,
+					NodeSelector: "zone=sh"},
+			},
+			giveWorkers:  []*WorkerInfo{{Key: "w1"}, {Key: "w3", Draining: true}},
+			wantExcluded: []string{"w1", "w3"},
+			wantPatchDag: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Worker: "w1", Status: entity.DagInstanceStatusPaused,
+					Reason: "worker[w2] is dead, taken over by worker[w1]"},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPaused}, Worker: "w2"},
+			},
+		},
+		{
+			caseDesc: "changed meanwhile",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Worker: "w2", Status: entity.DagInstanceStatusRunning},
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Worker: "w2", Status: entity.DagInstanceStatusRunning},
+			},
+			giveWorkers: []*WorkerInfo{{Key: "w1"}},
+			givePatchErr: map[string]error{
+				"dag-1": fmt.Errorf("dag instance[dag-1] does not match the condition: %w", data.ErrDataConflicted),
+			},
+			wantExcluded: []string{"w1"},
+			wantPatchDag: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusInit,
+					Reason: "worker[w2] is dead, wait for failover"},
+				{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Status: entity.DagInstanceStatusInit,
+					Reason: "worker[w2] is dead, wait for failover"},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}, Worker: "w2"},
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}, Worker: "w2"},
+			},
+		},
+		{
+			caseDesc: "patch failed",
+			giveDagIns: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Worker: "w2", Status: entity.DagInstanceStatusRunning},
+			},
+			giveWorkers: []*WorkerInfo{{Key: "w1"}},
+			givePatchErr: map[string]error{
+				"dag-1": fmt.Errorf("patch failed"),
+			},
+			wantExcluded: []string{"w1"},
+			wantPatchDag: []*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusInit,
+					Reason: "worker[w2] is dead, wait for failover"},
+			},
+			wantCond: []*PatchDagInsCondition{
+				{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}, Worker: "w2"},
+			},
+			wantErr: fmt.Errorf("patch dag instance[dag-1] of dead worker failed: %w", fmt.Errorf("patch failed")),
+		},
+		{
+			caseDesc:     "no dag instance of dead worker",
+			giveWorkers:  []*WorkerInfo{{Key: "w1"}},
+			wantExcluded: []string{"w1"},
+		},
+		{
+			caseDesc: "no alive worker",
+		},
+		{
+			caseDesc:     "get alive workers failed",
+			giveAliveErr: fmt.Errorf("alive failed"),
+			wantErr:      fmt.Errorf("alive failed"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var excluded []string
+			var patchedDag []*entity.DagInstance
+			var patchedCond []*PatchDagInsCondition
+			mStore := &MockStore{}
+			mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+				input := args.Get(0).(*ListDagInstanceInput)
+				assert.Equal(t, []entity.DagInstanceStatus{
+					entity.DagInstanceStatusRunning, entity.DagInstanceStatusPaused}, input.Status)
+				excluded = input.ExcludeWorkers
+			}).Return(tc.giveDagIns, nil)
+			mStore.On("PatchDagInsIf", mock.Anything, mock.Anything).Return(func(
+				dagIns *entity.DagInstance, cond *PatchDagInsCondition, fields ...string) error {
+				patchedDag = append(patchedDag, dagIns)
+				patchedCond = append(patchedCond, cond)
+				return tc.givePatchErr[dagIns.ID]
+			})
+			SetStore(mStore)
+
+			mKeeper := &MockKeeper{}
+			mKeeper.On("AliveWorkers").Return(tc.giveWorkers, tc.giveAliveErr)
+			SetKeeper(mKeeper)
+
+			wd := &DefWatchDog{closeCh: make(chan struct{})}
+			err := wd.handleDeadWorkerDagIns()
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantExcluded, excluded)
+			assert.Equal(t, tc.wantPatchDag, patchedDag)
+			assert.Equal(t, tc.wantCond, patchedCond)
+		})
+	}
+}
+
+func TestDefWatchDog_HandleSlaMissed(t *testing.T) {
+	dagIns := &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag-1"}, Status: entity.DagInstanceStatusRunning}
+	taskIns := &entity.TaskInstance{BaseInfo: entity.BaseInfo{ID: "task-1"}, DagInsID: "dag-2"}
+	taskDagIns := &entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "dag-2"}, Status: entity.DagInstanceStatusRunning}
+
+	eventCh := make(chan *event.SlaMissed, 2)
+	assert.NoError(t, goevent.Subscribe(&testSlaHandler{ch: eventCh}))
+
+	mStore := &MockStore{}
+	mStore.On("ListDagInstance", mock.Anything).Run(func(args mock.Arguments) {
+		assert.InDelta(t, time.Now().Unix(), args.Get(0).(*ListDagInstanceInput).SlaMissEnd, 1)
+	}).Return([]*entity.DagInstance{dagIns}, nil)
+	mStore.On("ListTaskInstance", mock.Anything).Run(func(args mock.Arguments) {
+		assert.InDelta(t, time.Now().Unix(), args.Get(0).(*ListTaskInstanceInput).SlaMissEnd, 1)
+	}).Return([]*entity.TaskInstance{taskIns}, nil)
+	mStore.On("GetDagInstance", "dag-2").Return(taskDagIns, nil)
+	mStore.On("PatchDagIns", &entity.DagInstance{
+		BaseInfo:  entity.BaseInfo{ID: "dag-1"},
+		SlaMissed: true,
+	}).Return(nil)
+	mStore.On("PatchTaskIns", &entity.TaskInstance{
+		BaseInfo:  entity.BaseInfo{ID: "task-1"},
+		SlaMissed: true,
+	}).Return(nil)
+	SetStore(mStore)
+
+	wd := &DefWatchDog{closeCh: make(chan struct{})}
+	assert.NoError(t, wd.handleSlaMissed())
+	mStore.AssertExpectations(t)
+	assert.True(t, dagIns.SlaMissed)
+	assert.True(t, taskIns.SlaMissed)
+
+	var got []*event.SlaMissed
+	for len(got) < 2 {
+		select {
+		case e := <-eventCh:
+			got = append(got, e)
+		case <-time.After(time.Second):
+			assert.FailNow(t, "sla missed events are not published")
+		}
+	}
+	assert.ElementsMatch(t, []*event.SlaMissed{
+		{DagIns: dagIns},
+		{DagIns: taskDagIns, TaskIns: taskIns},
+	}, got)
+}
+
+type testSlaHandler struct {
+	ch chan *event.SlaMissed
+}
+
+func (h *testSlaHandler) Topic() []string {
+	return []string{event.KeySlaMissed}
+}
+
+func (h *testSlaHandler) Handle(ctx context.Context, e goevent.Event) {
+	select {
+	case h.ch <- e.(*event.SlaMissed):
+	default:
+	}
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPareSelectors(t *testing.T) {
+	tests := []struct {
+		caseDesc      string
+		giveSelector  string
+		wantSelectors []Selector
+		wantErr       error
+	}{
+		{
+			caseDesc:     "equal",
+			giveSelector: "zone=bj",
+			wantSelectors: []Selector{
+				{Key: "zone", Op: SelectorOpEqual, Values: []string{"bj"}},
+			},
+		},
+		{
+			caseDesc:     "multiple expressions",
+			giveSelector: " zone = bj, net in (a, b ,c),gpu=true",
+			wantSelectors: []Selector{
+				{Key: "zone", Op: SelectorOpEqual, Values: []string{"bj"}},
+				{Key: "net", Op: SelectorOpIn, Values: []string{"a", "b", "c"}},
+				{Key: "gpu", Op: SelectorOpEqual, Values: []string{"true"}},
+			},
+		},
+		{
+			caseDesc:     "empty",
+			giveSelector: "",
+			wantErr:      fmt.Errorf("selector expression can not be empty"),
+		},
+		{
+			caseDesc:     "unknown operator",
+			giveSelector: "zone>bj",
+			wantErr:      fmt.Errorf("selector string 'zone>bj' operator is not '=' or 'in'"),
+		},
+		{
+			caseDesc:     "no bracket",
+			giveSelector: "zone in a",
+			wantErr:      fmt.Errorf("selector string 'zone in a' values must be enclosed in '()'"),
+		},
+		{
+			caseDesc:     "bracket not closed",
+			giveSelector: "zone in (a,b",
+			wantErr:      fmt.Errorf("you have '(' in label selector but did'n finded ')'"),
+		},
+		{
+			caseDesc:     "empty key",
+			giveSelector: "=bj",
+			wantErr:      fmt.Errorf("selector string '=bj' key can not be empty"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			selectors, err := PareSelectors(tc.giveSelector)
+			assert.Equal(t, tc.wantErr, err)
+			assert.Equal(t, tc.wantSelectors, selectors)
+		})
+	}
+}
+
+func TestMatchSelectors(t *testing.T) {
+	selectors, err := PareSelectors("zone=bj, net in (a,b)")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		caseDesc   string
+		giveLabels map[string]string
+		wantMatch  bool
+	}{
+		{
+			caseDesc:   "matched",
+			giveLabels: map[string]string{"zone": "bj", "net": "b", "other": "x"},
+			wantMatch:  true,
+		},
+		{
+			caseDesc:   "value not in",
+			giveLabels: map[string]string{"zone": "bj", "net": "c"},
+		},
+		{
+			caseDesc:   "key missed",
+			giveLabels: map[string]string{"zone": "bj"},
+		},
+		{
+			caseDesc: "no labels",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			assert.Equal(t, tc.wantMatch, MatchSelectors(selectors, tc.giveLabels))
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/log"
+	"github.com/shiningrush/fastflow/pkg/mod"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+)
+
+const (
+	// SignatureHeader is the header which carry the signature of request,
+	// its value looks like "sha256=<hex of Sign(secret, method, path, timestamp, nonce, query, body)>"
+	SignatureHeader = "X-Fastflow-Signature"
+	// TimestampHeader is the header which carry the unix seconds when the request is sent, it is signed too
+	TimestampHeader = "X-Fastflow-Timestamp"
+	// NonceHeader is the header which carry an unique id of request, it is signed too,
+	// the requests with same nonce within the window run the dag only once
+	NonceHeader = "X-Fastflow-Nonce"
+
+	signaturePrefix = "sha256="
+	maxBodyBytes    = 1 << 20
+	defaultMaxSkew  = 5 * time.Minute
+)
+
+// HandlerOption
+type HandlerOption struct {
+	// Secret is the shared secret used to check signature, it cannot be empty
+	Secret string
+	// MaxSkew is the max difference between the request timestamp and now, default 5m,
+	// the requests out of it will be rejected, so a captured request cannot be replayed later,
+	// and the ones in it are deduplicated by nonce
+	MaxSkew time.Duration
+}
+
+// RunResponse
+type RunResponse struct {
+	DagInsID string `json:"dagInsId"`
+}
+
+// HttpHandler used to run dag by webhook, the last segment of path is the dag id,
+// you can use it like that
+//
+//	http.Handle("/webhook/", webhook.HttpHandler(&webhook.HandlerOption{Secret: "secret"}))
+//
+// then "POST /webhook/{dagId}" will run the dag, both query params and json body(body first)
+// will be mapped to dag vars, the signature cover the method, path, timestamp, nonce, query params and body.
+// because it depend on Commander, so you should call this function after fastflow start
+func HttpHandler(opt *HandlerOption) http.Handler {
+	if opt == nil || opt.Secret == "" {
+		panic("webhook secret cannot be empty")
+	}
+	maxSkew := opt.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+	return &handler{secret: []byte(opt.Secret), maxSkew: maxSkew}
+}
+
+type handler struct {
+	secret  []byte
+	maxSkew time.Duration
+}
+
+// ServeHTTP
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+		return
+	}
+
+	dagId := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if dagId == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("dag id cannot be empty"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("read body failed: %w", err))
+		return
+	}
+	if err := h.verify(r, body); err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	vars, err := parseVars(r, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// a request accepted in the skew window may be replayed until the window ends,
+	// so the nonce is kept as idempotency key for twice of max skew
+	dagIns, err := mod.GetCommander().RunDag(dagId, vars,
+		mod.RunTrigger(entity.TriggerWebhook),
+		mod.RunIdempotencyKey("webhook-"+r.Header.Get(NonceHeader), 2*h.maxSkew))
+	if err != nil {
+		if errors.Is(err, data.ErrDataNotFound) {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &RunResponse{DagInsID: dagIns.ID})
+}
+
+func (h *handler) verify(r *http.Request, body []byte) error {
+	timestamp := r.Header.Get(TimestampHeader)
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("timestamp is invalid")
+	}
+	skew := time.Since(time.Unix(sec, 0))
+	if skew > h.maxSkew || skew < -h.maxSkew {
+		return fmt.Errorf("timestamp is out of the window")
+	}
+
+	nonce := r.Header.Get(NonceHeader)
+	if nonce == "" {
+		return fmt.Errorf("nonce cannot be empty")
+	}
+
+	signature := r.Header.Get(SignatureHeader)
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return fmt.Errorf("signature is invalid")
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, signaturePrefix))
+	if err != nil || !hmac.Equal(got, Sign(h.secret, r.Method, r.URL.Path, timestamp, nonce, r.URL.Query(), body)) {
+		return fmt.Errorf("signature is invalid")
+	}
+	return nil
+}
+
+// Sign return the hmac-sha256 of "{method}\n{path}\n{timestamp}\n{nonce}\n{query}\n{body}", client can use it
+// to build signature header. The path is the whole path including dag id, and the query is canonical form
+// which is encoded by url.Values.Encode(sorted by key)
+func Sign(secret []byte, method, path, timestamp, nonce string, query url.Values, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{method, path, timestamp, nonce, query.Encode()}, "\n") + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func parseVars(r *http.Request, body []byte) (map[string]string, error) {
+	vars := map[string]string{}
+	for key, values := range r.URL.Query() {
+		if len(values) > 0 {
+			vars[key] = values[0]
+		}
+	}
+
+	if len(body) == 0 {
+		return vars, nil
+	}
+	bodyVars := map[string]interface{}{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep the precision of number
+	decoder.UseNumber()
+	if err := decoder.Decode(&bodyVars); err != nil {
+		return nil, fmt.Errorf("body must be a json object: %w", err)
+	}
+	for key, value := range bodyVars {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			vars[key] = v
+		case map[string]interface{}, []interface{}:
+			bs, err := json.Marshal(v)
+			if err != nil {
+				return nil, fmt.Errorf("marshal var[%s] failed: %w", key, err)
+			}
+			vars[key] = string(bs)
+		default:
+			vars[key] = fmt.Sprint(v)
+		}
+	}
+	return vars, nil
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Error("write webhook response failed",
+			"module", "webhook",
+			"err", err)
+	}
+}
@@ -0,0 +1,277 @@
+package webhook
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shiningrush/fastflow/pkg/entity"
+	"github.com/shiningrush/fastflow/pkg/mod"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHttpHandler(t *testing.T) {
+	secret := "secret"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	expired := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	signAt := func(path, timestamp, rawQuery, body string) string {
+		query, _ := url.ParseQuery(rawQuery)
+		return signaturePrefix + hex.EncodeToString(
+			Sign([]byte(secret), http.MethodPost, path, timestamp, "nonce", query, []byte(body)))
+	}
+	sign := func(body string) string {
+		return signAt("/webhook/dag", now, "", body)
+	}
+	dag := &entity.Dag{
+		BaseInfo: entity.BaseInfo{ID: "dag"},
+		Status:   entity.DagStatusNormal,
+		Vars: entity.DagVars{
+			"name":  {DefaultValue: "default"},
+			"count": {},
+			"obj":   {},
+			"query": {},
+		},
+	}
+
+	tests := []struct {
+		caseDesc      string
+		giveMethod    string
+		givePath      string
+		giveBody      string
+		giveSignature string
+		giveTimestamp string
+		giveNonce     string
+		giveGetErr    error
+		giveCreateErr error
+		wantCode      int
+		wantBody      string
+		wantDagIns    *entity.DagInstance
+	}{
+		{
+			caseDesc:      "normal",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag?query=q&name=from-query",
+			giveBody:      `{"name":"from-body","count":10,"obj":{"a":1},"unknown":"x"}`,
+			giveSignature: signAt("/webhook/dag", now, "name=from-query&query=q", `{"name":"from-body","count":10,"obj":{"a":1},"unknown":"x"}`),
+			wantCode:      http.StatusOK,
+			wantBody:      `{"dagInsId":"ins-id"}`,
+			wantDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins-id"},
+				DagID:    "dag",
+				Trigger:  entity.TriggerWebhook,
+				Vars: entity.DagInstanceVars{
+					"name":  {Value: "from-body"},
+					"count": {Value: "10"},
+					"obj":   {Value: `{"a":1}`},
+					"query": {Value: "q"},
+				},
+				ShareData:      &entity.ShareData{},
+				Status:         entity.DagInstanceStatusInit,
+				IdempotencyKey: "webhook-nonce",
+			},
+		},
+		{
+			caseDesc:      "empty body",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			wantCode:      http.StatusOK,
+			wantBody:      `{"dagInsId":"ins-id"}`,
+			wantDagIns: &entity.DagInstance{
+				BaseInfo: entity.BaseInfo{ID: "ins-id"},
+				DagID:    "dag",
+				Trigger:  entity.TriggerWebhook,
+				Vars: entity.DagInstanceVars{
+					"name":  {Value: "default"},
+					"count": {},
+					"obj":   {},
+					"query": {},
+				},
+				ShareData:      &entity.ShareData{},
+				Status:         entity.DagInstanceStatusInit,
+				IdempotencyKey: "webhook-nonce",
+			},
+		},
+		{
+			caseDesc:   "method not allowed",
+			giveMethod: http.MethodGet,
+			givePath:   "/webhook/dag",
+			wantCode:   http.StatusMethodNotAllowed,
+			wantBody:   `{"error":"method GET is not allowed"}`,
+		},
+		{
+			caseDesc:      "invalid signature",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveBody:      `{"name":"from-body"}`,
+			giveSignature: sign(`{"name":"other"}`),
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "query not signed",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag?name=injected",
+			giveSignature: sign(""),
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "expired timestamp",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: signAt("/webhook/dag", expired, "", ""),
+			giveTimestamp: expired,
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"timestamp is out of the window"}`,
+		},
+		{
+			caseDesc:      "timestamp not signed",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: signAt("/webhook/dag", expired, "", ""),
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "no timestamp",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			giveTimestamp: "-",
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"timestamp is invalid"}`,
+		},
+		{
+			caseDesc:      "signature for other dag",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/other",
+			giveSignature: sign(""),
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "nonce not signed",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			giveNonce:     "other",
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "no nonce",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			giveNonce:     "-",
+			wantCode:      http.StatusUnauthorized,
+			wantBody:      `{"error":"nonce cannot be empty"}`,
+		},
+		{
+			caseDesc:      "replayed",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			giveCreateErr: fmt.Errorf("conflicted: %w", data.ErrDataConflicted),
+			wantCode:      http.StatusOK,
+			wantBody:      `{"dagInsId":"existed-id"}`,
+		},
+		{
+			caseDesc:   "no signature",
+			giveMethod: http.MethodPost,
+			givePath:   "/webhook/dag",
+			wantCode:   http.StatusUnauthorized,
+			wantBody:   `{"error":"signature is invalid"}`,
+		},
+		{
+			caseDesc:      "invalid body",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveBody:      `[1]`,
+			giveSignature: sign(`[1]`),
+			wantCode:      http.StatusBadRequest,
+		},
+		{
+			caseDesc:      "dag not found",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/dag",
+			giveSignature: sign(""),
+			giveGetErr:    fmt.Errorf("not found: %w", data.ErrDataNotFound),
+			wantCode:      http.StatusNotFound,
+			wantBody:      `{"error":"not found: data not found"}`,
+		},
+		{
+			caseDesc:      "no dag id",
+			giveMethod:    http.MethodPost,
+			givePath:      "/webhook/",
+			giveSignature: sign(""),
+			wantCode:      http.StatusNotFound,
+			wantBody:      `{"error":"dag id cannot be empty"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.caseDesc, func(t *testing.T) {
+			var created *entity.DagInstance
+			mStore := &mod.MockStore{}
+			mStore.On("GetDag", "dag").Return(dag, tc.giveGetErr)
+			mStore.On("CreateDagIns", mock.Anything).Run(func(args mock.Arguments) {
+				if tc.giveCreateErr != nil {
+					return
+				}
+				created = args.Get(0).(*entity.DagInstance)
+				created.ID = "ins-id"
+			}).Return(tc.giveCreateErr)
+			mStore.On("ListDagInstance", &mod.ListDagInstanceInput{
+				DagID:          "dag",
+				IdempotencyKey: "webhook-nonce",
+			}).Return([]*entity.DagInstance{
+				{BaseInfo: entity.BaseInfo{ID: "existed-id", CreatedAt: time.Now().Unix()}},
+			}, nil)
+			mod.SetStore(mStore)
+			mod.SetCommander(&mod.DefCommander{})
+
+			req := httptest.NewRequest(tc.giveMethod, tc.givePath, strings.NewReader(tc.giveBody))
+			if tc.giveSignature != "" {
+				req.Header.Set(SignatureHeader, tc.giveSignature)
+			}
+			switch tc.giveNonce {
+			case "":
+				req.Header.Set(NonceHeader, "nonce")
+			case "-":
+			default:
+				req.Header.Set(NonceHeader, tc.giveNonce)
+			}
+			switch tc.giveTimestamp {
+			case "":
+				req.Header.Set(TimestampHeader, now)
+			case "-":
+			default:
+				req.Header.Set(TimestampHeader, tc.giveTimestamp)
+			}
+			rec := httptest.NewRecorder()
+			HttpHandler(&HandlerOption{Secret: secret}).ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.wantCode, rec.Code)
+			if tc.wantBody != "" {
+				assert.JSONEq(t, tc.wantBody, rec.Body.String())
+			}
+			assert.Equal(t, tc.wantDagIns, created)
+		})
+	}
+}
+
+func TestHttpHandler_EmptySecret(t *testing.T) {
+	assert.Panics(t, func() {
+		HttpHandler(&HandlerOption{})
+	})
+}
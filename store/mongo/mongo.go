@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,10 +34,12 @@ type StoreOption struct {
 
 // Store
 type Store struct {
-	opt            *StoreOption
-	dagClsName     string
-	dagInsClsName  string
-	taskInsClsName string
+	opt                *StoreOption
+	dagClsName         string
+	dagInsClsName      string
+	taskInsClsName     string
+	dagScheduleClsName string
+	dagVersionClsName  string
 
 	mongoClient *mongo.Client
 	mongoDb     *mongo.Database
@@ -68,6 +71,26 @@ func (s *Store) Init() error {
 	s.mongoClient = client
 	s.mongoDb = s.mongoClient.Database(s.opt.Database)
 
+	if err := s.ensureIdempotencyIndex(ctx); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ensureIdempotencyIndex make the idempotency key unique within a dag, empty key is not indexed
+func (s *Store) ensureIdempotencyIndex(ctx context.Context) error {
+	if _, err := s.mongoDb.Collection(s.dagInsClsName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "dagId", Value: 1},
+			{Key: "idempotencyKey", Value: 1},
+		},
+		Options: options.Index().
+			SetName("dag_id_idempotency_key_index").
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"idempotencyKey": bson.M{"$gt": ""}}),
+	}); err != nil {
+		return fmt.Errorf("create idempotency index failed: %w", err)
+	}
 	return nil
 }
 
@@ -84,10 +107,14 @@ func (s *Store) readOpt() error {
 	s.dagClsName = "dag"
 	s.dagInsClsName = "dag_instance"
 	s.taskInsClsName = "task_instance"
+	s.dagScheduleClsName = "dag_schedule"
+	s.dagVersionClsName = "dag_version"
 	if s.opt.Prefix != "" {
 		s.dagClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagClsName)
 		s.dagInsClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagInsClsName)
 		s.taskInsClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.taskInsClsName)
+		s.dagScheduleClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagScheduleClsName)
+		s.dagVersionClsName = fmt.Sprintf("%s_%s", s.opt.Prefix, s.dagVersionClsName)
 	}
 
 	return nil
@@ -110,7 +137,25 @@ func (s *Store) CreateDag(dag *entity.Dag) error {
 	if err != nil {
 		return err
 	}
-	return s.genericCreate(dag, s.dagClsName)
+
+	// versions of a deleted dag may still exist, so continue from the latest one
+	latest, err := s.latestDagVersion(dag.ID)
+	if err != nil {
+		return err
+	}
+	dag.Version = latest + 1
+	dag.Initial()
+	// the version is saved before the dag, so the stored dag always has its version
+	if err := s.upsertDagVersion(dag); err != nil {
+		return err
+	}
+	if err := s.genericCreate(dag, s.dagClsName); err != nil {
+		if errors.Is(err, data.ErrDataConflicted) {
+			s.repairDagVersion(dag.ID, dag.Version)
+		}
+		return err
+	}
+	return nil
 }
 
 // CreateDagIns
@@ -171,6 +216,18 @@ func (s *Store) PatchTaskIns(taskIns *entity.TaskInstance) error {
 	if len(taskIns.Traces) > 0 {
 		update["traces"] = taskIns.Traces
 	}
+	if taskIns.Branch != nil {
+		update["branch"] = taskIns.Branch
+	}
+	if taskIns.Attempt != 0 {
+		update["attempt"] = taskIns.Attempt
+	}
+	if taskIns.NextRetryAt != 0 {
+		update["nextRetryAt"] = taskIns.NextRetryAt
+	}
+	if taskIns.SlaMissed {
+		update["slaMissed"] = taskIns.SlaMissed
+	}
 	update = bson.M{
 		"$set": update,
 	}
@@ -185,6 +242,52 @@ func (s *Store) PatchTaskIns(taskIns *entity.TaskInstance) error {
 
 // PatchDagIns
 func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...string) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+	if _, err := s.mongoDb.Collection(s.dagInsClsName).UpdateOne(
+		ctx, bson.M{"_id": dagIns.ID}, buildDagInsPatch(dagIns, mustsPatchFields)); err != nil {
+		return fmt.Errorf("patch dag instance failed: %w", err)
+	}
+
+	goevent.Publish(&event.DagInstancePatched{
+		Payload:         dagIns,
+		MustPatchFields: mustsPatchFields,
+	})
+	return nil
+}
+
+// PatchDagInsIf patch dag instance only when the stored one matches the condition,
+// return data.ErrDataConflicted if it does not match
+func (s *Store) PatchDagInsIf(
+	dagIns *entity.DagInstance, cond *mod.PatchDagInsCondition, mustsPatchFields ...string) error {
+	query := bson.M{"_id": dagIns.ID}
+	if len(cond.Status) > 0 {
+		query["status"] = bson.M{
+			"$in": cond.Status,
+		}
+	}
+	if cond.Worker != "" {
+		query["worker"] = cond.Worker
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+	ret, err := s.mongoDb.Collection(s.dagInsClsName).UpdateOne(ctx, query, buildDagInsPatch(dagIns, mustsPatchFields))
+	if err != nil {
+		return fmt.Errorf("patch dag instance failed: %w", err)
+	}
+	if ret.MatchedCount == 0 {
+		return fmt.Errorf("dag instance[%s] does not match the condition: %w", dagIns.ID, data.ErrDataConflicted)
+	}
+
+	goevent.Publish(&event.DagInstancePatched{
+		Payload:         dagIns,
+		MustPatchFields: mustsPatchFields,
+	})
+	return nil
+}
+
+func buildDagInsPatch(dagIns *entity.DagInstance, mustsPatchFields []string) bson.M {
 	update := bson.M{
 		"updatedAt": time.Now().Unix(),
 	}
@@ -204,32 +307,94 @@ func (s *Store) PatchDagIns(dagIns *entity.DagInstance, mustsPatchFields ...stri
 	if utils.StringsContain(mustsPatchFields, "Reason") || dagIns.Reason != "" {
 		update["reason"] = dagIns.Reason
 	}
+	if utils.StringsContain(mustsPatchFields, "IdempotencyKey") || dagIns.IdempotencyKey != "" {
+		update["idempotencyKey"] = dagIns.IdempotencyKey
+	}
+	if dagIns.Deadline != 0 {
+		update["deadline"] = dagIns.Deadline
+	}
+	if dagIns.SlaDueAt != 0 {
+		update["slaDueAt"] = dagIns.SlaDueAt
+	}
+	if dagIns.SlaMissed {
+		update["slaMissed"] = dagIns.SlaMissed
+	}
+	if dagIns.Generation != 0 {
+		update["generation"] = dagIns.Generation
+	}
 
-	update = bson.M{
+	return bson.M{
 		"$set": update,
 	}
+}
+
+// UpdateDag update the dag only when its version is the same as the stored one, then the version is increased,
+// return data.ErrDataConflicted if the dag is updated by others since it was read
+func (s *Store) UpdateDag(dag *entity.Dag) error {
+	// check task's connection
+	_, err := mod.BuildRootNode(mod.MapTasksToGetter(dag.Tasks))
+	if err != nil {
+		return err
+	}
+
+	query := bson.M{"_id": dag.ID, "version": dag.Version}
+	if dag.Version == 0 {
+		// the dags created before versioning have no version
+		query["version"] = bson.M{"$exists": false}
+	}
+	baseVersion := dag.Version
+	dag.Version++
+	dag.Update()
+	// the version is saved before the dag, so the stored dag always has its version
+	if err := s.upsertDagVersion(dag); err != nil {
+		dag.Version = baseVersion
+		return err
+	}
 
 	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
 	defer cancel()
-	if _, err := s.mongoDb.Collection(s.dagInsClsName).UpdateOne(ctx, bson.M{"_id": dagIns.ID}, update); err != nil {
-		return fmt.Errorf("patch dag instance failed: %w", err)
+	ret, err := s.mongoDb.Collection(s.dagClsName).ReplaceOne(ctx, query, dag)
+	if err != nil {
+		dag.Version = baseVersion
+		return fmt.Errorf("update dag failed: %w", err)
+	}
+	if ret.MatchedCount == 0 {
+		s.repairDagVersion(dag.ID, dag.Version)
+		dag.Version = baseVersion
+		return fmt.Errorf("dag[%s] is not found or not version %d: %w", dag.ID, baseVersion, data.ErrDataConflicted)
 	}
+	return nil
+}
 
-	goevent.Publish(&event.DagInstancePatched{
-		Payload:         dagIns,
-		MustPatchFields: mustsPatchFields,
-	})
+// upsertDagVersion save the snapshot of dag, it is keyed by dag id and version, so it is safe to save again
+func (s *Store) upsertDagVersion(dag *entity.Dag) error {
+	version := entity.NewDagVersion(dag)
+	version.Initial()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+	if _, err := s.mongoDb.Collection(s.dagVersionClsName).ReplaceOne(
+		ctx,
+		bson.M{"_id": version.ID}, version, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("upsert version %d of dag[%s] failed: %w", dag.Version, dag.ID, err)
+	}
 	return nil
 }
 
-// UpdateDag
-func (s *Store) UpdateDag(dag *entity.Dag) error {
-	// check task's connection
-	_, err := mod.BuildRootNode(mod.MapTasksToGetter(dag.Tasks))
+// repairDagVersion save the snapshot of the stored dag again if it has the given version,
+// because the snapshot may be overwritten by the writer who lost the same version
+func (s *Store) repairDagVersion(dagId string, version int) {
+	stored, err := s.GetDag(dagId)
 	if err != nil {
-		return err
+		log.Errorf("get dag[%s] to repair its version failed: %s", dagId, err)
+		return
+	}
+	if stored.Version != version {
+		return
+	}
+	if err := s.upsertDagVersion(stored); err != nil {
+		log.Errorf("repair version %d of dag[%s] failed: %s", version, dagId, err)
 	}
-	return s.genericUpdate(dag, s.dagClsName)
 }
 
 // UpdateDagIns
@@ -341,6 +506,70 @@ func (s *Store) GetDagInstance(dagInsId string) (*entity.DagInstance, error) {
 	return ret, nil
 }
 
+// GetDagSchedule
+func (s *Store) GetDagSchedule(dagId string) (*entity.DagSchedule, error) {
+	ret := new(entity.DagSchedule)
+	if err := s.genericGet(s.dagScheduleClsName, dagId, ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// UpsertDagSchedule
+func (s *Store) UpsertDagSchedule(schedule *entity.DagSchedule) error {
+	if schedule.CreatedAt == 0 {
+		schedule.Initial()
+	} else {
+		schedule.Update()
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+	if _, err := s.mongoDb.Collection(s.dagScheduleClsName).ReplaceOne(
+		ctx,
+		bson.M{"_id": schedule.ID}, schedule, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("upsert dag schedule failed: %w", err)
+	}
+	return nil
+}
+
+// GetDagVersion
+func (s *Store) GetDagVersion(dagId string, version int) (*entity.DagVersion, error) {
+	ret := new(entity.DagVersion)
+	if err := s.genericGet(s.dagVersionClsName, entity.DagVersionID(dagId, version), ret); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// ListDagVersion list the versions of dag, sorted by version
+func (s *Store) ListDagVersion(dagId string) ([]*entity.DagVersion, error) {
+	var ret []*entity.DagVersion
+	err := s.genericList(&ret, s.dagVersionClsName, bson.M{"dagId": dagId}, options.Find().SetSort(bson.M{"version": 1}))
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (s *Store) latestDagVersion(dagId string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+
+	ret := new(entity.DagVersion)
+	err := s.mongoDb.Collection(s.dagVersionClsName).FindOne(
+		ctx, bson.M{"dagId": dagId}, options.FindOne().SetSort(bson.M{"version": -1})).Decode(ret)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("get latest dag version failed: %w", err)
+	}
+	return ret.Version, nil
+}
+
 func (s *Store) genericGet(clsName, id string, ret interface{}) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
 	defer cancel()
@@ -357,7 +586,25 @@ func (s *Store) genericGet(clsName, id string, ret interface{}) error {
 
 // ListDag
 func (s *Store) ListDag(input *mod.ListDagInput) ([]*entity.Dag, error) {
+	if input == nil {
+		input = &mod.ListDagInput{}
+	}
+
 	query := bson.M{}
+	if len(input.Status) > 0 {
+		query["status"] = bson.M{
+			"$in": input.Status,
+		}
+	}
+	if input.HasCron {
+		query["cron"] = bson.M{
+			"$exists": true,
+			"$ne":     "",
+		}
+	}
+	if input.DependOnDagID != "" {
+		query["dependsOnDags.dagId"] = input.DependOnDagID
+	}
 
 	var ret []*entity.Dag
 	err := s.genericList(&ret, s.dagClsName, query)
@@ -369,36 +616,117 @@ func (s *Store) ListDag(input *mod.ListDagInput) ([]*entity.Dag, error) {
 
 // ListDagInstance
 func (s *Store) ListDagInstance(input *mod.ListDagInstanceInput) ([]*entity.DagInstance, error) {
+	opt := &options.FindOptions{}
+	if input.Limit > 0 {
+		opt.Limit = &input.Limit
+	}
+	if input.Offset > 0 {
+		opt.Skip = &input.Offset
+	}
+	if len(input.SortBy) > 0 {
+		opt.Sort = buildSort(input.SortBy)
+	}
+
+	var ret []*entity.DagInstance
+	err := s.genericList(&ret, s.dagInsClsName, buildDagInsQuery(input), opt)
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// CountDagInstance
+func (s *Store) CountDagInstance(input *mod.ListDagInstanceInput) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+
+	cnt, err := s.mongoDb.Collection(s.dagInsClsName).CountDocuments(ctx, buildDagInsQuery(input))
+	if err != nil {
+		return 0, fmt.Errorf("count %s failed: %w", s.dagInsClsName, err)
+	}
+	return cnt, nil
+}
+
+func buildDagInsQuery(input *mod.ListDagInstanceInput) bson.M {
 	query := bson.M{}
 	if len(input.Status) > 0 {
 		query["status"] = bson.M{
 			"$in": input.Status,
 		}
 	}
+	workerQuery := bson.M{}
 	if input.Worker != "" {
-		query["worker"] = input.Worker
+		workerQuery["$eq"] = input.Worker
+	}
+	if len(input.ExcludeWorkers) > 0 {
+		workerQuery["$nin"] = input.ExcludeWorkers
+	}
+	if len(workerQuery) > 0 {
+		query["worker"] = workerQuery
+	}
+	dagIdQuery := bson.M{}
+	if input.DagID != "" {
+		dagIdQuery["$eq"] = input.DagID
+	}
+	if len(input.ExcludeDagIDs) > 0 {
+		dagIdQuery["$nin"] = input.ExcludeDagIDs
+	}
+	if len(dagIdQuery) > 0 {
+		query["dagId"] = dagIdQuery
+	}
+	if input.ParentDagInsID != "" {
+		query["parentDagInsId"] = input.ParentDagInsID
+	}
+	if input.ParentTaskInsID != "" {
+		query["parentTaskInsId"] = input.ParentTaskInsID
 	}
 	if input.UpdatedEnd > 0 {
 		query["updatedAt"] = bson.M{
 			"$lte": input.UpdatedEnd,
 		}
 	}
+	if input.RunAtEnd > 0 {
+		query["runAt"] = bson.M{
+			"$lte": input.RunAtEnd,
+		}
+	}
+	if input.DeadlineEnd > 0 {
+		query["deadline"] = bson.M{
+			"$gt":  0,
+			"$lte": input.DeadlineEnd,
+		}
+	}
+	if input.SlaMissEnd > 0 {
+		query["slaDueAt"] = bson.M{
+			"$gt":  0,
+			"$lte": input.SlaMissEnd,
+		}
+		query["slaMissed"] = bson.M{
+			"$ne": true,
+		}
+	}
 	if input.HasCmd {
 		query["cmd"] = bson.M{
 			"$ne": nil,
 		}
 	}
-	opt := &options.FindOptions{}
-	if input.Limit > 0 {
-		opt.Limit = &input.Limit
+	if input.IdempotencyKey != "" {
+		query["idempotencyKey"] = input.IdempotencyKey
 	}
+	return query
+}
 
-	var ret []*entity.DagInstance
-	err := s.genericList(&ret, s.dagInsClsName, query, opt)
-	if err != nil {
-		return nil, err
+// buildSort convert fields to mongo sort, field with prefix "-" means descending
+func buildSort(fields []string) bson.D {
+	sort := bson.D{}
+	for _, f := range fields {
+		if strings.HasPrefix(f, "-") {
+			sort = append(sort, bson.E{Key: strings.TrimPrefix(f, "-"), Value: -1})
+			continue
+		}
+		sort = append(sort, bson.E{Key: f, Value: 1})
 	}
-	return ret, nil
+	return sort
 }
 
 // ListTaskInstance
@@ -431,6 +759,15 @@ func (s *Store) ListTaskInstance(input *mod.ListTaskInstanceInput) ([]*entity.Ta
 	if input.DagInsID != "" {
 		query["dagInsId"] = input.DagInsID
 	}
+	if input.SlaMissEnd > 0 {
+		query["slaDueAt"] = bson.M{
+			"$gt":  0,
+			"$lte": input.SlaMissEnd,
+		}
+		query["slaMissed"] = bson.M{
+			"$ne": true,
+		}
+	}
 	opt := &options.FindOptions{}
 	if len(input.SelectField) > 0 {
 		fields := bson.M{}
@@ -477,6 +814,28 @@ func (s *Store) BatchDeleteTaskIns(ids []string) error {
 	return s.genericBatchDelete(ids, s.taskInsClsName)
 }
 
+// BatchDeleteDagSchedule
+func (s *Store) BatchDeleteDagSchedule(ids []string) error {
+	return s.genericBatchDelete(ids, s.dagScheduleClsName)
+}
+
+// BatchDeleteDagVersion delete all versions of the given dags
+func (s *Store) BatchDeleteDagVersion(dagIds []string) error {
+	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
+	defer cancel()
+
+	_, err := s.mongoDb.Collection(s.dagVersionClsName).DeleteMany(ctx, bson.M{
+		"dagId": bson.M{
+			"$in": dagIds,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("delete failed: %w", err)
+	}
+
+	return nil
+}
+
 func (s *Store) genericBatchDelete(ids []string, clsName string) error {
 	ctx, cancel := context.WithTimeout(context.TODO(), s.opt.Timeout)
 	defer cancel()
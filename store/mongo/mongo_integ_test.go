@@ -4,12 +4,14 @@
 package mongo
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/shiningrush/fastflow/pkg/entity"
 	"github.com/shiningrush/fastflow/pkg/mod"
+	"github.com/shiningrush/fastflow/pkg/utils/data"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -33,7 +35,8 @@ func TestStore_Dag(t *testing.T) {
 			BaseInfo: entity.BaseInfo{
 				ID: "test2",
 			},
-			Tasks: []entity.Task{{ID: "test"}},
+			Tasks:         []entity.Task{{ID: "test"}},
+			DependsOnDags: []entity.DagDependency{{DagID: "test1"}},
 		},
 	}
 	// create
@@ -42,6 +45,11 @@ func TestStore_Dag(t *testing.T) {
 		assert.NoError(t, err)
 	}
 
+	downstream, err := s.ListDag(&mod.ListDagInput{DependOnDagID: "test1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(downstream))
+	assert.Equal(t, "test2", downstream[0].ID)
+
 	ret, err := s.ListDag(nil)
 	assert.NoError(t, err)
 	time.Sleep(time.Second)
@@ -130,6 +138,11 @@ func TestStore_DagIns(t *testing.T) {
 		assert.NoError(t, err)
 	}
 
+	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{ExcludeWorkers: []string{"worker-0"}})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, "worker-1", ret[0].Worker)
+
 	ret, err = s.ListDagInstance(&mod.ListDagInstanceInput{})
 	assert.NoError(t, err)
 	for i := range ret {
@@ -204,3 +217,176 @@ func TestStore_TaskIns(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, 0, len(ret))
 }
+
+func TestStore_DagSchedule(t *testing.T) {
+	s := NewStore(&StoreOption{
+		ConnStr: mongoConn,
+	})
+
+	err := s.Init()
+	assert.NoError(t, err)
+
+	_, err = s.GetDagSchedule("test1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+
+	// insert
+	err = s.UpsertDagSchedule(&entity.DagSchedule{
+		BaseInfo:    entity.BaseInfo{ID: "test1"},
+		LastFiredAt: 100,
+	})
+	assert.NoError(t, err)
+	ret, err := s.GetDagSchedule("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), ret.LastFiredAt)
+	assert.Greater(t, ret.CreatedAt, int64(0))
+
+	// update
+	ret.LastFiredAt = 200
+	err = s.UpsertDagSchedule(ret)
+	assert.NoError(t, err)
+	ret, err = s.GetDagSchedule("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), ret.LastFiredAt)
+
+	// delete
+	err = s.BatchDeleteDagSchedule([]string{"test1"})
+	assert.NoError(t, err)
+	_, err = s.GetDagSchedule("test1")
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+}
+
+func TestStore_DagInsIdempotencyKey(t *testing.T) {
+	s := NewStore(&StoreOption{
+		ConnStr: mongoConn,
+	})
+
+	err := s.Init()
+	assert.NoError(t, err)
+
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, DagID: "dag", IdempotencyKey: "key"})
+	assert.NoError(t, err)
+	// same key within the same dag
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test2"}, DagID: "dag", IdempotencyKey: "key"})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+	// same key within other dag
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test3"}, DagID: "dag2", IdempotencyKey: "key"})
+	assert.NoError(t, err)
+	// empty key is not unique
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test4"}, DagID: "dag"})
+	assert.NoError(t, err)
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test5"}, DagID: "dag"})
+	assert.NoError(t, err)
+
+	ret, err := s.ListDagInstance(&mod.ListDagInstanceInput{DagID: "dag", IdempotencyKey: "key"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(ret))
+	assert.Equal(t, "test1", ret[0].ID)
+
+	// release the key
+	err = s.PatchDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}}, "IdempotencyKey")
+	assert.NoError(t, err)
+	err = s.CreateDagIns(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test2"}, DagID: "dag", IdempotencyKey: "key"})
+	assert.NoError(t, err)
+
+	err = s.BatchDeleteDagIns([]string{"test1", "test2", "test3", "test4", "test5"})
+	assert.NoError(t, err)
+}
+
+func TestStore_DagVersion(t *testing.T) {
+	s := NewStore(&StoreOption{
+		ConnStr: mongoConn,
+	})
+
+	err := s.Init()
+	assert.NoError(t, err)
+
+	// create
+	dag := &entity.Dag{
+		BaseInfo: entity.BaseInfo{ID: "version-test"},
+		Name:     "v1",
+		Tasks:    []entity.Task{{ID: "task1", ActionName: "action"}},
+	}
+	err = s.CreateDag(dag)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dag.Version)
+
+	// update
+	dag.Name = "v2"
+	err = s.UpdateDag(dag)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, dag.Version)
+	ret, err := s.GetDag("version-test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, ret.Version)
+
+	v1, err := s.GetDagVersion("version-test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1", v1.Dag.Name)
+
+	vers, err := s.ListDagVersion("version-test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(vers))
+	assert.Equal(t, 1, vers[0].Version)
+	assert.Equal(t, "v2", vers[1].Dag.Name)
+
+	// update based on an old version
+	stale := *dag
+	stale.Version = 1
+	stale.Name = "stale"
+	err = s.UpdateDag(&stale)
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+	assert.Equal(t, 1, stale.Version)
+	ret, err = s.GetDag("version-test")
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", ret.Name)
+	assert.Equal(t, 2, ret.Version)
+	_, err = s.GetDagVersion("version-test", 3)
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+	// the snapshot overwritten by the stale update is repaired
+	v2, err := s.GetDagVersion("version-test", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "v2", v2.Dag.Name)
+
+	// delete
+	err = s.BatchDeleteDag([]string{"version-test"})
+	assert.NoError(t, err)
+	err = s.BatchDeleteDagVersion([]string{"version-test"})
+	assert.NoError(t, err)
+	_, err = s.GetDagVersion("version-test", 1)
+	assert.True(t, errors.Is(err, data.ErrDataNotFound))
+}
+
+func TestStore_PatchDagInsIf(t *testing.T) {
+	s := NewStore(&StoreOption{
+		ConnStr: mongoConn,
+	})
+
+	err := s.Init()
+	assert.NoError(t, err)
+
+	err = s.CreateDagIns(&entity.DagInstance{
+		BaseInfo: entity.BaseInfo{ID: "test1"},
+		Status:   entity.DagInstanceStatusPending,
+		Worker:   "w1",
+	})
+	assert.NoError(t, err)
+
+	// not matched
+	err = s.PatchDagInsIf(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, Status: entity.DagInstanceStatusInit},
+		&mod.PatchDagInsCondition{Worker: "w2"})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+	err = s.PatchDagInsIf(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, Status: entity.DagInstanceStatusInit},
+		&mod.PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusRunning}})
+	assert.True(t, errors.Is(err, data.ErrDataConflicted))
+
+	// matched
+	err = s.PatchDagInsIf(&entity.DagInstance{BaseInfo: entity.BaseInfo{ID: "test1"}, Status: entity.DagInstanceStatusInit},
+		&mod.PatchDagInsCondition{Status: []entity.DagInstanceStatus{entity.DagInstanceStatusPending}, Worker: "w1"})
+	assert.NoError(t, err)
+	ret, err := s.GetDagInstance("test1")
+	assert.NoError(t, err)
+	assert.Equal(t, entity.DagInstanceStatusInit, ret.Status)
+
+	err = s.BatchDeleteDagIns([]string{"test1"})
+	assert.NoError(t, err)
+}
@@ -23,6 +23,63 @@ db.dag_instance.createIndex(
         name: "updated_at_index",
     }
 );
+db.dag_instance.createIndex(
+    {
+        "runAt": 1
+    },
+    {
+        name: "run_at_index",
+        sparse: true,
+    }
+);
+db.dag_instance.createIndex(
+    {
+        "dagId": 1,
+        "status": 1
+    },
+    {
+        name: "dag_id_status_index",
+    }
+);
+db.dag_instance.createIndex(
+    {
+        "status": 1,
+        "createdAt": 1
+    },
+    {
+        name: "status_created_at_index",
+    }
+);
+// it is created by store automatically
+db.dag_instance.createIndex(
+    {
+        "dagId": 1,
+        "idempotencyKey": 1
+    },
+    {
+        name: "dag_id_idempotency_key_index",
+        unique: true,
+        partialFilterExpression: {"idempotencyKey": {"$gt": ""}},
+    }
+);
+db.dag_instance.createIndex(
+    {
+        "parentDagInsId": 1
+    },
+    {
+        name: "parent_dag_ins_id_index",
+        sparse: true,
+    }
+);
+db.dag_instance.createIndex(
+    {
+        "parentTaskInsId": 1
+    },
+    {
+        name: "parent_task_ins_id_index",
+        sparse: true,
+    }
+);
 
 // "task_instance" should replace with your collection name
 db.task_instance.createIndex(